@@ -0,0 +1,336 @@
+package viewproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/blakewilliams/viewproxy/pkg/multiplexer"
+)
+
+const (
+	// Emitted after each key is fetched by WarmCache. The progress of the
+	// warmup is available via CacheWarmupFromContext.
+	EventCacheWarmupProgress = "viewproxy.cache_warmup_progress"
+	// Emitted when fetching a key fails during WarmCache. The error is
+	// available via CacheWarmupErrorFromContext.
+	EventCacheWarmupFailed = "viewproxy.cache_warmup_failed"
+	// Emitted when WarmCache pauses because the target is unavailable or in
+	// maintenance mode. The pause is available via CacheWarmupFromContext.
+	EventCacheWarmupPaused = "viewproxy.cache_warmup_paused"
+)
+
+const defaultWarmupBackoff = 5 * time.Second
+
+// The number of times a key is fetched when the target is unavailable
+const warmupAttempts = 3
+
+// CacheWarmup is the progress of a WarmCache call.
+type CacheWarmup struct {
+	// The number of keys being warmed
+	Total int
+	// The number of keys fetched, including failures
+	Completed int
+	// The number of keys that could not be fetched
+	Failed int
+	// How long the warmup is paused for, only set for
+	// EventCacheWarmupPaused
+	Paused time.Duration
+}
+
+type cacheWarmupContextKey struct{}
+type cacheWarmupErrorContextKey struct{}
+
+// CacheWarmupFromContext returns the progress of the cache warmup. It is only
+// available to EventCacheWarmupProgress and EventCacheWarmupFailed
+// subscribers.
+func CacheWarmupFromContext(ctx context.Context) *CacheWarmup {
+	if ctx == nil {
+		return nil
+	}
+
+	if warmup := ctx.Value(cacheWarmupContextKey{}); warmup != nil {
+		return warmup.(*CacheWarmup)
+	}
+	return nil
+}
+
+// CacheWarmupErrorFromContext returns the error that caused fetching a key to
+// fail during the cache warmup.
+func CacheWarmupErrorFromContext(ctx context.Context) error {
+	if ctx == nil {
+		return nil
+	}
+
+	if err := ctx.Value(cacheWarmupErrorContextKey{}); err != nil {
+		return err.(error)
+	}
+	return nil
+}
+
+// PersistCacheKeys writes the popular keys of the SharedCache to
+// CacheKeysPath every interval until ctx is done, so a future server can warm
+// its cache via WarmCache. Only keys are written, not response bodies.
+func (s *Server) PersistCacheKeys(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := s.writeCacheKeys(); err != nil {
+					s.Logger.Printf("Could not persist cache keys: %s", err)
+				}
+			}
+		}
+	}()
+}
+
+// WarmCache fetches the keys persisted to CacheKeysPath by PersistCacheKeys
+// through the SharedCache, using up to concurrency requests at once. It
+// returns once every key has been fetched, so it can be called on startup
+// before the server is marked as ready.
+//
+// Failing to fetch a key doesn't fail the warmup, EventCacheWarmupFailed is
+// emitted instead. Nothing is warmed when the key file doesn't exist or the
+// server has no SharedCache.
+//
+// Every fetch pauses when the target responds with a 503, for its
+// Retry-After duration or WarmupBackoff, and the key is fetched again once
+// the pause is over. Fetches also pause for WarmupBackoff while the target
+// responds with the MaintenanceHeader.
+func (s *Server) WarmCache(ctx context.Context, concurrency int) error {
+	if s.SharedCache == nil {
+		return nil
+	}
+
+	keys, err := s.readCacheKeys()
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var mu sync.Mutex
+	warmup := &CacheWarmup{Total: len(keys)}
+	queue := make(chan multiplexer.PopularKey)
+	wg := sync.WaitGroup{}
+	pause := &warmupPause{}
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for key := range queue {
+				var err error
+				for attempt := 1; ; attempt++ {
+					if err = pause.wait(ctx); err != nil {
+						break
+					}
+
+					var wait time.Duration
+					wait, err = s.warmCacheKey(ctx, key)
+					if wait > 0 {
+						pause.extend(wait)
+
+						mu.Lock()
+						progress := *warmup
+						mu.Unlock()
+						progress.Paused = wait
+						s.Notifier.Emit(EventCacheWarmupPaused, context.WithValue(ctx, cacheWarmupContextKey{}, &progress), func(context.Context) {})
+					}
+
+					// Keys are fetched again when the target was unavailable
+					if err == nil || wait == 0 || attempt >= warmupAttempts {
+						break
+					}
+				}
+
+				mu.Lock()
+				warmup.Completed++
+				if err != nil {
+					warmup.Failed++
+				}
+				progress := *warmup
+				mu.Unlock()
+
+				eventCtx := context.WithValue(ctx, cacheWarmupContextKey{}, &progress)
+				if err != nil {
+					failedCtx := context.WithValue(eventCtx, cacheWarmupErrorContextKey{}, err)
+					s.Notifier.Emit(EventCacheWarmupFailed, failedCtx, func(context.Context) {})
+				}
+				s.Notifier.Emit(EventCacheWarmupProgress, eventCtx, func(context.Context) {})
+			}
+		}()
+	}
+
+send:
+	for _, key := range keys {
+		select {
+		case queue <- key:
+		case <-ctx.Done():
+			break send
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	return ctx.Err()
+}
+
+// warmCacheKey fetches the key through the SharedCache, returning how long
+// to pause the warmup when the target is unavailable or in maintenance mode.
+func (s *Server) warmCacheKey(ctx context.Context, key multiplexer.PopularKey) (time.Duration, error) {
+	req := s.newRequest()
+	headerKeys := make([]string, 0, len(key.Header))
+	for name, values := range key.Header {
+		headerKeys = append(headerKeys, name)
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+
+	req.WithRequestable(&warmupRequestable{url: key.URL, headerKeys: headerKeys})
+	results, err := req.Do(ctx)
+	if err != nil {
+		var wait time.Duration
+		var resultErr *multiplexer.ResultError
+		if errors.As(err, &resultErr) {
+			wait = s.warmupPauseFor(resultErr.Result)
+		}
+
+		return wait, fmt.Errorf("could not warm %s: %w", s.SecretFilter.FilterURLString(key.URL), err)
+	}
+
+	return s.warmupPauseFor(results[0]), nil
+}
+
+// warmupPauseFor returns how long to pause the warmup after the result, or 0
+// when the target is available.
+func (s *Server) warmupPauseFor(result *multiplexer.Result) time.Duration {
+	if result.StatusCode == http.StatusServiceUnavailable {
+		if retryAfter, ok := multiplexer.ParseRetryAfter(result.Header().Get("Retry-After"), time.Now()); ok && retryAfter > 0 {
+			return retryAfter
+		}
+
+		return s.WarmupBackoff
+	}
+
+	if s.MaintenanceHeader != "" && result.Header().Get(s.MaintenanceHeader) != "" {
+		return s.WarmupBackoff
+	}
+
+	return 0
+}
+
+// warmupPause is shared by the workers of a warmup, so they all pause when
+// one of them finds the target unavailable.
+type warmupPause struct {
+	mu    sync.Mutex
+	until time.Time
+}
+
+// extend pauses the warmup for at least d from now.
+func (wp *warmupPause) extend(d time.Duration) {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+
+	if until := time.Now().Add(d); until.After(wp.until) {
+		wp.until = until
+	}
+}
+
+// wait returns once the warmup isn't paused, or ctx is done.
+func (wp *warmupPause) wait(ctx context.Context) error {
+	wp.mu.Lock()
+	d := time.Until(wp.until)
+	wp.mu.Unlock()
+
+	if d <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// writeCacheKeys atomically replaces the key file with the popular keys of the
+// SharedCache.
+func (s *Server) writeCacheKeys() error {
+	if s.CacheKeysPath == "" || s.SharedCache == nil {
+		return nil
+	}
+
+	keys, err := json.Marshal(s.SharedCache.PopularKeys())
+	if err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(s.CacheKeysPath), filepath.Base(s.CacheKeysPath)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.Write(keys); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), s.CacheKeysPath)
+}
+
+func (s *Server) readCacheKeys() ([]multiplexer.PopularKey, error) {
+	if s.CacheKeysPath == "" {
+		return nil, os.ErrNotExist
+	}
+
+	contents, err := os.ReadFile(s.CacheKeysPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []multiplexer.PopularKey
+	if err := json.Unmarshal(contents, &keys); err != nil {
+		return nil, fmt.Errorf("could not unmarshal cache keys: %w", err)
+	}
+
+	return keys, nil
+}
+
+// warmupRequestable fetches a popular key through the SharedCache.
+type warmupRequestable struct {
+	url        string
+	headerKeys []string
+}
+
+var _ multiplexer.SharedRequestable = &warmupRequestable{}
+
+func (wr *warmupRequestable) URL() string                 { return wr.url }
+func (wr *warmupRequestable) TemplateURL() string         { return wr.url }
+func (wr *warmupRequestable) Metadata() map[string]string { return map[string]string{} }
+func (wr *warmupRequestable) Shared() (bool, []string)    { return true, wr.headerKeys }
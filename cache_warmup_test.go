@@ -0,0 +1,173 @@
+package viewproxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/blakewilliams/viewproxy/pkg/fragment"
+	"github.com/blakewilliams/viewproxy/pkg/multiplexer"
+	"github.com/blakewilliams/viewproxy/pkg/notifier"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWarmCache(t *testing.T) {
+	var mu sync.Mutex
+	counts := make(map[string]int)
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		counts[r.URL.Path]++
+		mu.Unlock()
+
+		switch r.URL.Path {
+		case "/layout":
+			w.Write([]byte(`<html><viewproxy-fragment id="body"></viewproxy-fragment></html>`))
+		case "/broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.Write([]byte(r.URL.Path))
+		}
+	}))
+	defer target.Close()
+
+	keysPath := filepath.Join(t.TempDir(), "cache_keys.json")
+	newWarmServer := func() *Server {
+		server := newServer(t, target.URL)
+		server.SharedCache = multiplexer.NewSharedCache(time.Minute)
+		server.CacheKeysPath = keysPath
+		require.NoError(t, server.Get("/hello", fragment.Define(
+			"/layout",
+			fragment.Shared(),
+			fragment.WithChild("body", fragment.Define("/body")),
+		)))
+
+		return server
+	}
+
+	// Serve traffic and persist the popular keys before "restarting"
+	previous := newWarmServer()
+	previous.CreateHandler().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/hello", nil))
+	require.NoError(t, previous.writeCacheKeys())
+	require.Equal(t, 1, counts["/layout"])
+
+	contents, err := os.ReadFile(keysPath)
+	require.NoError(t, err)
+	require.JSONEq(t, `[{"url": "`+target.URL+`/layout"}]`, string(contents))
+
+	// Failed keys are reported but don't fail the warmup
+	require.NoError(t, os.WriteFile(keysPath, []byte(`[{"url": "`+target.URL+`/layout"}, {"url": "`+target.URL+`/broken"}]`), 0600))
+
+	server := newWarmServer()
+	n := notifier.New()
+	var progress []CacheWarmup
+	var failures []error
+	n.On(EventCacheWarmupProgress, func(ctx context.Context) {
+		progress = append(progress, *CacheWarmupFromContext(ctx))
+	})
+	n.On(EventCacheWarmupFailed, func(ctx context.Context) {
+		failures = append(failures, CacheWarmupErrorFromContext(ctx))
+	})
+	server.Notifier = n
+
+	require.NoError(t, server.WarmCache(context.Background(), 1))
+	require.Equal(t, 2, counts["/layout"])
+	require.Equal(t, []CacheWarmup{{Total: 2, Completed: 1}, {Total: 2, Completed: 2, Failed: 1}}, progress)
+	require.Len(t, failures, 1)
+	require.Contains(t, failures[0].Error(), "could not warm")
+
+	// The layout is served from the warmed cache
+	w := httptest.NewRecorder()
+	server.CreateHandler().ServeHTTP(w, httptest.NewRequest("GET", "/hello", nil))
+
+	require.Equal(t, "<html>/body</html>", w.Body.String())
+	require.Equal(t, 2, counts["/layout"])
+	require.Equal(t, multiplexer.SharedCacheStats{Hits: 1, Misses: 2}, server.SharedCache.Stats())
+}
+
+func TestWarmCache_MissingKeyFile(t *testing.T) {
+	server := newServer(t, targetServer.URL)
+	server.CacheKeysPath = filepath.Join(t.TempDir(), "missing.json")
+
+	require.NoError(t, server.WarmCache(context.Background(), 4))
+}
+
+func TestWarmCache_PausesWhileUnavailable(t *testing.T) {
+	var mu sync.Mutex
+	var requests []time.Time
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, time.Now())
+		n := len(requests)
+		mu.Unlock()
+
+		switch n {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 2:
+			w.Header().Set("X-Maintenance", "true")
+			w.Write([]byte(r.URL.Path))
+		default:
+			w.Write([]byte(r.URL.Path))
+		}
+	}))
+	defer target.Close()
+
+	keysPath := filepath.Join(t.TempDir(), "cache_keys.json")
+	require.NoError(t, os.WriteFile(keysPath, []byte(`[{"url": "`+target.URL+`/layout"}, {"url": "`+target.URL+`/body"}]`), 0600))
+
+	server := newServer(t, target.URL)
+	server.SharedCache = multiplexer.NewSharedCache(time.Minute)
+	server.CacheKeysPath = keysPath
+	server.MaintenanceHeader = "X-Maintenance"
+	server.WarmupBackoff = 50 * time.Millisecond
+
+	n := notifier.New()
+	var paused []time.Duration
+	var progress []CacheWarmup
+	n.On(EventCacheWarmupPaused, func(ctx context.Context) {
+		paused = append(paused, CacheWarmupFromContext(ctx).Paused)
+	})
+	n.On(EventCacheWarmupProgress, func(ctx context.Context) {
+		progress = append(progress, *CacheWarmupFromContext(ctx))
+	})
+	server.Notifier = n
+
+	require.NoError(t, server.WarmCache(context.Background(), 1))
+
+	// The 503 and the maintenance response both pause the warmup, and the
+	// unavailable key is fetched again
+	require.Len(t, requests, 3)
+	require.GreaterOrEqual(t, requests[1].Sub(requests[0]), server.WarmupBackoff)
+	require.GreaterOrEqual(t, requests[2].Sub(requests[1]), server.WarmupBackoff)
+	require.Equal(t, []time.Duration{server.WarmupBackoff, server.WarmupBackoff}, paused)
+	require.Equal(t, []CacheWarmup{{Total: 2, Completed: 1}, {Total: 2, Completed: 2}}, progress)
+}
+
+func TestWarmCache_PauseRespectsContext(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer target.Close()
+
+	keysPath := filepath.Join(t.TempDir(), "cache_keys.json")
+	require.NoError(t, os.WriteFile(keysPath, []byte(`[{"url": "`+target.URL+`/layout"}]`), 0600))
+
+	server := newServer(t, target.URL)
+	server.SharedCache = multiplexer.NewSharedCache(time.Minute)
+	server.CacheKeysPath = keysPath
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	require.ErrorIs(t, server.WarmCache(ctx, 1), context.DeadlineExceeded)
+	require.Less(t, time.Since(start), time.Second)
+}
@@ -0,0 +1,67 @@
+package viewproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// ErrInvalidCACertificate is returned by WithClientCertificate when the CA
+// file contains no PEM encoded certificates.
+var ErrInvalidCACertificate = errors.New("no certificates found in CA file")
+
+// WithClientCertificate authenticates fragment and pass-through requests to
+// the target with the client certificate and key in the given PEM files, for
+// targets that require mutual TLS. The target's certificate is verified using
+// the CA certificates in caFile, or the system's when caFile is empty.
+//
+// The certificate is used by the transport configured by WithTripperOptions,
+// WithHTTPClient or WithTransport, regardless of the order the options are
+// given in. It can't be combined with WithH2C, or with a transport that isn't
+// an *http.Transport.
+func WithClientCertificate(certFile string, keyFile string, caFile string) ServerOption {
+	return namedOption("WithClientCertificate", func(server *Server) error {
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("could not load client certificate: %w", err)
+		}
+
+		config := &tls.Config{
+			Certificates: []tls.Certificate{certificate},
+			MinVersion:   tls.VersionTLS12,
+		}
+
+		if caFile != "" {
+			pem, err := os.ReadFile(caFile)
+			if err != nil {
+				return fmt.Errorf("could not load CA certificate: %w", err)
+			}
+
+			config.RootCAs = x509.NewCertPool()
+			if !config.RootCAs.AppendCertsFromPEM(pem) {
+				return fmt.Errorf("%w: %s", ErrInvalidCACertificate, caFile)
+			}
+		}
+
+		server.clientTLSConfig = config
+		server.configurePassThroughTLS()
+
+		return server.checkClientTLS()
+	})
+}
+
+// configurePassThroughTLS makes the pass-through reverse proxy use the client
+// certificate, regardless of the order WithPassThrough and
+// WithClientCertificate are given in.
+func (s *Server) configurePassThroughTLS() {
+	if s.reverseProxy == nil || s.clientTLSConfig == nil {
+		return
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = s.clientTLSConfig
+	s.reverseProxy.Transport = transport
+}
@@ -0,0 +1,138 @@
+package viewproxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/blakewilliams/viewproxy/pkg/fragment"
+	"github.com/blakewilliams/viewproxy/pkg/multiplexer"
+	"github.com/stretchr/testify/require"
+)
+
+// writeClientCertificate writes a self-signed client certificate and its key
+// to PEM files, returning their paths and the certificate.
+func writeClientCertificate(t *testing.T) (string, string, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "viewproxy"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	certificate, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client-key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+
+	return certFile, keyFile, certificate
+}
+
+// startMutualTLSTarget starts a target that requires the given client
+// certificate, returning it and the path of its CA certificate.
+func startMutualTLSTarget(t *testing.T, clientCertificate *x509.Certificate) (*httptest.Server, string) {
+	target := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello " + r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCertificate)
+	target.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	target.StartTLS()
+	t.Cleanup(target.Close)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: target.Certificate().Raw}), 0600))
+
+	return target, caFile
+}
+
+func TestWithClientCertificate(t *testing.T) {
+	certFile, keyFile, certificate := writeClientCertificate(t)
+	target, caFile := startMutualTLSTarget(t, certificate)
+
+	server := newServer(t, target.URL, WithClientCertificate(certFile, keyFile, caFile), WithPassThrough(target.URL))
+	require.NoError(t, server.Get("/hello", fragment.Define("/hello")))
+
+	for _, path := range []string{"/hello", "/passed-through"} {
+		w := httptest.NewRecorder()
+		server.CreateHandler().ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+
+		require.Equal(t, http.StatusOK, w.Code, path)
+		require.Equal(t, "hello viewproxy", w.Body.String(), path)
+	}
+
+	// Requests without the certificate are rejected
+	server = newServer(t, target.URL)
+	require.NoError(t, server.Get("/hello", fragment.Define("/hello")))
+	w := httptest.NewRecorder()
+	server.CreateHandler().ServeHTTP(w, httptest.NewRequest("GET", "/hello", nil))
+	require.Equal(t, http.StatusInternalServerError, w.Code)
+}
+
+func TestWithClientCertificate_TransportOptions(t *testing.T) {
+	certFile, keyFile, certificate := writeClientCertificate(t)
+	target, caFile := startMutualTLSTarget(t, certificate)
+	withCertificate := WithClientCertificate(certFile, keyFile, caFile)
+
+	// The certificate is used by the configured transport in either order
+	optionSets := [][]ServerOption{
+		{withCertificate, WithTripperOptions(multiplexer.WithMaxIdleConnsPerHost(8))},
+		{WithTripperOptions(multiplexer.WithMaxIdleConnsPerHost(8)), withCertificate},
+		{WithHTTPClient(&http.Client{}), withCertificate},
+		{withCertificate, WithTransport(http.DefaultTransport.(*http.Transport).Clone())},
+	}
+
+	for i, opts := range optionSets {
+		server := newServer(t, target.URL, opts...)
+		require.NoError(t, server.Get("/hello", fragment.Define("/hello")))
+
+		w := httptest.NewRecorder()
+		server.CreateHandler().ServeHTTP(w, httptest.NewRequest("GET", "/hello", nil))
+
+		require.Equal(t, http.StatusOK, w.Code, i)
+		require.Equal(t, "hello viewproxy", w.Body.String(), i)
+	}
+
+	_, err := NewServer(target.URL, WithH2C(), withCertificate)
+	require.ErrorIs(t, err, ErrConflictingTransportOptions)
+	require.Contains(t, err.Error(), "WithClientCertificate and WithH2C")
+
+	_, err = NewServer(target.URL, withCertificate, WithTransport(&countingTransport{}))
+	require.ErrorIs(t, err, ErrConflictingTransportOptions)
+}
+
+func TestWithClientCertificate_Invalid(t *testing.T) {
+	certFile, keyFile, _ := writeClientCertificate(t)
+
+	_, err := NewServer("https://localhost:9999", WithClientCertificate(certFile, "missing.pem", ""))
+	var optionErr *OptionError
+	require.ErrorAs(t, err, &optionErr)
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	_, err = NewServer("https://localhost:9999", WithClientCertificate(certFile, keyFile, keyFile))
+	require.ErrorIs(t, err, ErrInvalidCACertificate)
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"log"
@@ -16,8 +19,15 @@ import (
 )
 
 func main() {
+	validateOnly := flag.Bool("validate-only", false, "print a JSON validation report of the configuration and exit")
+	flag.Parse()
+
 	target := getTarget()
-	server, err := viewproxy.NewServer(target, viewproxy.WithPassThrough(target))
+	server, err := viewproxy.NewServer(
+		target,
+		viewproxy.WithPassThrough(target),
+		viewproxy.WithPathPrefix(os.Getenv("PATH_PREFIX")),
+	)
 
 	if err != nil {
 		panic(err)
@@ -29,20 +39,20 @@ func main() {
 
 	server.Get(
 		"/hello/:name",
-		fragment.Define("/layout/:name", fragment.WithChildren(fragment.Children{
-			"body": fragment.Define("/body/:name", fragment.WithChildren(fragment.Children{
-				"header":  fragment.Define("/header/:name", fragment.WithMetadata(map[string]string{"title": "Hello"})),
-				"message": fragment.Define("/message/:name"),
+		fragment.Define("/layout/:name", fragment.WithTimingLabel("layout"), fragment.WithChildren(fragment.Children{
+			"body": fragment.Define("/body/:name", fragment.WithTimingLabel("body"), fragment.WithChildren(fragment.Children{
+				"header":  fragment.Define("/header/:name", fragment.WithTimingLabel("header"), fragment.WithMetadata(map[string]string{"title": "Hello"})),
+				"message": fragment.Define("/message/:name", fragment.WithTimingLabel("message")),
 			})),
 		})),
 	)
 
 	server.AroundResponse = func(h http.Handler) http.Handler {
-		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		return multiplexer.WithCombinedServerTimingHeader(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
 			// Strip etag header from response
 			rw.Header().Del("etag")
 			h.ServeHTTP(rw, r)
-		})
+		}))
 	}
 
 	// setup middleware
@@ -58,9 +68,38 @@ func main() {
 		multiplexer.NewStandardTripper(&http.Client{}),
 	)
 
+	if *validateOnly {
+		os.Exit(printValidationReport(server))
+	}
+
 	server.ListenAndServe()
 }
 
+// printValidationReport prints the validation report of the server as JSON and
+// returns the exit status for the highest severity finding.
+func printValidationReport(server *viewproxy.Server) int {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	report := server.ValidateConfiguration(ctx, viewproxy.WithPassThroughProbe())
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	switch report.Severity() {
+	case viewproxy.SeverityError:
+		return 2
+	case viewproxy.SeverityWarning:
+		return 1
+	default:
+		return 0
+	}
+}
+
 func buildLogger() *log.Logger {
 	file, err := os.OpenFile("log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
 	defer file.Close()
@@ -0,0 +1,78 @@
+package viewproxy
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/blakewilliams/viewproxy/pkg/multiplexer"
+)
+
+// refetchNotModified fetches the fragments that responded with 304 Not
+// Modified again without conditional headers when other fragments changed,
+// since the response is stitched from their bodies. The results are returned
+// unchanged when every fragment or no fragment is unchanged.
+func (s *Server) refetchNotModified(ctx context.Context, route *Route, header http.Header, requestables []multiplexer.Requestable, results []*multiplexer.Result) ([]*multiplexer.Result, error) {
+	notModified := make([]int, 0)
+	for i, result := range results {
+		if result.NotModified() {
+			notModified = append(notModified, i)
+		}
+	}
+
+	if len(notModified) == 0 || len(notModified) == len(results) {
+		return results, nil
+	}
+
+	req := s.newRouteRequest(route)
+	req.Header = header.Clone()
+	for _, name := range multiplexer.ConditionalHeaders {
+		req.Header.Del(name)
+	}
+	for _, i := range notModified {
+		req.WithRequestable(requestables[i])
+	}
+
+	refetched, err := req.Do(ctx)
+	if err != nil {
+		multiplexer.ReleaseResults(results, nil)
+		return refetched, err
+	}
+
+	for j, i := range notModified {
+		results[i].Release()
+		results[i] = refetched[j]
+	}
+
+	return results, nil
+}
+
+// allNotModified returns true when every fragment responded with 304 Not
+// Modified, so the client's cached response is still fresh.
+func allNotModified(results []*multiplexer.Result) bool {
+	for _, result := range results {
+		if !result.NotModified() {
+			return false
+		}
+	}
+
+	return len(results) > 0
+}
+
+// latestLastModified returns the most recent Last-Modified header of the
+// results, and false when a result doesn't have one.
+func latestLastModified(results []*multiplexer.Result) (time.Time, bool) {
+	var latest time.Time
+	for _, result := range results {
+		lastModified, err := http.ParseTime(result.Header().Get("Last-Modified"))
+		if err != nil {
+			return time.Time{}, false
+		}
+
+		if lastModified.After(latest) {
+			latest = lastModified
+		}
+	}
+
+	return latest, len(results) > 0
+}
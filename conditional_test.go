@@ -0,0 +1,116 @@
+package viewproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/blakewilliams/viewproxy/pkg/fragment"
+	"github.com/stretchr/testify/require"
+)
+
+// startConditionalTarget starts a target whose fragments were last modified
+// at the given times.
+func startConditionalTarget(t *testing.T, lastModified map[string]time.Time) *testTarget {
+	target := startTarget(t)
+	for path, modified := range lastModified {
+		body := path
+		if path == "/layout" {
+			body = `<body><viewproxy-fragment id="body"></viewproxy-fragment><viewproxy-fragment id="footer"></viewproxy-fragment></body>`
+		}
+
+		target.respond(path, &targetResponse{
+			header: http.Header{"Last-Modified": {modified.Format(http.TimeFormat)}},
+			body:   body,
+		})
+	}
+
+	return target
+}
+
+func newConditionalServer(t *testing.T, target *testTarget) *Server {
+	server := newServer(t, target.URL)
+	server.ConditionalFragments = true
+	require.NoError(t, server.Get("/hello", fragment.Define("/layout",
+		fragment.WithoutValidation(),
+		fragment.WithChild("body", fragment.Define("/body", fragment.WithoutValidation())),
+		fragment.WithChild("footer", fragment.Define("/footer", fragment.WithoutValidation())),
+	)))
+
+	return server
+}
+
+// conditions returns the If-Modified-Since header of each request for the
+// path, in the order received.
+func conditions(target *testTarget, path string) []string {
+	values := make([]string, 0)
+	for _, header := range target.requestHeaders(path) {
+		values = append(values, header.Get("If-Modified-Since"))
+	}
+
+	return values
+}
+
+func getSince(server *Server, since time.Time) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "/hello", nil)
+	r.Header.Set("If-Modified-Since", since.Format(http.TimeFormat))
+	w := httptest.NewRecorder()
+	server.CreateHandler().ServeHTTP(w, r)
+
+	return w
+}
+
+func TestConditionalFragments_AllFresh(t *testing.T) {
+	modified := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	target := startConditionalTarget(t, map[string]time.Time{
+		"/layout": modified,
+		"/body":   modified.Add(time.Hour),
+		"/footer": modified,
+	})
+	server := newConditionalServer(t, target)
+
+	w := getSince(server, modified.Add(time.Hour))
+	require.Equal(t, http.StatusNotModified, w.Code)
+	require.Empty(t, w.Body.String())
+	require.Equal(t, modified.Add(time.Hour).Format(http.TimeFormat), w.Header().Get("Last-Modified"))
+
+	for _, path := range []string{"/layout", "/body", "/footer"} {
+		require.Equal(t, 1, target.count(path))
+	}
+}
+
+func TestConditionalFragments_PartiallyStale(t *testing.T) {
+	modified := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	target := startConditionalTarget(t, map[string]time.Time{
+		"/layout": modified,
+		"/body":   modified.Add(2 * time.Hour),
+		"/footer": modified,
+	})
+	server := newConditionalServer(t, target)
+
+	w := getSince(server, modified.Add(time.Hour))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "<body>/body/footer</body>", w.Body.String())
+	// The latest Last-Modified is used, so the next request revalidates the
+	// body against it
+	require.Equal(t, modified.Add(2*time.Hour).Format(http.TimeFormat), w.Header().Get("Last-Modified"))
+
+	// Unchanged fragments are fetched again without the conditional header
+	since := modified.Add(time.Hour).Format(http.TimeFormat)
+	require.Equal(t, []string{since, ""}, conditions(target, "/layout"))
+	require.Equal(t, []string{since}, conditions(target, "/body"))
+	require.Equal(t, []string{since, ""}, conditions(target, "/footer"))
+}
+
+func TestConditionalFragments_Disabled(t *testing.T) {
+	modified := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	target := startConditionalTarget(t, map[string]time.Time{"/layout": modified, "/body": modified, "/footer": modified})
+	server := newConditionalServer(t, target)
+	server.ConditionalFragments = false
+
+	w := getSince(server, modified)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "<body>/body/footer</body>", w.Body.String())
+	require.Equal(t, []string{""}, conditions(target, "/body"))
+}
@@ -0,0 +1,199 @@
+package viewproxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/blakewilliams/viewproxy/pkg/fragment"
+	"github.com/blakewilliams/viewproxy/pkg/multiplexer"
+)
+
+const defaultDiscoveryPath = "/_viewproxy/definition"
+
+// DiscoveredFragment is the JSON representation of a fragment returned by the
+// target when discovering a route.
+type DiscoveredFragment struct {
+	Path string `json:"path"`
+	// Values can be strings, booleans, or numbers
+	Metadata         map[string]interface{}        `json:"metadata"`
+	IgnoreValidation bool                          `json:"ignoreValidation"`
+	Children         map[string]DiscoveredFragment `json:"children"`
+}
+
+// DiscoveredRoute is the JSON representation of a route's definition returned
+// by the target when discovering a route.
+type DiscoveredRoute struct {
+	Root     DiscoveredFragment `json:"root"`
+	Metadata map[string]string  `json:"metadata"`
+}
+
+type DiscoveryOption = func(*discoveryConfig)
+
+type discoveryConfig struct {
+	path     string
+	deferred bool
+}
+
+// WithDiscoveryPath sets the path on the target that route definitions are
+// requested from. Defaults to `/_viewproxy/definition`.
+func WithDiscoveryPath(path string) DiscoveryOption {
+	return func(config *discoveryConfig) {
+		config.path = path
+	}
+}
+
+// DeferDiscovery defers discovering the route until the first request that
+// matches it. The discovered definition is cached, failed discoveries are
+// retried on the next request.
+func DeferDiscovery() DiscoveryOption {
+	return func(config *discoveryConfig) {
+		config.deferred = true
+	}
+}
+
+// pendingDiscovery is attached to placeholder routes whose discovery was
+// deferred.
+type pendingDiscovery struct {
+	mu     sync.Mutex
+	config *discoveryConfig
+	route  *Route
+}
+
+// GetDiscovered defines a route whose fragments are discovered by requesting
+// `/_viewproxy/definition?route=<path>` from the target. The response is
+// validated like routes defined via Get, and any failure is returned.
+func (s *Server) GetDiscovered(path string, opts ...DiscoveryOption) error {
+	config := &discoveryConfig{path: defaultDiscoveryPath}
+	for _, opt := range opts {
+		opt(config)
+	}
+
+	if config.deferred {
+		route := newRoute(path, map[string]string{}, fragment.Define(path, fragment.WithoutValidation()))
+		route.discovery = &pendingDiscovery{config: config}
+
+		s.routesMu.Lock()
+		defer s.routesMu.Unlock()
+		s.routes = append(s.routes, route)
+
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.ProxyTimeout)
+	defer cancel()
+
+	route, err := s.discoverRoute(ctx, path, config)
+	if err != nil {
+		return err
+	}
+
+	s.routesMu.Lock()
+	defer s.routesMu.Unlock()
+
+	if err := s.checkFragmentPaths(s.fragmentPathCollisions(route, s.routes)); err != nil {
+		return err
+	}
+
+	s.routes = append(s.routes, route)
+
+	return nil
+}
+
+// resolveDiscovery returns the discovered route for a placeholder route,
+// discovering it and replacing the placeholder on the first call.
+func (s *Server) resolveDiscovery(ctx context.Context, placeholder *Route) (*Route, error) {
+	pending := placeholder.discovery
+
+	pending.mu.Lock()
+	defer pending.mu.Unlock()
+
+	if pending.route != nil {
+		return pending.route, nil
+	}
+
+	route, err := s.discoverRoute(ctx, placeholder.Path, pending.config)
+	if err != nil {
+		return nil, err
+	}
+
+	s.routesMu.Lock()
+	others := make([]*Route, 0, len(s.routes))
+	for _, existing := range s.routes {
+		if existing != placeholder {
+			others = append(others, existing)
+		}
+	}
+
+	if err := s.checkFragmentPaths(s.fragmentPathCollisions(route, others)); err != nil {
+		s.routesMu.Unlock()
+		return nil, err
+	}
+
+	for i, existing := range s.routes {
+		if existing == placeholder {
+			s.routes[i] = route
+		}
+	}
+	s.routesMu.Unlock()
+
+	pending.route = route
+	return route, nil
+}
+
+func (s *Server) discoverRoute(ctx context.Context, path string, config *discoveryConfig) (*Route, error) {
+	discoveryURL := *s.targetURL
+	discoveryURL.Path = config.path
+	discoveryURL.RawQuery = url.Values{"route": []string{path}}.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, discoveryURL.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not create discovery request for %s: %w", path, err)
+	}
+
+	if s.HmacSecret != "" {
+		multiplexer.SignRequest(s.HmacSecret, req)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not discover route %s: %w", path, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not discover route %s: target responded with %d", path, resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("could not read discovery response for %s: %w", path, err)
+	}
+
+	var discovered DiscoveredRoute
+	if err := json.Unmarshal(body, &discovered); err != nil {
+		return nil, fmt.Errorf("could not unmarshal discovery response for %s: %w", path, err)
+	}
+
+	route, err := NewRoute(path, discoveredDefinition(discovered.Root), WithRouteMetadata(discovered.Metadata))
+	if err != nil {
+		return nil, fmt.Errorf("discovered route %s is invalid: %w", path, err)
+	}
+
+	return route, nil
+}
+
+func discoveredDefinition(discovered DiscoveredFragment) *fragment.Definition {
+	f := fragment.Define(discovered.Path, fragment.WithTypedMetadata(discovered.Metadata))
+	f.IgnoreValidation = discovered.IgnoreValidation
+
+	for name, child := range discovered.Children {
+		fragment.WithChild(name, discoveredDefinition(child))(f)
+	}
+
+	return f
+}
@@ -0,0 +1,106 @@
+package viewproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func startDiscoveryTargetServer(discoveries *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/_viewproxy/definition":
+			atomic.AddInt32(discoveries, 1)
+
+			switch r.URL.Query().Get("route") {
+			case "/hello/:name":
+				w.Write([]byte(`{
+					"root": {
+						"path": "/layout",
+						"ignoreValidation": true,
+						"children": {"body": {"path": "/body/:name"}}
+					},
+					"metadata": {"owner": "web"}
+				}`))
+			case "/invalid/:name":
+				w.Write([]byte(`{"root": {"path": "/layout/:id"}}`))
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		case "/layout":
+			w.Write([]byte(`<html><viewproxy-fragment id="body"></viewproxy-fragment></html>`))
+		case "/body/world":
+			w.Write([]byte("hello world"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestGetDiscovered(t *testing.T) {
+	var discoveries int32
+	target := startDiscoveryTargetServer(&discoveries)
+	defer target.Close()
+
+	server := newServer(t, target.URL)
+	require.NoError(t, server.GetDiscovered("/hello/:name"))
+	require.Equal(t, int32(1), atomic.LoadInt32(&discoveries))
+
+	routes := server.Routes()
+	require.Len(t, routes, 1)
+	require.Equal(t, "web", routes[0].Metadata["owner"])
+	require.Equal(t, []string{"root", "root.body"}, routes[0].FragmentOrder())
+
+	w := httptest.NewRecorder()
+	server.CreateHandler().ServeHTTP(w, httptest.NewRequest("GET", "/hello/world", nil))
+
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.Equal(t, "<html>hello world</html>", w.Body.String())
+}
+
+func TestGetDiscovered_Errors(t *testing.T) {
+	var discoveries int32
+	target := startDiscoveryTargetServer(&discoveries)
+	defer target.Close()
+
+	server := newServer(t, target.URL)
+
+	err := server.GetDiscovered("/missing")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "target responded with 404")
+
+	err = server.GetDiscovered("/invalid/:name")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "discovered route /invalid/:name is invalid")
+
+	require.Len(t, server.Routes(), 0)
+}
+
+func TestGetDiscovered_Deferred(t *testing.T) {
+	var discoveries int32
+	target := startDiscoveryTargetServer(&discoveries)
+	defer target.Close()
+
+	server := newServer(t, target.URL)
+	require.NoError(t, server.GetDiscovered("/hello/:name", DeferDiscovery()))
+	require.NoError(t, server.GetDiscovered("/missing", DeferDiscovery()))
+	require.Equal(t, int32(0), atomic.LoadInt32(&discoveries))
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		server.CreateHandler().ServeHTTP(w, httptest.NewRequest("GET", "/hello/world", nil))
+
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+		require.Equal(t, "<html>hello world</html>", w.Body.String())
+	}
+	require.Equal(t, int32(1), atomic.LoadInt32(&discoveries))
+
+	w := httptest.NewRecorder()
+	server.CreateHandler().ServeHTTP(w, httptest.NewRequest("GET", "/missing", nil))
+
+	require.Equal(t, http.StatusInternalServerError, w.Result().StatusCode)
+	require.Equal(t, int32(2), atomic.LoadInt32(&discoveries))
+}
@@ -0,0 +1,63 @@
+package viewproxy
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+)
+
+const (
+	defaultNotFoundBody      = "404 not found"
+	defaultInternalErrorBody = "500 internal server error"
+	defaultErrorContentType  = "text/plain; charset=utf-8"
+)
+
+// errorBodyData is the data available to NotFoundBody and InternalErrorBody
+// templates.
+type errorBodyData struct {
+	// The path of the request
+	Path string
+}
+
+// stitchErrorHeaders are forwarded from the root fragment's response, but don't
+// describe the error body written when the response can't be stitched.
+var stitchErrorHeaders = []string{"Content-Encoding", "ETag", "Last-Modified"}
+
+// writeStitchError responds with a 500 when the fragments of the response
+// can't be stitched together.
+func (s *Server) writeStitchError(w http.ResponseWriter, r *http.Request) {
+	for _, name := range stitchErrorHeaders {
+		w.Header().Del(name)
+	}
+
+	s.writeErrorBody(w, r, http.StatusInternalServerError, s.InternalErrorBody, s.InternalErrorContentType)
+}
+
+// writeErrorBody writes the status code and the body template rendered for the
+// request. Values are HTML escaped when the template is rendered.
+func (s *Server) writeErrorBody(w http.ResponseWriter, r *http.Request, statusCode int, body string, contentType string) {
+	rendered, err := renderErrorBody(body, r)
+	if err != nil {
+		s.Logger.Printf("Could not render error body: %s", err)
+		rendered = []byte(http.StatusText(statusCode))
+		contentType = defaultErrorContentType
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(statusCode)
+	w.Write(rendered)
+}
+
+func renderErrorBody(body string, r *http.Request) ([]byte, error) {
+	tmpl, err := template.New("error").Parse(body)
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, errorBodyData{Path: r.URL.Path}); err != nil {
+		return nil, err
+	}
+
+	return b.Bytes(), nil
+}
@@ -0,0 +1,59 @@
+package viewproxy
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+type fragmentHeadersContextKey struct{}
+
+// fragmentHeaders contains the headers set by SetFragmentHeader. Middleware
+// can set headers from other goroutines, so access is guarded by mu.
+type fragmentHeaders struct {
+	mu     sync.Mutex
+	header http.Header
+}
+
+// SetFragmentHeader sets a header on every fragment request made for the
+// current request, e.g. a device class derived from the User-Agent in
+// AroundRequest middleware. Fragment headers replace forwarded headers of the
+// same name, and are set before fragment requests are signed.
+//
+// Headers set once fragments have been requested aren't applied. Does nothing
+// when the request doesn't match a route.
+func SetFragmentHeader(ctx context.Context, key string, value string) {
+	headers := fragmentHeadersFrom(ctx)
+	if headers == nil {
+		return
+	}
+
+	headers.mu.Lock()
+	defer headers.mu.Unlock()
+	headers.header.Set(key, value)
+}
+
+// FragmentHeadersFromContext returns a copy of the headers set by
+// SetFragmentHeader for the current request, or nil when the request doesn't
+// match a route.
+func FragmentHeadersFromContext(ctx context.Context) http.Header {
+	headers := fragmentHeadersFrom(ctx)
+	if headers == nil {
+		return nil
+	}
+
+	headers.mu.Lock()
+	defer headers.mu.Unlock()
+	return headers.header.Clone()
+}
+
+func fragmentHeadersFrom(ctx context.Context) *fragmentHeaders {
+	if ctx == nil {
+		return nil
+	}
+
+	if headers, ok := ctx.Value(fragmentHeadersContextKey{}).(*fragmentHeaders); ok {
+		return headers
+	}
+	return nil
+}
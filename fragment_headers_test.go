@@ -0,0 +1,63 @@
+package viewproxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/blakewilliams/viewproxy/pkg/fragment"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetFragmentHeader(t *testing.T) {
+	var mu sync.Mutex
+	deviceClasses := make(map[string]string)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		deviceClasses[r.URL.Path] = r.Header.Get("X-Device-Class")
+		mu.Unlock()
+
+		if r.URL.Path == "/layout" {
+			w.Write([]byte(`<viewproxy-fragment id="header"></viewproxy-fragment><viewproxy-fragment id="body"></viewproxy-fragment>`))
+		}
+	}))
+	defer target.Close()
+
+	server := newServer(t, target.URL)
+	server.AroundRequest = func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.Contains(r.UserAgent(), "Mobile") {
+				SetFragmentHeader(r.Context(), "X-Device-Class", "mobile")
+			}
+
+			require.Equal(t, "mobile", FragmentHeadersFromContext(r.Context()).Get("X-Device-Class"))
+			next.ServeHTTP(w, r)
+		})
+	}
+
+	root := fragment.Define("/layout", fragment.WithoutValidation(),
+		fragment.WithChild("header", fragment.Define("/header", fragment.WithoutValidation())),
+		fragment.WithChild("body", fragment.Define("/body", fragment.WithoutValidation())),
+	)
+	require.NoError(t, server.Get("/hello", root))
+
+	r := httptest.NewRequest("GET", "/hello", nil)
+	r.Header.Set("User-Agent", "Mobile Safari")
+	// Fragment headers replace forwarded headers
+	r.Header.Set("X-Device-Class", "desktop")
+	w := httptest.NewRecorder()
+	server.CreateHandler().ServeHTTP(w, r)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, map[string]string{"/layout": "mobile", "/header": "mobile", "/body": "mobile"}, deviceClasses)
+}
+
+func TestSetFragmentHeader_WithoutRoute(t *testing.T) {
+	ctx := context.Background()
+	SetFragmentHeader(ctx, "X-Device-Class", "mobile")
+
+	require.Nil(t, FragmentHeadersFromContext(ctx))
+}
@@ -0,0 +1,75 @@
+package viewproxy
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/blakewilliams/viewproxy/pkg/fragment"
+)
+
+// WithHost restricts the route to requests for the given host, e.g.
+// `marketing.example.com`, and fetches its fragments from target instead of
+// the server's target. The server's target is used when target is empty.
+//
+// Routes are matched in the order they're defined, so host-scoped routes
+// should be defined before routes that match every host.
+func WithHost(host string, target string) GetOption {
+	return func(route *Route) {
+		route.Host = host
+		route.targetURL = nil
+		route.targetErr = nil
+
+		if target == "" {
+			return
+		}
+
+		targetURL, err := url.Parse(target)
+		if err != nil {
+			route.targetErr = fmt.Errorf("route %s has invalid target for host %s: %w", route.Path, host, err)
+			return
+		}
+
+		route.targetURL = targetURL
+	}
+}
+
+// HostRouter defines routes scoped to a single host. It's returned by
+// Server.Host.
+type HostRouter struct {
+	server *Server
+	host   string
+	target string
+}
+
+// Host returns a HostRouter that defines routes for requests to the given host,
+// fetching their fragments from target. See WithHost.
+func (s *Server) Host(host string, target string) *HostRouter {
+	return &HostRouter{server: s, host: host, target: target}
+}
+
+// Get defines a route for the host. See Server.Get.
+func (hr *HostRouter) Get(path string, root *fragment.Definition, opts ...GetOption) error {
+	return hr.server.Get(path, root, append(opts, WithHost(hr.host, hr.target))...)
+}
+
+// matchesHost returns true when the route matches requests for the given host.
+// Routes without a host match every host, and ports are ignored unless the
+// route's host includes one.
+func (r *Route) matchesHost(host string) bool {
+	if r.Host == "" || strings.EqualFold(r.Host, host) {
+		return true
+	}
+
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		return strings.EqualFold(r.Host, hostname)
+	}
+
+	return false
+}
+
+// routeKey identifies a route by its host and path.
+func routeKey(route *Route) string {
+	return route.Host + route.Path
+}
@@ -0,0 +1,87 @@
+package viewproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/blakewilliams/viewproxy/pkg/fragment"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHostRouting(t *testing.T) {
+	newTarget := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name + " " + r.URL.Path))
+		}))
+	}
+
+	app := newTarget("app")
+	defer app.Close()
+	marketing := newTarget("marketing")
+	defer marketing.Close()
+
+	server := newServer(t, app.URL)
+	require.NoError(t, server.Host("marketing.example.com", marketing.URL).Get("/", fragment.Define("/home")))
+	require.NoError(t, server.Get("/", fragment.Define("/dashboard")))
+
+	get := func(target string) string {
+		w := httptest.NewRecorder()
+		server.CreateHandler().ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+
+		return w.Body.String()
+	}
+
+	require.Equal(t, "marketing /home", get("http://marketing.example.com/"))
+	require.Equal(t, "marketing /home", get("http://MARKETING.example.com:8080/"))
+	require.Equal(t, "app /dashboard", get("http://app.example.com/"))
+
+	route, _ := server.MatchingRoute("/")
+	require.Equal(t, "", route.Host)
+
+	route, _ = server.MatchingRouteForHost("marketing.example.com", "/")
+	require.Equal(t, "marketing.example.com", route.Host)
+
+	// Forwarded hosts are only used when trusted
+	r := httptest.NewRequest("GET", "http://internal/", nil)
+	r.Header.Set("X-Forwarded-Host", "marketing.example.com")
+	w := httptest.NewRecorder()
+	server.CreateHandler().ServeHTTP(w, r)
+	require.Equal(t, "app /dashboard", w.Body.String())
+
+	server.TrustForwardedHeaders = true
+	w = httptest.NewRecorder()
+	server.CreateHandler().ServeHTTP(w, r)
+	require.Equal(t, "marketing /home", w.Body.String())
+}
+
+func TestWithHost_InvalidTarget(t *testing.T) {
+	server := newServer(t, targetServer.URL)
+
+	err := server.Get("/", fragment.Define("/home"), WithHost("marketing.example.com", "://invalid"))
+	require.ErrorContains(t, err, "invalid target for host marketing.example.com")
+}
+
+func TestReloadRoutes_Hosts(t *testing.T) {
+	server := newServer(t, targetServer.URL)
+
+	routes := make([]*Route, 0, 2)
+	for _, host := range []string{"one.example.com", "two.example.com"} {
+		route, err := NewRoute("/", fragment.Define("/home"), WithHost(host, ""))
+		require.NoError(t, err)
+		routes = append(routes, route)
+	}
+
+	require.NoError(t, server.ReloadRoutes(routes))
+	require.Len(t, server.Routes(), 2)
+
+	changed := make([]*Route, 0)
+	server.OnRouteChanged = func(route *Route) { changed = append(changed, route) }
+
+	route, err := NewRoute("/", fragment.Define("/home"), WithHost("two.example.com", "http://other.internal"))
+	require.NoError(t, err)
+
+	require.NoError(t, server.ReloadRoutes([]*Route{routes[0], route}))
+	require.Equal(t, []*Route{route}, changed)
+	require.Same(t, routes[0], server.Routes()[0])
+}
@@ -0,0 +1,106 @@
+package viewproxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type pathPrefixContextKey struct{}
+
+// WithPathPrefix mounts the server under the given path prefix, e.g. `/app`,
+// so its handler can be used in an existing mux. The prefix is stripped before
+// routes are matched and requests are passed through, and is added back to
+// relative redirect locations. Requests outside of the prefix are 404s.
+func WithPathPrefix(prefix string) ServerOption {
+	return namedOption("WithPathPrefix", func(server *Server) error {
+		if strings.ContainsAny(prefix, "?#") {
+			return fmt.Errorf("%w: %q", ErrInvalidPathPrefix, prefix)
+		}
+
+		server.pathPrefix = "/" + strings.Trim(prefix, "/")
+		if server.pathPrefix == "/" {
+			server.pathPrefix = ""
+		}
+
+		return nil
+	})
+}
+
+// PathPrefixFromContext returns the path prefix that was stripped from the
+// request, or an empty string if the server has no prefix.
+func PathPrefixFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+
+	if prefix := ctx.Value(pathPrefixContextKey{}); prefix != nil {
+		return prefix.(string)
+	}
+	return ""
+}
+
+// stripPathPrefix returns a copy of the request without the server's path
+// prefix, or false if the request is not under the prefix.
+func (s *Server) stripPathPrefix(r *http.Request) (*http.Request, bool) {
+	path := strings.TrimPrefix(r.URL.Path, s.pathPrefix)
+	rawPath := strings.TrimPrefix(r.URL.RawPath, s.pathPrefix)
+
+	if len(path) == len(r.URL.Path) || (path != "" && !strings.HasPrefix(path, "/")) {
+		return nil, false
+	}
+
+	if path == "" {
+		path = "/"
+	}
+
+	stripped := r.Clone(context.WithValue(r.Context(), pathPrefixContextKey{}, s.pathPrefix))
+	stripped.URL = new(url.URL)
+	*stripped.URL = *r.URL
+	stripped.URL.Path = path
+	stripped.URL.RawPath = rawPath
+	stripped.RequestURI = stripped.URL.RequestURI()
+
+	return stripped, true
+}
+
+// prefixedResponseWriter adds the path prefix to relative redirect locations
+// written by the target.
+type prefixedResponseWriter struct {
+	http.ResponseWriter
+	prefix      string
+	wroteHeader bool
+}
+
+func (pw *prefixedResponseWriter) WriteHeader(statusCode int) {
+	if !pw.wroteHeader && !isInformational(statusCode) {
+		pw.wroteHeader = true
+
+		location := pw.Header().Get("Location")
+		if strings.HasPrefix(location, "/") && !strings.HasPrefix(location, "//") {
+			pw.Header().Set("Location", pw.prefix+location)
+		}
+	}
+
+	pw.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (pw *prefixedResponseWriter) Write(p []byte) (int, error) {
+	if !pw.wroteHeader {
+		pw.WriteHeader(http.StatusOK)
+	}
+
+	return pw.ResponseWriter.Write(p)
+}
+
+func (pw *prefixedResponseWriter) Flush() {
+	if flusher, ok := pw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (pw *prefixedResponseWriter) Unwrap() http.ResponseWriter {
+	return pw.ResponseWriter
+}
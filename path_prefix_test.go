@@ -0,0 +1,103 @@
+package viewproxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/blakewilliams/viewproxy/pkg/fragment"
+	"github.com/stretchr/testify/require"
+)
+
+func startPrefixTarget(t *testing.T) *testTarget {
+	target := startTarget(t)
+	target.respond("/layout/world", &targetResponse{body: "layout"})
+	target.respond("/other/page", &targetResponse{body: "passed through /other/page"})
+	target.respond("/old", &targetResponse{status: http.StatusFound, header: http.Header{"Location": {"/new"}}})
+
+	return target
+}
+
+// originalPath returns the original path sent with the last request for the
+// layout.
+func originalPath(target *testTarget) string {
+	headers := target.requestHeaders("/layout/world")
+	return headers[len(headers)-1].Get(HeaderViewProxyOriginalPath)
+}
+
+func mountWithPrefix(t *testing.T, server *Server) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/app/", server.CreateHandler())
+	mounted := httptest.NewServer(mux)
+	t.Cleanup(mounted.Close)
+
+	return mounted
+}
+
+func getBody(t *testing.T, client *http.Client, url string) (*http.Response, string) {
+	resp, err := client.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	return resp, string(body)
+}
+
+func TestServer_PathPrefix(t *testing.T) {
+	target := startPrefixTarget(t)
+	server := newServer(t, target.URL, WithPassThrough(target.URL), WithPathPrefix("/app/"))
+	err := server.Get("/hello/:name", fragment.Define("/layout/:name"))
+	require.NoError(t, err)
+	mounted := mountWithPrefix(t, server)
+
+	resp, body := getBody(t, http.DefaultClient, mounted.URL+"/app/hello/world")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "layout", body)
+	require.Equal(t, "/hello/world", originalPath(target))
+
+	resp, body = getBody(t, http.DefaultClient, mounted.URL+"/app/other/page")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "passed through /other/page", body)
+
+	noRedirects := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, _ = getBody(t, noRedirects, mounted.URL+"/app/old")
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+	require.Equal(t, "/app/new", resp.Header.Get("Location"))
+}
+
+func TestServer_PathPrefixOriginalPathIncludesPrefix(t *testing.T) {
+	target := startPrefixTarget(t)
+	server := newServer(t, target.URL, WithPathPrefix("/app"))
+	server.OriginalPathIncludesPrefix = true
+	err := server.Get("/hello/:name", fragment.Define("/layout/:name"))
+	require.NoError(t, err)
+	mounted := mountWithPrefix(t, server)
+
+	getBody(t, http.DefaultClient, mounted.URL+"/app/hello/world?a=b")
+	require.Equal(t, "/app/hello/world?a=b", originalPath(target))
+}
+
+func TestServer_PathPrefixOutsidePrefix(t *testing.T) {
+	server := newServer(t, targetServer.URL, WithPathPrefix("/app"))
+
+	for _, path := range []string{"/hello", "/application"} {
+		w := httptest.NewRecorder()
+		server.CreateHandler().ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+
+		require.Equal(t, http.StatusNotFound, w.Result().StatusCode)
+	}
+}
+
+func TestWithPathPrefix_Error(t *testing.T) {
+	_, err := NewServer(targetServer.URL, WithPathPrefix("/app?x"))
+
+	var optionErr *OptionError
+	require.ErrorAs(t, err, &optionErr)
+	require.Equal(t, "WithPathPrefix", optionErr.Option)
+	require.ErrorIs(t, err, ErrInvalidPathPrefix)
+}
@@ -1,9 +1,16 @@
 package fragment
 
 import (
+	"bytes"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/blakewilliams/viewproxy/pkg/multiplexer"
 )
@@ -15,28 +22,125 @@ type DefinitionOption = func(*Definition)
 type Definition struct {
 	Path             string
 	routeParts       []string
+	rawQuery         string
+	queryTemplate    url.Values
 	dynamicParts     []string
+	optionalParts    []string
 	Metadata         map[string]string
+	typedMetadata    map[string]interface{}
 	IgnoreValidation bool
-	children         map[string]*Definition
+	// Fetcher is used to fetch the fragment instead of making an HTTP request
+	// to the target.
+	Fetcher multiplexer.FragmentFetcher
+	// StaticContent is used as the content of the fragment instead of making a
+	// request when it is non-nil.
+	StaticContent []byte
+	// RetryPolicy configures retries for transient failures
+	RetryPolicy multiplexer.RetryPolicy
+	// Shared fragments can be fetched via the server's SharedCache
+	Shared bool
+	// The request headers that affect the response of a shared fragment
+	SharedHeaders []string
+	// Condition determines if the fragment is rendered for a request. When nil
+	// the fragment is always rendered.
+	Condition func(*http.Request) bool
+	// The name used to report the fragment's timing in the Server-Timing
+	// header. Fragments without a label are not reported.
+	TimingLabel string
+	// The latency and error rate objective of the fragment, evaluated by the
+	// server's SLOMonitor. Nil when the fragment has no objective.
+	SLO *SLO
+	// Values used for dynamic parts of the path that the route doesn't
+	// provide, keyed by their name including the leading `:`
+	paramDefaults map[string]string
+	// Lazy fragments are not requested, a placeholder with the fragment's URL
+	// is rendered instead so it can be loaded by the client
+	Lazy bool
+	// Fragments are fetched in ascending priority order. Fragments with a
+	// priority greater than 0 are optional and are skipped when they're still
+	// pending once the server's OptionalFragmentBudget is consumed.
+	Priority int
+	// Rendered in place of the fragment when it's skipped
+	Fallback []byte
+	// Overrides the maximum size of the fragment's response body. The
+	// request's default is used when 0.
+	MaxBodySize int64
+	// Static query params added to the fragment's URL. Params with the same
+	// name forwarded from the request take precedence unless OverrideQuery is
+	// set.
+	Query url.Values
+	// When true, Query replaces params with the same name forwarded from the
+	// request
+	OverrideQuery bool
+	// Headers sent with the fragment's request only, replacing request headers
+	// with the same name
+	Headers http.Header
+	// The method of the fragment's request. Defaults to GET when empty.
+	Method string
+	// The body sent with the fragment's request
+	Body []byte
+	// Non-2xx status codes that are rendered instead of failing the request,
+	// e.g. 204 or 404 for fragments that may have no content
+	AllowedStatusCodes []int
+	// Overrides the server's target the fragment is fetched from
+	Target *url.URL
+	// The error from parsing the target passed to WithTarget
+	targetErr error
+	// Fragments that must succeed before the fragment is fetched
+	dependencies []multiplexer.Dependency
+	alternates   []*Definition
+	children     map[string]*Definition
+	canary       *canary
 }
 
+type canary struct {
+	definition *Definition
+	mu         sync.RWMutex
+	percent    float64
+}
+
+// Define returns a new fragment definition for the given path. The path can
+// contain dynamic parts, e.g. `/users/:id`, and a query string whose values can
+// also be dynamic, e.g. `/render?partial=header&variant=:variant`. A path of
+// `/` requests the root of the target. Routes reject definitions with an empty
+// path, see HasEmptyPath.
 func Define(path string, options ...DefinitionOption) *Definition {
-	safePath := strings.TrimPrefix(path, "/")
+	safePath, rawQuery := splitQuery(strings.TrimPrefix(path, "/"))
+	// Invalid query strings are ignored, the same as url.ParseQuery
+	queryTemplate, _ := url.ParseQuery(rawQuery)
+
 	definition := &Definition{
-		Path:       path,
-		routeParts: strings.Split(safePath, "/"),
-		Metadata:   make(map[string]string),
-		children:   make(map[string]*Definition),
+		Path:          path,
+		routeParts:    strings.Split(safePath, "/"),
+		rawQuery:      rawQuery,
+		queryTemplate: queryTemplate,
+		Metadata:      make(map[string]string),
+		children:      make(map[string]*Definition),
 	}
 
 	dynamicParts := make([]string, 0)
-	for _, part := range definition.routeParts {
+	optionalParts := make([]string, 0)
+	addDynamicPart := func(part string) {
 		if strings.HasPrefix(part, ":") {
-			dynamicParts = append(dynamicParts, part)
+			name := strings.TrimSuffix(part, "?")
+			dynamicParts = append(dynamicParts, name)
+
+			if name != part {
+				optionalParts = append(optionalParts, name)
+			}
+		}
+	}
+
+	for _, part := range definition.routeParts {
+		addDynamicPart(part)
+	}
+	for _, values := range queryTemplate {
+		for _, value := range values {
+			addDynamicPart(value)
 		}
 	}
 	definition.dynamicParts = dynamicParts
+	definition.optionalParts = optionalParts
 
 	for _, option := range options {
 		option(definition)
@@ -45,6 +149,24 @@ func Define(path string, options ...DefinitionOption) *Definition {
 	return definition
 }
 
+// splitQuery splits the query string from the path. A `?` ending a dynamic
+// part, e.g. `:id?`, marks the part as optional and does not start the query.
+func splitQuery(path string) (string, string) {
+	for i := 0; i < len(path); i++ {
+		if path[i] != '?' {
+			continue
+		}
+
+		segmentStart := strings.LastIndex(path[:i], "/") + 1
+		optional := strings.HasPrefix(path[segmentStart:i], ":") && (i == len(path)-1 || path[i+1] == '/')
+		if !optional {
+			return path[:i], path[i+1:]
+		}
+	}
+
+	return path, ""
+}
+
 func (d *Definition) Children() map[string]*Definition {
 	return d.children
 }
@@ -80,33 +202,490 @@ func WithMetadata(metadata map[string]string) DefinitionOption {
 	}
 }
 
+// WithTypedMetadata sets metadata values that may not be strings, such as
+// booleans and numbers. The values remain available as strings via Metadata.
+func WithTypedMetadata(metadata map[string]interface{}) DefinitionOption {
+	return func(definition *Definition) {
+		definition.typedMetadata = metadata
+
+		stringMetadata := make(map[string]string, len(definition.Metadata)+len(metadata))
+		for key, value := range definition.Metadata {
+			stringMetadata[key] = value
+		}
+		for key, value := range metadata {
+			stringMetadata[key] = fmt.Sprint(value)
+		}
+		definition.Metadata = stringMetadata
+	}
+}
+
+// TypedMetadata returns the metadata of the definition, preserving the type of
+// values set via WithTypedMetadata.
+func (d *Definition) TypedMetadata() map[string]interface{} {
+	metadata := make(map[string]interface{}, len(d.Metadata))
+	for key, value := range d.Metadata {
+		metadata[key] = value
+	}
+	for key, value := range d.typedMetadata {
+		metadata[key] = value
+	}
+
+	return metadata
+}
+
+// Static defines a fragment with constant content that is rendered without
+// making a request.
+func Static(content []byte, options ...DefinitionOption) *Definition {
+	return Define("", append([]DefinitionOption{WithStaticContent(content)}, options...)...)
+}
+
+// WithStaticContent renders the fragment using the given content instead of
+// making a request. Static fragments are not validated against the route
+// since they have no dynamic parts to fill.
+func WithStaticContent(content []byte) DefinitionOption {
+	return func(definition *Definition) {
+		definition.StaticContent = content
+	}
+}
+
+// WithPriority sets the priority of the fragment. Fragments with a priority
+// greater than 0 are optional and can be skipped to avoid timing out the page.
+func WithPriority(priority int) DefinitionOption {
+	return func(definition *Definition) {
+		definition.Priority = priority
+	}
+}
+
+// WithFallback sets the content rendered in place of the fragment when it's
+// skipped.
+func WithFallback(content []byte) DefinitionOption {
+	return func(definition *Definition) {
+		definition.Fallback = content
+	}
+}
+
+// Lazy renders a placeholder containing the fragment's URL instead of
+// requesting the fragment, so it can be loaded later by the client.
+func Lazy() DefinitionOption {
+	return func(definition *Definition) {
+		definition.Lazy = true
+	}
+}
+
+// HasEmptyPath returns true when the definition's path is empty, ignoring its
+// query, e.g. `?partial=header`. Static definitions have an empty path since
+// they're never requested.
+func (d *Definition) HasEmptyPath() bool {
+	path, _ := splitQuery(d.Path)
+	return path == ""
+}
+
+// IsStatic returns true when the fragment is rendered from StaticContent
+// instead of being requested.
+func (d *Definition) IsStatic() bool {
+	return d.StaticContent != nil
+}
+
+// WithRetry makes up to the given number of attempts to fetch the fragment
+// when it fails with a connection error or a 502, 503, or 504 status code,
+// waiting for backoff between attempts.
+func WithRetry(attempts int, backoff time.Duration) DefinitionOption {
+	return func(definition *Definition) {
+		definition.RetryPolicy = multiplexer.RetryPolicy{Attempts: attempts, Backoff: backoff}
+	}
+}
+
+// Shared marks the fragment as safe to share across requests and routes via
+// the server's SharedCache. Requests are shared when they have the same URL
+// and the same values for the given headers. When no headers are given only
+// requests without cookies or authorization are shared.
+func Shared(headerKeys ...string) DefinitionOption {
+	return func(definition *Definition) {
+		definition.Shared = true
+		definition.SharedHeaders = headerKeys
+	}
+}
+
+// WithCondition only renders the fragment when fn returns true for the
+// incoming request. Conditional fragments that are not rendered are not
+// fetched and are replaced with empty content, along with their children.
+func WithCondition(fn func(*http.Request) bool) DefinitionOption {
+	return func(definition *Definition) {
+		definition.Condition = fn
+	}
+}
+
+// WithAlternate renders the alternate definition in place of the defined
+// fragment when the alternate's condition matches the incoming request.
+// Alternates are checked in the order they are added. The children of the
+// original definition are used for the alternate.
+func WithAlternate(alternate *Definition) DefinitionOption {
+	return func(definition *Definition) {
+		definition.alternates = append(definition.alternates, alternate)
+	}
+}
+
+// Alternates returns the alternates of the definition.
+func (d *Definition) Alternates() []*Definition {
+	return d.alternates
+}
+
+// SelectFor returns the definition to render for the given request, which is
+// the first alternate with a matching condition, or the definition itself if
+// its condition matches. nil is returned when no definition should be
+// rendered.
+func (d *Definition) SelectFor(r *http.Request) *Definition {
+	for _, alternate := range d.alternates {
+		if alternate.Condition == nil || alternate.Condition(r) {
+			return alternate
+		}
+	}
+
+	if d.Condition == nil || d.Condition(r) {
+		return d
+	}
+
+	return nil
+}
+
+// WithTimingLabel reports the fragment's timing in the Server-Timing header
+// using the given label.
+func WithTimingLabel(label string) DefinitionOption {
+	return func(definition *Definition) {
+		definition.TimingLabel = label
+	}
+}
+
+// SLO is the service level objective of a fragment.
+type SLO struct {
+	// The 99th percentile latency of the fragment's requests
+	P99 time.Duration
+	// The maximum ratio of the fragment's requests that fail, between 0 and 1
+	MaxErrorRate float64
+}
+
+// WithSLO sets the latency and error rate objective of the fragment. The
+// server's SLOMonitor emits an event when the fragment breaches either.
+func WithSLO(p99 time.Duration, maxErrorRate float64) DefinitionOption {
+	return func(definition *Definition) {
+		definition.SLO = &SLO{P99: p99, MaxErrorRate: maxErrorRate}
+	}
+}
+
+// WithQuery adds static query params to the fragment's URL, e.g.
+// `WithQuery(url.Values{"variant": {"compact"}})`. Params forwarded from the
+// request with the same name are kept instead.
+func WithQuery(query url.Values) DefinitionOption {
+	return func(definition *Definition) {
+		if definition.Query == nil {
+			definition.Query = make(url.Values, len(query))
+		}
+
+		for name, values := range query {
+			definition.Query[name] = append(definition.Query[name], values...)
+		}
+	}
+}
+
+// WithQueryOverride is like WithQuery, but the static query params replace
+// params forwarded from the request with the same name.
+func WithQueryOverride(query url.Values) DefinitionOption {
+	return func(definition *Definition) {
+		WithQuery(query)(definition)
+		definition.OverrideQuery = true
+	}
+}
+
+// WithHeaders adds headers sent only with the fragment's request, e.g.
+// `WithHeaders(http.Header{"X-Fragment-Role": {"sidebar"}})`. The headers
+// replace request headers with the same name.
+func WithHeaders(header http.Header) DefinitionOption {
+	return func(definition *Definition) {
+		if definition.Headers == nil {
+			definition.Headers = make(http.Header, len(header))
+		}
+
+		for name, values := range header {
+			name = http.CanonicalHeaderKey(name)
+			definition.Headers[name] = append(definition.Headers[name], values...)
+		}
+	}
+}
+
+// WithMethod requests the fragment using the given method, e.g. POST for
+// targets that render fragments from a request body. Fragments requested
+// with a method other than GET are never retried, hedged, or shared.
+func WithMethod(method string) DefinitionOption {
+	return func(definition *Definition) {
+		definition.Method = method
+	}
+}
+
+// WithBody sends the given body with the fragment's request. The body's
+// Content-Type can be set using WithHeaders.
+func WithBody(body []byte) DefinitionOption {
+	return func(definition *Definition) {
+		definition.Body = body
+	}
+}
+
+// WithAllowedStatusCodes renders the fragment's response when the target
+// responds with one of the given non-2xx status codes, instead of failing the
+// request, e.g. `WithAllowedStatusCodes(204, 404)` for an ads fragment.
+func WithAllowedStatusCodes(codes ...int) DefinitionOption {
+	return func(definition *Definition) {
+		definition.AllowedStatusCodes = append(definition.AllowedStatusCodes, codes...)
+	}
+}
+
+// WithTarget fetches the fragment from the given base URL, e.g.
+// `https://search.internal`, instead of the server's target. Invalid URLs
+// are reported when the route is validated.
+func WithTarget(target string) DefinitionOption {
+	return func(definition *Definition) {
+		definition.Target, definition.targetErr = url.Parse(target)
+		if definition.targetErr != nil {
+			definition.targetErr = fmt.Errorf("fragment %s has invalid target: %w", definition.Path, definition.targetErr)
+		}
+	}
+}
+
+// TargetError returns the error from parsing the target passed to WithTarget,
+// if any.
+func (d *Definition) TargetError() error {
+	return d.targetErr
+}
+
+// DependsOn fetches the fragment only after the fragment with the given key,
+// e.g. `root.layout`, succeeds. inject is called with the dependency's result
+// and can add query params and headers to the fragment's request, e.g. a
+// token returned in a header by the layout. The fragment fails with a
+// multiplexer.DependencyError when the dependency fails.
+func DependsOn(key string, inject func(dep *multiplexer.Result, q url.Values, h http.Header)) DefinitionOption {
+	return func(definition *Definition) {
+		definition.dependencies = append(definition.dependencies, multiplexer.Dependency{Key: key, Inject: inject})
+	}
+}
+
+// Dependencies returns the fragments that must succeed before the fragment is
+// fetched.
+func (d *Definition) Dependencies() []multiplexer.Dependency {
+	return d.dependencies
+}
+
+// WithParamDefault sets the value used for the named dynamic part of the
+// fragment's path when the route doesn't provide it, e.g.
+// `WithParamDefault(":name", "guest")`.
+func WithParamDefault(name string, value string) DefinitionOption {
+	if !strings.HasPrefix(name, ":") {
+		name = ":" + name
+	}
+
+	return func(definition *Definition) {
+		if definition.paramDefaults == nil {
+			definition.paramDefaults = make(map[string]string)
+		}
+		definition.paramDefaults[name] = value
+	}
+}
+
+// ParamDefaults returns the default values of the fragment's dynamic parts,
+// keyed by their name including the leading `:`.
+func (d *Definition) ParamDefaults() map[string]string {
+	return d.paramDefaults
+}
+
+// WithMaxBodySize overrides the maximum size in bytes of the fragment's
+// response body.
+func WithMaxBodySize(size int64) DefinitionOption {
+	return func(definition *Definition) {
+		definition.MaxBodySize = size
+	}
+}
+
+// WithFetcher fetches the fragment using the given fetcher instead of making
+// an HTTP request to the target.
+func WithFetcher(fetcher multiplexer.FragmentFetcher) DefinitionOption {
+	return func(definition *Definition) {
+		definition.Fetcher = fetcher
+	}
+}
+
+// Canary serves the given definition in place of the defined fragment for the
+// given percentage (0-100) of requests. The children of the original
+// definition are used for both the original and the canary.
+func Canary(definition *Definition, percent float64) DefinitionOption {
+	return func(d *Definition) {
+		d.canary = &canary{definition: definition, percent: percent}
+	}
+}
+
+// CanaryDefinition returns the canary definition, or nil if the definition has
+// no canary.
+func (d *Definition) CanaryDefinition() *Definition {
+	if d.canary == nil {
+		return nil
+	}
+
+	return d.canary.definition
+}
+
+// CanaryPercent returns the percentage of requests that are served by the
+// canary definition.
+func (d *Definition) CanaryPercent() float64 {
+	if d.canary == nil {
+		return 0
+	}
+
+	d.canary.mu.RLock()
+	defer d.canary.mu.RUnlock()
+
+	return d.canary.percent
+}
+
+// SetCanaryPercent sets the percentage of requests that are served by the
+// canary definition. It is safe to call while requests are being served.
+func (d *Definition) SetCanaryPercent(percent float64) error {
+	if d.canary == nil {
+		return fmt.Errorf("fragment %s has no canary", d.Path)
+	}
+
+	if percent < 0 || percent > 100 {
+		return fmt.Errorf("canary percent must be between 0 and 100, got %v", percent)
+	}
+
+	d.canary.mu.Lock()
+	defer d.canary.mu.Unlock()
+
+	d.canary.percent = percent
+
+	return nil
+}
+
+// SelectCanary returns the definition that should be used for requests
+// identified by key, and whether that is the canary definition. A given key
+// will consistently select the same definition as long as the canary percent
+// is unchanged.
+func (d *Definition) SelectCanary(key string) (*Definition, bool) {
+	return d.SelectCanaryWithPercent(key, d.CanaryPercent())
+}
+
+// SelectCanaryWithPercent is like SelectCanary, but serves the canary to the
+// given percentage of requests instead of the definition's CanaryPercent.
+func (d *Definition) SelectCanaryWithPercent(key string, percent float64) (*Definition, bool) {
+	if d.canary == nil {
+		return d, false
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(d.Path))
+	hash.Write([]byte(key))
+	bucket := float64(hash.Sum32()%10000) / 100
+
+	if bucket < percent {
+		return d.canary.definition, true
+	}
+
+	return d, false
+}
+
+// DynamicParts returns the names of the dynamic parts of the path, including
+// the leading `:`. Optional parts are returned without their trailing `?`.
 func (d *Definition) DynamicParts() []string {
 	return d.dynamicParts
 }
 
+// PathParts returns the segments of the fragment's path without its query,
+// e.g. `[]string{"users", ":id"}` for `/users/:id?tab=profile`.
+func (d *Definition) PathParts() []string {
+	return d.routeParts
+}
+
+// OptionalParts returns the names of the dynamic parts of the path that are
+// optional, e.g. `:id` for `/items/:id?`.
+func (d *Definition) OptionalParts() []string {
+	return d.optionalParts
+}
+
 func (d *Definition) Requestable(target *url.URL, pathParams map[string]string, query url.Values) (*Request, error) {
+	if d.Target != nil {
+		target = d.Target
+	}
+
 	var path strings.Builder
 
 	for _, part := range d.routeParts {
-		path.WriteByte('/')
-
 		if strings.HasPrefix(part, ":") {
-			if replacement, ok := pathParams[part]; ok {
-				path.WriteString(replacement)
-			} else {
-				return nil, fmt.Errorf("no parameter was provided for %s in route %s", part, d.Path)
+			replacement, ok, err := d.parameter(part, pathParams)
+			if err != nil {
+				return nil, err
 			}
+
+			// Optional parts are omitted from the path when absent
+			if !ok {
+				continue
+			}
+
+			path.WriteByte('/')
+			path.WriteString(replacement)
 		} else {
+			path.WriteByte('/')
 			path.WriteString(part)
 		}
 	}
 
-	requestURL, err := buildURL(target, path.String(), query.Encode())
+	// The query template takes precedence over static and forwarded query
+	// params
+	mergedQuery := make(url.Values, len(query)+len(d.Query)+len(d.queryTemplate))
+	for name, values := range query {
+		mergedQuery[name] = values
+	}
+
+	for name, values := range d.Query {
+		if _, forwarded := mergedQuery[name]; forwarded && !d.OverrideQuery {
+			continue
+		}
+
+		mergedQuery[name] = values
+	}
+
+	for name, values := range d.queryTemplate {
+		templateValues := make([]string, 0, len(values))
+
+		for _, value := range values {
+			if !strings.HasPrefix(value, ":") {
+				templateValues = append(templateValues, value)
+				continue
+			}
+
+			replacement, ok, err := d.parameter(value, pathParams)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+
+			// Parameters are path escaped, they're escaped again when the
+			// query is encoded
+			unescaped, err := url.PathUnescape(replacement)
+			if err != nil {
+				return nil, fmt.Errorf("could not encode url: %w", err)
+			}
+			templateValues = append(templateValues, unescaped)
+		}
+
+		if len(templateValues) > 0 {
+			mergedQuery[name] = templateValues
+		}
+	}
+
+	requestURL, err := buildURL(target, path.String(), mergedQuery.Encode())
 	if err != nil {
 		return nil, err
 	}
 
-	templateURL, err := buildURL(target, strings.Join(d.routeParts, "/"), "")
+	templateURL, err := buildURL(target, strings.Join(d.routeParts, "/"), d.rawQuery)
 	if err != nil {
 		return nil, err
 	}
@@ -114,10 +693,34 @@ func (d *Definition) Requestable(target *url.URL, pathParams map[string]string,
 	return &Request{
 		RequestURL:  requestURL,
 		Definition:  d,
+		Parameters:  pathParams,
 		templateURL: templateURL,
 	}, nil
 }
 
+// parameter returns the escaped value of the dynamic part, e.g. `:name` or
+// `:name?`, falling back to its default. ok is false when an optional part is
+// absent.
+func (d *Definition) parameter(part string, pathParams map[string]string) (value string, ok bool, err error) {
+	name := strings.TrimSuffix(part, "?")
+	replacement, provided := pathParams[name]
+
+	if name != part && replacement == "" {
+		return "", false, nil
+	}
+
+	if !provided {
+		defaultValue, hasDefault := d.paramDefaults[name]
+		if !hasDefault {
+			return "", false, fmt.Errorf("no parameter was provided for %s in route %s", part, d.Path)
+		}
+
+		replacement = url.PathEscape(defaultValue)
+	}
+
+	return replacement, true, nil
+}
+
 func buildURL(base *url.URL, path string, query string) (*url.URL, error) {
 	unescapedPath, err := url.PathUnescape(path)
 	if err != nil {
@@ -133,13 +736,114 @@ func buildURL(base *url.URL, path string, query string) (*url.URL, error) {
 }
 
 type Request struct {
-	RequestURL  *url.URL
-	Definition  *Definition
+	RequestURL *url.URL
+	Definition *Definition
+	// Canary is true when Definition is the canary of the defined fragment
+	Canary bool
+	// Parameters contains the escaped dynamic parts of the route used to build
+	// the request, keyed by their name including the leading `:`.
+	Parameters map[string]string
+	// The key of the fragment in the route, e.g. `root.layout.header`
+	FragmentKey string
 	templateURL *url.URL
 }
 
 var _ multiplexer.Requestable = &Request{}
+var _ multiplexer.FetcherRequestable = &Request{}
+var _ multiplexer.RetryRequestable = &Request{}
+var _ multiplexer.SharedRequestable = &Request{}
+var _ multiplexer.KeyedRequestable = &Request{}
+var _ multiplexer.TypedMetadataRequestable = &Request{}
+var _ multiplexer.TimingLabelRequestable = &Request{}
+var _ multiplexer.MaxBodySizeRequestable = &Request{}
+var _ multiplexer.PriorityRequestable = &Request{}
+var _ multiplexer.AllowedStatusRequestable = &Request{}
+var _ multiplexer.DependentRequestable = &Request{}
+var _ multiplexer.FailoverRequestable = &Request{}
+var _ multiplexer.HeaderRequestable = &Request{}
+var _ multiplexer.MethodRequestable = &Request{}
+
+func (fr *Request) URL() string                          { return fr.RequestURL.String() }
+func (fr *Request) TemplateURL() string                  { return fr.templateURL.String() }
+func (fr *Request) Fetcher() multiplexer.FragmentFetcher { return fr.Definition.Fetcher }
+func (fr *Request) RetryPolicy() multiplexer.RetryPolicy { return fr.Definition.RetryPolicy }
+func (fr *Request) Key() string                          { return fr.FragmentKey }
+func (fr *Request) TimingLabel() string                  { return fr.Definition.TimingLabel }
+func (fr *Request) MaxBodySize() int64                   { return fr.Definition.MaxBodySize }
+func (fr *Request) Priority() int                        { return fr.Definition.Priority }
+func (fr *Request) AllowedStatusCodes() []int            { return fr.Definition.AllowedStatusCodes }
+func (fr *Request) Headers() http.Header                 { return fr.Definition.Headers }
+func (fr *Request) Method() string                       { return fr.Definition.Method }
+func (fr *Request) Shared() (bool, []string) {
+	return fr.Definition.Shared, fr.Definition.SharedHeaders
+}
+func (fr *Request) Dependencies() []multiplexer.Dependency {
+	return fr.Definition.dependencies
+}
+
+// NewBody returns a reader for the fragment's body, or nil when it has none.
+func (fr *Request) NewBody() io.ReadCloser {
+	if fr.Definition.Body == nil {
+		return nil
+	}
+
+	return io.NopCloser(bytes.NewReader(fr.Definition.Body))
+}
+
+// WithQuery returns a copy of the request for the same URL with the given
+// query.
+func (fr *Request) WithQuery(query url.Values) multiplexer.Requestable {
+	requestURL := *fr.RequestURL
+	requestURL.RawQuery = query.Encode()
+
+	request := *fr
+	request.RequestURL = &requestURL
+
+	return &request
+}
 
-func (fr *Request) URL() string                 { return fr.RequestURL.String() }
-func (fr *Request) TemplateURL() string         { return fr.templateURL.String() }
-func (fr *Request) Metadata() map[string]string { return fr.Definition.Metadata }
+// WithTarget returns a copy of the request for the same path and query on the
+// given target.
+func (fr *Request) WithTarget(target *url.URL) multiplexer.Requestable {
+	requestURL := *fr.RequestURL
+	requestURL.Scheme = target.Scheme
+	requestURL.Host = target.Host
+
+	templateURL := *fr.templateURL
+	templateURL.Scheme = target.Scheme
+	templateURL.Host = target.Host
+
+	request := *fr
+	request.RequestURL = &requestURL
+	request.templateURL = &templateURL
+
+	return &request
+}
+
+// Metadata returns the metadata of the definition. When the definition has a
+// canary, the `canary` key indicates whether the canary was selected.
+func (fr *Request) Metadata() map[string]string {
+	if fr.Definition.canary == nil && !fr.Canary {
+		return fr.Definition.Metadata
+	}
+
+	metadata := make(map[string]string, len(fr.Definition.Metadata)+1)
+	for key, value := range fr.Definition.Metadata {
+		metadata[key] = value
+	}
+	metadata["canary"] = strconv.FormatBool(fr.Canary)
+
+	return metadata
+}
+
+// TypedMetadata returns the typed metadata of the definition. When the
+// definition has a canary, the `canary` key is a bool indicating whether the
+// canary was selected.
+func (fr *Request) TypedMetadata() map[string]interface{} {
+	metadata := fr.Definition.TypedMetadata()
+	if fr.Definition.canary != nil || fr.Canary {
+		metadata["canary"] = fr.Canary
+	}
+
+	return metadata
+}
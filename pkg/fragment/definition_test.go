@@ -1,6 +1,10 @@
 package fragment
 
 import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"testing"
 
@@ -22,6 +26,19 @@ func TestFragment_IntoRequestable(t *testing.T) {
 	require.Equal(t, "http://fake.net/hello/:name", requestable.TemplateURL())
 }
 
+func TestFragment_IntoRequestable_TargetRoot(t *testing.T) {
+	definition := Define("/?partial=header")
+	require.False(t, definition.HasEmptyPath())
+	require.True(t, Define("").HasEmptyPath())
+	require.True(t, Define("?partial=header").HasEmptyPath())
+
+	base, _ := url.Parse("http://fake.net/app")
+	requestable, err := definition.Requestable(base, map[string]string{}, url.Values{})
+	require.NoError(t, err)
+
+	require.Equal(t, "http://fake.net/?partial=header", requestable.URL())
+}
+
 func TestFragment_IntoRequestable_MissingDynamicPart(t *testing.T) {
 	definition := Define("/hello/:name")
 	_, err := definition.Requestable(
@@ -33,6 +50,104 @@ func TestFragment_IntoRequestable_MissingDynamicPart(t *testing.T) {
 	require.EqualError(t, err, "no parameter was provided for :name in route /hello/:name")
 }
 
+func TestFragment_IntoRequestable_ParamDefault(t *testing.T) {
+	definition := Define("/hello/:name", WithParamDefault(":name", "guest user"))
+
+	requestable, err := definition.Requestable(target, map[string]string{}, url.Values{})
+	require.NoError(t, err)
+	require.Equal(t, "http://fake.net/hello/guest%20user", requestable.URL())
+
+	requestable, err = definition.Requestable(target, map[string]string{":name": "fox.mulder"}, url.Values{})
+	require.NoError(t, err)
+	require.Equal(t, "http://fake.net/hello/fox.mulder", requestable.URL())
+}
+
+func TestFragment_IntoRequestable_QueryTemplate(t *testing.T) {
+	definition := Define("/render?partial=header&variant=:variant")
+	require.Equal(t, []string{":variant"}, definition.DynamicParts())
+
+	requestable, err := definition.Requestable(
+		target,
+		map[string]string{":variant": "dark%20mode"},
+		url.Values{"variant": []string{"light"}, "page": []string{"2"}},
+	)
+	require.NoError(t, err)
+
+	require.Equal(t, "http://fake.net/render?page=2&partial=header&variant=dark+mode", requestable.URL())
+	require.Equal(t, "http://fake.net/render?partial=header&variant=:variant", requestable.TemplateURL())
+}
+
+func TestFragment_IntoRequestable_Query(t *testing.T) {
+	definition := Define("/header", WithQuery(url.Values{"variant": {"compact"}, "theme": {"dark"}}))
+	forwarded := url.Values{"theme": {"light"}, "page": {"2"}}
+
+	requestable, err := definition.Requestable(target, map[string]string{}, forwarded)
+	require.NoError(t, err)
+	require.Equal(t, "http://fake.net/header?page=2&theme=light&variant=compact", requestable.URL())
+	require.Equal(t, "http://fake.net/header", requestable.TemplateURL())
+
+	definition = Define("/header", WithQueryOverride(url.Values{"variant": {"compact"}, "theme": {"dark"}}))
+
+	requestable, err = definition.Requestable(target, map[string]string{}, forwarded)
+	require.NoError(t, err)
+	require.Equal(t, "http://fake.net/header?page=2&theme=dark&variant=compact", requestable.URL())
+}
+
+func TestFragment_WithHeaders(t *testing.T) {
+	definition := Define("/sidebar",
+		WithHeaders(http.Header{"x-fragment-role": {"sidebar"}}),
+		WithHeaders(http.Header{"X-Fragment-Role": {"nav"}}),
+	)
+
+	requestable, err := definition.Requestable(target, map[string]string{}, url.Values{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"sidebar", "nav"}, requestable.Headers().Values("X-Fragment-Role"))
+}
+
+func TestFragment_WithMethodAndBody(t *testing.T) {
+	requestable, err := Define("/render", WithMethod(http.MethodPost), WithBody([]byte("id=1"))).Requestable(target, map[string]string{}, url.Values{})
+	require.NoError(t, err)
+	require.Equal(t, http.MethodPost, requestable.Method())
+
+	// Each request gets a new reader for the body
+	for i := 0; i < 2; i++ {
+		body, err := io.ReadAll(requestable.NewBody())
+		require.NoError(t, err)
+		require.Equal(t, "id=1", string(body))
+	}
+
+	requestable, err = Define("/render").Requestable(target, map[string]string{}, url.Values{})
+	require.NoError(t, err)
+	require.Empty(t, requestable.Method())
+	require.Nil(t, requestable.NewBody())
+}
+
+func TestFragment_IntoRequestable_Target(t *testing.T) {
+	definition := Define("/search/:query", WithTarget("https://search.internal"))
+	require.NoError(t, definition.TargetError())
+
+	requestable, err := definition.Requestable(target, map[string]string{":query": "cats"}, url.Values{})
+	require.NoError(t, err)
+	require.Equal(t, "https://search.internal/search/cats", requestable.URL())
+	require.Equal(t, "https://search.internal/search/:query", requestable.TemplateURL())
+
+	definition = Define("/search", WithTarget("://invalid"))
+	require.Error(t, definition.TargetError())
+}
+
+func TestFragment_Request_WithQuery(t *testing.T) {
+	definition := Define("/body", DependsOn("root", nil))
+	require.Len(t, definition.Dependencies(), 1)
+
+	requestable, err := definition.Requestable(target, map[string]string{}, url.Values{"a": {"1"}})
+	require.NoError(t, err)
+
+	injected := requestable.WithQuery(url.Values{"a": {"1"}, "token": {"abc"}})
+	require.Equal(t, "http://fake.net/body?a=1&token=abc", injected.URL())
+	require.Equal(t, "http://fake.net/body?a=1", requestable.URL())
+	require.Equal(t, "http://fake.net/body", injected.TemplateURL())
+}
+
 func TestFragment_IntoRequestable_HandlesURLEncodings(t *testing.T) {
 	definition := Define("/hello/:name")
 	requestable, err := definition.Requestable(
@@ -44,3 +159,112 @@ func TestFragment_IntoRequestable_HandlesURLEncodings(t *testing.T) {
 	require.Equal(t, "http://fake.net/hello/mulder%2fscully", requestable.URL())
 	require.Equal(t, "http://fake.net/hello/:name", requestable.TemplateURL())
 }
+
+func TestFragment_Canary(t *testing.T) {
+	canary := Define("/hello/:name/v2")
+	definition := Define("/hello/:name", Canary(canary, 5))
+
+	canaryCount := 0
+	for i := 0; i < 10000; i++ {
+		selected, isCanary := definition.SelectCanary(fmt.Sprintf("request-%d", i))
+
+		if isCanary {
+			require.Equal(t, canary, selected)
+			canaryCount++
+		} else {
+			require.Equal(t, definition, selected)
+		}
+	}
+
+	require.InDelta(t, 500, canaryCount, 100)
+
+	// Keys consistently select the same definition
+	for i := 0; i < 100; i++ {
+		_, first := definition.SelectCanary(fmt.Sprintf("user-%d", i))
+		_, second := definition.SelectCanary(fmt.Sprintf("user-%d", i))
+		require.Equal(t, first, second)
+	}
+}
+
+func TestFragment_SelectFor(t *testing.T) {
+	isMobile := func(r *http.Request) bool { return r.Header.Get("X-Mobile") != "" }
+	isTablet := func(r *http.Request) bool { return r.Header.Get("X-Tablet") != "" }
+
+	mobile := Define("/mobile_nav", WithCondition(isMobile))
+	desktop := Define("/desktop_nav", WithAlternate(mobile))
+	tabletOnly := Define("/tablet_nav", WithCondition(isTablet))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	require.Equal(t, desktop, desktop.SelectFor(r))
+	require.Nil(t, tabletOnly.SelectFor(r))
+
+	r.Header.Set("X-Mobile", "1")
+	r.Header.Set("X-Tablet", "1")
+	require.Equal(t, mobile, desktop.SelectFor(r))
+	require.Equal(t, tabletOnly, tabletOnly.SelectFor(r))
+}
+
+func TestFragment_TypedMetadata(t *testing.T) {
+	definition := Define(
+		"/hello/:name",
+		WithMetadata(map[string]string{"page": "homepage"}),
+		WithTypedMetadata(map[string]interface{}{"cacheable": true, "weight": 2}),
+		Canary(Define("/hello/:name/v2"), 0),
+	)
+
+	require.Equal(t, map[string]string{"page": "homepage", "cacheable": "true", "weight": "2"}, definition.Metadata)
+	require.Equal(t, map[string]interface{}{"page": "homepage", "cacheable": true, "weight": 2}, definition.TypedMetadata())
+
+	requestable, err := definition.Requestable(target, map[string]string{":name": "world"}, url.Values{})
+	require.NoError(t, err)
+	require.Equal(t, false, requestable.TypedMetadata()["canary"])
+	require.Equal(t, "false", requestable.Metadata()["canary"])
+}
+
+func TestFragment_SetCanaryPercent(t *testing.T) {
+	canary := Define("/hello/:name/v2")
+	definition := Define("/hello/:name", Canary(canary, 0))
+
+	for i := 0; i < 1000; i++ {
+		_, isCanary := definition.SelectCanary(fmt.Sprintf("request-%d", i))
+		require.False(t, isCanary)
+	}
+
+	require.NoError(t, definition.SetCanaryPercent(100))
+	require.Equal(t, float64(100), definition.CanaryPercent())
+
+	for i := 0; i < 1000; i++ {
+		_, isCanary := definition.SelectCanary(fmt.Sprintf("request-%d", i))
+		require.True(t, isCanary)
+	}
+
+	require.EqualError(t, definition.SetCanaryPercent(101), "canary percent must be between 0 and 100, got 101")
+	require.EqualError(t, Define("/foo").SetCanaryPercent(5), "fragment /foo has no canary")
+}
+
+func TestFragment_CanaryMetadata(t *testing.T) {
+	canary := Define("/hello/:name/v2", WithMetadata(map[string]string{"a": "b"}))
+	definition := Define("/hello/:name", Canary(canary, 100))
+
+	selected, isCanary := definition.SelectCanary("key")
+	requestable, err := selected.Requestable(target, map[string]string{":name": "world"}, url.Values{})
+	require.NoError(t, err)
+	requestable.Canary = isCanary
+
+	require.Equal(t, map[string]string{"a": "b", "canary": "true"}, requestable.Metadata())
+	require.Equal(t, map[string]string{"a": "b"}, canary.Metadata)
+}
+
+func TestFragment_IntoRequestable_OptionalParts(t *testing.T) {
+	definition := Define("/items/:id?/body")
+	require.Equal(t, []string{":id"}, definition.DynamicParts())
+	require.Equal(t, []string{":id"}, definition.OptionalParts())
+
+	requestable, err := definition.Requestable(target, map[string]string{":id": "1"}, url.Values{})
+	require.NoError(t, err)
+	require.Equal(t, "http://fake.net/items/1/body", requestable.URL())
+
+	requestable, err = definition.Requestable(target, map[string]string{}, url.Values{})
+	require.NoError(t, err)
+	require.Equal(t, "http://fake.net/items/body", requestable.URL())
+}
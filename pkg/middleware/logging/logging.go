@@ -1,6 +1,7 @@
 package logging
 
 import (
+	"fmt"
 	"net/http"
 	"time"
 
@@ -28,7 +29,10 @@ func (rw *ResponseWrapper) Write(p []byte) (int, error) {
 }
 
 func (rw *ResponseWrapper) WriteHeader(statusCode int) {
-	rw.StatusCode = statusCode
+	// Informational responses, e.g. 103 Early Hints, precede the final status
+	if statusCode >= 200 || statusCode == http.StatusSwitchingProtocols {
+		rw.StatusCode = statusCode
+	}
 	rw.responseWriter.WriteHeader(statusCode)
 }
 
@@ -38,6 +42,10 @@ func Middleware(server *viewproxy.Server, l logger) func(http.Handler) http.Hand
 			start := time.Now()
 			route := viewproxy.RouteFromContext(r.Context())
 
+			if suppressed := viewproxy.SuppressedRouteFromContext(r.Context()); suppressed != nil {
+				l.Printf("Route %s is disabled for %s", suppressed.Path, r.URL.Path)
+			}
+
 			if route != nil {
 				l.Printf("Handling %s", r.URL.Path)
 			} else if server.PassThroughEnabled() {
@@ -52,14 +60,39 @@ func Middleware(server *viewproxy.Server, l logger) func(http.Handler) http.Hand
 			duration := time.Since(start)
 
 			if route != nil {
-				l.Printf("Rendered %d in %dms for %s", wrapper.StatusCode, duration.Milliseconds(), r.URL.Path)
+				if fanOut := viewproxy.FanOutFromContext(r.Context()); fanOut != nil {
+					// Every fragment that failed is logged, in a stable order
+					for _, err := range fanOut.Errors {
+						l.Printf("Fragment error for %s: %s", r.URL.Path, err)
+					}
+					l.Printf(
+						"Rendered %d in %dms for %s (fragments: %d, skipped: %d)",
+						wrapper.StatusCode,
+						duration.Milliseconds(),
+						r.URL.Path,
+						fanOut.Configured,
+						fanOut.Skipped(),
+					)
+				} else {
+					l.Printf("Rendered %d in %dms for %s", wrapper.StatusCode, duration.Milliseconds(), r.URL.Path)
+				}
 			} else if server.PassThroughEnabled() {
-				l.Printf("Proxied %d in %dms for %s", wrapper.StatusCode, duration.Milliseconds(), r.URL.Path)
+				l.Printf("Proxied %d in %dms for %s%s", wrapper.StatusCode, duration.Milliseconds(), r.URL.Path, redirectSuffix(server, wrapper))
 			}
 		})
 	}
 }
 
+// redirectSuffix returns the secret filtered location of redirects
+func redirectSuffix(server *viewproxy.Server, wrapper *ResponseWrapper) string {
+	location := wrapper.Header().Get("Location")
+	if location == "" || wrapper.StatusCode < 300 || wrapper.StatusCode > 399 {
+		return ""
+	}
+
+	return fmt.Sprintf(" to %s", server.SecretFilter.FilterURLString(location))
+}
+
 type logTripper struct {
 	logger       logger
 	secretFilter secretfilter.Filter
@@ -71,6 +104,11 @@ func NewLogTripper(l logger, sf secretfilter.Filter, tripper multiplexer.Tripper
 }
 
 func (t *logTripper) Request(r *http.Request) (*http.Response, error) {
+	// Synthetic requests, e.g. prefetches, would pollute the logs
+	if multiplexer.IsSynthetic(r.Context()) {
+		return t.tripper.Request(r)
+	}
+
 	start := time.Now()
 	res, err := t.tripper.Request(r)
 	duration := time.Since(start)
@@ -80,7 +118,7 @@ func (t *logTripper) Request(r *http.Request) (*http.Response, error) {
 		if requestable != nil {
 			// TODO fragment.URL is full path
 			safeUrl := t.secretFilter.FilterURLString(requestable.URL())
-			t.logger.Printf("Fragment exception in %dms for %s\nerror: %s", duration.Milliseconds(), safeUrl, err)
+			t.logger.Printf("Fragment exception in %dms for %s%s\nerror: %s", duration.Milliseconds(), safeUrl, attemptSuffix(r), err)
 		} else {
 			safeUrl := t.secretFilter.FilterURL(r.URL)
 			t.logger.Printf("Proxy exception in %dms for %s\nerror: %s", duration.Milliseconds(), safeUrl, err)
@@ -92,7 +130,11 @@ func (t *logTripper) Request(r *http.Request) (*http.Response, error) {
 	if requestable != nil {
 		// TODO fragment.URL is full path
 		safeUrl := t.secretFilter.FilterURLString(requestable.URL())
-		t.logger.Printf("Fragment %d in %dms for %s", res.StatusCode, duration.Milliseconds(), safeUrl)
+		if requestable.Metadata()["canary"] == "true" {
+			t.logger.Printf("Fragment canary %d in %dms for %s%s", res.StatusCode, duration.Milliseconds(), safeUrl, attemptSuffix(r))
+		} else {
+			t.logger.Printf("Fragment %d in %dms for %s%s", res.StatusCode, duration.Milliseconds(), safeUrl, attemptSuffix(r))
+		}
 	} else {
 		safeUrl := t.secretFilter.FilterURL(r.URL)
 		t.logger.Printf("Proxy request %d in %dms for %s", res.StatusCode, duration.Milliseconds(), safeUrl)
@@ -100,3 +142,12 @@ func (t *logTripper) Request(r *http.Request) (*http.Response, error) {
 
 	return res, err
 }
+
+// attemptSuffix returns the attempt number of retried fragment requests
+func attemptSuffix(r *http.Request) string {
+	if attempt := multiplexer.AttemptFromContext(r.Context()); attempt > 1 {
+		return fmt.Sprintf(" (attempt %d)", attempt)
+	}
+
+	return ""
+}
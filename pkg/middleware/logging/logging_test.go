@@ -1,6 +1,7 @@
 package logging
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -61,7 +62,7 @@ func TestLoggingMiddleware(t *testing.T) {
 	require.Equal(t, 200, resp.StatusCode)
 
 	require.Equal(t, "Handling /hello/world", log.logs[0])
-	require.Regexp(t, regexp.MustCompile(`Rendered 200 in \d+ms for /hello/world`), log.logs[1])
+	require.Regexp(t, regexp.MustCompile(`Rendered 200 in \d+ms for /hello/world \(fragments: 2, skipped: 0\)`), log.logs[1])
 
 	// Proxying disabled
 	r = httptest.NewRequest("GET", "/fake", nil)
@@ -73,6 +74,70 @@ func TestLoggingMiddleware(t *testing.T) {
 	require.Equal(t, "Proxying is disabled and no route matches /fake", log.logs[2])
 }
 
+func TestLoggingMiddleware_FragmentErrors(t *testing.T) {
+	targetServer := startTargetServer()
+	defer targetServer.Close()
+
+	viewProxyServer, err := viewproxy.NewServer(targetServer.URL)
+	require.NoError(t, err)
+	viewProxyServer.Get("/broken", fragment.Define("/missing", fragment.WithoutValidation()))
+
+	log := &SliceLogger{logs: make([]string, 0)}
+	viewProxyServer.AroundRequest = Middleware(viewProxyServer, log)
+
+	w := httptest.NewRecorder()
+	viewProxyServer.CreateHandler().ServeHTTP(w, httptest.NewRequest("GET", "/broken", nil))
+	require.Equal(t, 500, w.Result().StatusCode)
+
+	require.Len(t, log.logs, 3)
+	require.Regexp(t, regexp.MustCompile(`^Fragment error for /broken: .*status: 404`), log.logs[1])
+	require.Regexp(t, regexp.MustCompile(`^Rendered 500 in \d+ms for /broken`), log.logs[2])
+}
+
+func TestLoggingMiddleware_SuppressedRoute(t *testing.T) {
+	targetServer := startTargetServer()
+	defer targetServer.Close()
+
+	viewProxyServer, err := viewproxy.NewServer(targetServer.URL)
+	require.NoError(t, err)
+	viewProxyServer.Get("/hello/:name", fragment.Define("/body/:name"), viewproxy.WithRouteEnabledFunc(func(context.Context) bool {
+		return false
+	}))
+
+	log := &SliceLogger{logs: make([]string, 0)}
+	viewProxyServer.AroundRequest = Middleware(viewProxyServer, log)
+
+	w := httptest.NewRecorder()
+	viewProxyServer.CreateHandler().ServeHTTP(w, httptest.NewRequest("GET", "/hello/world", nil))
+	require.Equal(t, 404, w.Result().StatusCode)
+
+	require.Equal(t, []string{
+		"Route /hello/:name is disabled for /hello/world",
+		"Proxying is disabled and no route matches /hello/world",
+	}, log.logs)
+}
+
+func TestLoggingMiddleware_Redirects(t *testing.T) {
+	var targetServer *httptest.Server
+	targetServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, targetServer.URL+"/login?token=secret", http.StatusFound)
+	}))
+	defer targetServer.Close()
+
+	viewProxyServer, err := viewproxy.NewServer(targetServer.URL, viewproxy.WithPassThrough(targetServer.URL))
+	require.NoError(t, err)
+
+	log := &SliceLogger{logs: make([]string, 0)}
+	viewProxyServer.AroundRequest = Middleware(viewProxyServer, log)
+
+	w := httptest.NewRecorder()
+	viewProxyServer.CreateHandler().ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/account", nil))
+	require.Equal(t, 302, w.Result().StatusCode)
+
+	require.Equal(t, "Proxying /account", log.logs[0])
+	require.Regexp(t, regexp.MustCompile(`^Proxied 302 in \d+ms for /account to http://example.com/login\?token=FILTERED$`), log.logs[1])
+}
+
 func TestLogTripperFragments(t *testing.T) {
 	targetServer := startTargetServer()
 	viewProxyServer, err := viewproxy.NewServer(targetServer.URL, viewproxy.WithPassThrough(targetServer.URL))
@@ -96,6 +161,63 @@ func TestLogTripperFragments(t *testing.T) {
 	require.Regexp(t, regexp.MustCompile(`Fragment 200 in \d+ms for http:\/\/.*`), log.logs[1])
 }
 
+func TestLogTripperRetriedFragments(t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		attempt := requests
+		mu.Unlock()
+
+		if attempt < 3 {
+			conn, _, err := w.(http.Hijacker).Hijack()
+			require.NoError(t, err)
+			conn.Close()
+			return
+		}
+
+		w.Write([]byte("hello world"))
+	}))
+	defer targetServer.Close()
+
+	viewProxyServer, err := viewproxy.NewServer(targetServer.URL)
+	require.NoError(t, err)
+
+	viewProxyServer.Get("/hello", fragment.Define("/body", fragment.WithoutValidation(), fragment.WithRetry(3, 0)))
+
+	log := &SliceLogger{logs: make([]string, 0)}
+	viewProxyServer.MultiplexerTripper = NewLogTripper(log, secretfilter.New(), multiplexer.NewStandardTripper(&http.Client{}))
+
+	w := httptest.NewRecorder()
+	viewProxyServer.CreateHandler().ServeHTTP(w, httptest.NewRequest("GET", "/hello", nil))
+	require.Equal(t, 200, w.Result().StatusCode)
+
+	require.Len(t, log.logs, 3)
+	require.Regexp(t, regexp.MustCompile(`^Fragment exception in \d+ms for http://[^ ]+/body\n`), log.logs[0])
+	require.Regexp(t, regexp.MustCompile(`^Fragment exception in \d+ms for http://[^ ]+/body \(attempt 2\)\n`), log.logs[1])
+	require.Regexp(t, regexp.MustCompile(`^Fragment 200 in \d+ms for http://[^ ]+/body \(attempt 3\)$`), log.logs[2])
+}
+
+func TestLogTripperSkipsSyntheticRequests(t *testing.T) {
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello world"))
+	}))
+	defer targetServer.Close()
+
+	log := &SliceLogger{logs: make([]string, 0)}
+	tripper := NewLogTripper(log, secretfilter.New(), multiplexer.NewStandardTripper(&http.Client{}))
+
+	r, err := http.NewRequestWithContext(multiplexer.WithSynthetic(context.Background()), "GET", targetServer.URL, nil)
+	require.NoError(t, err)
+
+	res, err := tripper.Request(r)
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, 200, res.StatusCode)
+	require.Empty(t, log.logs)
+}
+
 func startTargetServer() *httptest.Server {
 	instance := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		parts := strings.Split(r.URL.Path, "/")
@@ -103,7 +225,7 @@ func startTargetServer() *httptest.Server {
 
 		if strings.HasPrefix(r.URL.Path, "/layouts/test_layout/") {
 			w.WriteHeader(http.StatusOK)
-			w.Write([]byte("<html><view-proxy-content></view-proxy-content></html>"))
+			w.Write([]byte("<html><viewproxy-fragment id=\"body\"></viewproxy-fragment></html>"))
 		} else if strings.HasPrefix(r.URL.Path, "/header") {
 			w.WriteHeader(http.StatusOK)
 			w.Write([]byte("<body>"))
@@ -0,0 +1,169 @@
+package multiplexer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrBodyTooLarge is returned when a fragment's response body exceeds the
+// maximum body size.
+type ErrBodyTooLarge struct {
+	TemplateURL string
+	Limit       int64
+}
+
+func (e *ErrBodyTooLarge) Error() string {
+	return fmt.Sprintf("response body for %s exceeded limit of %d bytes", e.TemplateURL, e.Limit)
+}
+
+// MaxBodySizeRequestable is implemented by requestables that override the
+// maximum response body size of the request. A value of 0 uses the request's
+// MaxBodyBytes.
+type MaxBodySizeRequestable interface {
+	Requestable
+	MaxBodySize() int64
+}
+
+func (r *Request) maxBodyBytesFor(requestable Requestable) int64 {
+	if mr, ok := requestable.(MaxBodySizeRequestable); ok && mr.MaxBodySize() > 0 {
+		return mr.MaxBodySize()
+	}
+
+	return r.MaxBodyBytes
+}
+
+// Buffers larger than this are not returned to the pool, so a single large
+// body doesn't stay in memory
+const maxPooledBufferSize = 4 << 20
+
+// bodyBuffers holds the buffers response bodies are read into. Bodies are
+// copied out of the buffer, so results are safe to retain after the buffer is
+// reused.
+var bodyBuffers = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+func getBodyBuffer() *bytes.Buffer {
+	return bodyBuffers.Get().(*bytes.Buffer)
+}
+
+func putBodyBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBufferSize {
+		return
+	}
+
+	buf.Reset()
+	bodyBuffers.Put(buf)
+}
+
+// copyBuffer returns a copy of the buffer's contents that is safe to retain
+// after the buffer is returned to the pool.
+func copyBuffer(buf *bytes.Buffer) []byte {
+	content := make([]byte, buf.Len())
+	copy(content, buf.Bytes())
+
+	return content
+}
+
+// readBodyBuffer reads the body into a pooled buffer, returning an
+// ErrBodyTooLarge if it's larger than limit. No limit is enforced when limit
+// is 0. The buffer is sized by sizeHint, e.g. the Content-Length, when it's
+// greater than 0. The caller must return the buffer to the pool, copying the
+// body out of it if it's retained.
+func readBodyBuffer(body io.Reader, limit int64, sizeHint int64, templateURL string) (*bytes.Buffer, error) {
+	buf := getBodyBuffer()
+
+	if limit > 0 {
+		// Read an extra byte to tell bodies that are exactly the limit apart
+		// from bodies that exceed it
+		body = io.LimitReader(body, limit+1)
+	}
+
+	// The hint comes from the backend, so it's only trusted up to the limit
+	// and the size of pooled buffers
+	if sizeHint > 0 && sizeHint <= maxPooledBufferSize && (limit <= 0 || sizeHint <= limit) {
+		// ReadFrom needs MinRead bytes of space to detect the end of the body
+		buf.Grow(int(sizeHint) + bytes.MinRead)
+	}
+
+	if _, err := buf.ReadFrom(body); err != nil {
+		putBodyBuffer(buf)
+		return nil, err
+	}
+
+	if limit > 0 && int64(buf.Len()) > limit {
+		putBodyBuffer(buf)
+		return nil, &ErrBodyTooLarge{TemplateURL: templateURL, Limit: limit}
+	}
+
+	return buf, nil
+}
+
+// The number of pooled bodies that haven't been released, so tests can check
+// that every pooled body is returned to the pool
+var pooledBodiesInUse int64
+
+// pooledBody is the pooled buffer holding the body of a result fetched with
+// Request.PooledBodies. Copies of the result share it, so it's only released
+// once.
+type pooledBody struct {
+	buf      *bytes.Buffer
+	released int32
+}
+
+func newPooledBody(buf *bytes.Buffer) *pooledBody {
+	atomic.AddInt64(&pooledBodiesInUse, 1)
+	return &pooledBody{buf: buf}
+}
+
+func (pb *pooledBody) release() {
+	if !atomic.CompareAndSwapInt32(&pb.released, 0, 1) {
+		return
+	}
+	atomic.AddInt64(&pooledBodiesInUse, -1)
+
+	// Bodies used after they're released read the poisoned bytes instead of
+	// the body of another request
+	if poisonReleasedBodies {
+		poison(pb.buf.Bytes())
+	}
+
+	putBodyBuffer(pb.buf)
+}
+
+func poison(b []byte) {
+	for i := range b {
+		b[i] = 0xDD
+	}
+}
+
+// usePooledBody returns true when the body of the requestable can be handed
+// out in a pooled buffer. Bodies cached by the SharedCache outlive the
+// request, so they're always copied.
+func (r *Request) usePooledBody(requestable Requestable) bool {
+	if !r.PooledBodies {
+		return false
+	}
+
+	_, shared := sharedCacheKey(requestable, withRequestableHeaders(r.Header, requestable))
+	return !shared || r.SharedCache == nil
+}
+
+// ReleaseResults releases the pooled bodies of the results and of the results
+// of ResultErrors, including each error of a MultiError, see Result.Release.
+func ReleaseResults(results []*Result, err error) {
+	for _, result := range results {
+		result.Release()
+	}
+
+	for _, err := range Errors(err) {
+		var resultErr *ResultError
+		if errors.As(err, &resultErr) {
+			resultErr.Result.Release()
+		}
+	}
+}
@@ -0,0 +1,7 @@
+//go:build debug || race
+
+package multiplexer
+
+// Released pooled bodies are overwritten so they can't be mistaken for a
+// valid body when used after Result.Release
+const poisonReleasedBodies = true
@@ -0,0 +1,5 @@
+//go:build !debug && !race
+
+package multiplexer
+
+const poisonReleasedBodies = false
@@ -0,0 +1,273 @@
+package multiplexer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// ErrDependencyCycle is returned when requestables depend on each other in a
+// cycle.
+var ErrDependencyCycle = errors.New("dependency cycle")
+
+// ErrDependencyNotRequested is returned when a requestable depends on a key
+// that isn't requested, e.g. a fragment whose condition didn't match.
+var ErrDependencyNotRequested = errors.New("dependency was not requested")
+
+// ErrDependencySkipped is returned when a requestable depends on an optional
+// requestable that was skipped.
+var ErrDependencySkipped = errors.New("dependency was skipped")
+
+// Dependency is a requestable that must succeed before the requestable that
+// depends on it is fetched.
+type Dependency struct {
+	// The key of the requestable, see KeyedRequestable
+	Key string
+	// Called with the result of the dependency before the dependent
+	// requestable is fetched, to add query params and headers to its request.
+	// Can be nil.
+	Inject func(dep *Result, query url.Values, header http.Header)
+}
+
+// DependentRequestable is implemented by requestables that are only fetched
+// once their dependencies succeed. Requestables without dependencies are still
+// fetched concurrently. Dependent requestables are not shared or coalesced,
+// since their request depends on the results of other requestables.
+type DependentRequestable interface {
+	Requestable
+	Dependencies() []Dependency
+	// WithQuery returns a copy of the requestable that requests its URL with
+	// the given query.
+	WithQuery(query url.Values) Requestable
+}
+
+func dependenciesFor(requestable Requestable) []Dependency {
+	if dr, ok := requestable.(DependentRequestable); ok {
+		return dr.Dependencies()
+	}
+
+	return nil
+}
+
+// DependencyError is returned when a requestable can't be fetched because one
+// of its dependencies failed. The dependency's error is wrapped.
+type DependencyError struct {
+	// The key of the dependent requestable
+	Key string
+	// The key of the dependency
+	Dependency string
+	Err        error
+}
+
+func (de *DependencyError) Error() string {
+	return fmt.Sprintf("fragment %s depends on %s: %s", de.Key, de.Dependency, de.Err)
+}
+
+func (de *DependencyError) Unwrap() error {
+	return de.Err
+}
+
+// resolvedDependency is a dependency along with the index of the requestable
+// it refers to, or -1 when it isn't requested.
+type resolvedDependency struct {
+	Dependency
+	index int
+}
+
+// awaitedResult is the outcome of a requestable that others depend on. done
+// is closed once result or err is set.
+type awaitedResult struct {
+	done   chan struct{}
+	result *Result
+	err    error
+}
+
+// resolveDependencies maps the index of each requestable with dependencies to
+// its resolved dependencies, and returns the requestables that are depended
+// on. Both are nil when no requestable has dependencies.
+func (r *Request) resolveDependencies() (map[int][]resolvedDependency, map[int]*awaitedResult, error) {
+	var dependencies map[int][]resolvedDependency
+	indexes := make(map[string]int)
+
+	for i, requestable := range r.requestables {
+		if len(dependenciesFor(requestable)) > 0 && dependencies == nil {
+			dependencies = make(map[int][]resolvedDependency)
+		}
+
+		if key := keyFor(requestable); key != "" {
+			if _, ok := indexes[key]; !ok {
+				indexes[key] = i
+			}
+		}
+	}
+
+	if dependencies == nil {
+		return nil, nil, nil
+	}
+
+	awaited := make(map[int]*awaitedResult)
+	for i, requestable := range r.requestables {
+		for _, dependency := range dependenciesFor(requestable) {
+			index, ok := indexes[dependency.Key]
+			if !ok {
+				index = -1
+			} else if _, ok := awaited[index]; !ok {
+				awaited[index] = &awaitedResult{done: make(chan struct{})}
+			}
+
+			dependencies[i] = append(dependencies[i], resolvedDependency{Dependency: dependency, index: index})
+		}
+	}
+
+	if err := r.dependencyCycle(dependencies); err != nil {
+		return nil, nil, err
+	}
+
+	return dependencies, awaited, nil
+}
+
+// dependencyCycle returns an error when requestables depend on each other in
+// a cycle, since none of them could ever be fetched.
+func (r *Request) dependencyCycle(dependencies map[int][]resolvedDependency) error {
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[int]int, len(dependencies))
+
+	var visit func(i int) error
+	visit = func(i int) error {
+		state[i] = visiting
+
+		for _, dependency := range dependencies[i] {
+			if dependency.index < 0 || state[dependency.index] == visited {
+				continue
+			}
+
+			if state[dependency.index] == visiting {
+				return &DependencyError{Key: keyFor(r.requestables[i]), Dependency: dependency.Key, Err: ErrDependencyCycle}
+			}
+
+			if err := visit(dependency.index); err != nil {
+				return err
+			}
+		}
+
+		state[i] = visited
+		return nil
+	}
+
+	for i := range r.requestables {
+		if state[i] == 0 {
+			if err := visit(i); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// completeDependency records the outcome of the requestables at the given
+// indexes, waking the requestables that depend on them.
+func completeDependency(awaited map[int]*awaitedResult, indexes []int, result *Result, err error) {
+	for _, i := range indexes {
+		if a, ok := awaited[i]; ok {
+			a.result, a.err = result, err
+			close(a.done)
+		}
+	}
+}
+
+// awaitDependencies waits for the dependencies of the requestable to succeed,
+// returning the requestable and headers with the values injected by the
+// dependencies. The wait is subject to the request's Timeout.
+func (r *Request) awaitDependencies(ctx context.Context, requestable Requestable, dependencies []resolvedDependency, awaited map[int]*awaitedResult) (Requestable, http.Header, error) {
+	requestURL, err := url.Parse(requestable.URL())
+	if err != nil {
+		return requestable, nil, err
+	}
+
+	query := requestURL.Query()
+	header := http.Header{}
+
+	for _, dependency := range dependencies {
+		if dependency.index < 0 {
+			return requestable, nil, &DependencyError{Key: keyFor(requestable), Dependency: dependency.Key, Err: ErrDependencyNotRequested}
+		}
+
+		a := awaited[dependency.index]
+		select {
+		case <-a.done:
+		case <-ctx.Done():
+			// A failed dependency completes before it cancels the request,
+			// so report its failure instead of the cancellation
+			select {
+			case <-a.done:
+			default:
+				return requestable, nil, ctx.Err()
+			}
+		}
+
+		err := a.err
+		if err == nil {
+			err = r.dependencyFailure(r.requestables[dependency.index], a.result)
+		}
+		if err != nil {
+			return requestable, nil, &DependencyError{Key: keyFor(requestable), Dependency: dependency.Key, Err: err}
+		}
+
+		if dependency.Inject != nil {
+			dependency.Inject(a.result, query, header)
+		}
+	}
+
+	if encoded := query.Encode(); encoded != requestURL.RawQuery {
+		requestable = requestable.(DependentRequestable).WithQuery(query)
+	}
+
+	return requestable, header, nil
+}
+
+// dependencyFailure returns an error when the result of a dependency isn't
+// successful, even if it isn't an error for the request, e.g. because it was
+// skipped or Non2xxErrors is false.
+func (r *Request) dependencyFailure(requestable Requestable, result *Result) error {
+	if result.Skipped {
+		return ErrDependencySkipped
+	}
+
+	if result.StatusCode >= 200 && result.StatusCode <= 299 {
+		return nil
+	}
+
+	if ar, ok := requestable.(AllowedStatusRequestable); ok {
+		for _, allowed := range ar.AllowedStatusCodes() {
+			if result.StatusCode == allowed {
+				return nil
+			}
+		}
+	}
+
+	return newResultError(requestable, r, result)
+}
+
+// mergeHeaders returns the headers with the injected headers added, leaving
+// both unmodified.
+func mergeHeaders(headers http.Header, injected http.Header) http.Header {
+	if len(injected) == 0 {
+		return headers
+	}
+
+	merged := make(http.Header, len(headers)+len(injected))
+	for name, values := range headers {
+		merged[name] = values
+	}
+	for name, values := range injected {
+		merged[name] = append(merged[name], values...)
+	}
+
+	return merged
+}
@@ -0,0 +1,177 @@
+package multiplexer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/blakewilliams/viewproxy/pkg/notifier"
+	"github.com/stretchr/testify/require"
+)
+
+type dependentRequestable struct {
+	fakeRequestable
+	dependencies []Dependency
+}
+
+func (dr *dependentRequestable) Dependencies() []Dependency { return dr.dependencies }
+func (dr *dependentRequestable) WithQuery(query url.Values) Requestable {
+	u, _ := url.Parse(dr.url)
+	u.RawQuery = query.Encode()
+
+	copied := *dr
+	copied.url = u.String()
+	return &copied
+}
+
+func newKeyedRequestable(key string, url string) *fakeRequestable {
+	requestable := newFakeRequestable(url)
+	requestable.key = key
+	return requestable
+}
+
+func newDependentRequestable(key string, url string, dependencies ...Dependency) *dependentRequestable {
+	return &dependentRequestable{fakeRequestable: *newKeyedRequestable(key, url), dependencies: dependencies}
+}
+
+func startDependencyServer(t *testing.T, requests *int32) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+
+		switch r.URL.Path {
+		case "/layout":
+			time.Sleep(20 * time.Millisecond)
+			w.Header().Set("X-Token", "abc123")
+			w.Write([]byte("layout"))
+		case "/error":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/slow":
+			time.Sleep(60 * time.Millisecond)
+		default:
+			w.Write([]byte(r.URL.RawQuery + " " + r.Header.Get("X-Personalization")))
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestDependenciesInjectQueryAndHeaders(t *testing.T) {
+	var requests int32
+	server := startDependencyServer(t, &requests)
+
+	r := newRequest()
+	r.WithRequestable(newDependentRequestable("root.body", server.URL+"/body?a=1", Dependency{
+		Key: "root",
+		Inject: func(dep *Result, query url.Values, header http.Header) {
+			query.Set("token", dep.HttpResponse.Header.Get("X-Token"))
+			header.Set("X-Personalization", string(dep.Body))
+		},
+	}))
+	r.WithRequestable(newKeyedRequestable("root", server.URL+"/layout"))
+	r.WithRequestable(newKeyedRequestable("root.footer", server.URL+"/footer"))
+
+	results, err := r.Do(context.Background())
+	require.NoError(t, err)
+
+	require.Equal(t, "a=1&token=abc123 layout", string(results[0].Body))
+	require.Equal(t, server.URL+"/body?a=1&token=abc123", results[0].Url)
+	require.Equal(t, "layout", string(results[1].Body))
+	require.Equal(t, " ", string(results[2].Body))
+}
+
+func TestDependencyFailureFailsFast(t *testing.T) {
+	var requests int32
+	server := startDependencyServer(t, &requests)
+
+	r := newRequest()
+	r.Non2xxErrors = false
+	r.WithRequestable(newKeyedRequestable("root", server.URL+"/error"))
+	r.WithRequestable(newDependentRequestable("root.body", server.URL+"/body", Dependency{Key: "root"}))
+
+	start := time.Now()
+	_, err := r.Do(context.Background())
+
+	var dependencyErr *DependencyError
+	require.ErrorAs(t, err, &dependencyErr)
+	require.Equal(t, "root.body", dependencyErr.Key)
+	require.Equal(t, "root", dependencyErr.Dependency)
+
+	var resultErr *ResultError
+	require.ErrorAs(t, err, &resultErr)
+	require.Equal(t, http.StatusInternalServerError, resultErr.Result.StatusCode)
+
+	require.Less(t, time.Since(start), r.Timeout)
+	require.Equal(t, int32(1), atomic.LoadInt32(&requests), "the dependent fragment should not be requested")
+}
+
+func TestDependencyOnFailedRequestable(t *testing.T) {
+	var requests int32
+	server := startDependencyServer(t, &requests)
+	dependencyErrs := make(chan error, 1)
+
+	n := notifier.New()
+	n.Around(EventFetchSingle, func(ctx context.Context, next func(context.Context)) {
+		next(ctx)
+		if fetch := FetchFromContext(ctx); keyFor(fetch.Requestable) == "root.body" {
+			dependencyErrs <- fetch.Err
+		}
+	})
+
+	r := newRequest()
+	r.Notifier = n
+	r.WithRequestable(newKeyedRequestable("root", server.URL+"/error"))
+	r.WithRequestable(newDependentRequestable("root.body", server.URL+"/body", Dependency{Key: "root"}))
+
+	_, err := r.Do(context.Background())
+
+	var resultErr *ResultError
+	require.ErrorAs(t, err, &resultErr)
+	require.Equal(t, "root", resultErr.Key)
+
+	// The dependent fails with the dependency's error instead of the
+	// cancellation of the request
+	var dependencyErr *DependencyError
+	require.ErrorAs(t, <-dependencyErrs, &dependencyErr)
+	require.Equal(t, int32(1), atomic.LoadInt32(&requests))
+}
+
+func TestDependencyCycle(t *testing.T) {
+	r := newRequest()
+	r.WithRequestable(newDependentRequestable("root", "http://localhost:9990/layout", Dependency{Key: "root.body"}))
+	r.WithRequestable(newDependentRequestable("root.body", "http://localhost:9990/body", Dependency{Key: "root"}))
+
+	_, err := r.Do(context.Background())
+	require.ErrorIs(t, err, ErrDependencyCycle)
+}
+
+func TestDependencyNotRequested(t *testing.T) {
+	var requests int32
+	server := startDependencyServer(t, &requests)
+
+	r := newRequest()
+	r.WithRequestable(newDependentRequestable("root.body", server.URL+"/body", Dependency{Key: "root"}))
+
+	_, err := r.Do(context.Background())
+	require.ErrorIs(t, err, ErrDependencyNotRequested)
+	require.Equal(t, int32(0), atomic.LoadInt32(&requests))
+}
+
+func TestDependenciesShareTimeout(t *testing.T) {
+	var requests int32
+	server := startDependencyServer(t, &requests)
+
+	r := newRequest()
+	r.Timeout = 100 * time.Millisecond
+	r.WithRequestable(newKeyedRequestable("root", server.URL+"/slow"))
+	r.WithRequestable(newDependentRequestable("root.body", server.URL+"/slow", Dependency{Key: "root"}))
+
+	_, err := r.Do(context.Background())
+
+	var timeoutErr *TimeoutError
+	require.ErrorAs(t, err, &timeoutErr)
+}
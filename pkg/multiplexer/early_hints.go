@@ -0,0 +1,61 @@
+package multiplexer
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"sync"
+)
+
+// maxTrailerDrain is the most bytes read after a gzipped body to reach the
+// end of the response, where trailers are sent.
+const maxTrailerDrain = 4 << 10
+
+// earlyHintsTrace records the headers of 103 Early Hints responses using an
+// httptrace.ClientTrace, calling Request.OnEarlyHints as they're received.
+type earlyHintsTrace struct {
+	mu    sync.Mutex
+	hints []http.Header
+}
+
+// withClientTrace returns a context that records the early hints received by
+// requests made with it.
+func (et *earlyHintsTrace) withClientTrace(ctx context.Context, r *Request, requestable Requestable) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			if code != http.StatusEarlyHints {
+				return nil
+			}
+
+			hints := http.Header(header).Clone()
+
+			et.mu.Lock()
+			et.hints = append(et.hints, hints)
+			et.mu.Unlock()
+
+			if r.OnEarlyHints != nil {
+				r.OnEarlyHints(ctx, requestable, hints)
+			}
+
+			return nil
+		},
+	})
+}
+
+func (et *earlyHintsTrace) finish() []http.Header {
+	et.mu.Lock()
+	defer et.mu.Unlock()
+
+	return et.hints
+}
+
+// drainForTrailer reads the rest of the response when it declares trailers,
+// since they're only set once the body has been read to the end. Gzipped
+// bodies are decompressed without reading the end of the response.
+func drainForTrailer(resp *http.Response) {
+	if len(resp.Trailer) > 0 {
+		io.CopyN(io.Discard, resp.Body, maxTrailerDrain)
+	}
+}
@@ -0,0 +1,75 @@
+package multiplexer
+
+import (
+	"context"
+
+	"github.com/blakewilliams/viewproxy/pkg/notifier"
+)
+
+const (
+	// Emitted around fetching every requestable of a Request, for both Do and
+	// DoStream.
+	EventFetchAll = "multiplexer.fetch_all"
+	// Emitted around fetching a single requestable. The fetch is available via
+	// FetchFromContext.
+	EventFetchSingle = "multiplexer.fetch_single"
+)
+
+// Fetch describes the fetch of a single requestable. Result and Err are set
+// once the fetch completes, so they can be read by Around subscribers after
+// calling next.
+type Fetch struct {
+	Requestable Requestable
+	Method      string
+	// The URL of the requestable with secrets filtered, so it's safe to
+	// report
+	URL    string
+	Result *Result
+	Err    error
+}
+
+type fetchContextKey struct{}
+
+func init() {
+	// The result of the fetch is written once it completes, so async
+	// subscribers get the fetch as it was when the event was emitted
+	notifier.RegisterSnapshot(fetchContextKey{}, func(value interface{}) interface{} {
+		fetch := *value.(*Fetch)
+		return &fetch
+	})
+}
+
+// FetchFromContext returns the fetch of the current requestable. It is only
+// available to EventFetchSingle subscribers.
+func FetchFromContext(ctx context.Context) *Fetch {
+	if ctx == nil {
+		return nil
+	}
+
+	if fetch := ctx.Value(fetchContextKey{}); fetch != nil {
+		return fetch.(*Fetch)
+	}
+	return nil
+}
+
+// RequestOption configures a Request created by NewRequest.
+type RequestOption = func(*Request)
+
+// WithNotifier emits EventFetchAll and EventFetchSingle using the given
+// notifier.
+func WithNotifier(n notifier.Notifier) RequestOption {
+	return func(r *Request) {
+		r.Notifier = n
+	}
+}
+
+// emit emits the event via the Notifier, or calls fn directly when there is
+// no Notifier.
+func (r *Request) emit(name string, ctx context.Context, fn func(context.Context)) {
+	if r.Notifier == nil {
+		fn(ctx)
+		return
+	}
+
+	r.Notifier.Emit(name, ctx, fn)
+}
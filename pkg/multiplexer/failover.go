@@ -0,0 +1,92 @@
+package multiplexer
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+)
+
+// FailoverRequestable is implemented by requestables that can be fetched from
+// another replica of their target, see Request.Failover.
+type FailoverRequestable interface {
+	Requestable
+	// WithTarget returns a copy of the requestable fetched from the given
+	// replica, keeping its path and query.
+	WithTarget(target *url.URL) Requestable
+}
+
+// FailoverAttempt describes a request made to another replica after the
+// previous replica failed with a transport error. It's available to the
+// Tripper via FailoverFromContext.
+type FailoverAttempt struct {
+	// The host of the replica that failed
+	FailedHost string
+	// The transport error returned by the replica that failed
+	Err error
+}
+
+type failoverContextKey struct{}
+
+// FailoverFromContext returns the failover attempt the request is made for,
+// or nil when the request isn't a failover.
+func FailoverFromContext(ctx context.Context) *FailoverAttempt {
+	if ctx == nil {
+		return nil
+	}
+
+	if attempt, ok := ctx.Value(failoverContextKey{}).(*FailoverAttempt); ok {
+		return attempt
+	}
+
+	return nil
+}
+
+// fetchUrlWithFailover fetches the requestable, fetching it again from another
+// replica returned by Failover when it fails with a transport error. Unlike
+// retries, which request the same URL, each failover requests a different
+// replica. HTTP status errors never fail over.
+func (r *Request) fetchUrlWithFailover(ctx context.Context, requestable Requestable, headers http.Header) (*Result, error) {
+	result, err := r.fetchUrl(ctx, methodFor(requestable), requestable, headers, bodyFor(requestable))
+	if r.Failover == nil {
+		return result, err
+	}
+
+	var failedOver []string
+	for len(failedOver) < r.MaxFailovers && isTransportFailure(ctx, err) {
+		fr, ok := requestable.(FailoverRequestable)
+		if !ok {
+			break
+		}
+
+		failed, parseErr := url.Parse(requestable.URL())
+		if parseErr != nil {
+			break
+		}
+
+		replica := r.Failover(failed)
+		if replica == nil {
+			break
+		}
+
+		failedOver = append(failedOver, failed.Host)
+		requestable = fr.WithTarget(replica)
+
+		attempt := &FailoverAttempt{FailedHost: failed.Host, Err: err}
+		result, err = r.fetchUrl(context.WithValue(ctx, failoverContextKey{}, attempt), methodFor(requestable), requestable, headers, bodyFor(requestable))
+	}
+
+	if result != nil {
+		result.FailedOver = failedOver
+	}
+
+	return result, err
+}
+
+// isTransportFailure returns true when err is a transport error, e.g. a
+// refused connection, that wasn't caused by the request being canceled or
+// timing out.
+func isTransportFailure(ctx context.Context, err error) bool {
+	var transportErr *FragmentTransportError
+	return errors.As(err, &transportErr) && ctx.Err() == nil
+}
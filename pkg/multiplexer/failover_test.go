@@ -0,0 +1,119 @@
+package multiplexer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type failoverRequestable struct {
+	fakeRequestable
+}
+
+func (fr *failoverRequestable) WithTarget(target *url.URL) Requestable {
+	u, _ := url.Parse(fr.url)
+	u.Scheme = target.Scheme
+	u.Host = target.Host
+
+	copied := *fr
+	copied.url = u.String()
+	return &copied
+}
+
+type failoverTripper struct {
+	mu       sync.Mutex
+	attempts []*FailoverAttempt
+}
+
+func (ft *failoverTripper) Request(r *http.Request) (*http.Response, error) {
+	ft.mu.Lock()
+	ft.attempts = append(ft.attempts, FailoverFromContext(r.Context()))
+	ft.mu.Unlock()
+
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func deadServerURL(t *testing.T) *url.URL {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Close()
+
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	return u
+}
+
+func TestFailover(t *testing.T) {
+	live := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.RequestURI()))
+	}))
+	defer live.Close()
+	liveURL, _ := url.Parse(live.URL)
+	dead := deadServerURL(t)
+
+	tripper := &failoverTripper{}
+	r := newRequest()
+	r.Tripper = tripper
+	r.MaxFailovers = 1
+	r.Failover = func(failed *url.URL) *url.URL {
+		require.Equal(t, dead.Host, failed.Host)
+		return liveURL
+	}
+	r.WithRequestable(&failoverRequestable{*newFakeRequestable(dead.String() + "/header?a=1")})
+
+	results, err := r.Do(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "/header?a=1", string(results[0].Body))
+	require.Equal(t, live.URL+"/header?a=1", results[0].Url)
+	require.Equal(t, []string{dead.Host}, results[0].FailedOver)
+
+	// The tripper can tell the failover apart from the original request
+	require.Len(t, tripper.attempts, 2)
+	require.Nil(t, tripper.attempts[0])
+	require.Equal(t, dead.Host, tripper.attempts[1].FailedHost)
+	require.Error(t, tripper.attempts[1].Err)
+}
+
+func TestFailover_Exhausted(t *testing.T) {
+	dead := deadServerURL(t)
+	otherDead := deadServerURL(t)
+
+	failovers := 0
+	r := newRequest()
+	r.MaxFailovers = 2
+	r.Failover = func(failed *url.URL) *url.URL {
+		failovers++
+		return otherDead
+	}
+	r.WithRequestable(&failoverRequestable{*newFakeRequestable(dead.String() + "/header")})
+
+	_, err := r.Do(context.Background())
+
+	var transportErr *FragmentTransportError
+	require.ErrorAs(t, err, &transportErr)
+	require.Equal(t, 2, failovers)
+}
+
+func TestFailover_StatusErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	r := newRequest()
+	r.MaxFailovers = 1
+	r.Failover = func(failed *url.URL) *url.URL {
+		t.Fatal("status errors should not fail over")
+		return nil
+	}
+	r.WithRequestable(&failoverRequestable{*newFakeRequestable(server.URL + "/header")})
+
+	_, err := r.Do(context.Background())
+
+	var resultErr *ResultError
+	require.ErrorAs(t, err, &resultErr)
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"strings"
 )
 
 // Hop-by-hop headers defined here: https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers
@@ -18,6 +19,24 @@ var HopByHopHeaders []string = []string{
 	"Upgrade",
 }
 
+// ConditionalHeaders are the request headers that make a GET conditional, so
+// a fragment can respond with 304 Not Modified.
+var ConditionalHeaders []string = []string{
+	"If-None-Match",
+	"If-Modified-Since",
+}
+
+// isConditional returns true when the headers contain a conditional header.
+func isConditional(headers http.Header) bool {
+	for _, name := range ConditionalHeaders {
+		if headers.Get(name) != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
 // TODO remove headers listed in the Connection header
 func HeadersFromRequest(req *http.Request) http.Header {
 	newHeaders := make(http.Header)
@@ -63,21 +82,102 @@ func forwardedForFromRequest(req *http.Request) string {
 	return host
 }
 
+// SetCookiePolicy decides which Set-Cookie headers of the results are
+// forwarded when several results set a cookie with the same name.
+type SetCookiePolicy int
+
+const (
+	// LastSetCookieWins forwards the Set-Cookie header of the last result
+	// setting each cookie name, in the order requestables were added
+	LastSetCookieWins SetCookiePolicy = iota
+	// FirstSetCookieWins forwards the Set-Cookie header of the first result
+	// setting each cookie name
+	FirstSetCookieWins
+	// KeepAllSetCookies forwards every Set-Cookie header
+	KeepAllSetCookies
+)
+
+// WithDefaultHeaders forwards the response headers of the first result, and
+// the Set-Cookie headers of every result using LastSetCookieWins.
 func WithDefaultHeaders(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-		results := ResultsFromContext(r.Context())
-
-		if results != nil && len(results.Results()) > 0 {
-			headers := results.Results()[0].HeadersWithoutProxyHeaders()
-			for name, values := range headers {
-				for _, value := range values {
-					rw.Header().Add(name, value)
+	return WithResponseHeaders(LastSetCookieWins)(next)
+}
+
+// WithResponseHeaders forwards the response headers of the first result, e.g.
+// the layout, and the Set-Cookie headers of every result so cookies set by
+// any fragment are propagated. Cookies set by the same name in several
+// results are deduplicated using the policy. Set-Cookie headers of results
+// served from the SharedCache aren't forwarded, since they were set for
+// another request.
+func WithResponseHeaders(policy SetCookiePolicy) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			results := ResultsFromContext(r.Context())
+
+			if results != nil && len(results.Results()) > 0 {
+				headers := results.Results()[0].HeadersWithoutProxyHeaders()
+				for name, values := range headers {
+					if name == "Set-Cookie" {
+						continue
+					}
+
+					for _, value := range values {
+						rw.Header().Add(name, value)
+					}
+				}
+
+				for _, value := range setCookies(results.Results(), policy) {
+					rw.Header().Add("Set-Cookie", value)
+				}
+
+				rw.Header().Del("Content-Length")
+			}
+
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// setCookies returns the Set-Cookie headers of the results, deduplicated by
+// cookie name using the policy. Deduplicated cookies keep the position of the
+// first header setting their name.
+func setCookies(results []*Result, policy SetCookiePolicy) []string {
+	values := make([]string, 0)
+	positions := make(map[string]int)
+
+	for _, result := range results {
+		// Coalesced results share the response of another result
+		if result == nil || result.FromCache || result.Coalesced {
+			continue
+		}
+
+		for _, value := range result.Header().Values("Set-Cookie") {
+			if policy == KeepAllSetCookies {
+				values = append(values, value)
+				continue
+			}
+
+			name := setCookieName(value)
+			if i, ok := positions[name]; ok {
+				if policy == LastSetCookieWins {
+					values[i] = value
 				}
+				continue
 			}
 
-			rw.Header().Del("Content-Length")
+			positions[name] = len(values)
+			values = append(values, value)
 		}
+	}
+
+	return values
+}
+
+// setCookieName returns the name of the cookie set by a Set-Cookie header,
+// e.g. `session` for `session=abc; Path=/`.
+func setCookieName(value string) string {
+	pair, _, _ := strings.Cut(value, ";")
+	name, _, _ := strings.Cut(pair, "=")
 
-		next.ServeHTTP(rw, r)
-	})
+	return strings.TrimSpace(name)
 }
@@ -2,6 +2,7 @@ package multiplexer
 
 import (
 	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -40,3 +41,43 @@ func TestSetsDefaultForwardedHeaders(t *testing.T) {
 	require.Equal(t, "example.com", newHeaders.Get("X-Forwarded-Host"))
 	require.Equal(t, "httpz", newHeaders.Get("X-Forwarded-Proto"))
 }
+
+func resultWithHeaders(header http.Header) *Result {
+	return &Result{HttpResponse: &http.Response{Header: header}, StatusCode: http.StatusOK}
+}
+
+func TestWithResponseHeaders_SetCookie(t *testing.T) {
+	results := []*Result{
+		resultWithHeaders(http.Header{
+			"Content-Type": {"text/html"},
+			"Set-Cookie":   {"session=layout; Path=/", "theme=dark"},
+		}),
+		resultWithHeaders(http.Header{
+			"Content-Type": {"text/plain"},
+			"Set-Cookie":   {"session=body; Path=/; HttpOnly", "cart=1"},
+		}),
+		{Skipped: true},
+	}
+	cached := resultWithHeaders(http.Header{"Set-Cookie": {"shared=1"}})
+	cached.FromCache = true
+	results = append(results, cached)
+
+	testCases := map[SetCookiePolicy][]string{
+		LastSetCookieWins:  {"session=body; Path=/; HttpOnly", "theme=dark", "cart=1"},
+		FirstSetCookieWins: {"session=layout; Path=/", "theme=dark", "cart=1"},
+		KeepAllSetCookies:  {"session=layout; Path=/", "theme=dark", "session=body; Path=/; HttpOnly", "cart=1"},
+	}
+
+	for policy, want := range testCases {
+		handler := WithResponseHeaders(policy)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+		r := httptest.NewRequest("GET", "/", nil)
+		r = r.WithContext(ContextWithResults(r.Context(), results, nil))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		require.Equal(t, want, w.Header().Values("Set-Cookie"))
+		// Other headers are only forwarded from the first result
+		require.Equal(t, []string{"text/html"}, w.Header().Values("Content-Type"))
+	}
+}
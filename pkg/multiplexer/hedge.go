@@ -0,0 +1,122 @@
+package multiplexer
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+)
+
+type hedgeContextKey struct{}
+type slotsContextKey struct{}
+
+// HedgeFromContext returns true when the current request is a hedged
+// duplicate of a slow request. It can be used by a Tripper to observe hedging.
+func HedgeFromContext(ctx context.Context) bool {
+	if ctx == nil {
+		return false
+	}
+
+	hedge, _ := ctx.Value(hedgeContextKey{}).(bool)
+	return hedge
+}
+
+type hedgeAttempt struct {
+	result *Result
+	err    error
+	hedge  bool
+}
+
+// fetchUrlHedged makes an attempt to fetch the requestable, making a duplicate
+// hedged attempt when the first hasn't responded after HedgeAfter. The first
+// response is used and the other attempt is canceled. Only GET requests without
+// a body are hedged, and only when a concurrency slot is free.
+func (r *Request) fetchUrlHedged(ctx context.Context, method string, requestable Requestable, headers http.Header, body io.ReadCloser) (*Result, error) {
+	if r.HedgeAfter <= 0 || method != http.MethodGet || body != nil {
+		return r.fetchUrlAttempt(ctx, method, requestable, headers, body)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	attempts := make(chan hedgeAttempt, 2)
+	fetch := func(ctx context.Context, hedge bool) {
+		result, err := r.fetchUrlAttempt(ctx, method, requestable, headers, nil)
+		attempts <- hedgeAttempt{result: result, err: err, hedge: hedge}
+	}
+
+	go fetch(ctx, false)
+	pending := 1
+	hedged := false
+
+	timer := time.NewTimer(r.HedgeAfter)
+	defer timer.Stop()
+
+	var attempt hedgeAttempt
+	for {
+		select {
+		case <-timer.C:
+			release, ok := tryAcquireSlot(slotsFromContext(ctx))
+			if !ok {
+				continue
+			}
+
+			hedged = true
+			pending++
+			if r.OnHedge != nil {
+				r.OnHedge(ctx, requestable)
+			}
+
+			go func() {
+				defer release()
+				fetch(context.WithValue(ctx, hedgeContextKey{}, true), true)
+			}()
+			continue
+		case attempt = <-attempts:
+			pending--
+		}
+
+		// Use the first response, or the last error once every attempt failed
+		if attempt.err == nil || pending == 0 {
+			break
+		}
+	}
+
+	// Cancel the losing attempt and wait for it so it doesn't outlive the
+	// request. Its result is discarded when it responded anyway.
+	cancel()
+	for ; pending > 0; pending-- {
+		if lost := <-attempts; lost.err == nil {
+			lost.result.Release()
+		}
+	}
+
+	if attempt.err != nil {
+		return nil, attempt.err
+	}
+
+	attempt.result.Hedged = hedged
+	attempt.result.HedgeWon = attempt.hedge
+
+	return attempt.result, nil
+}
+
+func slotsFromContext(ctx context.Context) chan struct{} {
+	slots, _ := ctx.Value(slotsContextKey{}).(chan struct{})
+	return slots
+}
+
+// tryAcquireSlot returns a func that releases a free slot, or false when there
+// is no free slot. There's no limit when slots is nil.
+func tryAcquireSlot(slots chan struct{}) (func(), bool) {
+	if slots == nil {
+		return func() {}, true
+	}
+
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, true
+	default:
+		return nil, false
+	}
+}
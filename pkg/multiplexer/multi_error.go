@@ -0,0 +1,84 @@
+package multiplexer
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// MultiError is returned when several requestables fail. The errors are
+// ordered by the index of the requestable that failed, so errors.As finds the
+// error of the first failed requestable, e.g. its *ResultError.
+type MultiError struct {
+	Errors []error
+}
+
+func (me *MultiError) Error() string {
+	messages := make([]string, len(me.Errors))
+	for i, err := range me.Errors {
+		messages[i] = err.Error()
+	}
+
+	return fmt.Sprintf("%d requestables failed: %s", len(me.Errors), strings.Join(messages, "; "))
+}
+
+func (me *MultiError) Unwrap() []error {
+	return me.Errors
+}
+
+// Errors returns the errors of a MultiError, or a slice containing err when
+// it's another error. Returns nil when err is nil.
+func Errors(err error) []error {
+	if err == nil {
+		return nil
+	}
+
+	var multiErr *MultiError
+	if errors.As(err, &multiErr) {
+		return multiErr.Errors
+	}
+
+	return []error{err}
+}
+
+// indexedError is the error of the requestable at index, or of the whole
+// request when index is -1.
+type indexedError struct {
+	index int
+	err   error
+}
+
+// aggregateErrors returns the errors ordered by index, as a MultiError when
+// there are several. Errors of requestables that failed because a dependency
+// failed are left out when the dependency's error is reported.
+func aggregateErrors(failures []indexedError) error {
+	if len(failures) == 0 {
+		return nil
+	}
+
+	sort.SliceStable(failures, func(i, j int) bool {
+		return failures[i].index < failures[j].index
+	})
+
+	errs := make([]error, 0, len(failures))
+	for _, failure := range failures {
+		if _, ok := failure.err.(*DependencyError); !ok {
+			errs = append(errs, failure.err)
+		}
+	}
+
+	// Only dependents failed, e.g. when the dependency's status isn't an
+	// error
+	if len(errs) == 0 {
+		for _, failure := range failures {
+			errs = append(errs, failure.err)
+		}
+	}
+
+	if len(errs) == 1 {
+		return errs[0]
+	}
+
+	return &MultiError{Errors: errs}
+}
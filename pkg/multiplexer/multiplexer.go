@@ -1,6 +1,7 @@
 package multiplexer
 
 import (
+	"bytes"
 	"compress/gzip"
 	"context"
 	"crypto/hmac"
@@ -9,16 +10,15 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"net/http"
 	"net/url"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/blakewilliams/viewproxy/pkg/notifier"
 	"github.com/blakewilliams/viewproxy/pkg/secretfilter"
-	"go.opentelemetry.io/otel"
-	"go.opentelemetry.io/otel/attribute"
-	"go.opentelemetry.io/otel/trace"
 )
 
 type TimeoutError struct {
@@ -64,18 +64,97 @@ type Request struct {
 	Non2xxErrors bool
 	Tripper      Tripper
 	SecretFilter secretfilter.Filter
+	// The maximum size of ResultError.BodySnippet. Snippets aren't kept when
+	// 0. Defaults to DefaultErrorSnippetSize.
+	ErrorSnippetSize int
+	// When set, requestables that are shared are fetched via the SharedCache
+	SharedCache *SharedCache
+	// The maximum number of bytes, request headers and bodies, that can be
+	// sent to backends. Only used when the context passed to Do has no
+	// OutboundBytes. No limit is enforced when 0.
+	MaxOutboundBytes int64
+	// The maximum size of a fragment's response body, after decompression.
+	// Responses that exceed it fail with an ErrBodyTooLarge. No limit is
+	// enforced when 0.
+	MaxBodyBytes int64
+	// The fraction of Timeout, between 0 and 1, after which optional
+	// requestables that are still pending are canceled and returned as
+	// skipped results instead of failing the request. Disabled when 0.
+	OptionalBudget float64
+	// The maximum number of requestables fetched at once, the rest wait for
+	// a fetch to complete. Waiting requestables are still subject to Timeout.
+	// Unlimited when 0.
+	MaxConcurrency int
+	// When set, GET requests that haven't responded after this duration are
+	// duplicated, using the first response and canceling the other request.
+	// Hedged requests count towards MaxConcurrency and are only made when a
+	// slot is free. Disabled when 0.
+	HedgeAfter time.Duration
+	// Called when a hedged request is made for the requestable
+	OnHedge func(ctx context.Context, requestable Requestable)
+	// When set, EventFetchAll and EventFetchSingle are emitted via the
+	// Notifier
+	Notifier notifier.Notifier
+	// When true, Result.Timing is set for results fetched over HTTP using an
+	// httptrace.ClientTrace, which has a small cost
+	DetailedTiming bool
+	// When true, the bodies of results fetched over HTTP are pooled buffers
+	// instead of copies. Callers own the results and must call Release, e.g.
+	// via ReleaseResults, once they're done with the bodies. Bodies of shared
+	// requestables are still copied.
+	PooledBodies bool
+	// When set, requestables that fail with a transport error, e.g. a refused
+	// connection, are fetched again from the replica returned by Failover,
+	// given the URL that failed. Failover returns nil when there's no other
+	// replica. Only FailoverRequestable requestables fail over.
+	Failover func(failed *url.URL) *url.URL
+	// The maximum number of times a requestable fails over to another
+	// replica. Disabled when 0.
+	MaxFailovers int
+	// Called with the headers of each 103 Early Hints response received for
+	// the requestable, before its final response. It's called from the
+	// goroutine fetching the requestable.
+	OnEarlyHints func(ctx context.Context, requestable Requestable, header http.Header)
+	// When set, it's called with a copy of the headers for each requestable,
+	// right before they're signed using HmacSecret, and returns the headers
+	// to send, e.g. without the Cookie header for fragments that don't need
+	// it. It's called from the goroutine fetching the requestable. Identical
+	// requestables aren't coalesced when it's set, and SharedCache keys are
+	// still based on Header.
+	HeaderFunc func(requestable Requestable, header http.Header) http.Header
+	// Called once each requestable is fetched, with the time taken and the
+	// error the fetch failed with, if any. It isn't called for skipped or
+	// coalesced requestables, or for results served by the SharedCache, since
+	// their duration isn't the target's. It's called from the goroutine
+	// fetching the requestable.
+	OnFetchComplete func(ctx context.Context, requestable Requestable, duration time.Duration, err error)
+	// When true, the gzipped body of the first requestable, e.g. the layout,
+	// is kept as Result.CompressedBody so it can be written without being
+	// compressed again. Other results never have a CompressedBody.
+	KeepCompressedBody bool
 }
 
-func NewRequest(tripper Tripper) *Request {
-	return &Request{
-		ctx:          context.TODO(),
-		requestables: []Requestable{},
-		Timeout:      time.Duration(10) * time.Second,
-		HmacSecret:   "",
-		Non2xxErrors: true,
-		Header:       http.Header{},
-		Tripper:      tripper,
+// keepCompressedContextKey marks the context of the requestable whose
+// compressed body is kept
+type keepCompressedContextKey struct{}
+
+func NewRequest(tripper Tripper, opts ...RequestOption) *Request {
+	r := &Request{
+		ctx:              context.TODO(),
+		requestables:     []Requestable{},
+		Timeout:          time.Duration(10) * time.Second,
+		HmacSecret:       "",
+		Non2xxErrors:     true,
+		Header:           http.Header{},
+		Tripper:          tripper,
+		ErrorSnippetSize: DefaultErrorSnippetSize,
 	}
+
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	return r
 }
 
 func (r *Request) WithHeadersFromRequest(req *http.Request) {
@@ -90,75 +169,547 @@ func (r *Request) WithRequestable(requestable Requestable) {
 	r.requestables = append(r.requestables, requestable)
 }
 
+// RequestableCount returns the number of requestables that will be fetched
+func (r *Request) RequestableCount() int {
+	return len(r.requestables)
+}
+
+// FetchCount returns the number of fetches made for the requestables, fewer
+// than RequestableCount when identical requestables are coalesced.
+func (r *Request) FetchCount() int {
+	leaders, _ := r.coalesce()
+	return len(r.requestables) - len(leaders)
+}
+
+// Do fetches every requestable in parallel and returns the results in the
+// order the requestables were added.
 func (r *Request) Do(ctx context.Context) ([]*Result, error) {
-	tracer := otel.Tracer("multiplexer")
-	var span trace.Span
-	ctx, span = tracer.Start(ctx, "fetch_urls")
-	defer span.End()
+	if phases := PhaseTimingsFromContext(ctx); phases != nil {
+		defer func() { phases.DoReturned = time.Now() }()
+	}
+
+	// Results are collected into the slice instead of being received one at
+	// a time, so Do only wakes once all results are in or fetching failed
+	stream := newCollectedResultStream(len(r.requestables))
+	r.fetchAll(ctx, stream)
+
+	if stream.err != nil {
+		return make([]*Result, 0), stream.err
+	}
 
+	return stream.collected, nil
+}
+
+// DoStream fetches every requestable in parallel and sends each result as soon
+// as it completes. Result.Index is the index of the requestable the result
+// belongs to, so callers can reconstruct the order of the results.
+//
+// The results channel is closed once every requestable has completed, or when
+// fetching fails. The error channel then receives the error, if any, and is
+// closed. Pending requestables are canceled when fetching fails.
+func (r *Request) DoStream(ctx context.Context) (<-chan *Result, <-chan error) {
+	stream := newResultStream(len(r.requestables))
+	go r.fetchAll(ctx, stream)
+
+	return stream.results, stream.errs
+}
+
+// fetchAll fetches every requestable into the stream, returning once the
+// stream is finished and every fetch has returned.
+func (r *Request) fetchAll(ctx context.Context, stream *resultStream) {
+	r.emit(EventFetchAll, ctx, func(ctx context.Context) {
+		wait := r.stream(ctx, stream)
+		wait()
+		stream.close()
+	})
+}
+
+// stream starts fetching every requestable, sending results to the stream as
+// they complete and finishing it once all have completed or fetching failed.
+// The returned func blocks until the stream is finished and every fetch has
+// returned, and finishes it when the request is canceled or times out.
+// Finishing the stream cancels the fetches still in flight.
+func (r *Request) stream(ctx context.Context, stream *resultStream) (wait func()) {
 	ctx, cancel := context.WithTimeout(ctx, r.Timeout)
-	defer cancel()
+
+	if OutboundBytesFromContext(ctx) == nil {
+		ctx = ContextWithOutboundBytes(ctx, NewOutboundBytes(r.MaxOutboundBytes))
+	}
 
 	reqCount := len(r.requestables)
-	wg := sync.WaitGroup{}
-	wg.Add(reqCount)
-	errCh := make(chan error, reqCount)
-	results := make([]*Result, reqCount)
 
+	if reqCount == 0 {
+		stream.finish(nil, cancel)
+		return func() {}
+	}
+
+	// Requestables with dependencies wait for the requestables they depend
+	// on, which may be in the middle of the fetch order
+	dependencies, awaited, err := r.resolveDependencies()
+	if err != nil {
+		stream.finish(err, cancel)
+		return func() {}
+	}
+
+	// Optional requestables still pending once the budget is consumed are
+	// marked as skipped and canceled
+	skipped := make([]int32, reqCount)
+	optionalCancels := make(map[int]context.CancelFunc)
+	// Identical requestables share a single fetch, so only leaders are fetched
+	leaders, followers := r.coalesce()
+	remaining := int64(reqCount)
+	var timer *time.Timer
+
+	cleanup := func() {
+		if timer != nil {
+			timer.Stop()
+		}
+		for _, cancelOptional := range optionalCancels {
+			cancelOptional()
+		}
+		cancel()
+	}
+
+	// Limits the number of fetches in flight, including hedged requests,
+	// others wait for a free slot
+	var slots chan struct{}
+	if r.MaxConcurrency > 0 && (r.MaxConcurrency < reqCount || r.HedgeAfter > 0) {
+		slots = make(chan struct{}, r.MaxConcurrency)
+	}
+
+	reqCtxs := make([]context.Context, reqCount)
 	for i, f := range r.requestables {
-		reqCtx := context.WithValue(ctx, RequestableContextKey{}, f)
-
-		go func(ctx context.Context, requestable Requestable, i int, wg *sync.WaitGroup) {
-			defer wg.Done()
-			var span trace.Span
-			ctx, span = tracer.Start(ctx, "fetch_url")
-			for key, value := range requestable.Metadata() {
-				span.SetAttributes(attribute.String(key, value))
-			}
-			defer span.End()
+		reqCtxs[i] = context.WithValue(ctx, RequestableContextKey{}, f)
+		if r.KeepCompressedBody && i == 0 {
+			reqCtxs[i] = context.WithValue(reqCtxs[i], keepCompressedContextKey{}, true)
+		}
+		if slots != nil {
+			reqCtxs[i] = context.WithValue(reqCtxs[i], slotsContextKey{}, slots)
+		}
 
-			headersForRequest := r.Header
-			if r.HmacSecret != "" {
-				headersForRequest = r.headersWithHmac(requestable.URL())
+		if r.OptionalBudget > 0 && priorityFor(f) > 0 {
+			var cancelOptional context.CancelFunc
+			reqCtxs[i], cancelOptional = context.WithCancel(reqCtxs[i])
+			optionalCancels[i] = cancelOptional
+		}
+	}
+
+	// Started before fetching so the timer is set before cleanup can run
+	if len(optionalCancels) > 0 {
+		budget := time.Duration(float64(r.Timeout) * r.OptionalBudget)
+		timer = time.AfterFunc(budget, func() {
+			for i, cancelOptional := range optionalCancels {
+				atomic.StoreInt32(&skipped[i], 1)
+				cancelOptional()
 			}
+		})
+	}
+
+	// Tracks the fetches so none outlive the request
+	var fetches sync.WaitGroup
+	fetches.Add(reqCount - len(leaders))
+
+	for _, i := range r.fetchOrder() {
+		if _, ok := leaders[i]; ok {
+			continue
+		}
 
-			result, err := r.fetchUrl(ctx, "GET", requestable, headersForRequest, nil)
+		go func(ctx context.Context, requestable Requestable, i int) {
+			defer fetches.Done()
 
+			var injectedHeaders http.Header
+			var dependencyErr error
+			if len(dependencies[i]) > 0 {
+				requestable, injectedHeaders, dependencyErr = r.awaitDependencies(ctx, requestable, dependencies[i], awaited)
+				ctx = context.WithValue(ctx, RequestableContextKey{}, requestable)
+			}
+
+			fetch := &Fetch{Requestable: requestable, Method: methodFor(requestable), URL: r.filteredURL(requestable)}
+			fetchStart := time.Now()
+			r.emit(EventFetchSingle, context.WithValue(ctx, fetchContextKey{}, fetch), func(ctx context.Context) {
+				headersForRequest := mergeHeaders(withRequestableHeaders(r.Header, requestable), injectedHeaders)
+				if r.HeaderFunc != nil {
+					headersForRequest = r.HeaderFunc(requestable, headersForRequest.Clone())
+				}
+				if r.HmacSecret != "" {
+					headersForRequest = r.headersWithHmac(headersForRequest, fetch.Method, requestable.URL())
+				}
+
+				if dependencyErr != nil {
+					fetch.Err = dependencyErr
+				} else if release, err := acquireSlot(ctx, slots); err != nil {
+					fetch.Err = err
+				} else {
+					fetch.Result, fetch.Err = r.fetchRequestable(ctx, requestable, headersForRequest)
+					release()
+				}
+
+				if fetch.Err != nil && atomic.LoadInt32(&skipped[i]) == 1 {
+					fetch.Result, fetch.Err = &Result{Url: requestable.URL(), Skipped: true, TimingLabel: timingLabelFor(requestable)}, nil
+				}
+
+				// Errors of dependencies are already filtered
+				if fetch.Err != nil && fetch.Err != dependencyErr {
+					fetch.Err = r.filterError(requestable.TemplateURL(), fetch.Err)
+				}
+			})
+
+			result, err := fetch.Result, fetch.Err
+			if r.OnFetchComplete != nil && (result == nil || !(result.Skipped || result.Coalesced || result.FromCache)) {
+				r.OnFetchComplete(ctx, requestable, time.Since(fetchStart), err)
+			}
+			completeDependency(awaited, append([]int{i}, followers[i]...), result, err)
 			if err != nil {
-				errCh <- r.filterError(requestable.TemplateURL(), err)
+				if ctxErr := contextError(ctx); ctxErr != nil {
+					var resultErr *ResultError
+					if !stream.failed() {
+						// Report the cancellation or timeout that caused the
+						// failure
+						err = ctxErr
+					} else if !errors.As(err, &resultErr) {
+						// The fetch was likely canceled because another
+						// requestable failed, so only a status error that
+						// was received in full is reported alongside
+						stream.finish(nil, cleanup)
+						return
+					}
+				}
+				stream.fail(i, err, cleanup)
+				return
 			}
 
-			results[i] = result
-		}(reqCtx, f, i, &wg)
+			// Results of shared requestables are shared between requests, so
+			// the index is set on a copy
+			indexed := *result
+			indexed.Index = i
+			stream.send(&indexed)
+
+			for _, follower := range followers[i] {
+				coalesced := *result
+				coalesced.Index = follower
+				coalesced.Coalesced = true
+				coalesced.TimingLabel = timingLabelFor(r.requestables[follower])
+				stream.send(&coalesced)
+			}
+
+			if atomic.AddInt64(&remaining, -int64(1+len(followers[i]))) == 0 {
+				if phases := PhaseTimingsFromContext(ctx); phases != nil {
+					phases.FetchesDone = time.Now()
+				}
+				stream.finish(nil, cleanup)
+			}
+		}(reqCtxs[i], r.requestables[i], i)
 	}
 
-	// wait for all responses to complete
-	done := make(chan struct{})
-	go (func(wg *sync.WaitGroup) {
-		defer close(done)
-		wg.Wait()
-	})(&wg)
+	return func() {
+		select {
+		case <-ctx.Done():
+			stream.finish(contextError(ctx), cleanup)
+		case <-stream.done:
+		}
+
+		fetches.Wait()
+	}
+}
+
+// coalesce finds requestables that would make identical requests, so they can
+// share a single fetch. leaders maps the index of each requestable that shares
+// another's fetch to the index of that requestable, and followers maps the
+// inverse. Both are nil when no requestables are identical.
+func (r *Request) coalesce() (leaders map[int]int, followers map[int][]int) {
+	var seen map[string]int
+
+	for i, requestable := range r.requestables {
+		key, ok := r.coalesceKey(requestable)
+		if !ok {
+			continue
+		}
+
+		if seen == nil {
+			seen = make(map[string]int)
+		}
+
+		leader, ok := seen[key]
+		if !ok {
+			seen[key] = i
+			continue
+		}
+
+		if leaders == nil {
+			leaders = make(map[int]int)
+			followers = make(map[int][]int)
+		}
+		leaders[i] = leader
+		followers[leader] = append(followers[leader], i)
+	}
+
+	return leaders, followers
+}
+
+// coalesceKey returns a key that's equal for requestables making identical
+// requests, and false for requestables that can't be coalesced.
+func (r *Request) coalesceKey(requestable Requestable) (string, bool) {
+	// HeaderFunc can send different headers for identical requestables
+	if r.HeaderFunc != nil || fetcherFor(requestable) != nil || len(dependenciesFor(requestable)) > 0 || methodFor(requestable) != http.MethodGet {
+		return "", false
+	}
+
+	var allowed []int
+	if ar, ok := requestable.(AllowedStatusRequestable); ok {
+		allowed = ar.AllowedStatusCodes()
+	}
+
+	var headers http.Header
+	if hr, ok := requestable.(HeaderRequestable); ok {
+		headers = hr.Headers()
+	}
+
+	return fmt.Sprintf(
+		"%s\n%d\n%+v\n%d\n%v\n%v",
+		requestable.URL(),
+		priorityFor(requestable),
+		retryPolicyFor(requestable),
+		r.maxBodyBytesFor(requestable),
+		allowed,
+		headers,
+	), true
+}
+
+// fetchRequestable fetches the requestable via its fetcher, the SharedCache, or
+// over HTTP.
+func (r *Request) fetchRequestable(ctx context.Context, requestable Requestable, headers http.Header) (*Result, error) {
+	if fetcher := fetcherFor(requestable); fetcher != nil {
+		return r.fetchWith(ctx, fetcher, requestable, headers)
+	}
+
+	sharedHeaders := withRequestableHeaders(r.Header, requestable)
+	if key, ok := sharedCacheKey(requestable, sharedHeaders); ok && r.SharedCache != nil {
+		r.SharedCache.touchPopularKey(key, requestable, sharedHeaders)
+		return r.SharedCache.fetch(ctx, key, func() (*Result, error) {
+			return r.fetchUrlWithFailover(ctx, requestable, headers)
+		})
+	}
+
+	return r.fetchUrlWithFailover(ctx, requestable, headers)
+}
+
+// acquireSlot waits for a free slot, returning a func that releases it. There's
+// no limit when slots is nil.
+func acquireSlot(ctx context.Context, slots chan struct{}) (func(), error) {
+	if slots == nil {
+		return func() {}, nil
+	}
 
 	select {
-	case err := <-errCh:
-		cancel()
-		return make([]*Result, 0), err
-	case <-done:
-		return results, nil
+	case slots <- struct{}{}:
+		return func() { <-slots }, nil
 	case <-ctx.Done():
-		switch {
-		case errors.Is(ctx.Err(), context.Canceled):
-			return make([]*Result, 0), newCancellationError(ctx.Err())
-		case errors.Is(ctx.Err(), context.DeadlineExceeded):
-			return make([]*Result, 0), newTimeoutError(ctx.Err())
-		default:
-			return make([]*Result, 0), ctx.Err()
+		return nil, ctx.Err()
+	}
+}
+
+// contextError returns the error describing why the context is done, or nil if
+// it isn't.
+func contextError(ctx context.Context) error {
+	switch {
+	case ctx.Err() == nil:
+		return nil
+	case errors.Is(ctx.Err(), context.Canceled):
+		return newCancellationError(ctx.Err())
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return newTimeoutError(ctx.Err())
+	default:
+		return ctx.Err()
+	}
+}
+
+// resultStream receives results until it's finished, either because every
+// requestable completed or fetching failed. Results received after the stream
+// finished are discarded, while errors are collected until the stream is
+// closed, so that requestables failing at the same time are all reported in
+// the same order.
+type resultStream struct {
+	mu       sync.Mutex
+	finished bool
+	done     chan struct{}
+	failures []indexedError
+	// The error reported once the stream is closed
+	err error
+	// Set for streams created by DoStream
+	results chan *Result
+	errs    chan error
+	// Set for streams created by Do
+	collected []*Result
+}
+
+func newResultStream(size int) *resultStream {
+	return &resultStream{
+		done: make(chan struct{}),
+		// Buffered so that sends never block on the caller
+		results: make(chan *Result, size),
+		errs:    make(chan error, 1),
+	}
+}
+
+func newCollectedResultStream(size int) *resultStream {
+	return &resultStream{
+		done:      make(chan struct{}),
+		collected: make([]*Result, size),
+	}
+}
+
+func (rs *resultStream) send(result *Result) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if rs.finished {
+		return
+	}
+
+	if rs.results != nil {
+		rs.results <- result
+	} else {
+		rs.collected[result.Index] = result
+	}
+}
+
+// finish finishes the stream, failing it with the given error of the whole
+// request when it's not nil, and calls cleanup. Only the first call has an
+// effect.
+func (rs *resultStream) finish(err error, cleanup func()) {
+	rs.mu.Lock()
+	if rs.finished {
+		rs.mu.Unlock()
+		return
+	}
+	if err != nil {
+		rs.failures = append(rs.failures, indexedError{index: -1, err: err})
+	}
+	rs.finishLocked()
+	rs.mu.Unlock()
+
+	cleanup()
+}
+
+// fail records the error of the requestable at the given index and finishes
+// the stream when it hasn't finished yet. Errors recorded after the stream
+// finished are still reported.
+func (rs *resultStream) fail(index int, err error, cleanup func()) {
+	rs.mu.Lock()
+	rs.failures = append(rs.failures, indexedError{index: index, err: err})
+	if rs.finished {
+		rs.mu.Unlock()
+		return
+	}
+	rs.finishLocked()
+	rs.mu.Unlock()
+
+	cleanup()
+}
+
+func (rs *resultStream) finishLocked() {
+	rs.finished = true
+	if rs.results != nil {
+		close(rs.results)
+	}
+	close(rs.done)
+}
+
+// failed returns true when an error has been recorded.
+func (rs *resultStream) failed() bool {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	return len(rs.failures) > 0
+}
+
+// close reports the recorded errors once every fetch has returned.
+func (rs *resultStream) close() {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	rs.err = aggregateErrors(rs.failures)
+	if rs.errs != nil {
+		if rs.err != nil {
+			rs.errs <- rs.err
 		}
+		close(rs.errs)
 	}
 }
 
+// fetchOrder returns the indexes of the requestables in the order they should
+// be fetched, by ascending priority.
+func (r *Request) fetchOrder() []int {
+	order := make([]int, len(r.requestables))
+	for i := range order {
+		order[i] = i
+	}
+
+	sort.SliceStable(order, func(a, b int) bool {
+		return priorityFor(r.requestables[order[a]]) < priorityFor(r.requestables[order[b]])
+	})
+
+	return order
+}
+
 func (r *Request) fetchUrl(ctx context.Context, method string, requestable Requestable, headers http.Header, body io.ReadCloser) (*Result, error) {
 	start := time.Now()
+	policy := retryPolicyFor(requestable)
+
+	var result *Result
+	var err error
+
+	for attempt := 1; ; attempt++ {
+		result, err = r.fetchUrlHedged(context.WithValue(ctx, attemptContextKey{}, attempt), method, requestable, headers, body)
+
+		// Only idempotent requests without a body are retried
+		if attempt >= policy.Attempts || method != http.MethodGet || body != nil || !shouldRetry(ctx, result, err) {
+			break
+		}
+
+		timer := time.NewTimer(policy.Backoff)
+		select {
+		case <-timer.C:
+			// The result of the failed attempt is replaced by the retry
+			result.Release()
+			continue
+		case <-ctx.Done():
+			timer.Stop()
+		}
+
+		break
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	result.TotalDuration = time.Since(start)
+
+	if r.isErrorStatus(requestable, result.StatusCode) {
+		return nil, newResultError(requestable, r, result)
+	}
+
+	return result, nil
+}
+
+func (r *Request) fetchUrlAttempt(ctx context.Context, method string, requestable Requestable, headers http.Header, body io.ReadCloser) (*Result, error) {
+	start := time.Now()
+	attempt := AttemptFromContext(ctx)
+	outbound := OutboundBytesFromContext(ctx)
+
+	var trace *timingTrace
+	if r.DetailedTiming {
+		trace = newTimingTrace(start)
+		ctx = trace.withClientTrace(ctx)
+	}
+
+	hints := &earlyHintsTrace{}
+	ctx = hints.withClientTrace(ctx, r, requestable)
+
+	if outbound != nil && body != nil {
+		body = &countingReader{ReadCloser: body, outbound: outbound}
+	}
 
 	req, err := http.NewRequestWithContext(ctx, method, requestable.URL(), body)
 
@@ -172,31 +723,61 @@ func (r *Request) fetchUrl(ctx context.Context, method string, requestable Reque
 		}
 	}
 
-	resp, err := r.Tripper.Request(req)
+	if outbound != nil {
+		if err := outbound.add(headerSize(req.Header)); err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err := requestWithTripper(r.Tripper, req)
 
 	if err != nil {
-		return nil, err
+		return nil, &FragmentTransportError{
+			Key:         keyFor(requestable),
+			TemplateURL: requestable.TemplateURL(),
+			Err:         err,
+		}
 	}
 
 	defer resp.Body.Close()
 	duration := time.Since(start)
+	bodyStart := time.Now()
 
-	var responseBody []byte
+	var bodyBuffer *bytes.Buffer
+	var compressedBody *bytes.Buffer
+	limit := r.maxBodyBytesFor(requestable)
 
 	if resp.Header.Get("Content-Encoding") == "gzip" {
-		gzipReader, err := gzip.NewReader(resp.Body)
+		var compressed io.Reader = resp.Body
+
+		// Keep the compressed body so it can be written as-is when the
+		// response doesn't need to be stitched
+		if keep, _ := ctx.Value(keepCompressedContextKey{}).(bool); keep {
+			compressedBody = getBodyBuffer()
+			defer putBodyBuffer(compressedBody)
+			if resp.ContentLength > 0 && resp.ContentLength <= maxPooledBufferSize {
+				compressedBody.Grow(int(resp.ContentLength))
+			}
+			compressed = io.TeeReader(resp.Body, compressedBody)
+		}
+
+		gzipReader, err := gzip.NewReader(compressed)
 		if err != nil {
 			return nil, err
 		}
 		defer gzipReader.Close()
 
-		responseBody, err = ioutil.ReadAll(gzipReader)
+		// Limit the decompressed body so small payloads can't expand past it.
+		// The decompressed size isn't known up front.
+		bodyBuffer, err = readBodyBuffer(gzipReader, limit, 0, requestable.TemplateURL())
 
 		if err != nil {
 			return nil, err
 		}
+
+		drainForTrailer(resp)
 	} else {
-		responseBody, err = ioutil.ReadAll(resp.Body)
+		bodyBuffer, err = readBodyBuffer(resp.Body, limit, resp.ContentLength, requestable.TemplateURL())
 
 		if err != nil {
 			return nil, err
@@ -207,37 +788,172 @@ func (r *Request) fetchUrl(ctx context.Context, method string, requestable Reque
 		Url:          requestable.URL(),
 		Duration:     duration,
 		HttpResponse: resp,
-		Body:         responseBody,
 		StatusCode:   resp.StatusCode,
+		Attempts:     attempt,
+		TimingLabel:  timingLabelFor(requestable),
+		EarlyHints:   hints.finish(),
+	}
+
+	if len(resp.Trailer) > 0 {
+		result.Trailer = resp.Trailer
 	}
 
-	if r.Non2xxErrors && (resp.StatusCode < 200 || resp.StatusCode > 299) {
-		return nil, newResultError(requestable.TemplateURL(), r, result)
+	if r.usePooledBody(requestable) {
+		result.Body = bodyBuffer.Bytes()
+		result.pooled = newPooledBody(bodyBuffer)
+	} else {
+		result.Body = copyBuffer(bodyBuffer)
+		putBodyBuffer(bodyBuffer)
+	}
+
+	if compressedBody != nil {
+		result.CompressedBody = copyBuffer(compressedBody)
+	}
+
+	if trace != nil {
+		result.Timing = trace.finish(bodyStart)
+		// Trippers that don't make requests via net/http don't call the
+		// trace's hooks
+		if result.Timing.FirstByte == 0 {
+			result.Timing.FirstByte = duration
+		}
 	}
 
 	return result, nil
 }
 
-func (r *Request) headersWithHmac(url string) http.Header {
+func (r *Request) fetchWith(ctx context.Context, fetcher FragmentFetcher, requestable Requestable, headers http.Header) (*Result, error) {
+	start := time.Now()
+	result, err := fetcher.Fetch(ctx, requestable, headers)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if result == nil {
+		return nil, fmt.Errorf("fetcher returned no result for %s", requestable.TemplateURL())
+	}
+
+	if result.Url == "" {
+		result.Url = requestable.URL()
+	}
+	if result.Duration == 0 {
+		result.Duration = time.Since(start)
+	}
+	if result.StatusCode == 0 {
+		result.StatusCode = http.StatusOK
+	}
+	if result.Attempts == 0 {
+		result.Attempts = 1
+	}
+	if result.TotalDuration == 0 {
+		result.TotalDuration = time.Since(start)
+	}
+	if result.TimingLabel == "" {
+		result.TimingLabel = timingLabelFor(requestable)
+	}
+
+	if r.isErrorStatus(requestable, result.StatusCode) {
+		return nil, newResultError(requestable, r, result)
+	}
+
+	return result, nil
+}
+
+func fetcherFor(requestable Requestable) FragmentFetcher {
+	if fr, ok := requestable.(FetcherRequestable); ok {
+		return fr.Fetcher()
+	}
+
+	return nil
+}
+
+// headersWithHmac returns the headers with the Authorization header set to an
+// HMAC of the path and a timestamp. The method is included for requests that
+// aren't GET requests, so the signature of a GET request can't be used to
+// make a request with another method.
+func (r *Request) headersWithHmac(headers http.Header, method string, url string) http.Header {
 	newHeaders := http.Header{}
-	for name, value := range r.Header {
+	for name, value := range headers {
 		newHeaders[name] = value
 	}
 
+	setHmacHeaders(newHeaders, r.HmacSecret, method, pathFromFullUrl(url))
+
+	return newHeaders
+}
+
+// SignRequest sets the Authorization and X-Authorization-Time headers of the
+// request to an HMAC of its path and query and the current time, the way
+// fragment requests are signed using HmacSecret, e.g. for requests made to the
+// target outside of a Request.
+func SignRequest(secret string, r *http.Request) {
+	path := r.URL.Path
+	if r.URL.RawQuery != "" {
+		path += "?" + r.URL.RawQuery
+	}
+
+	setHmacHeaders(r.Header, secret, r.Method, path)
+}
+
+func setHmacHeaders(headers http.Header, secret string, method string, path string) {
 	timestamp := fmt.Sprintf("%d", time.Now().Unix())
 
-	mac := hmac.New(sha256.New, []byte(r.HmacSecret))
-	mac.Write(
-		[]byte(fmt.Sprintf("%s,%s", pathFromFullUrl(url), timestamp)),
-	)
+	headers.Set("Authorization", hex.EncodeToString(hmacSignature(secret, method, path, timestamp)))
+	headers.Set("X-Authorization-Time", timestamp)
+}
 
-	newHeaders.Set("Authorization", hex.EncodeToString(mac.Sum(nil)))
-	newHeaders.Set("X-Authorization-Time", timestamp)
+// ValidHmac returns true when the request is signed with the secret the way
+// requests made with HmacSecret are, e.g. because the target routed a
+// fragment request back to viewproxy. It returns false when secret is empty.
+func ValidHmac(secret string, r *http.Request) bool {
+	timestamp := r.Header.Get("X-Authorization-Time")
+	signature, err := hex.DecodeString(r.Header.Get("Authorization"))
+	if secret == "" || timestamp == "" || err != nil {
+		return false
+	}
 
-	return newHeaders
+	path := r.URL.Path
+	if r.URL.RawQuery != "" {
+		path += "?" + r.URL.RawQuery
+	}
+
+	return hmac.Equal(signature, hmacSignature(secret, r.Method, path, timestamp))
+}
+
+// hmacSignature returns the HMAC of the path and timestamp, including the
+// method for requests that aren't GET requests.
+func hmacSignature(secret string, method string, path string, timestamp string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	if method == http.MethodGet {
+		mac.Write([]byte(fmt.Sprintf("%s,%s", path, timestamp)))
+	} else {
+		mac.Write([]byte(fmt.Sprintf("%s,%s,%s", method, path, timestamp)))
+	}
+
+	return mac.Sum(nil)
+}
+
+// filteredURL returns the URL of the requestable with its query params
+// filtered, falling back to the template URL when there is no SecretFilter.
+func (r *Request) filteredURL(requestable Requestable) string {
+	if r.SecretFilter == nil {
+		return requestable.TemplateURL()
+	}
+
+	return r.SecretFilter.FilterURLString(requestable.URL())
 }
 
 func (r *Request) filterError(errURL string, err error) error {
+	var transportErr *FragmentTransportError
+	if errors.As(err, &transportErr) {
+		return &FragmentTransportError{
+			Key:         transportErr.Key,
+			TemplateURL: transportErr.TemplateURL,
+			Err:         r.filterError(errURL, transportErr.Err),
+		}
+	}
+
 	var urlErr *url.Error
 	if errors.As(err, &urlErr) {
 		return r.SecretFilter.FilterURLError(errURL, urlErr)
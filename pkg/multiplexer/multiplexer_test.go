@@ -1,14 +1,27 @@
 package multiplexer
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/blakewilliams/viewproxy/pkg/notifier"
 	"github.com/blakewilliams/viewproxy/pkg/secretfilter"
 	"github.com/stretchr/testify/require"
 )
@@ -18,11 +31,21 @@ var defaultTimeout = time.Duration(5) * time.Second
 type fakeRequestable struct {
 	templateURL string
 	url         string
+	key         string
+	retryPolicy RetryPolicy
+	maxBodySize int64
+	priority    int
+	allowed     []int
 }
 
 func (ff *fakeRequestable) URL() string                 { return ff.url }
 func (ff *fakeRequestable) TemplateURL() string         { return ff.templateURL }
 func (ff *fakeRequestable) Metadata() map[string]string { return make(map[string]string) }
+func (ff *fakeRequestable) RetryPolicy() RetryPolicy    { return ff.retryPolicy }
+func (ff *fakeRequestable) Key() string                 { return ff.key }
+func (ff *fakeRequestable) MaxBodySize() int64          { return ff.maxBodySize }
+func (ff *fakeRequestable) Priority() int               { return ff.priority }
+func (ff *fakeRequestable) AllowedStatusCodes() []int   { return ff.allowed }
 func newFakeRequestable(url string) *fakeRequestable {
 	return &fakeRequestable{url: url, templateURL: url}
 }
@@ -56,6 +79,131 @@ func TestRequestDoReturnsMultipleResponsesInOrder(t *testing.T) {
 	server.Close()
 }
 
+func TestRequestDetailedTiming(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+		w.Write([]byte("<body>"))
+	}))
+	defer server.Close()
+
+	r := newRequest()
+	r.DetailedTiming = true
+	r.WithRequestable(newFakeRequestable(server.URL))
+	results, err := r.Do(context.Background())
+	require.NoError(t, err)
+
+	timing := results[0].Timing
+	require.NotNil(t, timing)
+	require.Greater(t, timing.Connect, time.Duration(0))
+	require.GreaterOrEqual(t, timing.FirstByte, 10*time.Millisecond)
+	require.LessOrEqual(t, timing.FirstByte, results[0].Duration)
+	require.Greater(t, timing.BodyRead, time.Duration(0))
+	// The server is dialed by IP and doesn't use TLS
+	require.Zero(t, timing.DNS)
+	require.Zero(t, timing.TLS)
+
+	// Connection setup isn't timed when the connection is reused
+	results, err = r.Do(context.Background())
+	require.NoError(t, err)
+	require.Zero(t, results[0].Timing.Connect)
+
+	r = newRequest()
+	r.WithRequestable(newFakeRequestable(server.URL))
+	results, err = r.Do(context.Background())
+	require.NoError(t, err)
+	require.Nil(t, results[0].Timing)
+}
+
+func TestRequestEarlyHintsAndTrailer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/plain" {
+			w.Write([]byte("<body>"))
+			return
+		}
+
+		w.Header().Set("Link", "</app.css>; rel=preload; as=style")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Header().Del("Link")
+
+		w.Header().Set("Trailer", "Server-Timing")
+		if r.URL.Path == "/gzip" {
+			w.Header().Set("Content-Encoding", "gzip")
+			gzipWriter := gzip.NewWriter(w)
+			gzipWriter.Write([]byte("<body>"))
+			gzipWriter.Close()
+		} else {
+			w.Write([]byte("<body>"))
+		}
+		w.Header().Set("Server-Timing", "db;dur=5")
+	}))
+	defer server.Close()
+
+	var mu sync.Mutex
+	hinted := make([]string, 0, 2)
+
+	r := newRequest()
+	r.OnEarlyHints = func(ctx context.Context, requestable Requestable, header http.Header) {
+		mu.Lock()
+		defer mu.Unlock()
+		hinted = append(hinted, header.Get("Link"))
+	}
+	r.WithRequestable(newFakeRequestable(server.URL))
+	r.WithRequestable(newFakeRequestable(server.URL + "/gzip"))
+
+	results, err := r.Do(context.Background())
+	require.NoError(t, err)
+
+	for _, result := range results {
+		require.Equal(t, "<body>", string(result.Body))
+		require.Len(t, result.EarlyHints, 1)
+		require.Equal(t, "</app.css>; rel=preload; as=style", result.EarlyHints[0].Get("Link"))
+		require.Equal(t, "db;dur=5", result.Trailer.Get("Server-Timing"))
+	}
+	require.Equal(t, []string{"</app.css>; rel=preload; as=style", "</app.css>; rel=preload; as=style"}, hinted)
+
+	r = newRequest()
+	r.WithRequestable(newFakeRequestable(server.URL + "/plain"))
+	results, err = r.Do(context.Background())
+	require.NoError(t, err)
+	require.Nil(t, results[0].EarlyHints)
+	require.Nil(t, results[0].Trailer)
+}
+
+func TestRequestDoKeepCompressedBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		gzipWriter := gzip.NewWriter(w)
+		gzipWriter.Write([]byte(r.URL.Path))
+		gzipWriter.Close()
+	}))
+	defer server.Close()
+
+	r := newRequest()
+	r.Header.Set("Accept-Encoding", "gzip")
+	r.WithRequestable(newFakeRequestable(server.URL + "/layout"))
+	results, err := r.Do(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "/layout", string(results[0].Body))
+	require.Nil(t, results[0].CompressedBody)
+
+	// Only the first requestable's compressed body is kept
+	r = newRequest()
+	r.KeepCompressedBody = true
+	r.Header.Set("Accept-Encoding", "gzip")
+	r.WithRequestable(newFakeRequestable(server.URL + "/layout"))
+	r.WithRequestable(newFakeRequestable(server.URL + "/body"))
+	results, err = r.Do(context.Background())
+	require.NoError(t, err)
+
+	gzipReader, err := gzip.NewReader(bytes.NewReader(results[0].CompressedBody))
+	require.NoError(t, err)
+	decompressed, err := io.ReadAll(gzipReader)
+	require.NoError(t, err)
+	require.Equal(t, "/layout", string(decompressed))
+	require.Equal(t, "/body", string(results[1].Body))
+	require.Nil(t, results[1].CompressedBody)
+}
+
 func TestRequestDoForwardsHeaders(t *testing.T) {
 	server := startServer(t)
 	headers := http.Header{}
@@ -76,6 +224,158 @@ func TestRequestDoForwardsHeaders(t *testing.T) {
 	server.Close()
 }
 
+func TestRequestHeaderFunc(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "cookie=%s token=%s signed=%t", r.Header.Get("Cookie"), r.Header.Get("X-Service-Token"), r.Header.Get("Authorization") != "")
+	}))
+	defer server.Close()
+
+	r := newRequest()
+	r.HmacSecret = "secret"
+	r.Header.Set("Cookie", "session=abc")
+	r.HeaderFunc = func(requestable Requestable, header http.Header) http.Header {
+		if keyFor(requestable) == "anonymous" {
+			header.Del("Cookie")
+		} else {
+			header.Set("X-Service-Token", "token")
+		}
+
+		return header
+	}
+	// Identical requestables aren't coalesced since their headers can differ
+	r.WithRequestable(newKeyedRequestable("anonymous", server.URL))
+	r.WithRequestable(newKeyedRequestable("private", server.URL))
+
+	results, err := r.Do(context.Background())
+	require.NoError(t, err)
+
+	require.Equal(t, "cookie= token= signed=true", string(results[0].Body))
+	require.Equal(t, "cookie=session=abc token=token signed=true", string(results[1].Body))
+	require.False(t, results[1].Coalesced)
+	// The request's headers aren't modified
+	require.Equal(t, "session=abc", r.Header.Get("Cookie"))
+	require.Empty(t, r.Header.Get("X-Service-Token"))
+}
+
+func TestSignRequest(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "http://localhost/_viewproxy/definition?route=%2Fhello", nil)
+	SignRequest("secret", r)
+
+	require.NotEmpty(t, r.Header.Get("X-Authorization-Time"))
+	require.True(t, ValidHmac("secret", r))
+	require.False(t, ValidHmac("other", r))
+
+	// The query is part of the signature
+	r.URL.RawQuery = "route=%2Fgoodbye"
+	require.False(t, ValidHmac("secret", r))
+}
+
+type headerRequestable struct {
+	fakeRequestable
+	headers http.Header
+}
+
+func (hr *headerRequestable) Headers() http.Header { return hr.headers }
+
+func TestRequestableHeaders(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "role=%s accept=%s signed=%t", r.Header.Get("X-Fragment-Role"), r.Header.Get("Accept"), r.Header.Get("Authorization") != "")
+	}))
+	defer server.Close()
+
+	r := newRequest()
+	r.HmacSecret = "secret"
+	r.Header.Set("Accept", "text/html")
+	r.WithRequestable(&headerRequestable{
+		fakeRequestable: *newKeyedRequestable("sidebar", server.URL),
+		headers:         http.Header{"X-Fragment-Role": {"sidebar"}, "Accept": {"application/json"}},
+	})
+	// Requestables with different headers aren't coalesced
+	r.WithRequestable(newKeyedRequestable("body", server.URL))
+
+	results, err := r.Do(context.Background())
+	require.NoError(t, err)
+
+	require.Equal(t, "role=sidebar accept=application/json signed=true", string(results[0].Body))
+	require.Equal(t, "role= accept=text/html signed=true", string(results[1].Body))
+	require.False(t, results[1].Coalesced)
+	// The request's headers aren't modified
+	require.Equal(t, "text/html", r.Header.Get("Accept"))
+	require.Empty(t, r.Header.Get("X-Fragment-Role"))
+}
+
+type methodRequestable struct {
+	fakeRequestable
+	method string
+	body   string
+}
+
+func (mr *methodRequestable) Method() string { return mr.method }
+func (mr *methodRequestable) NewBody() io.ReadCloser {
+	return io.NopCloser(strings.NewReader(mr.body))
+}
+
+func TestRequestableMethodAndBody(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		body, _ := io.ReadAll(r.Body)
+
+		mac := hmac.New(sha256.New, []byte("secret"))
+		fmt.Fprintf(mac, "%s,%s,%s", r.Method, r.URL.Path, r.Header.Get("X-Authorization-Time"))
+		signed := hex.EncodeToString(mac.Sum(nil)) == r.Header.Get("Authorization")
+
+		fmt.Fprintf(w, "%s %s signed=%t", r.Method, body, signed)
+	}))
+	defer server.Close()
+
+	r := newRequest()
+	r.HmacSecret = "secret"
+	post := &methodRequestable{fakeRequestable: *newFakeRequestable(server.URL + "/render"), method: http.MethodPost, body: `{"id":1}`}
+	// Requests with a method other than GET aren't coalesced
+	r.WithRequestable(post)
+	r.WithRequestable(post)
+
+	results, err := r.Do(context.Background())
+	require.NoError(t, err)
+
+	require.Equal(t, `POST {"id":1} signed=true`, string(results[0].Body))
+	require.Equal(t, `POST {"id":1} signed=true`, string(results[1].Body))
+	require.False(t, results[1].Coalesced)
+	require.Equal(t, int32(2), atomic.LoadInt32(&requests))
+}
+
+func TestOnFetchComplete(t *testing.T) {
+	server := startServer(t)
+
+	var mu sync.Mutex
+	completed := make(map[string]error)
+	var durations []time.Duration
+
+	r := newRequest()
+	r.Non2xxErrors = false
+	r.OnFetchComplete = func(ctx context.Context, requestable Requestable, duration time.Duration, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		completed[requestable.URL()] = err
+		durations = append(durations, duration)
+	}
+	r.WithRequestable(newFakeRequestable("http://localhost:9990/"))
+	r.WithRequestable(newFakeRequestable("http://localhost:9990/wowomg"))
+	// Coalesced requestables are only fetched once
+	r.WithRequestable(newFakeRequestable("http://localhost:9990/"))
+	require.Equal(t, 3, r.RequestableCount())
+	require.Equal(t, 2, r.FetchCount())
+
+	_, err := r.Do(context.Background())
+	require.NoError(t, err)
+	server.Close()
+
+	require.Equal(t, map[string]error{"http://localhost:9990/": nil, "http://localhost:9990/wowomg": nil}, completed)
+	require.Len(t, durations, 2)
+	require.Greater(t, durations[0], time.Duration(0))
+}
+
 func TestFetch404ReturnsError(t *testing.T) {
 	server := startServer(t)
 
@@ -110,6 +410,40 @@ func TestResultErrorMessagesFilterUrls(t *testing.T) {
 	server.Close()
 }
 
+func TestResultErrorBodySnippet(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("X-Request-Id", "req-hunter2")
+		w.Header().Set("Set-Cookie", "session=abc")
+		w.WriteHeader(http.StatusInternalServerError)
+		// The 2 byte character straddles the snippet size
+		w.Write([]byte("token hunter2 " + strings.Repeat("a", 1008) + "é and the rest"))
+	}))
+	defer target.Close()
+
+	r := newRequest()
+	r.SecretFilter.AddSecret("hunter2")
+	r.WithRequestable(newFakeRequestable(target.URL))
+
+	_, err := r.Do(context.Background())
+
+	var resultErr *ResultError
+	require.ErrorAs(t, err, &resultErr)
+	require.Equal(t, "token FILTERED "+strings.Repeat("a", 1008), string(resultErr.BodySnippet))
+	require.Equal(t, http.Header{
+		"Content-Type": {"text/plain"},
+		"X-Request-Id": {"req-FILTERED"},
+	}, resultErr.Header)
+
+	r = newRequest()
+	r.ErrorSnippetSize = 0
+	r.WithRequestable(newFakeRequestable(target.URL))
+
+	_, err = r.Do(context.Background())
+	require.ErrorAs(t, err, &resultErr)
+	require.Nil(t, resultErr.BodySnippet)
+}
+
 func TestRequestErrorMessagesFilterUrls(t *testing.T) {
 	server := startServer(t)
 
@@ -179,6 +513,56 @@ func TestFetchCancelled(t *testing.T) {
 	require.EqualError(t, err, "multiplexer request was canceled: context canceled")
 }
 
+func TestAllowedStatusCodesAreNotErrors(t *testing.T) {
+	server := startServer(t)
+	defer server.Close()
+
+	allowed := newFakeRequestable("http://localhost:9990/?fragment=oops")
+	allowed.allowed = []int{404, 500}
+
+	r := newRequest()
+	r.WithRequestable(newFakeRequestable("http://localhost:9990?fragment=header"))
+	r.WithRequestable(allowed)
+
+	results, err := r.Do(context.Background())
+
+	require.NoError(t, err)
+	require.Equal(t, 200, results[0].StatusCode)
+	require.Equal(t, 500, results[1].StatusCode)
+
+	strict := newFakeRequestable("http://localhost:9990/?fragment=oops")
+	strict.allowed = []int{404}
+
+	r = newRequest()
+	r.WithRequestable(strict)
+
+	_, err = r.Do(context.Background())
+
+	var resultErr *ResultError
+	require.ErrorAs(t, err, &resultErr)
+	require.Equal(t, 500, resultErr.Result.StatusCode)
+}
+
+func TestNotModifiedIsNotAnError(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"abc"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("hello"))
+	}))
+	defer target.Close()
+
+	r := newRequest()
+	r.Header.Set("If-None-Match", `"abc"`)
+	r.WithRequestable(newFakeRequestable(target.URL))
+
+	results, err := r.Do(context.Background())
+	require.NoError(t, err)
+	require.True(t, results[0].NotModified())
+	require.Empty(t, results[0].Body)
+}
+
 func TestCanIgnoreNon2xxErrors(t *testing.T) {
 	server := startServer(t)
 
@@ -195,64 +579,1085 @@ func TestCanIgnoreNon2xxErrors(t *testing.T) {
 	server.Close()
 }
 
-func startServer(t *testing.T) *http.Server {
-	var testServer *http.Server
+type attemptTripper struct {
+	attempts []int
+	mu       sync.Mutex
+	tripper  Tripper
+}
 
-	instance := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		params := r.URL.Query()
-		fragment := params.Get("fragment")
+func (at *attemptTripper) Request(r *http.Request) (*http.Response, error) {
+	at.mu.Lock()
+	at.attempts = append(at.attempts, AttemptFromContext(r.Context()))
+	at.mu.Unlock()
 
-		if fragment == "header" {
-			w.Write([]byte("<body>"))
-		} else if fragment == "body" {
-			w.Write([]byte(fmt.Sprintf("hello %s", params.Get("name"))))
-		} else if fragment == "footer" {
-			w.Write([]byte("</body>"))
-		} else if fragment == "slow" {
-			time.Sleep(time.Duration(3) * time.Second)
-			w.Write([]byte("</body>"))
-		} else if fragment == "oops" {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte("500"))
-		} else if fragment == "echo_headers" {
-			for name, values := range r.Header {
-				for _, value := range values {
-					w.Write(
-						[]byte(fmt.Sprintf("%s:%s\n", name, value)),
-					)
-				}
-			}
-		} else if fragment == "bad_gateway" {
-			testServer.Close()
-		} else {
-			w.WriteHeader(http.StatusNotFound)
-			w.Write([]byte("Not found"))
-		}
-	})
+	return at.tripper.Request(r)
+}
+
+// misbehavingTripper violates the Tripper contract
+type misbehavingTripper struct {
+	resp *http.Response
+}
+
+func (mt *misbehavingTripper) Request(r *http.Request) (*http.Response, error) {
+	return mt.resp, nil
+}
+
+func TestTripperContractViolations(t *testing.T) {
+	tests := map[string]struct {
+		resp *http.Response
+		msg  string
+	}{
+		"nil response": {
+			resp: nil,
+			msg:  "fragment root.header: tripper *multiplexer.misbehavingTripper returned a nil response without an error",
+		},
+		"nil body": {
+			resp: &http.Response{StatusCode: http.StatusOK},
+			msg:  "fragment root.header: tripper *multiplexer.misbehavingTripper returned a response with a nil body",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := newRequest()
+			r.Tripper = &misbehavingTripper{resp: tc.resp}
+			req := newFakeRequestable("http://localhost:9990?fragment=header")
+			req.key = "root.header"
+			r.WithRequestable(req)
+
+			_, err := r.Do(context.Background())
+
+			var transportErr *FragmentTransportError
+			require.ErrorAs(t, err, &transportErr)
+			require.Equal(t, "root.header", transportErr.Key)
+			require.Equal(t, "http://localhost:9990?fragment=header", transportErr.TemplateURL)
+			require.EqualError(t, err, tc.msg)
+		})
+	}
+}
+
+func TestTransportErrorsIdentifyFragment(t *testing.T) {
+	server := startServer(t)
+	defer server.Close()
+
+	r := newRequest()
+	req := newFakeRequestable("http://localhost:9990/wowomg?fragment=bad_gateway&foo=bar")
+	req.templateURL = "http://localhost:9990/:name?fragment=bad_gateway&foo=bar"
+	req.key = "root.body"
+	r.WithRequestable(req)
+
+	_, err := r.Do(context.Background())
+
+	var transportErr *FragmentTransportError
+	require.ErrorAs(t, err, &transportErr)
+	require.Equal(t, "root.body", transportErr.Key)
+
+	var urlErr *url.Error
+	require.ErrorAs(t, err, &urlErr)
+	require.Equal(t, "fragment root.body: Get \"http://localhost:9990/:name?foo=FILTERED&fragment=FILTERED\": EOF", err.Error())
+}
+
+func TestRetryTransientFailures(t *testing.T) {
+	server := startServer(t)
+	defer server.Close()
+
+	tripper := &attemptTripper{tripper: NewStandardTripper(&http.Client{})}
+	r := newRequest()
+	r.Tripper = tripper
+	req := newFakeRequestable("http://localhost:9990?fragment=flaky&key=retry_success")
+	req.retryPolicy = RetryPolicy{Attempts: 3, Backoff: 10 * time.Millisecond}
+	r.WithRequestable(req)
+
+	results, err := r.Do(context.Background())
 
-	listener, err := net.Listen("tcp", "localhost:9990")
 	require.NoError(t, err)
+	require.Equal(t, 200, results[0].StatusCode)
+	require.Equal(t, 2, results[0].Attempts)
+	require.False(t, results[0].FromCache)
+	// Duration is the winning attempt, TotalDuration includes the backoff
+	require.GreaterOrEqual(t, results[0].TotalDuration, 10*time.Millisecond)
+	require.Less(t, results[0].Duration, results[0].TotalDuration)
+	require.Equal(t, []int{1, 2}, tripper.attempts)
+}
 
-	testServer = &http.Server{Handler: instance}
-	go func() {
-		if err := testServer.Serve(listener); err != nil && err != http.ErrServerClosed {
-			require.NoError(t, err)
+// hedgeTripper responds to hedged requests immediately and to other requests
+// after delay, recording the requests that were canceled
+type hedgeTripper struct {
+	delay    time.Duration
+	mu       sync.Mutex
+	requests int
+	canceled int
+}
+
+func (ht *hedgeTripper) Request(r *http.Request) (*http.Response, error) {
+	ht.mu.Lock()
+	ht.requests++
+	ht.mu.Unlock()
+
+	body := "hedge"
+	if !HedgeFromContext(r.Context()) {
+		select {
+		case <-time.After(ht.delay):
+			body = "first"
+		case <-r.Context().Done():
+			ht.mu.Lock()
+			ht.canceled++
+			ht.mu.Unlock()
+			return nil, r.Context().Err()
 		}
-	}()
+	}
 
-	return testServer
+	return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(body))}, nil
 }
 
-func TestTimeoutError(t *testing.T) {
-	originalError := errors.New("omg")
-	err := newTimeoutError(originalError)
+func TestHedgeAfter(t *testing.T) {
+	tripper := &hedgeTripper{delay: time.Second}
+	hedges := 0
 
-	require.Equal(t, "multiplexer timed out: omg", err.Error())
-	require.Equal(t, originalError, err.Unwrap())
+	r := newRequest()
+	r.Tripper = tripper
+	r.HedgeAfter = 10 * time.Millisecond
+	r.OnHedge = func(ctx context.Context, requestable Requestable) {
+		require.Equal(t, "http://localhost:9990?fragment=header", requestable.URL())
+		hedges++
+	}
+	r.WithRequestable(newFakeRequestable("http://localhost:9990?fragment=header"))
+
+	results, err := r.Do(context.Background())
+
+	require.NoError(t, err)
+	require.Equal(t, "hedge", string(results[0].Body))
+	require.True(t, results[0].Hedged)
+	require.True(t, results[0].HedgeWon)
+	require.Equal(t, 1, hedges)
+	// The slow request is canceled before Do returns
+	require.Equal(t, 2, tripper.requests)
+	require.Equal(t, 1, tripper.canceled)
 }
 
-func newRequest() *Request {
-	r := NewRequest(NewStandardTripper(&http.Client{}))
-	r.SecretFilter = secretfilter.New()
-	return r
+func TestHedgeAfter_NotHedged(t *testing.T) {
+	tripper := &hedgeTripper{delay: 20 * time.Millisecond}
+
+	// Fast responses are not hedged
+	r := newRequest()
+	r.Tripper = tripper
+	r.HedgeAfter = time.Second
+	r.WithRequestable(newFakeRequestable("http://localhost:9990?fragment=header"))
+
+	results, err := r.Do(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "first", string(results[0].Body))
+	require.False(t, results[0].Hedged)
+
+	// Hedged requests need a free concurrency slot
+	r = newRequest()
+	r.Tripper = tripper
+	r.HedgeAfter = time.Millisecond
+	r.MaxConcurrency = 1
+	r.WithRequestable(newFakeRequestable("http://localhost:9990?fragment=header"))
+
+	results, err = r.Do(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "first", string(results[0].Body))
+	require.False(t, results[0].Hedged)
+
+	// Only GET requests are hedged
+	result, err := r.fetchUrlHedged(context.Background(), http.MethodPost, newFakeRequestable("http://localhost:9990?fragment=header"), http.Header{}, nil)
+	require.NoError(t, err)
+	require.Equal(t, "first", string(result.Body))
+	require.Equal(t, 3, tripper.requests)
+}
+
+func TestRequestDoCoalescesIdenticalRequestables(t *testing.T) {
+	server := startServer(t)
+	defer server.Close()
+
+	tripper := &attemptTripper{tripper: NewStandardTripper(&http.Client{})}
+	r := newRequest()
+	r.Tripper = tripper
+
+	optional := newFakeRequestable("http://localhost:9990?fragment=header")
+	optional.priority = 1
+
+	r.WithRequestable(newFakeRequestable("http://localhost:9990?fragment=header"))
+	r.WithRequestable(newFakeRequestable("http://localhost:9990?fragment=footer"))
+	r.WithRequestable(newFakeRequestable("http://localhost:9990?fragment=header"))
+	// Requestables with different options are fetched separately
+	r.WithRequestable(optional)
+
+	results, err := r.Do(context.Background())
+
+	require.NoError(t, err)
+	require.Len(t, tripper.attempts, 3)
+	require.Len(t, results, 4)
+
+	require.Equal(t, "<body>", string(results[0].Body))
+	require.False(t, results[0].Coalesced)
+	require.Equal(t, "</body>", string(results[1].Body))
+	require.Equal(t, "<body>", string(results[2].Body))
+	require.Equal(t, 2, results[2].Index)
+	require.True(t, results[2].Coalesced)
+	require.False(t, results[3].Coalesced)
+}
+
+func TestRetryGivesUpAfterAttempts(t *testing.T) {
+	server := startServer(t)
+	defer server.Close()
+
+	tripper := &attemptTripper{tripper: NewStandardTripper(&http.Client{})}
+	r := newRequest()
+	r.Tripper = tripper
+	req := newFakeRequestable("http://localhost:9990?fragment=unavailable")
+	req.retryPolicy = RetryPolicy{Attempts: 3}
+	r.WithRequestable(req)
+
+	_, err := r.Do(context.Background())
+
+	var resultErr *ResultError
+	require.ErrorAs(t, err, &resultErr)
+	require.Equal(t, 503, resultErr.Result.StatusCode)
+	require.Equal(t, 3, resultErr.Result.Attempts)
+	require.Equal(t, []int{1, 2, 3}, tripper.attempts)
+}
+
+func TestRetryIgnoresClientErrors(t *testing.T) {
+	server := startServer(t)
+	defer server.Close()
+
+	tripper := &attemptTripper{tripper: NewStandardTripper(&http.Client{})}
+	r := newRequest()
+	r.Tripper = tripper
+	req := newFakeRequestable("http://localhost:9990/wowomg")
+	req.retryPolicy = RetryPolicy{Attempts: 3}
+	r.WithRequestable(req)
+
+	_, err := r.Do(context.Background())
+
+	var resultErr *ResultError
+	require.ErrorAs(t, err, &resultErr)
+	require.Equal(t, 404, resultErr.Result.StatusCode)
+	require.Equal(t, []int{1}, tripper.attempts)
+}
+
+// errTripper fails every request with err
+type errTripper struct {
+	err error
+}
+
+func (et *errTripper) Request(r *http.Request) (*http.Response, error) {
+	return nil, et.err
+}
+
+func TestRetryOnlyConnectionErrors(t *testing.T) {
+	errs := map[error][]int{
+		&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}:                                           {1, 2, 3},
+		&url.Error{Op: "Get", URL: "http://localhost:9990", Err: io.ErrUnexpectedEOF}:                             {1, 2, 3},
+		&url.Error{Op: "Get", URL: "http://localhost:9990", Err: errors.New("tls: failed to verify certificate")}: {1},
+		&url.Error{Op: "parse", URL: "http://[::1", Err: errors.New("missing ']' in host")}:                       {1},
+	}
+
+	for fetchErr, attempts := range errs {
+		tripper := &attemptTripper{tripper: &errTripper{err: fetchErr}}
+		r := newRequest()
+		r.Tripper = tripper
+		req := newFakeRequestable("http://localhost:9990?fragment=header")
+		req.retryPolicy = RetryPolicy{Attempts: 3}
+		r.WithRequestable(req)
+
+		_, err := r.Do(context.Background())
+
+		require.Error(t, err)
+		require.Equal(t, attempts, tripper.attempts, fetchErr.Error())
+	}
+}
+
+func TestRetryRespectsTimeout(t *testing.T) {
+	server := startServer(t)
+	defer server.Close()
+
+	start := time.Now()
+	r := newRequest()
+	req := newFakeRequestable("http://localhost:9990?fragment=unavailable")
+	req.retryPolicy = RetryPolicy{Attempts: 3, Backoff: time.Second}
+	r.WithRequestable(req)
+	r.Timeout = 100 * time.Millisecond
+
+	_, err := r.Do(context.Background())
+
+	require.Error(t, err)
+	require.Less(t, time.Since(start), 500*time.Millisecond)
+}
+
+func TestOutboundBytes(t *testing.T) {
+	server := startServer(t)
+	defer server.Close()
+
+	r := newRequest()
+	r.WithRequestable(newFakeRequestable("http://localhost:9990?fragment=header"))
+	r.WithRequestable(newFakeRequestable("http://localhost:9990?fragment=footer"))
+	r.Header.Add("X-Name", "viewproxy")
+	r.Timeout = defaultTimeout
+
+	outbound := NewOutboundBytes(0)
+	_, err := r.Do(ContextWithOutboundBytes(context.TODO(), outbound))
+
+	require.NoError(t, err)
+	// "X-Name: viewproxy\r\n" sent for each requestable
+	require.Equal(t, int64(2*len("X-Name: viewproxy\r\n")), outbound.Total())
+}
+
+func TestOutboundBytesLimit(t *testing.T) {
+	server := startServer(t)
+	defer server.Close()
+
+	r := newRequest()
+	r.WithRequestable(newFakeRequestable("http://localhost:9990?fragment=header"))
+	r.WithRequestable(newFakeRequestable("http://localhost:9990?fragment=footer"))
+	r.Header.Add("X-Name", "viewproxy")
+	r.Timeout = defaultTimeout
+	r.MaxOutboundBytes = int64(len("X-Name: viewproxy\r\n"))
+
+	_, err := r.Do(context.TODO())
+
+	var outboundErr *OutboundBytesExceededError
+	require.ErrorAs(t, err, &outboundErr)
+	require.Equal(t, r.MaxOutboundBytes, outboundErr.Limit)
+	require.Equal(t, "outbound bytes exceeded limit: 38 of 19 bytes", err.Error())
+}
+
+func TestMaxBodyBytes(t *testing.T) {
+	server := startServer(t)
+	defer server.Close()
+
+	r := newRequest()
+	r.WithRequestable(newFakeRequestable("http://localhost:9990?fragment=header"))
+	r.Timeout = defaultTimeout
+	r.MaxBodyBytes = int64(len("<body>"))
+
+	results, err := r.Do(context.TODO())
+	require.NoError(t, err)
+	require.Equal(t, "<body>", string(results[0].Body))
+
+	r.MaxBodyBytes = int64(len("<body>")) - 1
+	_, err = r.Do(context.TODO())
+
+	var bodyErr *ErrBodyTooLarge
+	require.ErrorAs(t, err, &bodyErr)
+	require.Equal(t, "http://localhost:9990?fragment=header", bodyErr.TemplateURL)
+	require.Equal(t, "response body for http://localhost:9990?fragment=header exceeded limit of 5 bytes", err.Error())
+}
+
+func TestReadBodyBuffer(t *testing.T) {
+	buf, err := readBodyBuffer(strings.NewReader("body"), 0, 4, "")
+	require.NoError(t, err)
+	require.Equal(t, "body", buf.String())
+	putBodyBuffer(buf)
+
+	// Content-Length can't be trusted
+	_, err = readBodyBuffer(strings.NewReader("longer than the limit"), 10, 5, "/fragment")
+	require.EqualError(t, err, "response body for /fragment exceeded limit of 10 bytes")
+}
+
+func TestPooledBodies(t *testing.T) {
+	server := startServer(t)
+	defer server.Close()
+
+	fetch := func(pooled bool) *Result {
+		r := newRequest()
+		r.PooledBodies = pooled
+		r.WithRequestable(newFakeRequestable("http://localhost:9990?fragment=header"))
+		r.WithRequestable(newFakeRequestable("http://localhost:9990?fragment=header"))
+
+		results, err := r.Do(context.Background())
+		require.NoError(t, err)
+		require.Equal(t, "<body>", string(results[0].Body))
+		require.Equal(t, "<body>", string(results[1].Body))
+
+		// Coalesced results share the body, it's only released once
+		ReleaseResults(results, nil)
+		return results[0]
+	}
+
+	// Copied bodies are safe to retain after the results are released
+	copied := fetch(false)
+	fetch(true)
+	require.Equal(t, "<body>", string(copied.Body))
+
+	pooled := fetch(true)
+	if poisonReleasedBodies {
+		require.Equal(t, bytes.Repeat([]byte{0xDD}, len("<body>")), pooled.Body)
+	}
+}
+
+// statusTripper responds with the next status of statuses, and with a 200
+// once they're exhausted. Requests that aren't hedged respond after delay,
+// even when they're canceled.
+type statusTripper struct {
+	mu       sync.Mutex
+	statuses []int
+	delay    time.Duration
+}
+
+func (st *statusTripper) Request(r *http.Request) (*http.Response, error) {
+	st.mu.Lock()
+	status := http.StatusOK
+	if len(st.statuses) > 0 {
+		status, st.statuses = st.statuses[0], st.statuses[1:]
+	}
+	st.mu.Unlock()
+
+	if !HedgeFromContext(r.Context()) {
+		time.Sleep(st.delay)
+	}
+
+	return &http.Response{StatusCode: status, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(http.StatusText(status)))}, nil
+}
+
+func TestPooledBodies_ReleasedWhenDiscarded(t *testing.T) {
+	inUse := atomic.LoadInt64(&pooledBodiesInUse)
+
+	// The result of a retried attempt is discarded
+	r := newRequest()
+	r.PooledBodies = true
+	r.Tripper = &statusTripper{statuses: []int{http.StatusServiceUnavailable}}
+	req := newFakeRequestable("http://localhost:9990?fragment=header")
+	req.retryPolicy = RetryPolicy{Attempts: 2}
+	r.WithRequestable(req)
+
+	results, err := r.Do(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 2, results[0].Attempts)
+	ReleaseResults(results, err)
+	require.Equal(t, inUse, atomic.LoadInt64(&pooledBodiesInUse))
+
+	// The result of the losing hedge attempt is discarded
+	r = newRequest()
+	r.PooledBodies = true
+	r.Tripper = &statusTripper{delay: 50 * time.Millisecond}
+	r.HedgeAfter = 10 * time.Millisecond
+	r.WithRequestable(newFakeRequestable("http://localhost:9990?fragment=header"))
+
+	results, err = r.Do(context.Background())
+	require.NoError(t, err)
+	require.True(t, results[0].HedgeWon)
+	ReleaseResults(results, err)
+	require.Equal(t, inUse, atomic.LoadInt64(&pooledBodiesInUse))
+}
+
+func TestMaxBodyBytesOverride(t *testing.T) {
+	server := startServer(t)
+	defer server.Close()
+
+	requestable := newFakeRequestable("http://localhost:9990?fragment=header")
+	requestable.maxBodySize = 1024
+
+	r := newRequest()
+	r.WithRequestable(requestable)
+	r.Timeout = defaultTimeout
+	r.MaxBodyBytes = 1
+
+	results, err := r.Do(context.TODO())
+	require.NoError(t, err)
+	require.Equal(t, "<body>", string(results[0].Body))
+}
+
+func TestMaxBodyBytesLimitsDecompressedBody(t *testing.T) {
+	server := startServer(t)
+	defer server.Close()
+
+	r := newRequest()
+	r.WithRequestable(newFakeRequestable("http://localhost:9990?fragment=gzip"))
+	r.Timeout = defaultTimeout
+	// The compressed body is well under the limit
+	r.MaxBodyBytes = 512
+
+	_, err := r.Do(context.TODO())
+
+	var bodyErr *ErrBodyTooLarge
+	require.ErrorAs(t, err, &bodyErr)
+	require.Equal(t, int64(512), bodyErr.Limit)
+}
+
+func TestRequestEmitsFetchEvents(t *testing.T) {
+	server := startServer(t)
+	defer server.Close()
+
+	n := notifier.New()
+	events := make([]string, 0)
+	var mu sync.Mutex
+	record := func(event string) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event)
+	}
+
+	n.Around(EventFetchAll, func(ctx context.Context, next func(context.Context)) {
+		record("start all")
+		next(ctx)
+		record("end all")
+	})
+	fetches := make([]*Fetch, 0)
+	n.Around(EventFetchSingle, func(ctx context.Context, next func(context.Context)) {
+		fetch := FetchFromContext(ctx)
+		require.Same(t, fetch.Requestable, RequestableFromContext(ctx))
+
+		next(ctx)
+		record("fetched " + fetch.URL)
+
+		mu.Lock()
+		fetches = append(fetches, fetch)
+		mu.Unlock()
+	})
+
+	r := NewRequest(NewStandardTripper(&http.Client{}), WithNotifier(n))
+	r.SecretFilter = secretfilter.New()
+	r.WithRequestable(newFakeRequestable("http://localhost:9990?fragment=header&secret=hunter2"))
+	r.WithRequestable(newFakeRequestable("http://localhost:9990/wowomg"))
+	_, err := r.Do(context.Background())
+	require.Error(t, err)
+
+	require.Equal(t, "start all", events[0])
+	require.Equal(t, "end all", events[len(events)-1])
+	require.Contains(t, events, "fetched http://localhost:9990?fragment=FILTERED&secret=FILTERED")
+	require.Contains(t, events, "fetched http://localhost:9990/wowomg")
+
+	for _, fetch := range fetches {
+		require.Equal(t, http.MethodGet, fetch.Method)
+		if errors.Is(fetch.Err, context.Canceled) {
+			// Fetches still in flight are canceled by the 404
+			continue
+		} else if fetch.Err != nil {
+			var resultErr *ResultError
+			require.ErrorAs(t, fetch.Err, &resultErr)
+			require.Equal(t, 404, resultErr.Result.StatusCode)
+		} else {
+			require.Equal(t, "<body>", string(fetch.Result.Body))
+		}
+	}
+}
+
+func startServer(t *testing.T) *http.Server {
+	var testServer *http.Server
+	var flakyMu sync.Mutex
+	flakyAttempts := make(map[string]int)
+
+	instance := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params := r.URL.Query()
+		fragment := params.Get("fragment")
+
+		if fragment == "header" {
+			w.Write([]byte("<body>"))
+		} else if fragment == "body" {
+			w.Write([]byte(fmt.Sprintf("hello %s", params.Get("name"))))
+		} else if fragment == "footer" {
+			w.Write([]byte("</body>"))
+		} else if fragment == "slow" {
+			time.Sleep(time.Duration(3) * time.Second)
+			w.Write([]byte("</body>"))
+		} else if fragment == "oops" {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("500"))
+		} else if fragment == "echo_headers" {
+			for name, values := range r.Header {
+				for _, value := range values {
+					w.Write(
+						[]byte(fmt.Sprintf("%s:%s\n", name, value)),
+					)
+				}
+			}
+		} else if fragment == "flaky" {
+			flakyMu.Lock()
+			flakyAttempts[params.Get("key")]++
+			attempts := flakyAttempts[params.Get("key")]
+			flakyMu.Unlock()
+
+			if attempts == 1 {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			w.Write([]byte("recovered"))
+		} else if fragment == "gzip" {
+			w.Header().Set("Content-Encoding", "gzip")
+			gzipWriter := gzip.NewWriter(w)
+			gzipWriter.Write(bytes.Repeat([]byte("a"), 1024))
+			gzipWriter.Close()
+		} else if fragment == "unavailable" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		} else if fragment == "bad_gateway" {
+			testServer.Close()
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("Not found"))
+		}
+	})
+
+	listener, err := net.Listen("tcp", "localhost:9990")
+	require.NoError(t, err)
+	// Closing the server before Serve is called leaves the listener open
+	t.Cleanup(func() { listener.Close() })
+
+	testServer = &http.Server{Handler: instance}
+	go func() {
+		if err := testServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			require.NoError(t, err)
+		}
+	}()
+
+	return testServer
+}
+
+func TestTimeoutError(t *testing.T) {
+	originalError := errors.New("omg")
+	err := newTimeoutError(originalError)
+
+	require.Equal(t, "multiplexer timed out: omg", err.Error())
+	require.Equal(t, originalError, err.Unwrap())
+}
+
+func newRequest() *Request {
+	r := NewRequest(NewStandardTripper(&http.Client{}))
+	r.SecretFilter = secretfilter.New()
+	return r
+}
+
+func TestOptionalBudgetSkipsPendingRequestables(t *testing.T) {
+	server := startServer(t)
+	defer server.Close()
+
+	slow := newFakeRequestable("http://localhost:9990?fragment=slow")
+	slow.priority = 1
+
+	r := newRequest()
+	r.WithRequestable(newFakeRequestable("http://localhost:9990?fragment=header"))
+	r.WithRequestable(slow)
+	r.Timeout = time.Second
+	r.OptionalBudget = 0.1
+
+	start := time.Now()
+	results, err := r.Do(context.Background())
+	require.NoError(t, err)
+	require.Less(t, time.Since(start), r.Timeout)
+
+	require.Equal(t, "<body>", string(results[0].Body))
+	require.False(t, results[0].Skipped)
+	require.True(t, results[1].Skipped)
+	require.Equal(t, "http://localhost:9990?fragment=slow", results[1].Url)
+}
+
+func TestOptionalBudgetDoesNotSkipRequiredRequestables(t *testing.T) {
+	server := startServer(t)
+	defer server.Close()
+
+	r := newRequest()
+	r.WithRequestable(newFakeRequestable("http://localhost:9990?fragment=slow"))
+	r.Timeout = 200 * time.Millisecond
+	r.OptionalBudget = 0.1
+
+	_, err := r.Do(context.Background())
+
+	var timeoutErr *TimeoutError
+	require.ErrorAs(t, err, &timeoutErr)
+}
+
+func TestFetchOrder(t *testing.T) {
+	r := newRequest()
+	for _, priority := range []int{2, 0, 1, 0} {
+		requestable := newFakeRequestable("http://localhost:9990?fragment=header")
+		requestable.priority = priority
+		r.WithRequestable(requestable)
+	}
+
+	require.Equal(t, []int{1, 3, 2, 0}, r.fetchOrder())
+}
+
+func TestPhaseTimings(t *testing.T) {
+	r := newRequest()
+	for i := 0; i < 3; i++ {
+		r.WithRequestable(&stubRequestable{newFakeRequestable("http://localhost:9990?fragment=header")})
+	}
+
+	phases := &PhaseTimings{}
+	start := time.Now()
+	results, err := r.Do(ContextWithPhaseTimings(context.Background(), phases))
+	require.NoError(t, err)
+	require.Len(t, results, 3)
+
+	require.False(t, phases.FetchesDone.Before(start))
+	require.False(t, phases.DoReturned.Before(phases.FetchesDone))
+}
+
+func TestRequestDoWithoutRequestables(t *testing.T) {
+	r := newRequest()
+
+	results, err := r.Do(context.Background())
+	require.NoError(t, err)
+	require.Len(t, results, 0)
+}
+
+type stubFetcher struct{}
+
+func (sf *stubFetcher) Fetch(ctx context.Context, requestable Requestable, header http.Header) (*Result, error) {
+	return &Result{Body: []byte("stub")}, nil
+}
+
+type stubRequestable struct {
+	*fakeRequestable
+}
+
+func (sr *stubRequestable) Fetcher() FragmentFetcher { return &stubFetcher{} }
+
+// nilFetcher returns neither a result nor an error
+type nilFetcher struct{}
+
+func (nf *nilFetcher) Fetch(ctx context.Context, requestable Requestable, header http.Header) (*Result, error) {
+	return nil, nil
+}
+
+type nilFetcherRequestable struct {
+	*fakeRequestable
+}
+
+func (nr *nilFetcherRequestable) Fetcher() FragmentFetcher { return &nilFetcher{} }
+
+func TestRequestFetcherWithoutResult(t *testing.T) {
+	r := newRequest()
+	r.WithRequestable(&nilFetcherRequestable{newFakeRequestable("http://localhost:9990?fragment=header")})
+
+	_, err := r.Do(context.Background())
+	require.EqualError(t, err, "fetcher returned no result for http://localhost:9990?fragment=header")
+}
+
+// delayedFetcher returns its body after delay, or err immediately when set
+type delayedFetcher struct {
+	delay time.Duration
+	body  string
+	err   error
+}
+
+func (df *delayedFetcher) Fetch(ctx context.Context, requestable Requestable, header http.Header) (*Result, error) {
+	if df.err != nil {
+		return nil, df.err
+	}
+
+	select {
+	case <-time.After(df.delay):
+		return &Result{Body: []byte(df.body)}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+type delayedRequestable struct {
+	*fakeRequestable
+	fetcher *delayedFetcher
+}
+
+func (dr *delayedRequestable) Fetcher() FragmentFetcher { return dr.fetcher }
+
+func TestRequestDoStreamSendsResultsInCompletionOrder(t *testing.T) {
+	r := newRequest()
+	r.WithRequestable(&delayedRequestable{newFakeRequestable("http://localhost:9990?fragment=layout"), &delayedFetcher{delay: 100 * time.Millisecond, body: "layout"}})
+	r.WithRequestable(&delayedRequestable{newFakeRequestable("http://localhost:9990?fragment=header"), &delayedFetcher{body: "header"}})
+	r.WithRequestable(&delayedRequestable{newFakeRequestable("http://localhost:9990?fragment=footer"), &delayedFetcher{body: "footer"}})
+
+	results, errs := r.DoStream(context.Background())
+
+	bodies := make([]string, 3)
+	order := make([]int, 0, 3)
+	for result := range results {
+		bodies[result.Index] = string(result.Body)
+		order = append(order, result.Index)
+	}
+
+	require.NoError(t, <-errs)
+	require.Equal(t, []string{"layout", "header", "footer"}, bodies)
+	require.ElementsMatch(t, []int{1, 2}, order[:2])
+	require.Equal(t, 0, order[2])
+}
+
+func TestRequestDoStreamStopsOnError(t *testing.T) {
+	fetchErr := errors.New("fetch failed")
+
+	r := newRequest()
+	r.WithRequestable(&delayedRequestable{newFakeRequestable("http://localhost:9990?fragment=layout"), &delayedFetcher{delay: time.Second, body: "layout"}})
+	r.WithRequestable(&delayedRequestable{newFakeRequestable("http://localhost:9990?fragment=header"), &delayedFetcher{err: fetchErr}})
+
+	start := time.Now()
+	results, errs := r.DoStream(context.Background())
+
+	for range results {
+		require.Fail(t, "expected no results")
+	}
+
+	require.ErrorIs(t, <-errs, fetchErr)
+	require.Less(t, time.Since(start), time.Second)
+
+	_, ok := <-errs
+	require.False(t, ok)
+}
+
+// concurrencyFetcher records the maximum number of concurrent fetches
+type concurrencyFetcher struct {
+	delay    time.Duration
+	mu       sync.Mutex
+	inFlight int
+	max      int
+}
+
+func (cf *concurrencyFetcher) Fetch(ctx context.Context, requestable Requestable, header http.Header) (*Result, error) {
+	cf.mu.Lock()
+	cf.inFlight++
+	if cf.inFlight > cf.max {
+		cf.max = cf.inFlight
+	}
+	cf.mu.Unlock()
+
+	defer func() {
+		cf.mu.Lock()
+		cf.inFlight--
+		cf.mu.Unlock()
+	}()
+
+	select {
+	case <-time.After(cf.delay):
+		return &Result{Body: []byte(requestable.URL())}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+type concurrencyRequestable struct {
+	*fakeRequestable
+	fetcher *concurrencyFetcher
+}
+
+func (cr *concurrencyRequestable) Fetcher() FragmentFetcher { return cr.fetcher }
+
+func TestMaxConcurrency(t *testing.T) {
+	fetcher := &concurrencyFetcher{delay: 20 * time.Millisecond}
+
+	r := newRequest()
+	r.MaxConcurrency = 2
+	for i := 0; i < 6; i++ {
+		r.WithRequestable(&concurrencyRequestable{newFakeRequestable(fmt.Sprintf("http://localhost:9990?fragment=%d", i)), fetcher})
+	}
+
+	results, err := r.Do(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, 2, fetcher.max)
+
+	for i, result := range results {
+		require.Equal(t, fmt.Sprintf("http://localhost:9990?fragment=%d", i), string(result.Body))
+	}
+}
+
+func TestMaxConcurrencyQueuedWorkRespectsTimeout(t *testing.T) {
+	fetcher := &concurrencyFetcher{delay: 200 * time.Millisecond}
+
+	r := newRequest()
+	r.MaxConcurrency = 1
+	r.Timeout = 300 * time.Millisecond
+	r.WithRequestable(&concurrencyRequestable{newFakeRequestable("http://localhost:9990?fragment=header"), fetcher})
+	r.WithRequestable(&concurrencyRequestable{newFakeRequestable("http://localhost:9990?fragment=footer"), fetcher})
+
+	_, err := r.Do(context.Background())
+
+	var timeoutErr *TimeoutError
+	require.ErrorAs(t, err, &timeoutErr)
+}
+
+// activeTripper counts the requests that have not returned yet
+type activeTripper struct {
+	active  int32
+	tripper Tripper
+}
+
+func (at *activeTripper) Request(r *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&at.active, 1)
+	defer atomic.AddInt32(&at.active, -1)
+
+	return at.tripper.Request(r)
+}
+
+func TestRequestDoCancelsSiblingsOnFailure(t *testing.T) {
+	var received int32
+	canceled := make(chan struct{}, 1)
+	// The failure waits for the slow fragment to arrive, so it's in flight
+	// when it's canceled
+	slowArrived := make(chan struct{})
+	var slowOnce sync.Once
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&received, 1)
+
+		switch r.URL.Path {
+		case "/fail":
+			<-slowArrived
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/slow":
+			slowOnce.Do(func() { close(slowArrived) })
+			select {
+			case <-r.Context().Done():
+				canceled <- struct{}{}
+			case <-time.After(5 * time.Second):
+			}
+		default:
+			w.Write([]byte(r.URL.Path))
+		}
+	}))
+	defer target.Close()
+
+	tripper := &activeTripper{tripper: NewStandardTripper(&http.Client{})}
+	r := newRequest()
+	r.Tripper = tripper
+	// The slow fragment holds one slot, the rest are fetched one at a time
+	r.MaxConcurrency = 2
+	for _, path := range []string{"/slow", "/fail", "/header", "/body", "/footer"} {
+		r.WithRequestable(newFakeRequestable(target.URL + path))
+	}
+
+	start := time.Now()
+	_, err := r.Do(context.Background())
+
+	var resultErr *ResultError
+	require.ErrorAs(t, err, &resultErr)
+	require.Equal(t, 500, resultErr.Result.StatusCode)
+	require.Less(t, time.Since(start), time.Second)
+
+	// Every fetch has returned by the time Do returns
+	require.Zero(t, atomic.LoadInt32(&tripper.active))
+
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		require.Fail(t, "expected the slow fragment request to be canceled")
+	}
+
+	// Queued fragments are not requested after the failure
+	receivedOnReturn := atomic.LoadInt32(&received)
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, receivedOnReturn, atomic.LoadInt32(&received))
+}
+
+// barrierTripper responds with the status of the requested path once every
+// request has arrived, so the requests fail at the same time.
+type barrierTripper struct {
+	arrived  sync.WaitGroup
+	statuses map[string]int
+}
+
+func (bt *barrierTripper) Request(r *http.Request) (*http.Response, error) {
+	bt.arrived.Done()
+	bt.arrived.Wait()
+
+	return &http.Response{
+		StatusCode: bt.statuses[r.URL.Path],
+		Header:     http.Header{},
+		Body:       io.NopCloser(strings.NewReader("")),
+		Request:    r,
+	}, nil
+}
+
+func TestRequestDoReportsSimultaneousFailuresInOrder(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		tripper := &barrierTripper{statuses: map[string]int{"/missing": 404, "/broken": 500}}
+		tripper.arrived.Add(2)
+
+		r := newRequest()
+		r.Tripper = tripper
+		r.WithRequestable(newFakeRequestable("http://localhost:9999/missing"))
+		r.WithRequestable(newFakeRequestable("http://localhost:9999/broken"))
+
+		_, err := r.Do(context.Background())
+
+		var multiErr *MultiError
+		require.ErrorAs(t, err, &multiErr)
+		require.Len(t, multiErr.Errors, 2)
+		require.Equal(t, multiErr.Errors, Errors(err))
+
+		var resultErr *ResultError
+		require.ErrorAs(t, err, &resultErr)
+		require.Equal(t, 404, resultErr.Result.StatusCode)
+
+		require.ErrorAs(t, multiErr.Errors[1], &resultErr)
+		require.Equal(t, 500, resultErr.Result.StatusCode)
+	}
+}
+
+func TestAggregateErrors(t *testing.T) {
+	first := errors.New("first")
+	second := errors.New("second")
+	dependencyErr := &DependencyError{}
+
+	require.Nil(t, aggregateErrors(nil))
+	require.Equal(t, first, aggregateErrors([]indexedError{{index: 1, err: first}, {index: 2, err: dependencyErr}}))
+	require.Equal(t, dependencyErr, aggregateErrors([]indexedError{{index: 2, err: dependencyErr}}))
+
+	err := aggregateErrors([]indexedError{{index: 3, err: second}, {index: -1, err: first}})
+	require.Equal(t, &MultiError{Errors: []error{first, second}}, err)
+	require.Equal(t, "2 requestables failed: first; second", err.Error())
+	require.ErrorIs(t, err, second)
+}
+
+func BenchmarkRequestDo(b *testing.B) {
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		r := newRequest()
+		for j := 0; j < 10; j++ {
+			r.WithRequestable(&stubRequestable{newFakeRequestable("http://localhost:9990?fragment=header")})
+		}
+
+		if _, err := r.Do(context.Background()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReadBody(b *testing.B) {
+	body := bytes.Repeat([]byte("<div>fragment</div>"), 4096)
+
+	b.Run("ReadAll", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := io.ReadAll(bytes.NewReader(body)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("Pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			buf, err := readBodyBuffer(bytes.NewReader(body), 0, int64(len(body)), "")
+			if err != nil {
+				b.Fatal(err)
+			}
+			copyBuffer(buf)
+			putBodyBuffer(buf)
+		}
+	})
+}
+
+// BenchmarkRequestDoLargeFragments fetches a 10 fragment route where each
+// fragment is ~75KB.
+func BenchmarkRequestDoLargeFragments(b *testing.B) {
+	body := bytes.Repeat([]byte("<div>fragment</div>"), 4096)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		r := newRequest()
+		for j := 0; j < 10; j++ {
+			r.WithRequestable(newFakeRequestable(fmt.Sprintf("%s/fragment/%d", server.URL, j)))
+		}
+
+		if _, err := r.Do(context.Background()); err != nil {
+			b.Fatal(err)
+		}
+	}
 }
@@ -0,0 +1,105 @@
+package multiplexer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+// OutboundBytesExceededError is returned when the bytes sent to backends
+// exceed the configured limit.
+type OutboundBytesExceededError struct {
+	Limit int64
+	Total int64
+}
+
+func (e *OutboundBytesExceededError) Error() string {
+	return fmt.Sprintf("outbound bytes exceeded limit: %d of %d bytes", e.Total, e.Limit)
+}
+
+// OutboundBytes tracks the total number of bytes, request headers and bodies,
+// sent to backends while handling a request.
+type OutboundBytes struct {
+	total int64
+	// The maximum number of bytes that can be sent to backends. No limit is
+	// enforced when 0.
+	Limit int64
+}
+
+// NewOutboundBytes returns a new OutboundBytes with the given limit.
+func NewOutboundBytes(limit int64) *OutboundBytes {
+	return &OutboundBytes{Limit: limit}
+}
+
+// Total returns the number of bytes sent to backends so far.
+func (o *OutboundBytes) Total() int64 {
+	return atomic.LoadInt64(&o.total)
+}
+
+// add records n outbound bytes, returning an OutboundBytesExceededError if the
+// limit has been exceeded.
+func (o *OutboundBytes) add(n int64) error {
+	total := atomic.AddInt64(&o.total, n)
+
+	if o.Limit > 0 && total > o.Limit {
+		return &OutboundBytesExceededError{Limit: o.Limit, Total: total}
+	}
+
+	return nil
+}
+
+type outboundBytesContextKey struct{}
+
+// ContextWithOutboundBytes returns a context that accounts for bytes sent to
+// backends using outbound.
+func ContextWithOutboundBytes(ctx context.Context, outbound *OutboundBytes) context.Context {
+	return context.WithValue(ctx, outboundBytesContextKey{}, outbound)
+}
+
+// OutboundBytesFromContext returns the OutboundBytes for the current request,
+// or nil if outbound bytes are not being accounted for.
+func OutboundBytesFromContext(ctx context.Context) *OutboundBytes {
+	if ctx == nil {
+		return nil
+	}
+
+	if outbound := ctx.Value(outboundBytesContextKey{}); outbound != nil {
+		return outbound.(*OutboundBytes)
+	}
+	return nil
+}
+
+// headerSize returns the number of bytes the header takes on the wire, e.g.
+// `Name: value\r\n` for each value.
+func headerSize(header http.Header) int64 {
+	var size int64
+
+	for name, values := range header {
+		for _, value := range values {
+			size += int64(len(name) + len(value) + 4)
+		}
+	}
+
+	return size
+}
+
+// countingReader accounts for each byte read from the request body as it's
+// sent to the backend.
+type countingReader struct {
+	io.ReadCloser
+	outbound *OutboundBytes
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(p)
+
+	if n > 0 {
+		if limitErr := cr.outbound.add(int64(n)); limitErr != nil {
+			return n, limitErr
+		}
+	}
+
+	return n, err
+}
@@ -0,0 +1,48 @@
+package multiplexer
+
+import (
+	"context"
+	"time"
+
+	"github.com/blakewilliams/viewproxy/pkg/notifier"
+)
+
+// PhaseTimings records when each phase of handling a request completed, which
+// can be used to find time spent between fragments completing and the response
+// being written. Phases that did not run are zero.
+type PhaseTimings struct {
+	// When every fragment request completed
+	FetchesDone time.Time
+	// When Request.Do returned
+	DoReturned time.Time
+	// When stitching the fragments together started
+	StitchStarted time.Time
+}
+
+type phaseTimingsContextKey struct{}
+
+func init() {
+	notifier.RegisterSnapshot(phaseTimingsContextKey{}, func(value interface{}) interface{} {
+		phases := *value.(*PhaseTimings)
+		return &phases
+	})
+}
+
+// ContextWithPhaseTimings returns a context that records the phases of the
+// request in phases.
+func ContextWithPhaseTimings(ctx context.Context, phases *PhaseTimings) context.Context {
+	return context.WithValue(ctx, phaseTimingsContextKey{}, phases)
+}
+
+// PhaseTimingsFromContext returns the PhaseTimings for the current request,
+// or nil if phases are not being recorded.
+func PhaseTimingsFromContext(ctx context.Context) *PhaseTimings {
+	if ctx == nil {
+		return nil
+	}
+
+	if phases := ctx.Value(phaseTimingsContextKey{}); phases != nil {
+		return phases.(*PhaseTimings)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package multiplexer
+
+import (
+	"container/list"
+	"net/http"
+)
+
+const defaultMaxPopularKeys = 1000
+
+// PopularKey identifies a shared requestable that was fetched recently, so it
+// can be fetched again to warm a SharedCache, e.g. after a deploy.
+type PopularKey struct {
+	URL string `json:"url"`
+	// The headers the requestable is shared by and their values
+	Header http.Header `json:"header,omitempty"`
+}
+
+// userIdentifyingHeaders are never recorded as part of a PopularKey, so keys
+// that vary by them are excluded.
+var userIdentifyingHeaders = map[string]bool{
+	"Authorization":       true,
+	"Cookie":              true,
+	"Proxy-Authorization": true,
+	"X-Csrf-Token":        true,
+	"X-Forwarded-For":     true,
+	"X-Real-Ip":           true,
+}
+
+// popularKeyFor returns the PopularKey of a shared requestable, and false when
+// it can't be shared or is shared by user identifying headers.
+func popularKeyFor(requestable Requestable, headers http.Header) (PopularKey, bool) {
+	sr, ok := requestable.(SharedRequestable)
+	if !ok {
+		return PopularKey{}, false
+	}
+
+	shared, headerKeys := sr.Shared()
+	if !shared {
+		return PopularKey{}, false
+	}
+
+	key := PopularKey{URL: requestable.URL()}
+	if len(headerKeys) == 0 {
+		return key, true
+	}
+
+	key.Header = make(http.Header, len(headerKeys))
+	for _, headerKey := range headerKeys {
+		headerKey = http.CanonicalHeaderKey(headerKey)
+		if userIdentifyingHeaders[headerKey] {
+			return PopularKey{}, false
+		}
+
+		key.Header[headerKey] = headers.Values(headerKey)
+	}
+
+	return key, true
+}
+
+// popularKeys is a least recently used list of popular keys, most recently used
+// first. It's not safe for concurrent use.
+type popularKeys struct {
+	max      int
+	order    *list.List
+	elements map[string]*list.Element
+}
+
+type popularKeyEntry struct {
+	cacheKey string
+	key      PopularKey
+}
+
+func newPopularKeys(max int) *popularKeys {
+	return &popularKeys{
+		max:      max,
+		order:    list.New(),
+		elements: make(map[string]*list.Element),
+	}
+}
+
+func (pk *popularKeys) touch(cacheKey string, key PopularKey) {
+	if element, ok := pk.elements[cacheKey]; ok {
+		pk.order.MoveToFront(element)
+		return
+	}
+
+	pk.elements[cacheKey] = pk.order.PushFront(&popularKeyEntry{cacheKey: cacheKey, key: key})
+
+	if pk.order.Len() > pk.max {
+		oldest := pk.order.Back()
+		pk.order.Remove(oldest)
+		delete(pk.elements, oldest.Value.(*popularKeyEntry).cacheKey)
+	}
+}
+
+func (pk *popularKeys) keys() []PopularKey {
+	keys := make([]PopularKey, 0, pk.order.Len())
+	for element := pk.order.Front(); element != nil; element = element.Next() {
+		keys = append(keys, element.Value.(*popularKeyEntry).key)
+	}
+
+	return keys
+}
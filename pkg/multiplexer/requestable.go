@@ -1,6 +1,10 @@
 package multiplexer
 
-import "context"
+import (
+	"context"
+	"io"
+	"net/http"
+)
 
 type RequestableContextKey struct{}
 
@@ -10,6 +14,173 @@ type Requestable interface {
 	Metadata() map[string]string
 }
 
+// FragmentFetcher fetches the content of a requestable from a source other than
+// HTTP, such as a gRPC service or a local template engine.
+type FragmentFetcher interface {
+	Fetch(ctx context.Context, requestable Requestable, header http.Header) (*Result, error)
+}
+
+// FetcherRequestable is implemented by requestables that can provide their own
+// FragmentFetcher. When Fetcher returns nil the requestable is fetched via the
+// Tripper.
+type FetcherRequestable interface {
+	Requestable
+	Fetcher() FragmentFetcher
+}
+
+// KeyedRequestable is implemented by requestables that know the key of the
+// fragment they fetch, e.g. `root.layout.header`. The key is used to identify
+// the fragment in errors.
+type KeyedRequestable interface {
+	Requestable
+	Key() string
+}
+
+func keyFor(requestable Requestable) string {
+	if kr, ok := requestable.(KeyedRequestable); ok {
+		return kr.Key()
+	}
+
+	return ""
+}
+
+// TypedMetadataRequestable is implemented by requestables with metadata values
+// that may not be strings.
+type TypedMetadataRequestable interface {
+	Requestable
+	TypedMetadata() map[string]interface{}
+}
+
+// TypedMetadataFor returns the typed metadata of the requestable, falling back
+// to its string metadata.
+func TypedMetadataFor(requestable Requestable) map[string]interface{} {
+	if tr, ok := requestable.(TypedMetadataRequestable); ok {
+		return tr.TypedMetadata()
+	}
+
+	metadata := make(map[string]interface{}, len(requestable.Metadata()))
+	for key, value := range requestable.Metadata() {
+		metadata[key] = value
+	}
+
+	return metadata
+}
+
+// TimingLabelRequestable is implemented by requestables that report their
+// timing in the Server-Timing header.
+type TimingLabelRequestable interface {
+	Requestable
+	TimingLabel() string
+}
+
+func timingLabelFor(requestable Requestable) string {
+	if tr, ok := requestable.(TimingLabelRequestable); ok {
+		return tr.TimingLabel()
+	}
+
+	return ""
+}
+
+// MethodRequestable is implemented by requestables that aren't fetched with a
+// GET request. NewBody is called for each request made for the requestable,
+// e.g. when it fails over, and returns a reader for the request body or nil
+// when the request has no body. Requestables with a method other than GET
+// are never retried, hedged, coalesced, or shared.
+type MethodRequestable interface {
+	Requestable
+	Method() string
+	NewBody() io.ReadCloser
+}
+
+// methodFor returns the method of the requestable, GET by default.
+func methodFor(requestable Requestable) string {
+	if mr, ok := requestable.(MethodRequestable); ok && mr.Method() != "" {
+		return mr.Method()
+	}
+
+	return http.MethodGet
+}
+
+// bodyFor returns a new reader for the body of the requestable, or nil when it
+// has no body.
+func bodyFor(requestable Requestable) io.ReadCloser {
+	if mr, ok := requestable.(MethodRequestable); ok {
+		return mr.NewBody()
+	}
+
+	return nil
+}
+
+// HeaderRequestable is implemented by requestables that send their own headers
+// in addition to the request's Header.
+type HeaderRequestable interface {
+	Requestable
+	Headers() http.Header
+}
+
+// withRequestableHeaders returns the headers with the requestable's own headers
+// set, replacing headers of the same name. The given headers aren't modified.
+func withRequestableHeaders(headers http.Header, requestable Requestable) http.Header {
+	hr, ok := requestable.(HeaderRequestable)
+	if !ok || len(hr.Headers()) == 0 {
+		return headers
+	}
+
+	merged := make(http.Header, len(headers)+len(hr.Headers()))
+	for name, values := range headers {
+		merged[name] = values
+	}
+	for name, values := range hr.Headers() {
+		merged[http.CanonicalHeaderKey(name)] = append([]string(nil), values...)
+	}
+
+	return merged
+}
+
+// PriorityRequestable is implemented by requestables with a fetch priority.
+// Requestables are fetched in ascending priority order, and requestables with
+// a priority greater than 0 are optional and can be skipped once the
+// request's OptionalBudget is consumed.
+type PriorityRequestable interface {
+	Requestable
+	Priority() int
+}
+
+func priorityFor(requestable Requestable) int {
+	if pr, ok := requestable.(PriorityRequestable); ok {
+		return pr.Priority()
+	}
+
+	return 0
+}
+
+// AllowedStatusRequestable is implemented by requestables that accept some
+// non-2xx status codes, e.g. a 404 from an optional fragment. Results with an
+// allowed status code are returned even when the request's Non2xxErrors is set.
+type AllowedStatusRequestable interface {
+	Requestable
+	AllowedStatusCodes() []int
+}
+
+// isErrorStatus returns true when a result with the given status code should
+// be returned as a ResultError. 304 Not Modified responses to conditional
+// requests are never errors.
+func (r *Request) isErrorStatus(requestable Requestable, statusCode int) bool {
+	if !r.Non2xxErrors || (statusCode >= 200 && statusCode <= 299) || statusCode == http.StatusNotModified {
+		return false
+	}
+
+	if ar, ok := requestable.(AllowedStatusRequestable); ok {
+		for _, allowed := range ar.AllowedStatusCodes() {
+			if statusCode == allowed {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
 func RequestableFromContext(ctx context.Context) Requestable {
 	if ctx == nil {
 		return nil
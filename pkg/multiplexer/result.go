@@ -5,23 +5,78 @@ import (
 	"fmt"
 	"net/http"
 	"time"
+	"unicode/utf8"
 )
 
 type ResultError struct {
 	Result *Result
+	// The fragment key of the requestable that returned the result, if any
+	Key string
+	// The start of the response body, at most the request's
+	// ErrorSnippetSize bytes without splitting a UTF-8 character, with the
+	// secrets of the SecretFilter filtered. Unlike the result's body, it's
+	// safe to retain.
+	BodySnippet []byte
+	// The response headers listed in ErrorHeaders
+	Header http.Header
 	msg    string
 }
 
+// DefaultErrorSnippetSize is the default size of ResultError.BodySnippet
+const DefaultErrorSnippetSize = 1024
+
+// ErrorHeaders are the response headers of failed requestables that are
+// kept in ResultError.Header.
+var ErrorHeaders []string = []string{
+	"Content-Type",
+	"Retry-After",
+	"X-Request-Id",
+}
+
 type Results interface {
 	Error() error
 	Results() []*Result
 }
 
-func newResultError(errURL string, req *Request, res *Result) *ResultError {
-	safeUrl := req.SecretFilter.FilterURLStringThrough(res.Url, errURL)
+func newResultError(requestable Requestable, req *Request, res *Result) *ResultError {
+	safeUrl := req.SecretFilter.FilterURLStringThrough(res.Url, requestable.TemplateURL())
 	msg := fmt.Sprintf("status: %d url: %s", res.StatusCode, safeUrl)
 
-	return &ResultError{Result: res, msg: msg}
+	resultErr := &ResultError{Result: res, Key: keyFor(requestable), Header: make(http.Header), msg: msg}
+
+	snippet := res.Body
+	if req.SecretFilter != nil {
+		snippet = req.SecretFilter.FilterSecrets(snippet)
+	}
+	resultErr.BodySnippet = truncateUTF8(snippet, req.ErrorSnippetSize)
+
+	for _, name := range ErrorHeaders {
+		for _, value := range res.Header().Values(name) {
+			if req.SecretFilter != nil {
+				value = string(req.SecretFilter.FilterSecrets([]byte(value)))
+			}
+			resultErr.Header.Add(name, value)
+		}
+	}
+
+	return resultErr
+}
+
+// truncateUTF8 returns a copy of at most size bytes of content, without
+// splitting a UTF-8 encoded character.
+func truncateUTF8(content []byte, size int) []byte {
+	if size <= 0 {
+		return nil
+	}
+
+	if len(content) > size {
+		for size > 0 && !utf8.RuneStart(content[size]) {
+			size--
+		}
+		content = content[:size]
+	}
+
+	return append([]byte(nil), content...)
 }
 
 func (re *ResultError) Error() string {
@@ -29,14 +84,85 @@ func (re *ResultError) Error() string {
 }
 
 type Result struct {
-	Url          string
+	Url string
+	// The time taken by the attempt that produced the result. Results served
+	// from the SharedCache report the time spent waiting on the cache. This is
+	// the duration reported in the Server-Timing header.
 	Duration     time.Duration
 	HttpResponse *http.Response
-	Body         []byte
-	StatusCode   int
+	// The response body. It's owned by the result and safe to retain, unless
+	// the request's PooledBodies is set.
+	Body []byte
+	// The gzipped response body as it was received, when the response was
+	// gzipped and Request.KeepCompressedBody is set. Body is always the
+	// decompressed body.
+	CompressedBody []byte
+	StatusCode     int
+	// The number of attempts made to fetch the result
+	Attempts int
+	// The time taken across every attempt, including the backoff between
+	// retries
+	TotalDuration time.Duration
+	// FromCache is true when the result was served by the SharedCache, either
+	// from a cached entry or by waiting on another request fetching it
+	FromCache bool
+	// Hedged is true when a hedged request was made because the first
+	// request was slow, and HedgeWon is true when the result is the response
+	// to the hedged request
+	Hedged   bool
+	HedgeWon bool
+	// The breakdown of Duration and the time spent reading the body. Only set
+	// for results fetched over HTTP when the request's DetailedTiming is true.
+	Timing *ResultTiming
+	// The hosts of the replicas that failed with a transport error before the
+	// result was fetched from another replica, see Request.Failover
+	FailedOver []string
+	// The headers of each 103 Early Hints response received before the final
+	// response, e.g. Link headers to preload
+	EarlyHints []http.Header
+	// The trailers sent after the response body, or nil when the response
+	// had none
+	Trailer http.Header
+	// The label used to report the result in the Server-Timing header
+	TimingLabel string
+	// Skipped is true when the requestable was optional and was canceled
+	// because the request's OptionalBudget was consumed
+	Skipped bool
+	// The index of the requestable the result belongs to, in the order
+	// requestables were added to the request
+	Index int
+	// Coalesced is true when the result was fetched for another, identical
+	// requestable in the same request and shared with this one
+	Coalesced bool
+	// The pooled buffer holding Body, when fetched with PooledBodies
+	pooled *pooledBody
 }
 
+// Release returns the buffer holding Body to the pool when the result was
+// fetched with Request.PooledBodies, and is a no-op otherwise. Body must not
+// be used once the result is released. Results sharing a body, e.g. coalesced
+// results, only release it once.
+func (r *Result) Release() {
+	if r == nil || r.pooled == nil {
+		return
+	}
+
+	r.pooled.release()
+}
+
+// NotModified returns true when the fragment responded to a conditional
+// request with 304 Not Modified, so the result has no body.
+func (r *Result) NotModified() bool {
+	return r.StatusCode == http.StatusNotModified
+}
+
+// Header returns the response headers of the result. Results that were not
+// fetched over HTTP have no headers.
 func (r *Result) Header() http.Header {
+	if r.HttpResponse == nil {
+		return http.Header{}
+	}
+
 	return r.HttpResponse.Header
 }
 
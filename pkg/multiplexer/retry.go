@@ -0,0 +1,116 @@
+package multiplexer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy configures how many times a requestable is attempted when it
+// fails with a transient error.
+type RetryPolicy struct {
+	// The maximum number of attempts, including the first. Values less than 2
+	// disable retries.
+	Attempts int
+	// The duration to wait between attempts
+	Backoff time.Duration
+}
+
+// RetryRequestable is implemented by requestables that can be retried when a
+// request fails with a connection error or a 502, 503, or 504 status code.
+type RetryRequestable interface {
+	Requestable
+	RetryPolicy() RetryPolicy
+}
+
+// ParseRetryAfter parses the value of a Retry-After header, which is either a
+// number of seconds or an HTTP date, into the duration to wait from now.
+func ParseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		if wait := date.Sub(now); wait > 0 {
+			return wait, true
+		}
+		return 0, true
+	}
+
+	return 0, false
+}
+
+type attemptContextKey struct{}
+
+// AttemptFromContext returns the attempt number of the current request,
+// starting at 1. It can be used by a Tripper to observe retries.
+func AttemptFromContext(ctx context.Context) int {
+	if ctx == nil {
+		return 0
+	}
+
+	if attempt := ctx.Value(attemptContextKey{}); attempt != nil {
+		return attempt.(int)
+	}
+	return 0
+}
+
+func retryPolicyFor(requestable Requestable) RetryPolicy {
+	if rr, ok := requestable.(RetryRequestable); ok {
+		return rr.RetryPolicy()
+	}
+
+	return RetryPolicy{}
+}
+
+func shouldRetry(ctx context.Context, result *Result, err error) bool {
+	// The request timed out or was canceled
+	if ctx.Err() != nil {
+		return false
+	}
+
+	if err != nil {
+		return isConnectionError(err)
+	}
+
+	switch result.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// isConnectionError returns true when err was caused by the connection to the
+// target, e.g. a refused or reset connection or a response that was cut
+// short. Other errors, like TLS failures, invalid URLs, or the errors of a
+// FragmentFetcher, fail the same way when retried.
+func isConnectionError(err error) bool {
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	// url.Error implements net.Error for every error returned by the client,
+	// so only the error it wraps is checked
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
@@ -0,0 +1,159 @@
+package multiplexer
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/blakewilliams/viewproxy/pkg/servertiming"
+)
+
+// ServerTimingLimits bounds the work done combining the Server-Timing headers
+// returned by fragments, and counts the metrics that were dropped. Limits are
+// disabled when 0.
+type ServerTimingLimits struct {
+	// Accessed atomically, kept first for 64-bit alignment
+	droppedMetrics int64
+	skippedHeaders int64
+
+	// Fragment Server-Timing headers longer than this are not parsed
+	MaxHeaderBytes int
+	// The maximum number of metrics parsed from each fragment
+	MaxMetricsPerResult int
+	// The maximum number of metrics in the combined header, including the
+	// fetch duration of each fragment
+	MaxMetrics int
+}
+
+// ServerTimingStats contains the number of fragment metrics dropped due to
+// ServerTimingLimits.
+type ServerTimingStats struct {
+	// Metrics dropped because a limit on the number of metrics was reached
+	DroppedMetrics int64
+	// Headers that were not parsed because they exceeded MaxHeaderBytes
+	SkippedHeaders int64
+}
+
+// DefaultServerTimingLimits are the limits used by
+// WithCombinedServerTimingHeader.
+var DefaultServerTimingLimits = NewServerTimingLimits()
+
+// NewServerTimingLimits returns limits that allow typical fragment metrics
+// while keeping the combined header to a reasonable size.
+func NewServerTimingLimits() *ServerTimingLimits {
+	return &ServerTimingLimits{
+		MaxHeaderBytes:      4096,
+		MaxMetricsPerResult: 20,
+		MaxMetrics:          100,
+	}
+}
+
+// Stats returns the number of metrics dropped since the limits were created.
+func (l *ServerTimingLimits) Stats() ServerTimingStats {
+	return ServerTimingStats{
+		DroppedMetrics: atomic.LoadInt64(&l.droppedMetrics),
+		SkippedHeaders: atomic.LoadInt64(&l.skippedHeaders),
+	}
+}
+
+// WithCombinedServerTimingHeader sets the Server-Timing header of the response
+// using the results of fragments with a timing label. Each fragment's
+// Result.Duration is reported using its label, and the Server-Timing metrics returned
+// by the fragment are reported prefixed with its label, e.g. `header-db`.
+// Results with a Timing also report its phases, e.g. `header-ttfb`.
+//
+// The metrics parsed from fragments are bounded by DefaultServerTimingLimits.
+func WithCombinedServerTimingHeader(next http.Handler) http.Handler {
+	return DefaultServerTimingLimits.WithCombinedServerTimingHeader(next)
+}
+
+// WithCombinedServerTimingHeader is like the package level
+// WithCombinedServerTimingHeader, using these limits.
+func (l *ServerTimingLimits) WithCombinedServerTimingHeader(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		results := ResultsFromContext(r.Context())
+
+		if results != nil {
+			metrics := l.metricsForResults(results.Results())
+
+			if len(metrics) > 0 {
+				rw.Header().Set("Server-Timing", servertiming.FormatHeader(metrics))
+			}
+		}
+
+		next.ServeHTTP(rw, r)
+	})
+}
+
+func (l *ServerTimingLimits) metricsForResults(results []*Result) []servertiming.Metric {
+	metrics := make([]servertiming.Metric, 0)
+	var dropped, skipped int64
+
+	for _, result := range results {
+		// Coalesced results were already reported by the result they share
+		if result == nil || result.TimingLabel == "" || result.Coalesced {
+			continue
+		}
+
+		metrics = append(metrics, servertiming.Metric{Name: result.TimingLabel, Duration: result.Duration})
+		metrics = append(metrics, detailedTimingMetrics(result)...)
+
+		header := result.Header().Get("Server-Timing")
+		if l.MaxHeaderBytes > 0 && len(header) > l.MaxHeaderBytes {
+			skipped++
+			continue
+		}
+
+		fragmentMetrics, fragmentDropped := servertiming.ParseHeaderLimit(header, l.MaxMetricsPerResult)
+		dropped += int64(fragmentDropped)
+
+		for _, metric := range fragmentMetrics {
+			metric.Name = result.TimingLabel + "-" + metric.Name
+			metrics = append(metrics, metric)
+		}
+	}
+
+	if l.MaxMetrics > 0 && len(metrics) > l.MaxMetrics {
+		dropped += int64(len(metrics) - l.MaxMetrics)
+		metrics = metrics[:l.MaxMetrics]
+	}
+
+	if dropped > 0 {
+		atomic.AddInt64(&l.droppedMetrics, dropped)
+	}
+	if skipped > 0 {
+		atomic.AddInt64(&l.skippedHeaders, skipped)
+	}
+
+	return metrics
+}
+
+// detailedTimingMetrics returns metrics for the phases of the result's Timing,
+// prefixed with its label. Connection phases are omitted when they didn't
+// happen, e.g. because the connection was reused.
+func detailedTimingMetrics(result *Result) []servertiming.Metric {
+	timing := result.Timing
+	if timing == nil {
+		return nil
+	}
+
+	metrics := make([]servertiming.Metric, 0, 5)
+	for _, phase := range []struct {
+		name     string
+		duration time.Duration
+	}{
+		{"dns", timing.DNS},
+		{"connect", timing.Connect},
+		{"tls", timing.TLS},
+	} {
+		if phase.duration > 0 {
+			metrics = append(metrics, servertiming.Metric{Name: result.TimingLabel + "-" + phase.name, Duration: phase.duration})
+		}
+	}
+
+	return append(
+		metrics,
+		servertiming.Metric{Name: result.TimingLabel + "-ttfb", Duration: timing.FirstByte},
+		servertiming.Metric{Name: result.TimingLabel + "-body", Duration: timing.BodyRead},
+	)
+}
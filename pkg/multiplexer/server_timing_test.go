@@ -0,0 +1,143 @@
+package multiplexer
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithCombinedServerTimingHeader(t *testing.T) {
+	header := http.Header{}
+	header.Set("Server-Timing", `db;dur=12;desc="Database", cache`)
+
+	results := []*Result{
+		{TimingLabel: "layout", Duration: 20 * time.Millisecond},
+		{TimingLabel: "header", Duration: 15 * time.Millisecond, HttpResponse: &http.Response{Header: header}},
+		{Duration: 5 * time.Millisecond, HttpResponse: &http.Response{Header: header}},
+		// Reported by the header result it was coalesced with
+		{TimingLabel: "header", Duration: 15 * time.Millisecond, HttpResponse: &http.Response{Header: header}, Coalesced: true},
+	}
+
+	handler := WithCombinedServerTimingHeader(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r = r.WithContext(ContextWithResults(context.Background(), results, nil))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	require.Equal(
+		t,
+		`layout;dur=20, header;dur=15, header-db;desc="Database";dur=12, header-cache`,
+		w.Result().Header.Get("Server-Timing"),
+	)
+}
+
+func TestWithCombinedServerTimingHeader_DetailedTiming(t *testing.T) {
+	results := []*Result{
+		{TimingLabel: "layout", Duration: 20 * time.Millisecond, Timing: &ResultTiming{
+			DNS:       time.Millisecond,
+			Connect:   2 * time.Millisecond,
+			FirstByte: 20 * time.Millisecond,
+			BodyRead:  5 * time.Millisecond,
+		}},
+		{Duration: 5 * time.Millisecond, Timing: &ResultTiming{FirstByte: 5 * time.Millisecond}},
+	}
+
+	handler := WithCombinedServerTimingHeader(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r = r.WithContext(ContextWithResults(context.Background(), results, nil))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	require.Equal(
+		t,
+		"layout;dur=20, layout-dns;dur=1, layout-connect;dur=2, layout-ttfb;dur=20, layout-body;dur=5",
+		w.Result().Header.Get("Server-Timing"),
+	)
+}
+
+func TestWithCombinedServerTimingHeader_NoLabels(t *testing.T) {
+	handler := WithCombinedServerTimingHeader(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r = r.WithContext(ContextWithResults(context.Background(), []*Result{{Duration: time.Millisecond}}, nil))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	require.Empty(t, w.Result().Header.Values("Server-Timing"))
+}
+
+func TestWithCombinedServerTimingHeader_Limits(t *testing.T) {
+	header := http.Header{}
+	header.Set("Server-Timing", "db;dur=1, cache;dur=2, render;dur=3")
+
+	oversized := http.Header{}
+	oversized.Set("Server-Timing", "db;dur=1, "+strings.Repeat("x", 64))
+
+	results := []*Result{
+		{TimingLabel: "layout", Duration: 20 * time.Millisecond, HttpResponse: &http.Response{Header: header}},
+		{TimingLabel: "header", Duration: 15 * time.Millisecond, HttpResponse: &http.Response{Header: oversized}},
+		{TimingLabel: "footer", Duration: 5 * time.Millisecond, HttpResponse: &http.Response{Header: header}},
+	}
+
+	limits := &ServerTimingLimits{MaxHeaderBytes: 64, MaxMetricsPerResult: 2, MaxMetrics: 5}
+	handler := limits.WithCombinedServerTimingHeader(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r = r.WithContext(ContextWithResults(context.Background(), results, nil))
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	require.Equal(
+		t,
+		"layout;dur=20, layout-db;dur=1, layout-cache;dur=2, header;dur=15, footer;dur=5",
+		w.Result().Header.Get("Server-Timing"),
+	)
+	// layout-render, footer-render, and the two footer metrics over MaxMetrics
+	require.Equal(t, ServerTimingStats{DroppedMetrics: 4, SkippedHeaders: 1}, limits.Stats())
+}
+
+func BenchmarkCombinedServerTimingHeader_Pathological(b *testing.B) {
+	entries := make([]string, 0, 1000)
+	for i := 0; i < cap(entries); i++ {
+		entries = append(entries, fmt.Sprintf(`metric%d;desc="Metric %d";dur=%d`, i, i, i))
+	}
+	header := http.Header{}
+	header.Set("Server-Timing", strings.Join(entries, ", "))
+
+	results := make([]*Result, 0, 10)
+	for i := 0; i < cap(results); i++ {
+		results = append(results, &Result{
+			TimingLabel:  fmt.Sprintf("fragment%d", i),
+			Duration:     time.Millisecond,
+			HttpResponse: &http.Response{Header: header},
+		})
+	}
+
+	for _, maxHeaderBytes := range []int{0, DefaultServerTimingLimits.MaxHeaderBytes} {
+		limits := NewServerTimingLimits()
+		limits.MaxHeaderBytes = maxHeaderBytes
+
+		b.Run(fmt.Sprintf("MaxHeaderBytes=%d", maxHeaderBytes), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				limits.metricsForResults(results)
+			}
+		})
+	}
+}
@@ -0,0 +1,210 @@
+package multiplexer
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SharedRequestable is implemented by requestables that can be shared across
+// requests, even for different routes, via a SharedCache.
+type SharedRequestable interface {
+	Requestable
+	// Shared returns true when the requestable can be shared along with the
+	// request headers that affect the response. When no headers are returned
+	// only requests without cookies or authorization are shared.
+	Shared() (bool, []string)
+}
+
+// SharedCacheStats contains counters for a SharedCache.
+type SharedCacheStats struct {
+	Hits   uint64
+	Misses uint64
+}
+
+// SharedCache is a short-lived in-process cache for requestables that are
+// fetched frequently with identical requests, like a layout shared by many
+// routes. Concurrent fetches of the same requestable are coalesced into a
+// single request.
+//
+// SharedCache is not intended to be a general purpose cache, the TTL should be
+// kept short.
+type SharedCache struct {
+	ttl      time.Duration
+	mu       sync.Mutex
+	entries  map[string]*sharedCacheEntry
+	inflight map[string]*sharedCacheCall
+	popular  *popularKeys
+	hits     uint64
+	misses   uint64
+}
+
+type sharedCacheEntry struct {
+	result    *Result
+	expiresAt time.Time
+}
+
+type sharedCacheCall struct {
+	done   chan struct{}
+	result *Result
+	err    error
+}
+
+// NewSharedCache returns a SharedCache that retains results for the given ttl.
+func NewSharedCache(ttl time.Duration) *SharedCache {
+	return &SharedCache{
+		ttl:      ttl,
+		entries:  make(map[string]*sharedCacheEntry),
+		inflight: make(map[string]*sharedCacheCall),
+		popular:  newPopularKeys(defaultMaxPopularKeys),
+	}
+}
+
+// Stats returns the number of hits and misses of the cache.
+func (sc *SharedCache) Stats() SharedCacheStats {
+	return SharedCacheStats{
+		Hits:   atomic.LoadUint64(&sc.hits),
+		Misses: atomic.LoadUint64(&sc.misses),
+	}
+}
+
+// PopularKeys returns the keys of the most recently fetched shared
+// requestables, most recent first. Keys that vary by user identifying headers,
+// like Cookie or Authorization, are excluded.
+func (sc *SharedCache) PopularKeys() []PopularKey {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	return sc.popular.keys()
+}
+
+// touchPopularKey records that the requestable was fetched via the cache.
+func (sc *SharedCache) touchPopularKey(cacheKey string, requestable Requestable, headers http.Header) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if element, ok := sc.popular.elements[cacheKey]; ok {
+		sc.popular.order.MoveToFront(element)
+		return
+	}
+
+	if key, ok := popularKeyFor(requestable, headers); ok {
+		sc.popular.touch(cacheKey, key)
+	}
+}
+
+// fetch returns the cached result for key, or calls fn to fetch it. Only
+// successful results are cached. Requests waiting on another request fetching
+// the same key stop waiting when ctx is done.
+func (sc *SharedCache) fetch(ctx context.Context, key string, fn func() (*Result, error)) (*Result, error) {
+	start := time.Now()
+	sc.mu.Lock()
+
+	if entry, ok := sc.entries[key]; ok {
+		if time.Now().Before(entry.expiresAt) {
+			sc.mu.Unlock()
+			atomic.AddUint64(&sc.hits, 1)
+			return cachedResult(entry.result, start), nil
+		}
+
+		delete(sc.entries, key)
+	}
+
+	if call, ok := sc.inflight[key]; ok {
+		sc.mu.Unlock()
+		atomic.AddUint64(&sc.hits, 1)
+
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		if call.err != nil {
+			return nil, call.err
+		}
+		return cachedResult(call.result, start), nil
+	}
+
+	call := &sharedCacheCall{done: make(chan struct{})}
+	sc.inflight[key] = call
+	sc.mu.Unlock()
+	atomic.AddUint64(&sc.misses, 1)
+
+	call.result, call.err = fn()
+
+	sc.mu.Lock()
+	delete(sc.inflight, key)
+	if call.err == nil {
+		sc.entries[key] = &sharedCacheEntry{result: call.result, expiresAt: time.Now().Add(sc.ttl)}
+	}
+	sc.mu.Unlock()
+	close(call.done)
+
+	if call.err != nil {
+		return nil, call.err
+	}
+	return copyResult(call.result), nil
+}
+
+// sharedCacheKey returns the cache key for a requestable and whether the
+// request can be shared.
+func sharedCacheKey(requestable Requestable, headers http.Header) (string, bool) {
+	sr, ok := requestable.(SharedRequestable)
+	// Conditional requests can be answered with a 304 without a body
+	if !ok || len(dependenciesFor(requestable)) > 0 || methodFor(requestable) != http.MethodGet || isConditional(headers) {
+		return "", false
+	}
+
+	shared, headerKeys := sr.Shared()
+	if !shared {
+		return "", false
+	}
+
+	if len(headerKeys) == 0 {
+		// Without declared headers only anonymous requests are shared
+		if headers.Get("Cookie") != "" || headers.Get("Authorization") != "" {
+			return "", false
+		}
+
+		return requestable.URL(), true
+	}
+
+	sortedKeys := make([]string, len(headerKeys))
+	copy(sortedKeys, headerKeys)
+	sort.Strings(sortedKeys)
+
+	var key strings.Builder
+	key.WriteString(requestable.URL())
+
+	for _, headerKey := range sortedKeys {
+		key.WriteString("\n")
+		key.WriteString(http.CanonicalHeaderKey(headerKey))
+		key.WriteString(":")
+		key.WriteString(strings.Join(headers.Values(headerKey), ","))
+	}
+
+	return key.String(), true
+}
+
+// copyResult returns a shallow copy of a result so that callers sharing a
+// result can't modify each other's fields.
+func copyResult(result *Result) *Result {
+	copied := *result
+	return &copied
+}
+
+// cachedResult returns a copy of a result served by the cache, timed from when
+// the cache was checked.
+func cachedResult(result *Result, start time.Time) *Result {
+	copied := copyResult(result)
+	copied.FromCache = true
+	copied.Duration = time.Since(start)
+	copied.TotalDuration = copied.Duration
+
+	return copied
+}
@@ -0,0 +1,142 @@
+package multiplexer
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type sharedRequestable struct {
+	fakeRequestable
+	headerKeys []string
+}
+
+func (sr *sharedRequestable) Shared() (bool, []string) { return true, sr.headerKeys }
+
+func TestSharedCacheKey(t *testing.T) {
+	anonymous := &sharedRequestable{fakeRequestable: *newFakeRequestable("http://localhost/layout")}
+	byLocale := &sharedRequestable{fakeRequestable: *newFakeRequestable("http://localhost/layout"), headerKeys: []string{"accept-language"}}
+
+	_, ok := sharedCacheKey(newFakeRequestable("http://localhost/layout"), http.Header{})
+	require.False(t, ok)
+
+	key, ok := sharedCacheKey(anonymous, http.Header{})
+	require.True(t, ok)
+	require.Equal(t, "http://localhost/layout", key)
+
+	_, ok = sharedCacheKey(anonymous, http.Header{"Cookie": {"user=1"}})
+	require.False(t, ok)
+
+	_, ok = sharedCacheKey(anonymous, http.Header{"Authorization": {"token"}})
+	require.False(t, ok)
+
+	_, ok = sharedCacheKey(byLocale, http.Header{"Accept-Language": {"en"}, "If-None-Match": {`"abc"`}})
+	require.False(t, ok)
+
+	english, ok := sharedCacheKey(byLocale, http.Header{"Accept-Language": {"en"}, "Cookie": {"user=1"}})
+	require.True(t, ok)
+
+	french, ok := sharedCacheKey(byLocale, http.Header{"Accept-Language": {"fr"}})
+	require.True(t, ok)
+	require.NotEqual(t, english, french)
+}
+
+func TestSharedCacheHitsAreFromCache(t *testing.T) {
+	cache := NewSharedCache(defaultTimeout)
+	fetch := func() (*Result, error) {
+		return &Result{StatusCode: 200, Duration: time.Second, TotalDuration: 2 * time.Second, Attempts: 2}, nil
+	}
+
+	miss, err := cache.fetch(context.Background(), "key", fetch)
+	require.NoError(t, err)
+	require.False(t, miss.FromCache)
+	require.Equal(t, time.Second, miss.Duration)
+	require.Equal(t, 2*time.Second, miss.TotalDuration)
+
+	hit, err := cache.fetch(context.Background(), "key", fetch)
+	require.NoError(t, err)
+	require.True(t, hit.FromCache)
+	require.Less(t, hit.Duration, time.Second)
+	require.Equal(t, hit.Duration, hit.TotalDuration)
+	require.Equal(t, 200, hit.StatusCode)
+}
+
+func TestSharedCacheDoesNotCacheErrors(t *testing.T) {
+	cache := NewSharedCache(defaultTimeout)
+	calls := 0
+
+	for i := 0; i < 2; i++ {
+		_, err := cache.fetch(context.Background(), "key", func() (*Result, error) {
+			calls++
+			return nil, http.ErrHandlerTimeout
+		})
+		require.Error(t, err)
+	}
+
+	require.Equal(t, 2, calls)
+	require.Equal(t, SharedCacheStats{Misses: 2}, cache.Stats())
+}
+
+func TestSharedCachePopularKeys(t *testing.T) {
+	server := startServer(t)
+	defer server.Close()
+
+	cache := NewSharedCache(defaultTimeout)
+	anonymous := &sharedRequestable{fakeRequestable: *newFakeRequestable("http://localhost:9990?fragment=header")}
+	byLocale := &sharedRequestable{fakeRequestable: *newFakeRequestable("http://localhost:9990?fragment=footer"), headerKeys: []string{"accept-language"}}
+	byUser := &sharedRequestable{fakeRequestable: *newFakeRequestable("http://localhost:9990?fragment=body"), headerKeys: []string{"cookie"}}
+
+	r := newRequest()
+	r.SharedCache = cache
+	r.Header.Set("Accept-Language", "en")
+	r.WithRequestable(anonymous)
+	r.WithRequestable(byLocale)
+	r.WithRequestable(byUser)
+
+	_, err := r.Do(context.Background())
+	require.NoError(t, err)
+
+	require.ElementsMatch(t, []PopularKey{
+		{URL: "http://localhost:9990?fragment=header"},
+		{URL: "http://localhost:9990?fragment=footer", Header: http.Header{"Accept-Language": {"en"}}},
+	}, cache.PopularKeys())
+}
+
+func TestPopularKeysEvictsLeastRecentlyUsed(t *testing.T) {
+	keys := newPopularKeys(2)
+	keys.touch("a", PopularKey{URL: "a"})
+	keys.touch("b", PopularKey{URL: "b"})
+	keys.touch("a", PopularKey{URL: "a"})
+	keys.touch("c", PopularKey{URL: "c"})
+
+	require.Equal(t, []PopularKey{{URL: "c"}, {URL: "a"}}, keys.keys())
+}
+
+func TestSharedCacheWaitersObserveCancellation(t *testing.T) {
+	cache := NewSharedCache(defaultTimeout)
+	release := make(chan struct{})
+	defer close(release)
+
+	go cache.fetch(context.Background(), "key", func() (*Result, error) {
+		<-release
+		return &Result{}, nil
+	})
+
+	require.Eventually(t, func() bool {
+		cache.mu.Lock()
+		defer cache.mu.Unlock()
+		return cache.inflight["key"] != nil
+	}, time.Second, time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := cache.fetch(ctx, "key", func() (*Result, error) {
+		require.Fail(t, "expected the in flight fetch to be shared")
+		return nil, nil
+	})
+	require.ErrorIs(t, err, context.Canceled)
+}
@@ -0,0 +1,23 @@
+package multiplexer
+
+import "context"
+
+type syntheticContextKey struct{}
+
+// WithSynthetic returns a context for requests that weren't made on behalf of
+// a user, e.g. background prefetches, so a Tripper can exclude them from logs
+// and analytics via IsSynthetic.
+func WithSynthetic(ctx context.Context) context.Context {
+	return context.WithValue(ctx, syntheticContextKey{}, true)
+}
+
+// IsSynthetic returns true when the request was made with a context returned
+// by WithSynthetic.
+func IsSynthetic(ctx context.Context) bool {
+	if ctx == nil {
+		return false
+	}
+
+	synthetic, _ := ctx.Value(syntheticContextKey{}).(bool)
+	return synthetic
+}
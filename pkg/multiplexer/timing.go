@@ -0,0 +1,100 @@
+package multiplexer
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// ResultTiming breaks down the time taken by the attempt that produced a
+// result. Phases that didn't happen, e.g. DNS and Connect when a connection is
+// reused, are 0.
+type ResultTiming struct {
+	// The time spent resolving the target's host
+	DNS time.Duration
+	// The time spent establishing the TCP connection
+	Connect time.Duration
+	// The time spent on the TLS handshake
+	TLS time.Duration
+	// The time from starting the request until the first byte of the
+	// response, including connection setup
+	FirstByte time.Duration
+	// The time spent reading and decompressing the response body
+	BodyRead time.Duration
+}
+
+// timingTrace records a ResultTiming using an httptrace.ClientTrace. The
+// trace's hooks can be called from other goroutines, e.g. while dialing.
+type timingTrace struct {
+	mu           sync.Mutex
+	start        time.Time
+	dnsStart     time.Time
+	connectStart time.Time
+	tlsStart     time.Time
+	timing       ResultTiming
+}
+
+func newTimingTrace(start time.Time) *timingTrace {
+	return &timingTrace{start: start}
+}
+
+// withClientTrace returns a context that records the timing of requests made
+// with it.
+func (tt *timingTrace) withClientTrace(ctx context.Context) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			tt.mu.Lock()
+			defer tt.mu.Unlock()
+			tt.dnsStart = time.Now()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			tt.mu.Lock()
+			defer tt.mu.Unlock()
+			tt.timing.DNS = time.Since(tt.dnsStart)
+		},
+		ConnectStart: func(string, string) {
+			tt.mu.Lock()
+			defer tt.mu.Unlock()
+			// Only the first dial is timed when several addresses are tried
+			if tt.connectStart.IsZero() {
+				tt.connectStart = time.Now()
+			}
+		},
+		ConnectDone: func(_ string, _ string, err error) {
+			tt.mu.Lock()
+			defer tt.mu.Unlock()
+			if err == nil && tt.timing.Connect == 0 {
+				tt.timing.Connect = time.Since(tt.connectStart)
+			}
+		},
+		TLSHandshakeStart: func() {
+			tt.mu.Lock()
+			defer tt.mu.Unlock()
+			tt.tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			tt.mu.Lock()
+			defer tt.mu.Unlock()
+			tt.timing.TLS = time.Since(tt.tlsStart)
+		},
+		GotFirstResponseByte: func() {
+			tt.mu.Lock()
+			defer tt.mu.Unlock()
+			tt.timing.FirstByte = time.Since(tt.start)
+		},
+	})
+}
+
+// finish returns the recorded timing, given the time the body started being
+// read.
+func (tt *timingTrace) finish(bodyStart time.Time) *ResultTiming {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+
+	timing := tt.timing
+	timing.BodyRead = time.Since(bodyStart)
+
+	return &timing
+}
@@ -0,0 +1,109 @@
+package multiplexer
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// TransportOption configures the http.Transport created by NewTransport.
+type TransportOption = func(*http.Transport)
+
+// Defaults used by NewTransport. Fragments are requested from a small number
+// of hosts, so far more idle connections are kept per host than the
+// http.DefaultTransport's 2.
+const (
+	DefaultMaxIdleConns        = 256
+	DefaultMaxIdleConnsPerHost = 64
+	DefaultIdleConnTimeout     = 90 * time.Second
+	DefaultDialTimeout         = 5 * time.Second
+)
+
+// NewTransport returns an http.Transport tuned for fetching fragments from a
+// few hosts, configured by the given options.
+//
+// The transport doesn't bound the time taken by requests, that's done by
+// Request.Timeout via the request's context. A dial timeout shorter than the
+// request's Timeout fails fast when a target can't be reached, leaving time to
+// fail over to another target.
+func NewTransport(opts ...TransportOption) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = DefaultMaxIdleConns
+	transport.MaxIdleConnsPerHost = DefaultMaxIdleConnsPerHost
+	transport.IdleConnTimeout = DefaultIdleConnTimeout
+	transport.ForceAttemptHTTP2 = true
+	WithDialTimeout(DefaultDialTimeout)(transport)
+
+	for _, opt := range opts {
+		opt(transport)
+	}
+
+	return transport
+}
+
+// NewStandardTripperWithTransport returns a standard Tripper that makes
+// requests using the given transport, e.g. one returned by NewTransport. The
+// client has no Timeout, requests are bounded by Request.Timeout.
+func NewStandardTripperWithTransport(transport *http.Transport) Tripper {
+	return NewStandardTripper(&http.Client{Transport: transport})
+}
+
+// WithMaxIdleConns sets the maximum number of idle connections kept across
+// all hosts. Unlimited when 0.
+func WithMaxIdleConns(n int) TransportOption {
+	return func(transport *http.Transport) {
+		transport.MaxIdleConns = n
+	}
+}
+
+// WithMaxIdleConnsPerHost sets the maximum number of idle connections kept for
+// each host.
+func WithMaxIdleConnsPerHost(n int) TransportOption {
+	return func(transport *http.Transport) {
+		transport.MaxIdleConnsPerHost = n
+	}
+}
+
+// WithIdleConnTimeout sets how long idle connections are kept before they're
+// closed. Idle connections are kept until they're closed by the host when 0.
+func WithIdleConnTimeout(timeout time.Duration) TransportOption {
+	return func(transport *http.Transport) {
+		transport.IdleConnTimeout = timeout
+	}
+}
+
+// WithTLSConfig sets the TLS configuration used to connect to targets, e.g.
+// to trust an internal certificate authority.
+func WithTLSConfig(config *tls.Config) TransportOption {
+	return func(transport *http.Transport) {
+		transport.TLSClientConfig = config
+	}
+}
+
+// WithDialTimeout sets the maximum time taken to establish a connection.
+func WithDialTimeout(timeout time.Duration) TransportOption {
+	return func(transport *http.Transport) {
+		dialer := &net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}
+		transport.DialContext = dialer.DialContext
+	}
+}
+
+// NewH2CTransport returns a transport that makes HTTP/2 requests over
+// cleartext connections without an upgrade (h2c with prior knowledge), so
+// concurrent fragment requests to a host are multiplexed over a single
+// connection. Every target must accept h2c, since https URLs are dialed
+// without TLS too.
+func NewH2CTransport() *http2.Transport {
+	dialer := &net.Dialer{Timeout: DefaultDialTimeout, KeepAlive: 30 * time.Second}
+
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network string, addr string, _ *tls.Config) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}
+}
@@ -0,0 +1,90 @@
+package multiplexer
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestNewTransport(t *testing.T) {
+	transport := NewTransport()
+	require.Equal(t, DefaultMaxIdleConns, transport.MaxIdleConns)
+	require.Equal(t, DefaultMaxIdleConnsPerHost, transport.MaxIdleConnsPerHost)
+	require.Equal(t, DefaultIdleConnTimeout, transport.IdleConnTimeout)
+	require.NotNil(t, transport.DialContext)
+
+	tlsConfig := &tls.Config{ServerName: "app.internal"}
+	transport = NewTransport(
+		WithMaxIdleConns(10),
+		WithMaxIdleConnsPerHost(5),
+		WithIdleConnTimeout(time.Second),
+		WithTLSConfig(tlsConfig),
+	)
+	require.Equal(t, 10, transport.MaxIdleConns)
+	require.Equal(t, 5, transport.MaxIdleConnsPerHost)
+	require.Equal(t, time.Second, transport.IdleConnTimeout)
+	require.Same(t, tlsConfig, transport.TLSClientConfig)
+
+	// The default transport is not modified
+	require.NotEqual(t, 5, http.DefaultTransport.(*http.Transport).MaxIdleConnsPerHost)
+}
+
+func TestNewStandardTripperWithTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "/", http.StatusFound)
+			return
+		}
+
+		w.Write([]byte("<body>"))
+	}))
+	defer server.Close()
+
+	r := NewRequest(NewStandardTripperWithTransport(NewTransport(WithDialTimeout(time.Second))))
+	r.Non2xxErrors = false
+	r.WithRequestable(newFakeRequestable(server.URL))
+	r.WithRequestable(newFakeRequestable(server.URL + "/redirect"))
+
+	results, err := r.Do(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "<body>", string(results[0].Body))
+	// Redirects are not followed
+	require.Equal(t, http.StatusFound, results[1].StatusCode)
+}
+
+func TestNewH2CTransport(t *testing.T) {
+	var connections int32
+	server := httptest.NewUnstartedServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}), &http2.Server{}))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&connections, 1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	r := NewRequest(NewStandardTripper(&http.Client{Transport: NewH2CTransport()}))
+	for i := 0; i < 10; i++ {
+		r.WithRequestable(newFakeRequestable(fmt.Sprintf("%s/fragment/%d", server.URL, i)))
+	}
+
+	results, err := r.Do(context.Background())
+	require.NoError(t, err)
+
+	for _, result := range results {
+		require.Equal(t, "HTTP/2.0", string(result.Body))
+	}
+	require.Equal(t, int32(1), atomic.LoadInt32(&connections), "fragments should share a single connection")
+}
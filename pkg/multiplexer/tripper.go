@@ -1,7 +1,14 @@
 package multiplexer
 
-import "net/http"
+import (
+	"fmt"
+	"net/http"
+)
 
+// Tripper makes the HTTP requests used to fetch fragments. Like
+// http.RoundTripper, implementations must return either a response with a
+// non-nil Body or a non-nil error. The body of the returned response is closed
+// by the caller.
 type Tripper interface {
 	Request(r *http.Request) (*http.Response, error)
 }
@@ -24,3 +31,49 @@ func NewStandardTripper(client *http.Client) Tripper {
 func (t *standardTripper) Request(r *http.Request) (*http.Response, error) {
 	return t.client.Do(r)
 }
+
+// FragmentTransportError is returned when a fragment could not be fetched
+// because the Tripper returned an error or violated the Tripper contract.
+type FragmentTransportError struct {
+	// The key of the fragment, e.g. `root.layout.header`. Empty when the
+	// requestable does not implement KeyedRequestable.
+	Key         string
+	TemplateURL string
+	Err         error
+}
+
+func (e *FragmentTransportError) Error() string {
+	if e.Key == "" {
+		return e.Err.Error()
+	}
+
+	return fmt.Sprintf("fragment %s: %s", e.Key, e.Err)
+}
+
+func (e *FragmentTransportError) Unwrap() error {
+	return e.Err
+}
+
+// requestWithTripper makes the request using tripper, validating that the
+// tripper has met its contract.
+func requestWithTripper(tripper Tripper, req *http.Request) (*http.Response, error) {
+	resp, err := tripper.Request(req)
+
+	if err != nil {
+		if resp != nil && resp.Body != nil {
+			resp.Body.Close()
+		}
+
+		return nil, err
+	}
+
+	if resp == nil {
+		return nil, fmt.Errorf("tripper %T returned a nil response without an error", tripper)
+	}
+
+	if resp.Body == nil {
+		return nil, fmt.Errorf("tripper %T returned a response with a nil body", tripper)
+	}
+
+	return resp, nil
+}
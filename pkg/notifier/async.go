@@ -0,0 +1,209 @@
+package notifier
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// Defaults used by OnAsync
+const (
+	DefaultAsyncQueueSize = 1024
+	DefaultAsyncWorkers   = 1
+)
+
+// AsyncOption configures an OnAsync subscription.
+type AsyncOption = func(*asyncQueue)
+
+// WithQueueSize sets the number of events that can wait to be handled by an
+// OnAsync subscription. Once full, the oldest waiting event is dropped to make
+// room for the newest.
+func WithQueueSize(size int) AsyncOption {
+	return func(queue *asyncQueue) {
+		if size > 0 {
+			queue.events = make([]context.Context, size)
+		}
+	}
+}
+
+// WithWorkers sets the number of goroutines handling the events of an OnAsync
+// subscription. With more than one worker events can be handled in any order.
+func WithWorkers(workers int) AsyncOption {
+	return func(queue *asyncQueue) {
+		if workers > 0 {
+			queue.workers = workers
+		}
+	}
+}
+
+// asyncQueue is a bounded queue of the events emitted for an OnAsync
+// subscription, handled by a fixed number of workers. It's a ring buffer that
+// drops the oldest event when full.
+type asyncQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	events  []context.Context
+	head    int
+	size    int
+	closed  bool
+	workers int
+	wg      sync.WaitGroup
+	dropped uint64
+}
+
+func newAsyncQueue(opts []AsyncOption) *asyncQueue {
+	queue := &asyncQueue{
+		events:  make([]context.Context, DefaultAsyncQueueSize),
+		workers: DefaultAsyncWorkers,
+	}
+	queue.cond = sync.NewCond(&queue.mu)
+
+	for _, opt := range opts {
+		opt(queue)
+	}
+
+	return queue
+}
+
+func (q *asyncQueue) start(fn OnFunc) {
+	q.wg.Add(q.workers)
+
+	for i := 0; i < q.workers; i++ {
+		go func() {
+			defer q.wg.Done()
+
+			for {
+				ctx, ok := q.pop()
+				if !ok {
+					return
+				}
+
+				fn(ctx)
+			}
+		}()
+	}
+}
+
+// push queues the event, dropping the oldest waiting event when the queue is
+// full. Events pushed once the queue is closed are dropped.
+func (q *asyncQueue) push(ctx context.Context) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		atomic.AddUint64(&q.dropped, 1)
+		return
+	}
+
+	if q.size == len(q.events) {
+		q.events[q.head] = nil
+		q.head = (q.head + 1) % len(q.events)
+		q.size--
+		atomic.AddUint64(&q.dropped, 1)
+	}
+
+	q.events[(q.head+q.size)%len(q.events)] = ctx
+	q.size++
+	q.cond.Signal()
+}
+
+// pop waits for an event, returning false once the queue is closed and empty.
+func (q *asyncQueue) pop() (context.Context, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for q.size == 0 && !q.closed {
+		q.cond.Wait()
+	}
+
+	if q.size == 0 {
+		return nil, false
+	}
+
+	ctx := q.events[q.head]
+	q.events[q.head] = nil
+	q.head = (q.head + 1) % len(q.events)
+	q.size--
+
+	return ctx, true
+}
+
+// close stops the queue from accepting events. Workers exit once the waiting
+// events are handled.
+func (q *asyncQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+func (q *asyncQueue) pending() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.size
+}
+
+// Pending returns the number of events waiting to be handled by an OnAsync
+// subscription, and 0 for other subscriptions.
+func (s *Subscription) Pending() int {
+	if s.queue == nil {
+		return 0
+	}
+
+	return s.queue.pending()
+}
+
+// Dropped returns the number of events an OnAsync subscription dropped
+// because its queue was full or it was removed, and 0 for other
+// subscriptions.
+func (s *Subscription) Dropped() uint64 {
+	if s.queue == nil {
+		return 0
+	}
+
+	return atomic.LoadUint64(&s.queue.dropped)
+}
+
+// untrackOnExit stops tracking the queue once its workers exit.
+func (n *DefaultNotifier) untrackOnExit(queue *asyncQueue) {
+	queue.wg.Wait()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.asyncQueues, queue)
+}
+
+// Shutdown stops OnAsync subscriptions from accepting events and waits for
+// the events they've queued to be handled, returning the context's error if
+// it's done first. Events queued for subscriptions removed with RemoveOn are
+// waited for too. Events emitted after Shutdown are dropped by OnAsync
+// subscriptions, other subscriptions are unaffected.
+func (n *DefaultNotifier) Shutdown(ctx context.Context) error {
+	n.mu.Lock()
+	queues := make([]*asyncQueue, 0, len(n.asyncQueues))
+	for queue := range n.asyncQueues {
+		queues = append(queues, queue)
+	}
+	n.shutdown = true
+	n.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		for _, queue := range queues {
+			queue.close()
+		}
+		for _, queue := range queues {
+			queue.wg.Wait()
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
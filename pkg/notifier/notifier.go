@@ -0,0 +1,258 @@
+package notifier
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Notifier emits named events that wrap a unit of work, allowing subscribers
+// to observe or instrument it.
+type Notifier interface {
+	Emit(name interface{}, ctx context.Context, fn func(context.Context))
+}
+
+// OnFunc is called when an event is emitted, before the work is performed.
+type OnFunc = func(ctx context.Context)
+
+// AroundFunc wraps the work performed for an event. Implementations must call
+// next to continue the chain.
+type AroundFunc = func(ctx context.Context, next func(context.Context))
+
+// OnAnyFunc is called when any event is emitted, before the work is
+// performed.
+type OnAnyFunc = func(name interface{}, ctx context.Context)
+
+// Subscription identifies an `On` subscription so that it can be removed with
+// RemoveOn.
+type Subscription struct {
+	name  interface{}
+	fn    OnFunc
+	anyFn OnAnyFunc
+	// The queue of events waiting to be handled by an OnAsync subscription
+	queue *asyncQueue
+}
+
+// DefaultNotifier is a Notifier that supports synchronous and asynchronous
+// `On` subscriptions and `Around` subscriptions.
+type DefaultNotifier struct {
+	mu                  sync.RWMutex
+	onAnySubscriptions  []*Subscription
+	onSubscriptions     map[interface{}][]*Subscription
+	aroundSubscriptions map[interface{}][]AroundFunc
+	// The queues of OnAsync subscriptions, including removed subscriptions,
+	// until their workers exit
+	asyncQueues map[*asyncQueue]struct{}
+	// True once Shutdown is called
+	shutdown bool
+}
+
+var _ Notifier = &DefaultNotifier{}
+
+func New() *DefaultNotifier {
+	return &DefaultNotifier{
+		onSubscriptions:     make(map[interface{}][]*Subscription),
+		aroundSubscriptions: make(map[interface{}][]AroundFunc),
+		asyncQueues:         make(map[*asyncQueue]struct{}),
+	}
+}
+
+// On subscribes fn to the named event. fn is called in the emitting goroutine
+// before the work for the event is performed.
+func (n *DefaultNotifier) On(name interface{}, fn OnFunc) *Subscription {
+	return n.subscribe(&Subscription{name: name, fn: fn})
+}
+
+// OnAsync subscribes fn to the named event. Emit queues the event instead of
+// calling fn, and fn is called by the subscription's workers so it doesn't
+// block Emit, e.g. when it performs I/O. The queue is bounded, dropping the
+// oldest event when it's full, see WithQueueSize, WithWorkers, and
+// Subscription.Dropped. No ordering is guaranteed between async
+// subscriptions, or between events when there's more than one worker.
+//
+// The context passed to fn retains the values of the emitted context but is
+// never canceled and has no deadline, since the emitting request may complete
+// before fn runs. fn must not rely on request-scoped cancellation.
+//
+// Values registered with RegisterSnapshot are copied when the event is
+// emitted, so fn reads them as they were at that point. Other pointer values
+// of the context are shared with the emitting request, which may still be
+// modifying or have released them, e.g. pooled result bodies, so fn must not
+// read them.
+func (n *DefaultNotifier) OnAsync(name interface{}, fn OnFunc, opts ...AsyncOption) *Subscription {
+	queue := newAsyncQueue(opts)
+	queue.start(fn)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.shutdown {
+		queue.close()
+	}
+
+	n.asyncQueues[queue] = struct{}{}
+	go n.untrackOnExit(queue)
+
+	subscription := &Subscription{name: name, fn: fn, queue: queue}
+	n.onSubscriptions[name] = append(n.onSubscriptions[name], subscription)
+
+	return subscription
+}
+
+// OnAny subscribes fn to every event. fn is called in the emitting goroutine
+// before the `On` subscriptions for the event.
+func (n *DefaultNotifier) OnAny(fn OnAnyFunc) *Subscription {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	subscription := &Subscription{anyFn: fn}
+	n.onAnySubscriptions = append(n.onAnySubscriptions, subscription)
+
+	return subscription
+}
+
+// RemoveOn removes a subscription created by On, OnAsync, or OnAny. Events
+// already queued for an OnAsync subscription are still handled.
+func (n *DefaultNotifier) RemoveOn(subscription *Subscription) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if subscription.queue != nil {
+		subscription.queue.close()
+	}
+
+	if subscription.anyFn != nil {
+		n.onAnySubscriptions = withoutSubscription(n.onAnySubscriptions, subscription)
+		return
+	}
+
+	n.onSubscriptions[subscription.name] = withoutSubscription(n.onSubscriptions[subscription.name], subscription)
+}
+
+func (n *DefaultNotifier) subscribe(subscription *Subscription) *Subscription {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.onSubscriptions[subscription.name] = append(n.onSubscriptions[subscription.name], subscription)
+
+	return subscription
+}
+
+// withoutSubscription returns a new slice so that slices being iterated by
+// Emit are not modified.
+func withoutSubscription(subscriptions []*Subscription, subscription *Subscription) []*Subscription {
+	filtered := make([]*Subscription, 0, len(subscriptions))
+
+	for _, s := range subscriptions {
+		if s != subscription {
+			filtered = append(filtered, s)
+		}
+	}
+
+	return filtered
+}
+
+// Around subscribes fn to the named event, wrapping the work performed for
+// the event. Subscriptions are called in the order they are registered, so
+// the first subscription is the outermost.
+func (n *DefaultNotifier) Around(name interface{}, fn AroundFunc) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.aroundSubscriptions[name] = append(n.aroundSubscriptions[name], fn)
+}
+
+// Emit calls the `OnAny` subscriptions and the `On` subscriptions for the
+// named event, then calls fn wrapped in the `Around` subscriptions for the
+// event.
+func (n *DefaultNotifier) Emit(name interface{}, ctx context.Context, fn func(context.Context)) {
+	n.mu.RLock()
+	onAnySubscriptions := n.onAnySubscriptions
+	onSubscriptions := n.onSubscriptions[name]
+	aroundSubscriptions := n.aroundSubscriptions[name]
+	n.mu.RUnlock()
+
+	for _, subscription := range onAnySubscriptions {
+		subscription.anyFn(name, ctx)
+	}
+
+	for _, subscription := range onSubscriptions {
+		if subscription.queue != nil {
+			subscription.queue.push(detachedContext{parent: ctx, snapshots: takeSnapshots(ctx)})
+		} else {
+			subscription.fn(ctx)
+		}
+	}
+
+	chain := fn
+	for i := len(aroundSubscriptions) - 1; i >= 0; i-- {
+		around := aroundSubscriptions[i]
+		next := chain
+		chain = func(ctx context.Context) {
+			around(ctx, next)
+		}
+	}
+
+	chain(ctx)
+}
+
+var (
+	snapshotsMu sync.RWMutex
+	snapshotFns = make(map[interface{}]func(interface{}) interface{})
+)
+
+// RegisterSnapshot registers a func returning a copy of the context value
+// stored under key. It's called when an event is queued for an OnAsync
+// subscription, so async subscribers read a copy of values the emitter keeps
+// modifying after the event, e.g. the counters of a request. It's usually
+// called from an init func by the package that owns key.
+func RegisterSnapshot(key interface{}, snapshot func(value interface{}) interface{}) {
+	snapshotsMu.Lock()
+	defer snapshotsMu.Unlock()
+
+	snapshotFns[key] = snapshot
+}
+
+// takeSnapshots returns copies of the registered values of ctx, keyed by
+// their context key.
+func takeSnapshots(ctx context.Context) map[interface{}]interface{} {
+	snapshotsMu.RLock()
+	defer snapshotsMu.RUnlock()
+
+	var snapshots map[interface{}]interface{}
+	for key, snapshot := range snapshotFns {
+		value := ctx.Value(key)
+		if value == nil {
+			continue
+		}
+
+		if snapshots == nil {
+			snapshots = make(map[interface{}]interface{}, len(snapshotFns))
+		}
+		snapshots[key] = snapshot(value)
+	}
+
+	return snapshots
+}
+
+// detachedContext exposes the values of its parent without its deadline or
+// cancellation, with the values copied by RegisterSnapshot funcs taking
+// precedence.
+type detachedContext struct {
+	parent    context.Context
+	snapshots map[interface{}]interface{}
+}
+
+var _ context.Context = detachedContext{}
+
+func (dc detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (dc detachedContext) Done() <-chan struct{}       { return nil }
+func (dc detachedContext) Err() error                  { return nil }
+
+func (dc detachedContext) Value(key interface{}) interface{} {
+	if value, ok := dc.snapshots[key]; ok {
+		return value
+	}
+
+	return dc.parent.Value(key)
+}
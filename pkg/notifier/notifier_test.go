@@ -0,0 +1,255 @@
+package notifier
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testKey struct{}
+
+func TestNotifier_Emit(t *testing.T) {
+	n := New()
+	calls := make([]string, 0)
+
+	n.On("event", func(ctx context.Context) { calls = append(calls, "on 1") })
+	n.On("event", func(ctx context.Context) { calls = append(calls, "on 2") })
+	n.On("other", func(ctx context.Context) { calls = append(calls, "other") })
+	n.Around("event", func(ctx context.Context, next func(context.Context)) {
+		calls = append(calls, "around 1 start")
+		next(ctx)
+		calls = append(calls, "around 1 end")
+	})
+	n.Around("event", func(ctx context.Context, next func(context.Context)) {
+		calls = append(calls, "around 2 start")
+		next(ctx)
+		calls = append(calls, "around 2 end")
+	})
+
+	n.Emit("event", context.Background(), func(ctx context.Context) {
+		calls = append(calls, "fn")
+	})
+
+	require.Equal(
+		t,
+		[]string{"on 1", "on 2", "around 1 start", "around 2 start", "fn", "around 2 end", "around 1 end"},
+		calls,
+	)
+}
+
+func TestNotifier_OnAsync(t *testing.T) {
+	n := New()
+	release := make(chan struct{})
+	done := make(chan context.Context)
+	calls := make([]string, 0)
+
+	n.On("event", func(ctx context.Context) { calls = append(calls, "on 1") })
+	n.OnAsync("event", func(ctx context.Context) {
+		<-release
+		done <- ctx
+	})
+	n.On("event", func(ctx context.Context) { calls = append(calls, "on 2") })
+
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), testKey{}, "value"), time.Minute)
+	n.Emit("event", ctx, func(ctx context.Context) {
+		calls = append(calls, "fn")
+	})
+	cancel()
+
+	// Emit returns without waiting on the async subscription
+	require.Equal(t, []string{"on 1", "on 2", "fn"}, calls)
+
+	close(release)
+	asyncCtx := <-done
+
+	require.Equal(t, "value", asyncCtx.Value(testKey{}))
+	require.NoError(t, asyncCtx.Err())
+
+	_, hasDeadline := asyncCtx.Deadline()
+	require.False(t, hasDeadline)
+}
+
+type counter struct {
+	count int
+}
+
+type counterKey struct{}
+
+func TestNotifier_OnAsyncSnapshots(t *testing.T) {
+	RegisterSnapshot(counterKey{}, func(value interface{}) interface{} {
+		c := *value.(*counter)
+		return &c
+	})
+
+	n := New()
+	done := make(chan int, 1)
+	n.OnAsync("event", func(ctx context.Context) {
+		done <- ctx.Value(counterKey{}).(*counter).count
+	})
+
+	c := &counter{count: 1}
+	n.Emit("event", context.WithValue(context.Background(), counterKey{}, c), func(context.Context) {
+		// Async subscribers don't race with the emitter
+		c.count++
+	})
+	c.count++
+
+	require.Equal(t, 1, <-done)
+}
+
+func TestNotifier_OnAny(t *testing.T) {
+	n := New()
+	calls := make([]string, 0)
+
+	n.On("event", func(ctx context.Context) { calls = append(calls, "on event") })
+	n.OnAny(func(name interface{}, ctx context.Context) {
+		calls = append(calls, fmt.Sprintf("any %s", name))
+	})
+
+	n.Emit("event", context.Background(), func(ctx context.Context) {})
+	n.Emit("other", context.Background(), func(ctx context.Context) {})
+
+	require.Equal(t, []string{"any event", "on event", "any other"}, calls)
+}
+
+func TestNotifier_RemoveOn(t *testing.T) {
+	n := New()
+	calls := make([]string, 0)
+
+	on := n.On("event", func(ctx context.Context) { calls = append(calls, "on") })
+	n.On("event", func(ctx context.Context) { calls = append(calls, "other on") })
+	anySubscription := n.OnAny(func(name interface{}, ctx context.Context) { calls = append(calls, "any") })
+
+	n.RemoveOn(on)
+	n.RemoveOn(anySubscription)
+
+	n.Emit("event", context.Background(), func(ctx context.Context) {})
+
+	require.Equal(t, []string{"other on"}, calls)
+}
+
+type eventKey struct{}
+
+func emitNumbered(n *DefaultNotifier, name string, i int) {
+	n.Emit(name, context.WithValue(context.Background(), eventKey{}, i), func(context.Context) {})
+}
+
+func TestNotifier_OnAsyncDropsOldest(t *testing.T) {
+	n := New()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var mu sync.Mutex
+	handled := make([]int, 0)
+
+	subscription := n.OnAsync("event", func(ctx context.Context) {
+		if ctx.Value(eventKey{}) == 1 {
+			close(started)
+			<-release
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		handled = append(handled, ctx.Value(eventKey{}).(int))
+	}, WithQueueSize(2))
+
+	emitNumbered(n, "event", 1)
+	<-started
+
+	for i := 2; i <= 5; i++ {
+		emitNumbered(n, "event", i)
+	}
+	require.Equal(t, 2, subscription.Pending())
+	require.Equal(t, uint64(2), subscription.Dropped())
+
+	close(release)
+	require.NoError(t, n.Shutdown(context.Background()))
+
+	// With a single worker events are handled in the order they're emitted
+	require.Equal(t, []int{1, 4, 5}, handled)
+	require.Zero(t, subscription.Pending())
+}
+
+func TestNotifier_OnAsyncWithoutOrdering(t *testing.T) {
+	n := New()
+	var mu sync.Mutex
+	handled := map[string][]int{}
+
+	record := func(name string) OnFunc {
+		return func(ctx context.Context) {
+			mu.Lock()
+			defer mu.Unlock()
+			handled[name] = append(handled[name], ctx.Value(eventKey{}).(int))
+		}
+	}
+	n.OnAsync("event", record("first"), WithWorkers(4))
+	n.OnAsync("event", record("second"))
+
+	for i := 0; i < 100; i++ {
+		emitNumbered(n, "event", i)
+	}
+	require.NoError(t, n.Shutdown(context.Background()))
+
+	// Every event is handled by each subscription, in no particular order
+	// across workers or subscriptions
+	for _, name := range []string{"first", "second"} {
+		sort.Ints(handled[name])
+		require.Len(t, handled[name], 100, name)
+		require.Equal(t, 0, handled[name][0])
+		require.Equal(t, 99, handled[name][99])
+	}
+}
+
+func TestNotifier_ShutdownWaitsForRemoved(t *testing.T) {
+	n := New()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var handled int32
+
+	subscription := n.OnAsync("event", func(ctx context.Context) {
+		if ctx.Value(eventKey{}) == 1 {
+			close(started)
+			<-release
+		}
+		atomic.AddInt32(&handled, 1)
+	})
+
+	emitNumbered(n, "event", 1)
+	<-started
+	emitNumbered(n, "event", 2)
+
+	// Events queued before the subscription is removed are still handled
+	n.RemoveOn(subscription)
+	require.Equal(t, 1, subscription.Pending())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, n.Shutdown(ctx), context.DeadlineExceeded)
+
+	close(release)
+	require.NoError(t, n.Shutdown(context.Background()))
+	require.Equal(t, int32(2), atomic.LoadInt32(&handled))
+}
+
+func TestNotifier_ShutdownDeadline(t *testing.T) {
+	n := New()
+	release := make(chan struct{})
+	defer close(release)
+
+	subscription := n.OnAsync("event", func(ctx context.Context) { <-release })
+	emitNumbered(n, "event", 1)
+	emitNumbered(n, "event", 2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, n.Shutdown(ctx), context.DeadlineExceeded)
+
+	// Events emitted after shutdown are dropped
+	emitNumbered(n, "event", 3)
+	require.Equal(t, uint64(1), subscription.Dropped())
+}
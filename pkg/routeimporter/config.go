@@ -1,25 +1,52 @@
 package routeimporter
 
 import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
 	"github.com/blakewilliams/viewproxy"
 	"github.com/blakewilliams/viewproxy/pkg/fragment"
 )
 
+// ErrEmptyPath is returned when a route entry or one of its fragments has an
+// empty `path`.
+var ErrEmptyPath = errors.New("path is empty")
+
 type ConfigFragment struct {
-	Path             string
-	Metadata         map[string]string
-	IgnoreValidation bool
-	Children         map[string]ConfigFragment
+	Path string `yaml:"path"`
+	// Values can be strings, booleans, or numbers. JSON numbers are decoded
+	// as float64, YAML numbers as int or float64.
+	Metadata         map[string]interface{}    `yaml:"metadata"`
+	IgnoreValidation bool                      `yaml:"ignoreValidation"`
+	Children         map[string]ConfigFragment `yaml:"children"`
+	// The latency and error rate objective of the fragment, see
+	// fragment.WithSLO
+	SLO *ConfigSLO `yaml:"slo"`
+}
+
+type ConfigSLO struct {
+	// The p99 latency objective as a duration, e.g. `250ms`
+	P99          string  `yaml:"p99"`
+	MaxErrorRate float64 `yaml:"maxErrorRate"`
 }
 
 type ConfigRouteEntry struct {
-	Path             string
-	Root             ConfigFragment    `json:"root"`
-	Metadata         map[string]string `json:"metadata"`
-	IgnoreValidation bool
+	Path             string            `yaml:"path"`
+	Root             ConfigFragment    `json:"root" yaml:"root"`
+	Metadata         map[string]string `json:"metadata" yaml:"metadata"`
+	IgnoreValidation bool              `yaml:"ignoreValidation"`
 }
 
+// LoadRoutes defines the routes of each entry on the server. When any route is
+// invalid, no routes are defined and the errors of every invalid route are
+// returned.
 func LoadRoutes(server *viewproxy.Server, routeEntries []ConfigRouteEntry) error {
+	if err := ValidateRoutes(routeEntries); err != nil {
+		return err
+	}
+
 	for _, routeEntry := range routeEntries {
 		root := createFragment(routeEntry.Root)
 
@@ -37,9 +64,133 @@ func LoadRoutes(server *viewproxy.Server, routeEntries []ConfigRouteEntry) error
 	return nil
 }
 
+// ValidateRoutes checks the routes of each entry without defining them,
+// returning the errors of every invalid route joined together.
+func ValidateRoutes(routeEntries []ConfigRouteEntry) error {
+	_, err := BuildRoutes(routeEntries)
+	return err
+}
+
+// BuildRoutes returns validated routes for the entries that can be passed to
+// Server.ReloadRoutes. When any route is invalid, the errors of every invalid
+// route are returned joined together.
+func BuildRoutes(routeEntries []ConfigRouteEntry) ([]*viewproxy.Route, error) {
+	routes := make([]*viewproxy.Route, 0, len(routeEntries))
+	errs := make([]error, 0)
+
+	for i, routeEntry := range routeEntries {
+		if err := emptyPathError(i, routeEntry); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		if key, err := findInvalidSLO("root", routeEntry.Root); err != nil {
+			errs = append(errs, fmt.Errorf("route %s: fragment %s: %w", routeEntry.Path, key, err))
+			continue
+		}
+
+		route, err := viewproxy.NewRoute(
+			routeEntry.Path,
+			createFragment(routeEntry.Root),
+			viewproxy.WithRouteMetadata(routeEntry.Metadata),
+		)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("route %s: %w", routeEntry.Path, err))
+			continue
+		}
+
+		routes = append(routes, route)
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	return routes, nil
+}
+
+// emptyPathError returns an error identifying the entry by its index when it
+// or one of its fragments has an empty path, since an empty fragment path
+// would request the root of the target.
+func emptyPathError(index int, routeEntry ConfigRouteEntry) error {
+	if routeEntry.Path == "" {
+		return fmt.Errorf("route %d: %w", index, ErrEmptyPath)
+	}
+
+	if key := findEmptyFragmentPath("root", routeEntry.Root); key != "" {
+		return fmt.Errorf("route %d (%s): fragment %s: %w", index, routeEntry.Path, key, ErrEmptyPath)
+	}
+
+	return nil
+}
+
+// findEmptyFragmentPath returns the key of the first fragment with an empty
+// path, or an empty string when every fragment has a path.
+func findEmptyFragmentPath(key string, template ConfigFragment) string {
+	if template.Path == "" {
+		return key
+	}
+
+	names := make([]string, 0, len(template.Children))
+	for name := range template.Children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if found := findEmptyFragmentPath(key+"."+name, template.Children[name]); found != "" {
+			return found
+		}
+	}
+
+	return ""
+}
+
+// findInvalidSLO returns the key of the first fragment with an SLO that can't
+// be parsed, and the error parsing it.
+func findInvalidSLO(key string, template ConfigFragment) (string, error) {
+	if _, err := parseSLO(template.SLO); err != nil {
+		return key, err
+	}
+
+	names := make([]string, 0, len(template.Children))
+	for name := range template.Children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if found, err := findInvalidSLO(key+"."+name, template.Children[name]); err != nil {
+			return found, err
+		}
+	}
+
+	return "", nil
+}
+
+// parseSLO returns the fragment.SLO of the config, or nil when there's none.
+func parseSLO(config *ConfigSLO) (*fragment.SLO, error) {
+	if config == nil {
+		return nil, nil
+	}
+
+	p99, err := time.ParseDuration(config.P99)
+	if err != nil {
+		return nil, fmt.Errorf("invalid slo p99: %w", err)
+	}
+
+	if config.MaxErrorRate < 0 || config.MaxErrorRate > 1 {
+		return nil, fmt.Errorf("invalid slo maxErrorRate %v: must be between 0 and 1", config.MaxErrorRate)
+	}
+
+	return &fragment.SLO{P99: p99, MaxErrorRate: config.MaxErrorRate}, nil
+}
+
 func createFragment(template ConfigFragment) *fragment.Definition {
-	f := fragment.Define(template.Path, fragment.WithMetadata(template.Metadata))
+	f := fragment.Define(template.Path, fragment.WithTypedMetadata(template.Metadata))
 	f.IgnoreValidation = template.IgnoreValidation
+	// Invalid SLOs are rejected when the routes are validated
+	f.SLO, _ = parseSLO(template.SLO)
 
 	for name, child := range template.Children {
 		fragment.WithChild(name, createFragment(child))(f)
@@ -2,8 +2,10 @@ package routeimporter
 
 import (
 	"testing"
+	"time"
 
 	"github.com/blakewilliams/viewproxy"
+	"github.com/blakewilliams/viewproxy/pkg/fragment"
 	"github.com/stretchr/testify/require"
 )
 
@@ -19,3 +21,79 @@ func TestLoadRoutesError(t *testing.T) {
 	err = LoadRoutes(server, []ConfigRouteEntry{entry})
 	require.Error(t, err)
 }
+
+func TestLoadRoutesReportsEveryError(t *testing.T) {
+	server, err := viewproxy.NewServer("localhost:9999")
+	require.NoError(t, err)
+
+	entries := []ConfigRouteEntry{
+		{Path: "/foo/bar", Root: ConfigFragment{Path: "/layout/:name"}},
+		{Path: "/hello/:name", Root: ConfigFragment{Path: "/layout/:name"}},
+		{Path: "/baz", Root: ConfigFragment{Path: "/layout/:id"}},
+	}
+
+	err = LoadRoutes(server, entries)
+
+	var validationErr *viewproxy.RouteValidationError
+	require.ErrorAs(t, err, &validationErr)
+	require.EqualError(
+		t,
+		err,
+		"route /foo/bar: static route /foo/bar has mismatched fragment route /layout/:name\n"+
+			"route /baz: static route /baz has mismatched fragment route /layout/:id",
+	)
+	require.Len(t, server.Routes(), 0)
+}
+
+func TestValidateRoutesEmptyPaths(t *testing.T) {
+	entries := []ConfigRouteEntry{
+		{Path: "/hello/:name", Root: ConfigFragment{Path: "/layout/:name"}},
+		{Path: "/about", Root: ConfigFragment{Path: "/layout", Children: map[string]ConfigFragment{
+			"sidebar": {Path: "", IgnoreValidation: true},
+		}}},
+		{Path: "", Root: ConfigFragment{Path: "/layout"}},
+	}
+
+	err := ValidateRoutes(entries)
+	require.ErrorIs(t, err, ErrEmptyPath)
+	require.EqualError(
+		t,
+		err,
+		"route 1 (/about): fragment root.sidebar: path is empty\n"+
+			"route 2: path is empty",
+	)
+}
+
+func TestValidateRoutes(t *testing.T) {
+	entries := []ConfigRouteEntry{
+		{Path: "/hello/:name", Root: ConfigFragment{Path: "/layout/:name"}},
+	}
+	require.NoError(t, ValidateRoutes(entries))
+
+	entries = append(entries, ConfigRouteEntry{Path: "/foo", Root: ConfigFragment{Path: "/layout/:name"}})
+	require.EqualError(t, ValidateRoutes(entries), "route /foo: static route /foo has mismatched fragment route /layout/:name")
+}
+
+func TestBuildRoutesSLO(t *testing.T) {
+	entries := []ConfigRouteEntry{
+		{Path: "/about", Root: ConfigFragment{Path: "/layout", Children: map[string]ConfigFragment{
+			"sidebar": {Path: "/sidebar", SLO: &ConfigSLO{P99: "250ms", MaxErrorRate: 0.01}},
+		}}},
+	}
+
+	routes, err := BuildRoutes(entries)
+	require.NoError(t, err)
+	require.Nil(t, routes[0].RootFragment.SLO)
+	require.Equal(t, &fragment.SLO{P99: 250 * time.Millisecond, MaxErrorRate: 0.01}, routes[0].RootFragment.Child("sidebar").SLO)
+
+	entries = append(entries,
+		ConfigRouteEntry{Path: "/hello", Root: ConfigFragment{Path: "/hello", SLO: &ConfigSLO{P99: "fast"}}},
+		ConfigRouteEntry{Path: "/bye", Root: ConfigFragment{Path: "/bye", SLO: &ConfigSLO{P99: "1s", MaxErrorRate: 2}}},
+	)
+	require.EqualError(
+		t,
+		ValidateRoutes(entries),
+		"route /hello: fragment root: invalid slo p99: time: invalid duration \"fast\"\n"+
+			"route /bye: fragment root: invalid slo maxErrorRate 2: must be between 0 and 1",
+	)
+}
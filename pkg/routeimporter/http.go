@@ -2,70 +2,113 @@ package routeimporter
 
 import (
 	"context"
-	"crypto/hmac"
-	"crypto/sha256"
-	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
-	"time"
 
 	"github.com/blakewilliams/viewproxy"
+	"github.com/blakewilliams/viewproxy/pkg/multiplexer"
 )
 
-func LoadHttp(ctx context.Context, server *viewproxy.Server, path string) error {
-	var routeEntries []ConfigRouteEntry
+// LoadHttp fetches the route configuration from the given path on the target
+// and loads the routes into the server.
+func LoadHttp(ctx context.Context, server *viewproxy.Server, path string, opts ...HttpOption) error {
+	config := newHttpConfig(opts)
+	inMaintenance := false
 
-	target, err := url.Parse(server.Target())
+	routesJson, err := fetchRoutesWithRetries(ctx, server, path, config, &inMaintenance)
+	if err != nil {
+		return err
+	}
+
+	routeEntries, err := parseRoutesJson(routesJson)
+	if err != nil {
+		return err
+	}
+
+	if err = LoadRoutes(server, routeEntries); err != nil {
+		return fmt.Errorf("could not load routes into server: %w", err)
+	}
+
+	return ctx.Err()
+}
+
+func fetchRoutesWithRetries(ctx context.Context, server *viewproxy.Server, path string, config *httpConfig, inMaintenance *bool) ([]byte, error) {
+	for attempt := 1; ; attempt++ {
+		routesJson, err := fetchRoutes(ctx, server, path, config, inMaintenance)
+
+		var unavailableErr *UnavailableError
+		if !errors.As(err, &unavailableErr) || attempt >= config.attempts {
+			return routesJson, err
+		}
+
+		server.Notifier.Emit(
+			EventRetryScheduled,
+			context.WithValue(ctx, unavailableErrorContextKey{}, unavailableErr),
+			func(context.Context) {},
+		)
 
+		if err := config.sleep(ctx, config.retryDelay(unavailableErr)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func fetchRoutes(ctx context.Context, server *viewproxy.Server, path string, config *httpConfig, inMaintenance *bool) ([]byte, error) {
+	target, err := url.Parse(server.Target())
 	if err != nil {
-		return fmt.Errorf("could not parse target: %w", err)
+		return nil, fmt.Errorf("could not parse target: %w", err)
 	}
 
 	target.Path = path
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
-
 	if err != nil {
-		return fmt.Errorf("Could not create a request when loading config: %w", err)
+		return nil, fmt.Errorf("Could not create a request when loading config: %w", err)
 	}
 
 	if server.HmacSecret != "" {
-		setHmacHeaders(req, server.HmacSecret)
+		multiplexer.SignRequest(server.HmacSecret, req)
 	}
 
 	resp, err := http.DefaultClient.Do(req)
-
 	if err != nil {
-		return fmt.Errorf("could not fetch JSON configuration: %w", err)
+		return nil, fmt.Errorf("could not fetch JSON configuration: %w", err)
 	}
+	defer resp.Body.Close()
 
-	routesJson, err := io.ReadAll(resp.Body)
+	if config.maintenanceHeader != "" {
+		maintenance := resp.Header.Get(config.maintenanceHeader) != ""
 
-	if err != nil {
-		return fmt.Errorf("could not read route config response body: %w", err)
+		if maintenance && !*inMaintenance {
+			server.Notifier.Emit(EventMaintenanceStarted, ctx, func(context.Context) {})
+		} else if !maintenance && *inMaintenance {
+			server.Notifier.Emit(EventMaintenanceEnded, ctx, func(context.Context) {})
+		}
+		*inMaintenance = maintenance
 	}
 
-	if err := json.Unmarshal(routesJson, &routeEntries); err != nil {
-		return fmt.Errorf("could not unmarshal route config json: %w", err)
+	if resp.StatusCode == http.StatusServiceUnavailable {
+		retryAfter, _ := ParseRetryAfter(resp.Header.Get("Retry-After"), config.now())
+		return nil, &UnavailableError{StatusCode: resp.StatusCode, RetryAfter: retryAfter}
 	}
 
-	if err = LoadRoutes(server, routeEntries); err != nil {
-		return fmt.Errorf("could not load routes into server: %w", err)
+	routesJson, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("could not read route config response body: %w", err)
 	}
 
-	return ctx.Err()
+	return routesJson, nil
 }
 
-func setHmacHeaders(r *http.Request, hmacSecret string) {
-	timestamp := fmt.Sprintf("%d", time.Now().Unix())
+func parseRoutesJson(routesJson []byte) ([]ConfigRouteEntry, error) {
+	var routeEntries []ConfigRouteEntry
 
-	mac := hmac.New(sha256.New, []byte(hmacSecret))
-	mac.Write(
-		[]byte(fmt.Sprintf("%s,%s", r.URL.Path, timestamp)),
-	)
+	if err := json.Unmarshal(routesJson, &routeEntries); err != nil {
+		return nil, fmt.Errorf("could not unmarshal route config json: %w", err)
+	}
 
-	r.Header.Set("Authorization", hex.EncodeToString(mac.Sum(nil)))
-	r.Header.Set("X-Authorization-Time", timestamp)
+	return routeEntries, nil
 }
@@ -14,6 +14,7 @@ import (
 	"time"
 
 	"github.com/blakewilliams/viewproxy"
+	"github.com/blakewilliams/viewproxy/pkg/notifier"
 	"github.com/stretchr/testify/require"
 )
 
@@ -25,6 +26,11 @@ var jsonConfig = []byte(`[
 		},
 		"root": {
 			"path": "/_viewproxy/users/new/layout",
+			"metadata": {
+				"team": "identity",
+				"cacheable": true,
+				"weight": 2
+			},
 			"children": {
 				"content": {
 					"path": "/_viewproxy/users/new/content"
@@ -127,7 +133,7 @@ func startTargetServer() *httptest.Server {
 	return testServer
 }
 
-func requireJsonConfigRoutesLoaded(t *testing.T, routes []viewproxy.Route) {
+func requireJsonConfigRoutesLoaded(t *testing.T, routes []*viewproxy.Route) {
 	require.Len(t, routes, 1)
 	route := routes[0]
 
@@ -136,5 +142,115 @@ func requireJsonConfigRoutesLoaded(t *testing.T, routes []viewproxy.Route) {
 	require.Len(t, route.FragmentsToRequest(), 2)
 
 	require.Contains(t, "/_viewproxy/users/new/layout", route.RootFragment.Path)
+	require.Equal(t, "identity", route.RootFragment.Metadata["team"])
+	require.Equal(t, "true", route.RootFragment.Metadata["cacheable"])
+	require.Equal(t, true, route.RootFragment.TypedMetadata()["cacheable"])
+	require.Equal(t, float64(2), route.RootFragment.TypedMetadata()["weight"])
 	require.Contains(t, "/_viewproxy/users/new/content", route.RootFragment.Child("content").Path)
 }
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2021, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+	wait, ok := ParseRetryAfter("120", now)
+	require.True(t, ok)
+	require.Equal(t, 2*time.Minute, wait)
+
+	wait, ok = ParseRetryAfter(now.Add(90*time.Second).Format(http.TimeFormat), now)
+	require.True(t, ok)
+	require.Equal(t, 90*time.Second, wait)
+
+	wait, ok = ParseRetryAfter(now.Add(-time.Minute).Format(http.TimeFormat), now)
+	require.True(t, ok)
+	require.Equal(t, time.Duration(0), wait)
+
+	_, ok = ParseRetryAfter("soon", now)
+	require.False(t, ok)
+	_, ok = ParseRetryAfter("", now)
+	require.False(t, ok)
+}
+
+func TestLoadHttp_RetryAfterAndMaintenance(t *testing.T) {
+	requests := 0
+	instance := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+
+		switch requests {
+		case 1:
+			w.Header().Set("X-Maintenance", "deploying")
+			w.Header().Set("Retry-After", "30")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 2:
+			w.Header().Set("X-Maintenance", "deploying")
+			w.Header().Set("Retry-After", "600")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 3:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.Write(jsonConfig)
+		}
+	})
+	testServer := httptest.NewServer(instance)
+	defer testServer.Close()
+
+	viewproxyServer, err := viewproxy.NewServer(testServer.URL)
+	require.NoError(t, err)
+
+	events := make([]string, 0)
+	n := notifier.New()
+	n.OnAny(func(name interface{}, ctx context.Context) {
+		if name == EventRetryScheduled {
+			name = fmt.Sprintf("%s %s", name, UnavailableErrorFromContext(ctx).RetryAfter)
+		}
+		events = append(events, name.(string))
+	})
+	viewproxyServer.Notifier = n
+
+	// Use a fake clock so the test doesn't wait for the backoff
+	waits := make([]time.Duration, 0)
+	fakeClock := func(config *httpConfig) {
+		config.sleep = func(ctx context.Context, d time.Duration) error {
+			waits = append(waits, d)
+			return nil
+		}
+	}
+
+	err = LoadHttp(
+		context.TODO(),
+		viewproxyServer,
+		"/_viewproxy_routes",
+		WithRetries(5, time.Second, time.Minute),
+		WithMaintenanceHeader("X-Maintenance"),
+		fakeClock,
+	)
+	require.NoError(t, err)
+	requireJsonConfigRoutesLoaded(t, viewproxyServer.Routes())
+
+	require.Equal(t, []time.Duration{30 * time.Second, time.Minute, time.Second}, waits)
+	require.Equal(t, []string{
+		EventMaintenanceStarted,
+		EventRetryScheduled + " 30s",
+		EventRetryScheduled + " 10m0s",
+		EventMaintenanceEnded,
+		EventRetryScheduled + " 0s",
+	}, events)
+}
+
+func TestLoadHttp_Unavailable(t *testing.T) {
+	instance := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	testServer := httptest.NewServer(instance)
+	defer testServer.Close()
+
+	viewproxyServer, err := viewproxy.NewServer(testServer.URL)
+	require.NoError(t, err)
+
+	err = LoadHttp(context.TODO(), viewproxyServer, "/_viewproxy_routes")
+
+	var unavailableErr *UnavailableError
+	require.ErrorAs(t, err, &unavailableErr)
+	require.Equal(t, 30*time.Second, unavailableErr.RetryAfter)
+	require.EqualError(t, err, "target is unavailable (status 503), retry after 30s")
+}
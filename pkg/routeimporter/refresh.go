@@ -0,0 +1,99 @@
+package routeimporter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/blakewilliams/viewproxy"
+)
+
+// Emitted when refreshing routes fails. The previous routes are kept and the
+// error is available via RefreshErrorFromContext.
+const EventRefreshFailed = "routeimporter.refresh_failed"
+
+type refreshErrorContextKey struct{}
+
+// RefreshErrorFromContext returns the error that caused a refresh to fail.
+func RefreshErrorFromContext(ctx context.Context) error {
+	if ctx == nil {
+		return nil
+	}
+
+	if err := ctx.Value(refreshErrorContextKey{}); err != nil {
+		return err.(error)
+	}
+	return nil
+}
+
+// LoadHttpWithRefresh loads routes like LoadHttp, then reloads them from the
+// target every interval until ctx is done, replacing the server's routes via
+// ReloadRoutes.
+//
+// Only the initial load returns an error. When a refresh fails the previous
+// routes are kept and EventRefreshFailed is emitted. Refreshes wait for the
+// target's Retry-After duration when it's longer than interval, and wait twice
+// as long while the target signals maintenance mode.
+func LoadHttpWithRefresh(ctx context.Context, server *viewproxy.Server, path string, interval time.Duration, opts ...HttpOption) error {
+	config := newHttpConfig(opts)
+	inMaintenance := false
+
+	if err := refreshRoutes(ctx, server, path, config, &inMaintenance); err != nil {
+		return err
+	}
+
+	go func() {
+		wait := interval
+
+		for {
+			if err := config.sleep(ctx, wait); err != nil {
+				return
+			}
+
+			err := refreshRoutes(ctx, server, path, config, &inMaintenance)
+			if ctx.Err() != nil {
+				return
+			}
+
+			wait = interval
+			if inMaintenance {
+				wait = 2 * interval
+			}
+
+			if err != nil {
+				var unavailableErr *UnavailableError
+				if errors.As(err, &unavailableErr) && unavailableErr.RetryAfter > wait {
+					wait = unavailableErr.RetryAfter
+				}
+
+				server.Notifier.Emit(
+					EventRefreshFailed,
+					context.WithValue(ctx, refreshErrorContextKey{}, err),
+					func(context.Context) {},
+				)
+			}
+		}
+	}()
+
+	return nil
+}
+
+func refreshRoutes(ctx context.Context, server *viewproxy.Server, path string, config *httpConfig, inMaintenance *bool) error {
+	routesJson, err := fetchRoutesWithRetries(ctx, server, path, config, inMaintenance)
+	if err != nil {
+		return err
+	}
+
+	routeEntries, err := parseRoutesJson(routesJson)
+	if err != nil {
+		return err
+	}
+
+	routes, err := BuildRoutes(routeEntries)
+	if err != nil {
+		return fmt.Errorf("could not build routes: %w", err)
+	}
+
+	return server.ReloadRoutes(routes)
+}
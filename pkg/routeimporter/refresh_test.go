@@ -0,0 +1,97 @@
+package routeimporter
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/blakewilliams/viewproxy"
+	"github.com/blakewilliams/viewproxy/pkg/notifier"
+	"github.com/stretchr/testify/require"
+)
+
+var refreshedJsonConfig = []byte(`[
+	{"path": "/users/new", "root": {"path": "/_viewproxy/users/new/layout"}},
+	{"path": "/users/edit", "root": {"path": "/_viewproxy/users/edit/layout"}}
+]`)
+
+func TestLoadHttpWithRefresh(t *testing.T) {
+	var mu sync.Mutex
+	config := jsonConfig
+	instance := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		w.Write(config)
+	})
+	testServer := httptest.NewServer(instance)
+	defer testServer.Close()
+
+	viewproxyServer, err := viewproxy.NewServer(testServer.URL)
+	require.NoError(t, err)
+
+	refreshErrors := make(chan error, 1)
+	n := notifier.New()
+	n.On(EventRefreshFailed, func(ctx context.Context) {
+		refreshErrors <- RefreshErrorFromContext(ctx)
+	})
+	viewproxyServer.Notifier = n
+
+	// Each tick of the fake clock triggers a refresh
+	ticks := make(chan time.Time)
+	fakeClock := func(config *httpConfig) {
+		config.sleep = func(ctx context.Context, d time.Duration) error {
+			select {
+			case <-ticks:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	err = LoadHttpWithRefresh(ctx, viewproxyServer, "/_viewproxy_routes", time.Minute, fakeClock)
+	require.NoError(t, err)
+	requireJsonConfigRoutesLoaded(t, viewproxyServer.Routes())
+
+	mu.Lock()
+	config = refreshedJsonConfig
+	mu.Unlock()
+	ticks <- time.Now()
+
+	require.Eventually(t, func() bool {
+		return len(viewproxyServer.Routes()) == 2
+	}, time.Second, time.Millisecond)
+
+	mu.Lock()
+	config = []byte("not json")
+	mu.Unlock()
+	ticks <- time.Now()
+
+	require.ErrorContains(t, <-refreshErrors, "could not unmarshal route config json")
+	require.Len(t, viewproxyServer.Routes(), 2)
+}
+
+func TestLoadHttpWithRefresh_InitialError(t *testing.T) {
+	instance := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("not json"))
+	})
+	testServer := httptest.NewServer(instance)
+	defer testServer.Close()
+
+	viewproxyServer, err := viewproxy.NewServer(testServer.URL)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	err = LoadHttpWithRefresh(ctx, viewproxyServer, "/_viewproxy_routes", time.Minute)
+	require.ErrorContains(t, err, "could not unmarshal route config json")
+	require.Len(t, viewproxyServer.Routes(), 0)
+}
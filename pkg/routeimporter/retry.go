@@ -0,0 +1,128 @@
+package routeimporter
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/blakewilliams/viewproxy/pkg/multiplexer"
+)
+
+const (
+	// Emitted when the target responds with the maintenance header
+	EventMaintenanceStarted = "routeimporter.maintenance_started"
+	// Emitted when the target responds without the maintenance header after
+	// having been in maintenance mode
+	EventMaintenanceEnded = "routeimporter.maintenance_ended"
+	// Emitted before waiting to retry loading routes from an unavailable
+	// target. The error is available via UnavailableErrorFromContext.
+	EventRetryScheduled = "routeimporter.retry_scheduled"
+)
+
+// UnavailableError is returned by LoadHttp when the target responds with a
+// 503, e.g. while it's being deployed.
+type UnavailableError struct {
+	StatusCode int
+	// The duration requested by the target's Retry-After header, or 0 when
+	// the header was not set
+	RetryAfter time.Duration
+}
+
+func (e *UnavailableError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("target is unavailable (status %d), retry after %s", e.StatusCode, e.RetryAfter)
+	}
+
+	return fmt.Sprintf("target is unavailable (status %d)", e.StatusCode)
+}
+
+type unavailableErrorContextKey struct{}
+
+// UnavailableErrorFromContext returns the error that caused a retry to be
+// scheduled.
+func UnavailableErrorFromContext(ctx context.Context) *UnavailableError {
+	if ctx == nil {
+		return nil
+	}
+
+	if err := ctx.Value(unavailableErrorContextKey{}); err != nil {
+		return err.(*UnavailableError)
+	}
+	return nil
+}
+
+// ParseRetryAfter parses the value of a Retry-After header, which is either a
+// number of seconds or an HTTP date, into the duration to wait from now.
+func ParseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	return multiplexer.ParseRetryAfter(value, now)
+}
+
+type httpConfig struct {
+	attempts          int
+	backoff           time.Duration
+	maxRetryAfter     time.Duration
+	maintenanceHeader string
+	now               func() time.Time
+	sleep             func(ctx context.Context, d time.Duration) error
+}
+
+type HttpOption = func(*httpConfig)
+
+// WithRetries retries loading routes when the target responds with a 503, up
+// to the given number of attempts. The target's Retry-After header is
+// respected, up to maxWait, falling back to backoff when it's not set.
+func WithRetries(attempts int, backoff time.Duration, maxWait time.Duration) HttpOption {
+	return func(config *httpConfig) {
+		config.attempts = attempts
+		config.backoff = backoff
+		config.maxRetryAfter = maxWait
+	}
+}
+
+// WithMaintenanceHeader sets the response header the target uses to signal
+// it's in maintenance mode. EventMaintenanceStarted and EventMaintenanceEnded
+// are emitted via the server's notifier when the signal changes.
+func WithMaintenanceHeader(name string) HttpOption {
+	return func(config *httpConfig) {
+		config.maintenanceHeader = name
+	}
+}
+
+func newHttpConfig(opts []HttpOption) *httpConfig {
+	config := &httpConfig{
+		attempts: 1,
+		now:      time.Now,
+		sleep:    sleep,
+	}
+
+	for _, opt := range opts {
+		opt(config)
+	}
+
+	return config
+}
+
+// retryDelay returns how long to wait before retrying after err.
+func (c *httpConfig) retryDelay(err *UnavailableError) time.Duration {
+	if err.RetryAfter <= 0 {
+		return c.backoff
+	}
+
+	if c.maxRetryAfter > 0 && err.RetryAfter > c.maxRetryAfter {
+		return c.maxRetryAfter
+	}
+
+	return err.RetryAfter
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
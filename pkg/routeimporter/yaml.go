@@ -0,0 +1,49 @@
+package routeimporter
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/blakewilliams/viewproxy"
+	"gopkg.in/yaml.v3"
+)
+
+func LoadYAMLFile(server *viewproxy.Server, filepath string) error {
+	file, err := os.Open(filepath)
+
+	if err != nil {
+		return fmt.Errorf("could not open config file: %w", err)
+	}
+	defer file.Close()
+
+	routesYAML, err := ioutil.ReadAll(file)
+
+	if err != nil {
+		return fmt.Errorf("could not read config file: %w", err)
+	}
+
+	err = LoadYAML(server, routesYAML)
+
+	if err != nil {
+		return fmt.Errorf("could not load config: %w", err)
+	}
+
+	return nil
+}
+
+func LoadYAML(server *viewproxy.Server, routesYAML []byte) error {
+	var routeEntries []ConfigRouteEntry
+
+	if err := yaml.Unmarshal(routesYAML, &routeEntries); err != nil {
+		return fmt.Errorf("could not unmarshal in LoadYAML: %w", err)
+	}
+
+	err := LoadRoutes(server, routeEntries)
+
+	if err != nil {
+		return fmt.Errorf("could not load routes in LoadYAML: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,55 @@
+package routeimporter
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/blakewilliams/viewproxy"
+	"github.com/stretchr/testify/require"
+)
+
+var yamlConfig = []byte(`
+- path: /users/new
+  metadata:
+    controller: sessions
+  root:
+    path: /_viewproxy/users/new/layout
+    metadata:
+      team: identity
+      cacheable: true
+      weight: 2.0
+    children:
+      content:
+        path: /_viewproxy/users/new/content
+`)
+
+func TestLoadYAML(t *testing.T) {
+	viewproxyServer, err := viewproxy.NewServer("http://fake.net")
+	require.NoError(t, err)
+	viewproxyServer.Logger = log.New(ioutil.Discard, "", log.Ldate|log.Ltime)
+
+	err = LoadYAML(viewproxyServer, yamlConfig)
+	require.NoError(t, err)
+
+	requireJsonConfigRoutesLoaded(t, viewproxyServer.Routes())
+}
+
+func TestLoadYAMLFile(t *testing.T) {
+	viewproxyServer, err := viewproxy.NewServer("http://fake.net")
+	require.NoError(t, err)
+	viewproxyServer.Logger = log.New(ioutil.Discard, "", log.Ldate|log.Ltime)
+
+	file, err := ioutil.TempFile(os.TempDir(), "config.yml")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+
+	file.Write(yamlConfig)
+	file.Close()
+
+	err = LoadYAMLFile(viewproxyServer, file.Name())
+	require.NoError(t, err)
+
+	requireJsonConfigRoutesLoaded(t, viewproxyServer.Routes())
+}
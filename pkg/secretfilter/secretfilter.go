@@ -1,8 +1,10 @@
 package secretfilter
 
 import (
+	"bytes"
 	"net/url"
 	"strings"
+	"sync"
 )
 
 type Filter interface {
@@ -13,12 +15,18 @@ type Filter interface {
 	FilterURLStringThrough(source string, target string) string
 	FilterQueryParams(params url.Values) url.Values
 	FilterURLError(errURL string, err *url.Error) *url.Error
+	AddSecret(secret string)
+	FilterSecrets(content []byte) []byte
 }
 
 type mapKey struct{}
 
 type secretFilter struct {
 	allowedMap map[string]mapKey
+	// Secrets are filtered from responses on the goroutines fetching
+	// fragments, so access is guarded by mu
+	mu      sync.RWMutex
+	secrets [][]byte
 }
 
 var _ Filter = &secretFilter{}
@@ -99,3 +107,29 @@ func (l *secretFilter) FilterURLError(errURL string, err *url.Error) *url.Error
 		Err: err.Err,
 	}
 }
+
+// AddSecret registers a secret literal, e.g. an API token, that is replaced
+// by FilterSecrets. Empty secrets are ignored.
+func (l *secretFilter) AddSecret(secret string) {
+	if secret == "" {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.secrets = append(l.secrets, []byte(secret))
+}
+
+// FilterSecrets returns a copy of the content with every registered secret
+// replaced by FILTERED.
+func (l *secretFilter) FilterSecrets(content []byte) []byte {
+	filtered := append([]byte(nil), content...)
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, secret := range l.secrets {
+		filtered = bytes.ReplaceAll(filtered, secret, []byte("FILTERED"))
+	}
+
+	return filtered
+}
@@ -119,3 +119,13 @@ func TestSecretFilter_FilterUrlError(t *testing.T) {
 	require.Equal(t, "Get", filtered.Op)
 	require.Equal(t, io.EOF, filtered.Err)
 }
+
+func TestSecretFilter_FilterSecrets(t *testing.T) {
+	filter := New()
+	filter.AddSecret("hunter2")
+	filter.AddSecret("")
+
+	content := []byte("token=hunter2, again hunter2")
+	require.Equal(t, "token=FILTERED, again FILTERED", string(filter.FilterSecrets(content)))
+	require.Equal(t, "token=hunter2, again hunter2", string(content))
+}
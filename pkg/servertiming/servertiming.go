@@ -0,0 +1,116 @@
+// Package servertiming parses and formats Server-Timing headers.
+package servertiming
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Metric struct {
+	Name        string
+	Duration    time.Duration
+	Description string
+}
+
+// String formats the metric for use in a Server-Timing header, e.g.
+// `db;desc="Database";dur=12.5`.
+func (m Metric) String() string {
+	var b strings.Builder
+	b.WriteString(m.Name)
+
+	if m.Description != "" {
+		b.WriteString(";desc=")
+		b.WriteString(strconv.Quote(m.Description))
+	}
+
+	if m.Duration > 0 {
+		b.WriteString(";dur=")
+		b.WriteString(strconv.FormatFloat(float64(m.Duration)/float64(time.Millisecond), 'f', -1, 64))
+	}
+
+	return b.String()
+}
+
+// FormatHeader formats the metrics as the value of a Server-Timing header.
+func FormatHeader(metrics []Metric) string {
+	values := make([]string, 0, len(metrics))
+	for _, metric := range metrics {
+		values = append(values, metric.String())
+	}
+
+	return strings.Join(values, ", ")
+}
+
+// ParseHeader parses the value of a Server-Timing header. Metrics without a
+// name and parameters that can't be parsed are ignored.
+func ParseHeader(header string) []Metric {
+	metrics, _ := ParseHeaderLimit(header, 0)
+	return metrics
+}
+
+// ParseHeaderLimit parses at most limit metrics from the value of a
+// Server-Timing header, returning the number of metrics that were dropped. The
+// parameters of dropped metrics are not parsed. There's no limit when limit is
+// 0.
+func ParseHeaderLimit(header string, limit int) ([]Metric, int) {
+	metrics := make([]Metric, 0)
+	dropped := 0
+
+	for _, entry := range splitQuoted(header, ',') {
+		parts := splitQuoted(entry, ';')
+		name := strings.TrimSpace(parts[0])
+		if name == "" {
+			continue
+		}
+
+		if limit > 0 && len(metrics) >= limit {
+			dropped++
+			continue
+		}
+
+		metric := Metric{Name: name}
+		for _, param := range parts[1:] {
+			key, value, _ := strings.Cut(param, "=")
+			key = strings.ToLower(strings.TrimSpace(key))
+			value = strings.TrimSpace(value)
+
+			switch key {
+			case "dur":
+				if duration, err := strconv.ParseFloat(value, 64); err == nil {
+					metric.Duration = time.Duration(duration * float64(time.Millisecond))
+				}
+			case "desc":
+				if unquoted, err := strconv.Unquote(value); err == nil {
+					value = unquoted
+				}
+				metric.Description = value
+			}
+		}
+
+		metrics = append(metrics, metric)
+	}
+
+	return metrics, dropped
+}
+
+// splitQuoted splits s by sep, ignoring separators in quoted strings.
+func splitQuoted(s string, sep byte) []string {
+	parts := make([]string, 0)
+	quoted := false
+	start := 0
+
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quoted:
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(parts, s[start:])
+}
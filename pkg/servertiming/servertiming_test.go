@@ -0,0 +1,38 @@
+package servertiming
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseHeader(t *testing.T) {
+	metrics := ParseHeader(`db;dur=12.5;desc="Database, primary", cache;desc=hit, ;dur=1, render;dur=invalid`)
+
+	require.Equal(t, []Metric{
+		{Name: "db", Duration: 12500 * time.Microsecond, Description: "Database, primary"},
+		{Name: "cache", Description: "hit"},
+		{Name: "render"},
+	}, metrics)
+}
+
+func TestFormatHeader(t *testing.T) {
+	header := FormatHeader([]Metric{
+		{Name: "db", Duration: 12500 * time.Microsecond, Description: "Database"},
+		{Name: "cache"},
+	})
+
+	require.Equal(t, `db;desc="Database";dur=12.5, cache`, header)
+	require.Equal(t, []Metric{
+		{Name: "db", Duration: 12500 * time.Microsecond, Description: "Database"},
+		{Name: "cache"},
+	}, ParseHeader(header))
+}
+
+func TestParseHeaderLimit(t *testing.T) {
+	metrics, dropped := ParseHeaderLimit(`db;dur=12.5, cache;desc=hit, , render;dur=3`, 1)
+
+	require.Equal(t, []Metric{{Name: "db", Duration: 12500 * time.Microsecond}}, metrics)
+	require.Equal(t, 2, dropped)
+}
@@ -0,0 +1,39 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// The kinds of exporters that can be created by Instrument
+const (
+	ExporterOTLP   = "otlp"
+	ExporterStdout = "stdout"
+	// Jaeger ingests OTLP directly, so spans are exported to the Jaeger
+	// collector via OTLP gRPC.
+	ExporterJaeger = "jaeger"
+)
+
+// newExporter returns the exporter for the ExporterKind of the config.
+func newExporter(config TracingConfig) (sdktrace.SpanExporter, error) {
+	switch config.ExporterKind {
+	case "", ExporterOTLP, ExporterJaeger:
+		options := make([]otlptracegrpc.Option, 0)
+		if config.Endpoint != "" {
+			options = append(options, otlptracegrpc.WithEndpoint(config.Endpoint))
+		}
+		if config.Insecure {
+			options = append(options, otlptracegrpc.WithInsecure())
+		}
+
+		return otlptracegrpc.New(context.Background(), options...)
+	case ExporterStdout:
+		return stdouttrace.New(stdouttrace.WithPrettyPrint())
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter %q", config.ExporterKind)
+	}
+}
@@ -0,0 +1,95 @@
+// Package tracing configures the OpenTelemetry tracer provider used to trace
+// requests handled by viewproxy.
+package tracing
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+type TracingConfig struct {
+	// The name of the service reported on spans
+	ServiceName string
+	// Exports the recorded spans. When nil, an exporter is created based on
+	// ExporterKind.
+	Exporter sdktrace.SpanExporter
+	// The kind of exporter to create when Exporter is nil, one of
+	// ExporterOTLP, ExporterStdout, or ExporterJaeger. Defaults to
+	// ExporterOTLP.
+	ExporterKind string
+	// The address spans are exported to by the OTLP and Jaeger exporters,
+	// e.g. `localhost:4317`. Defaults to the OTLP default endpoint.
+	Endpoint string
+	// Exports spans without TLS when using the OTLP or Jaeger exporters
+	Insecure bool
+	// The ratio of new traces that are sampled, from 0 to 1. Sampling
+	// decisions made by the parent of a span are always respected. Every
+	// trace is sampled when nil.
+	SampleRatio *float64
+	// Overrides the sampler used, ignoring SampleRatio
+	Sampler sdktrace.Sampler
+	// Handles errors that occur while exporting spans
+	ErrorHandler otel.ErrorHandler
+}
+
+// Instrument registers a global tracer provider using the given config. The
+// returned function flushes any pending spans and shuts down the provider and
+// its exporter.
+func Instrument(config TracingConfig) (func(), error) {
+	res, err := resource.Merge(
+		resource.Default(),
+		resource.NewSchemaless(attribute.String("service.name", config.ServiceName)),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	exporter := config.Exporter
+	if exporter == nil {
+		exporter, err = newExporter(config)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sampler(config)),
+		sdktrace.WithBatcher(exporter),
+	)
+
+	if config.ErrorHandler != nil {
+		otel.SetErrorHandler(config.ErrorHandler)
+	}
+
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	return func() {
+		if err := provider.Shutdown(context.Background()); err != nil {
+			otel.Handle(err)
+		}
+	}, nil
+}
+
+// SampleRatio returns a pointer to ratio for use in TracingConfig.
+func SampleRatio(ratio float64) *float64 {
+	return &ratio
+}
+
+func sampler(config TracingConfig) sdktrace.Sampler {
+	if config.Sampler != nil {
+		return config.Sampler
+	}
+
+	if config.SampleRatio == nil {
+		return sdktrace.ParentBased(sdktrace.AlwaysSample())
+	}
+
+	return sdktrace.ParentBased(sdktrace.TraceIDRatioBased(*config.SampleRatio))
+}
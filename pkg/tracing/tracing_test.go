@@ -0,0 +1,74 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// testExporter records exported spans, keeping them after shutdown
+type testExporter struct {
+	spans []sdktrace.ReadOnlySpan
+}
+
+func (e *testExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func (e *testExporter) Shutdown(ctx context.Context) error { return nil }
+
+func TestInstrument_SamplesEveryTraceByDefault(t *testing.T) {
+	exporter := &testExporter{}
+	shutdown, err := Instrument(TracingConfig{ServiceName: "viewproxy", Exporter: exporter})
+	require.NoError(t, err)
+
+	_, span := otel.Tracer("test").Start(context.Background(), "request")
+	span.End()
+	shutdown()
+
+	require.Len(t, exporter.spans, 1)
+}
+
+func TestInstrument_SampleRatio(t *testing.T) {
+	exporter := &testExporter{}
+	shutdown, err := Instrument(TracingConfig{
+		ServiceName: "viewproxy",
+		Exporter:    exporter,
+		SampleRatio: SampleRatio(0),
+	})
+	require.NoError(t, err)
+
+	_, span := otel.Tracer("test").Start(context.Background(), "unsampled")
+	span.End()
+
+	// Sampled parents are still respected
+	parent := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1},
+		SpanID:     trace.SpanID{1},
+		TraceFlags: trace.FlagsSampled,
+		Remote:     true,
+	})
+	ctx := trace.ContextWithRemoteSpanContext(context.Background(), parent)
+	_, span = otel.Tracer("test").Start(ctx, "sampled")
+	span.End()
+	shutdown()
+
+	require.Len(t, exporter.spans, 1)
+	require.Equal(t, "sampled", exporter.spans[0].Name())
+}
+
+func TestInstrument_ExporterKind(t *testing.T) {
+	for _, kind := range []string{"", ExporterOTLP, ExporterStdout, ExporterJaeger} {
+		shutdown, err := Instrument(TracingConfig{ServiceName: "viewproxy", ExporterKind: kind, Insecure: true})
+		require.NoError(t, err, kind)
+		shutdown()
+	}
+
+	_, err := Instrument(TracingConfig{ServiceName: "viewproxy", ExporterKind: "zipkin"})
+	require.EqualError(t, err, `unknown tracing exporter "zipkin"`)
+}
@@ -0,0 +1,117 @@
+// Package tracinghooks records OpenTelemetry spans for multiplexer events.
+package tracinghooks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/blakewilliams/viewproxy/pkg/multiplexer"
+	"github.com/blakewilliams/viewproxy/pkg/notifier"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RegisterMultiplexer subscribes to multiplexer events to record a
+// `fetch_urls` span around each request and a `fetch_url` span around each
+// fragment fetch.
+func RegisterMultiplexer(n *notifier.DefaultNotifier) {
+	n.Around(multiplexer.EventFetchAll, func(ctx context.Context, next func(context.Context)) {
+		ctx, span := otel.Tracer("multiplexer").Start(ctx, "fetch_urls")
+		defer span.End()
+
+		next(ctx)
+	})
+
+	n.Around(multiplexer.EventFetchSingle, func(ctx context.Context, next func(context.Context)) {
+		fetch := multiplexer.FetchFromContext(ctx)
+		if fetch == nil {
+			next(ctx)
+			return
+		}
+
+		ctx, span := otel.Tracer("multiplexer").Start(ctx, "fetch_url")
+		defer span.End()
+
+		for key, value := range multiplexer.TypedMetadataFor(fetch.Requestable) {
+			span.SetAttributes(metadataAttribute(key, value))
+		}
+		span.SetAttributes(
+			semconv.HTTPMethod(fetch.Method),
+			semconv.HTTPURL(fetch.URL),
+		)
+
+		next(ctx)
+
+		if fetch.Result != nil && fetch.Result.Skipped {
+			span.SetAttributes(attribute.Bool("skipped", true))
+		}
+		setSpanReplica(span, fetch.Result)
+		setSpanResult(span, fetch.Result, fetch.Err)
+	})
+}
+
+// metadataAttribute returns a span attribute for the metadata value, using the
+// attribute type matching the type of the value.
+func metadataAttribute(key string, value interface{}) attribute.KeyValue {
+	switch v := value.(type) {
+	case string:
+		return attribute.String(key, v)
+	case bool:
+		return attribute.Bool(key, v)
+	case int:
+		return attribute.Int(key, v)
+	case int64:
+		return attribute.Int64(key, v)
+	case float64:
+		return attribute.Float64(key, v)
+	case []string:
+		return attribute.StringSlice(key, v)
+	default:
+		return attribute.String(key, fmt.Sprint(v))
+	}
+}
+
+// setSpanReplica records the host of the replica the result was fetched from,
+// and the hosts of the replicas that failed over to it.
+func setSpanReplica(span trace.Span, result *multiplexer.Result) {
+	if result == nil {
+		return
+	}
+
+	if resultURL, err := url.Parse(result.Url); err == nil && resultURL.Host != "" {
+		span.SetAttributes(attribute.String("viewproxy.replica", resultURL.Host))
+	}
+
+	if len(result.FailedOver) > 0 {
+		span.SetAttributes(attribute.StringSlice("viewproxy.failed_over", result.FailedOver))
+	}
+}
+
+// setSpanResult records the status code and response size of a fragment on
+// its span. The span is marked as errored for non-2xx responses and transport
+// errors.
+func setSpanResult(span trace.Span, result *multiplexer.Result, err error) {
+	var resultErr *multiplexer.ResultError
+	if errors.As(err, &resultErr) {
+		result = resultErr.Result
+	}
+
+	if result != nil {
+		span.SetAttributes(
+			semconv.HTTPStatusCode(result.StatusCode),
+			semconv.HTTPResponseContentLength(len(result.Body)),
+		)
+	}
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	} else if result != nil && (result.StatusCode < 200 || result.StatusCode > 299) {
+		span.SetStatus(codes.Error, fmt.Sprintf("status: %d", result.StatusCode))
+	}
+}
@@ -0,0 +1,120 @@
+package tracinghooks
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/blakewilliams/viewproxy/pkg/multiplexer"
+	"github.com/blakewilliams/viewproxy/pkg/notifier"
+	"github.com/blakewilliams/viewproxy/pkg/secretfilter"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+type fakeRequestable struct {
+	url string
+}
+
+func (fr *fakeRequestable) URL() string         { return fr.url }
+func (fr *fakeRequestable) TemplateURL() string { return fr.url }
+func (fr *fakeRequestable) Metadata() map[string]string {
+	return map[string]string{"controller": "hello"}
+}
+
+func withSpanRecorder(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	return recorder
+}
+
+func namedSpans(recorder *tracetest.SpanRecorder, name string) []sdktrace.ReadOnlySpan {
+	spans := make([]sdktrace.ReadOnlySpan, 0)
+	for _, span := range recorder.Ended() {
+		if span.Name() == name {
+			spans = append(spans, span)
+		}
+	}
+
+	return spans
+}
+
+func spanAttributes(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	attributes := make(map[attribute.Key]attribute.Value)
+	for _, kv := range span.Attributes() {
+		attributes[kv.Key] = kv.Value
+	}
+
+	return attributes
+}
+
+func fetch(url string) error {
+	n := notifier.New()
+	RegisterMultiplexer(n)
+
+	r := multiplexer.NewRequest(multiplexer.NewStandardTripper(&http.Client{}), multiplexer.WithNotifier(n))
+	r.SecretFilter = secretfilter.New()
+	r.WithRequestable(&fakeRequestable{url: url})
+
+	_, err := r.Do(context.Background())
+	return err
+}
+
+func startServer(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Write([]byte("<body>"))
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestFetchSpanAttributes(t *testing.T) {
+	recorder := withSpanRecorder(t)
+	server := startServer(t)
+
+	require.NoError(t, fetch(server.URL+"/header?secret=hunter2"))
+
+	spans := namedSpans(recorder, "fetch_url")
+	require.Len(t, spans, 1)
+
+	attributes := spanAttributes(spans[0])
+	require.Equal(t, "GET", attributes["http.method"].AsString())
+	require.Equal(t, server.URL+"/header?secret=FILTERED", attributes["http.url"].AsString())
+	require.Equal(t, "hello", attributes["controller"].AsString())
+	require.Equal(t, strings.TrimPrefix(server.URL, "http://"), attributes["viewproxy.replica"].AsString())
+	require.Equal(t, int64(200), attributes["http.status_code"].AsInt64())
+	require.Equal(t, int64(len("<body>")), attributes["http.response_content_length"].AsInt64())
+	require.Equal(t, codes.Unset, spans[0].Status().Code)
+
+	// The fetch span is a child of the span for the whole request
+	parents := namedSpans(recorder, "fetch_urls")
+	require.Len(t, parents, 1)
+	require.Equal(t, parents[0].SpanContext().SpanID(), spans[0].Parent().SpanID())
+}
+
+func TestFetchSpanErrorStatus(t *testing.T) {
+	recorder := withSpanRecorder(t)
+	server := startServer(t)
+
+	require.Error(t, fetch(server.URL+"/missing"))
+
+	spans := namedSpans(recorder, "fetch_url")
+	require.Len(t, spans, 1)
+	require.Equal(t, int64(404), spanAttributes(spans[0])["http.status_code"].AsInt64())
+	require.Equal(t, codes.Error, spans[0].Status().Code)
+}
@@ -0,0 +1,272 @@
+package viewproxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blakewilliams/viewproxy/pkg/multiplexer"
+)
+
+// ErrInvalidPrefetchLimits is returned by WithPrefetchHints when the
+// concurrency or rate of prefetches isn't greater than 0.
+var ErrInvalidPrefetchLimits = errors.New("prefetch concurrency and rate must be greater than 0")
+
+// The number of hinted routes waiting to be prefetched before hints are
+// dropped
+const prefetchQueueSize = 64
+
+// prefetchHint is a route the client is likely to navigate to next, parsed
+// from a hint like `</hello/bob>; rel=prefetch; viewproxy-route="/hello/:name"`.
+type prefetchHint struct {
+	url   *url.URL
+	route string
+}
+
+type prefetch struct {
+	route *Route
+	url   *url.URL
+	host  string
+}
+
+// prefetcher fetches the shared fragments of hinted routes in the background
+// so they're cached in the SharedCache by the time the client requests them.
+type prefetcher struct {
+	server      *Server
+	header      string
+	concurrency int
+	limiter     *rateLimiter
+	queue       chan *prefetch
+	start       sync.Once
+	ctx         context.Context
+	cancel      context.CancelFunc
+}
+
+// WithPrefetchHints prefetches the routes hinted by the given header of the
+// root fragment's response, e.g.
+// `Link: </hello/bob>; rel=prefetch; viewproxy-route="/hello/:name"`, so the
+// client's next navigation is fast. Only the shared fragments of hinted routes
+// are fetched, anonymously and in the background, through the SharedCache.
+// Hints for routes that don't exist or don't match the hinted URL are ignored.
+//
+// At most concurrency prefetches are made at once and at most maxPerSecond
+// are started each second, hints beyond that are dropped. Prefetches are made
+// with a context marked by multiplexer.WithSynthetic.
+func WithPrefetchHints(header string, concurrency int, maxPerSecond int) ServerOption {
+	return namedOption("WithPrefetchHints", func(server *Server) error {
+		if concurrency <= 0 || maxPerSecond <= 0 {
+			return ErrInvalidPrefetchLimits
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		server.prefetcher = &prefetcher{
+			server:      server,
+			header:      header,
+			concurrency: concurrency,
+			limiter:     newRateLimiter(maxPerSecond),
+			queue:       make(chan *prefetch, prefetchQueueSize),
+			ctx:         ctx,
+			cancel:      cancel,
+		}
+
+		return nil
+	})
+}
+
+// enqueueHints queues the valid routes hinted by the root fragment's result
+// of a request. Workers are started by the first hint.
+func (p *prefetcher) enqueueHints(r *http.Request, root *multiplexer.Result) {
+	if p == nil || root == nil || root.HttpResponse == nil || p.server.SharedCache == nil {
+		return
+	}
+
+	for _, hint := range parsePrefetchHints(root.HttpResponse.Header.Values(p.header)) {
+		route, _ := p.server.matchingRequestRoute(r.Host, hint.url.EscapedPath())
+		if route == nil || route.Path != hint.route || !route.enabledFor(r.Context()) {
+			continue
+		}
+
+		if !p.limiter.allow() {
+			return
+		}
+
+		p.start.Do(p.startWorkers)
+		select {
+		case p.queue <- &prefetch{route: route, url: hint.url, host: r.Host}:
+		default:
+			return
+		}
+	}
+}
+
+func (p *prefetcher) startWorkers() {
+	for i := 0; i < p.concurrency; i++ {
+		go func() {
+			for {
+				select {
+				case <-p.ctx.Done():
+					return
+				case next := <-p.queue:
+					p.server.prefetchRoute(p.ctx, next)
+				}
+			}
+		}()
+	}
+}
+
+// stop stops the workers, abandoning queued prefetches.
+func (p *prefetcher) stop() {
+	if p != nil {
+		p.cancel()
+	}
+}
+
+// prefetchRoute fetches the shared fragments of the route for the hinted URL
+// without the headers of the request that hinted it, so user cookies are never
+// forwarded and the fragments are cached for anonymous requests.
+func (s *Server) prefetchRoute(ctx context.Context, next *prefetch) {
+	ctx = multiplexer.WithSynthetic(ctx)
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, next.url.String(), nil)
+	if err != nil {
+		return
+	}
+	r.Host = next.host
+
+	req := s.newRequest()
+	req.HmacSecret = s.HmacSecret
+	dynamicParts, _ := next.route.fragmentParameters(next.url.EscapedPath())
+	query := url.Values{}
+	for name, values := range next.url.Query() {
+		if next.route.forwardsQueryParam(name) && !s.stripsQueryParam(name) {
+			query[name] = values
+		}
+	}
+
+	skipped := make([]string, 0)
+	for i, f := range next.route.FragmentsToRequest() {
+		key := next.route.FragmentOrder()[i]
+		if hasSkippedAncestor(key, skipped) {
+			continue
+		}
+
+		selected := f.SelectFor(r)
+		if selected == nil || selected.Lazy {
+			skipped = append(skipped, key)
+			continue
+		}
+
+		definition, canary := next.route.selectCanary(key, selected, s.CanaryKey(r))
+		if definition.IsStatic() || !definition.Shared {
+			continue
+		}
+
+		targetURL := next.route.targetURL
+		if targetURL == nil {
+			targetURL = s.targets.next()
+		}
+
+		requestable, err := definition.Requestable(targetURL, dynamicParts, query)
+		if err != nil {
+			continue
+		}
+		requestable.Canary = canary
+		requestable.FragmentKey = key
+		req.WithRequestable(requestable)
+	}
+
+	if req.RequestableCount() == 0 {
+		return
+	}
+
+	results, err := req.Do(ctx)
+	multiplexer.ReleaseResults(results, err)
+}
+
+// rootResult returns the result of the root fragment, given the keys of the
+// requested fragments in the order of the results.
+func rootResult(requested []string, results []*multiplexer.Result) *multiplexer.Result {
+	for i, key := range requested {
+		if key == "root" && i < len(results) {
+			return results[i]
+		}
+	}
+
+	return nil
+}
+
+// parsePrefetchHints returns the hints with `rel=prefetch` and a
+// `viewproxy-route` param in the header values. Each value can contain
+// several comma separated hints.
+func parsePrefetchHints(values []string) []prefetchHint {
+	hints := make([]prefetchHint, 0)
+
+	for _, value := range values {
+		for _, link := range strings.Split(value, ",") {
+			parts := strings.Split(link, ";")
+			target := strings.TrimSpace(parts[0])
+			if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+
+			var rel, route string
+			for _, param := range parts[1:] {
+				name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+				value = strings.Trim(value, `"`)
+
+				switch strings.ToLower(name) {
+				case "rel":
+					rel = value
+				case "viewproxy-route":
+					route = value
+				}
+			}
+
+			hintURL, err := url.Parse(target[1 : len(target)-1])
+			// Only paths are hinted, hints for other hosts are ignored
+			if err != nil || hintURL.Host != "" || !strings.EqualFold(rel, "prefetch") || route == "" {
+				continue
+			}
+
+			hints = append(hints, prefetchHint{url: hintURL, route: route})
+		}
+	}
+
+	return hints
+}
+
+// rateLimiter allows a maximum number of events each second.
+type rateLimiter struct {
+	max         int
+	mu          sync.Mutex
+	windowStart time.Time
+	count       int
+	now         func() time.Time
+}
+
+func newRateLimiter(max int) *rateLimiter {
+	return &rateLimiter{max: max, now: time.Now}
+}
+
+// allow returns true and counts the event when fewer than max events were
+// allowed in the current second.
+func (rl *rateLimiter) allow() bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := rl.now()
+	if now.Sub(rl.windowStart) >= time.Second {
+		rl.windowStart = now
+		rl.count = 0
+	}
+
+	if rl.count >= rl.max {
+		return false
+	}
+
+	rl.count++
+	return true
+}
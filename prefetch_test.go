@@ -0,0 +1,125 @@
+package viewproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/blakewilliams/viewproxy/pkg/fragment"
+	"github.com/blakewilliams/viewproxy/pkg/multiplexer"
+	"github.com/stretchr/testify/require"
+)
+
+// startPrefetchTarget starts a target whose home layout responds with the
+// given prefetch hints.
+func startPrefetchTarget(t *testing.T, hints ...string) *testTarget {
+	target := startTarget(t)
+	respondWithHints(target, hints...)
+	for _, name := range []string{"bob", "a", "b", "c"} {
+		target.respond("/layout/"+name, &targetResponse{body: `<viewproxy-fragment id="body"></viewproxy-fragment>`})
+	}
+
+	return target
+}
+
+func respondWithHints(target *testTarget, hints ...string) {
+	target.respond("/layouts/home", &targetResponse{header: http.Header{"X-Prefetch": hints}})
+}
+
+func newPrefetchServer(t *testing.T, target *testTarget, maxPerSecond int) *Server {
+	server := newServer(t, target.URL, WithPrefetchHints("X-Prefetch", 2, maxPerSecond))
+	t.Cleanup(server.prefetcher.stop)
+	server.SharedCache = multiplexer.NewSharedCache(time.Minute)
+
+	require.NoError(t, server.Get("/home", fragment.Define("/layouts/home", fragment.WithoutValidation())))
+	require.NoError(t, server.Get("/hello/:name", fragment.Define("/layout/:name",
+		fragment.WithoutValidation(),
+		fragment.Shared(),
+		fragment.WithChild("body", fragment.Define("/body/:name", fragment.WithoutValidation())),
+	)))
+
+	return server
+}
+
+func getWithCookie(server *Server, path string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", path, nil)
+	r.Header.Set("Cookie", "session=abc")
+	w := httptest.NewRecorder()
+	server.CreateHandler().ServeHTTP(w, r)
+
+	return w
+}
+
+func TestPrefetchHints(t *testing.T) {
+	target := startPrefetchTarget(t,
+		`</hello/bob>; rel=prefetch; viewproxy-route="/hello/:name", </about>; rel=prefetch; viewproxy-route="/about"`,
+		`</hello/alice>; rel=prefetch; viewproxy-route="/about"`,
+		`</hello/carol>; rel=preload; viewproxy-route="/hello/:name"`,
+	)
+	server := newPrefetchServer(t, target, 10)
+
+	require.Equal(t, http.StatusOK, getWithCookie(server, "/home").Code)
+	require.Eventually(t, func() bool { return target.count("/layout/bob") == 1 }, time.Second, 5*time.Millisecond)
+
+	// The prefetched fragment is served from the SharedCache, while fragments
+	// that aren't shared are never prefetched
+	w := httptest.NewRecorder()
+	server.CreateHandler().ServeHTTP(w, httptest.NewRequest("GET", "/hello/bob", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, 1, target.count("/layout/bob"))
+	require.Equal(t, 1, target.count("/body/bob"))
+
+	// Hints for routes that don't exist or don't match, and hints that
+	// aren't prefetches are ignored
+	require.Equal(t, 0, target.count("/layout/alice"))
+	require.Equal(t, 0, target.count("/layout/carol"))
+
+	for _, path := range []string{"/layout/bob", "/body/bob"} {
+		require.Empty(t, target.requestHeaders(path)[0].Get("Cookie"), "cookies should not be forwarded to prefetches")
+	}
+}
+
+func TestPrefetchHints_RateLimit(t *testing.T) {
+	target := startPrefetchTarget(t,
+		`</hello/a>; rel=prefetch; viewproxy-route="/hello/:name"`,
+		`</hello/b>; rel=prefetch; viewproxy-route="/hello/:name"`,
+		`</hello/c>; rel=prefetch; viewproxy-route="/hello/:name"`,
+	)
+	server := newPrefetchServer(t, target, 2)
+	now := time.Unix(1700000000, 0)
+	server.prefetcher.limiter.now = func() time.Time { return now }
+
+	getWithCookie(server, "/home")
+	require.Eventually(t, func() bool {
+		return target.count("/layout/a")+target.count("/layout/b") == 2
+	}, time.Second, 5*time.Millisecond)
+
+	getWithCookie(server, "/home")
+	time.Sleep(20 * time.Millisecond)
+	require.Equal(t, 0, target.count("/layout/c"))
+
+	respondWithHints(target, `</hello/c>; rel=prefetch; viewproxy-route="/hello/:name"`)
+
+	now = now.Add(time.Second)
+	getWithCookie(server, "/home")
+	require.Eventually(t, func() bool { return target.count("/layout/c") == 1 }, time.Second, 5*time.Millisecond)
+}
+
+func TestWithPrefetchHints_InvalidLimits(t *testing.T) {
+	_, err := NewServer("http://localhost:9999", WithPrefetchHints("Link", 0, 10))
+	require.ErrorIs(t, err, ErrInvalidPrefetchLimits)
+}
+
+func TestParsePrefetchHints(t *testing.T) {
+	hints := parsePrefetchHints([]string{
+		`</hello/bob?page=2>; rel="prefetch"; viewproxy-route="/hello/:name"`,
+		`<https://example.com/hello/bob>; rel=prefetch; viewproxy-route="/hello/:name"`,
+		`</hello/bob>; rel=prefetch`,
+		`/hello/bob; rel=prefetch; viewproxy-route="/hello/:name"`,
+	})
+
+	require.Len(t, hints, 1)
+	require.Equal(t, "/hello/bob?page=2", hints[0].url.String())
+	require.Equal(t, "/hello/:name", hints[0].route)
+}
@@ -0,0 +1,203 @@
+package viewproxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/blakewilliams/viewproxy/pkg/fragment"
+	"github.com/blakewilliams/viewproxy/pkg/multiplexer"
+)
+
+const defaultMaxRequestDepth = 3
+
+// FragmentPathCollisionError describes a fragment requested from the server's
+// own address whose path, with the server's path prefix, matches the path of
+// a route. Requests for the fragment recurse through viewproxy. It's returned
+// by Get, ReloadRoutes, and discovery when StrictFragmentPaths is set.
+type FragmentPathCollisionError struct {
+	// The path of the route the fragment belongs to
+	Route string
+	// The key of the fragment, e.g. `root.header`
+	FragmentKey string
+	// The path of the fragment
+	FragmentPath string
+	// The path of the route matching the fragment's path
+	MatchedRoute string
+}
+
+func (e *FragmentPathCollisionError) Error() string {
+	return fmt.Sprintf(
+		"route %s fragment %s: path %s matches route %s",
+		e.Route,
+		e.FragmentKey,
+		e.FragmentPath,
+		e.MatchedRoute,
+	)
+}
+
+// requestDepth returns the number of times the request has passed through
+// viewproxy, according to its X-Viewproxy-Depth header. The header is only
+// trusted on requests signed with the HmacSecret, or made from the loopback
+// address, so clients can't set it. Other requests have a depth of 0.
+func (s *Server) requestDepth(r *http.Request) int {
+	if !multiplexer.ValidHmac(s.HmacSecret, r) && !isLoopbackAddr(r.RemoteAddr) {
+		return 0
+	}
+
+	depth, err := strconv.Atoi(r.Header.Get(HeaderViewProxyDepth))
+	if err != nil || depth < 0 {
+		return 0
+	}
+
+	return depth
+}
+
+// isLoopbackAddr returns true when the remote address of a request is a
+// loopback address, e.g. `127.0.0.1:51234`.
+func isLoopbackAddr(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return false
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// checkFragmentPaths logs a warning for each collision, returning the first
+// collision instead when StrictFragmentPaths is set.
+func (s *Server) checkFragmentPaths(collisions []*FragmentPathCollisionError) error {
+	for _, collision := range collisions {
+		if s.StrictFragmentPaths {
+			return collision
+		}
+
+		s.Logger.Printf("Warning: %s", collision)
+	}
+
+	return nil
+}
+
+// fragmentPathCollisions returns the fragments of route that request one of
+// routes from the server itself, and the fragments of routes that request
+// route.
+func (s *Server) fragmentPathCollisions(route *Route, routes []*Route) []*FragmentPathCollisionError {
+	collisions := s.collidingFragments(route, append([]*Route{route}, routes...))
+
+	for _, other := range routes {
+		collisions = append(collisions, s.collidingFragments(other, []*Route{route})...)
+	}
+
+	return collisions
+}
+
+// collidingFragments returns the fragments of route requested from the
+// server's own address whose path, with the server's path prefix, matches one
+// of routes.
+func (s *Server) collidingFragments(route *Route, routes []*Route) []*FragmentPathCollisionError {
+	collisions := make([]*FragmentPathCollisionError, 0)
+
+	var prefixParts []string
+	if s.pathPrefix != "" {
+		prefixParts = strings.Split(s.pathPrefix[1:], "/")
+	}
+
+	for i, f := range route.FragmentsToRequest() {
+		definitions := append([]*fragment.Definition{f}, f.Alternates()...)
+		if canary := f.CanaryDefinition(); canary != nil {
+			definitions = append(definitions, canary)
+		}
+
+		for _, definition := range definitions {
+			// Only fragments requested from the server itself can recurse
+			if definition.IsStatic() || definition.Fetcher != nil || !s.requestsOwnAddr(definition) {
+				continue
+			}
+
+			for _, other := range routes {
+				routeParts := append(append([]string{}, prefixParts...), other.Parts[1:]...)
+				if !pathsCollide(routeParts, definition.PathParts()) {
+					continue
+				}
+
+				collisions = append(collisions, &FragmentPathCollisionError{
+					Route:        route.Path,
+					FragmentKey:  route.FragmentOrder()[i],
+					FragmentPath: definition.Path,
+					MatchedRoute: other.Path,
+				})
+			}
+		}
+	}
+
+	return collisions
+}
+
+// requestsOwnAddr returns true when the fragment is requested from the
+// address the server listens on, either via its own Target or one of the
+// server's targets.
+func (s *Server) requestsOwnAddr(definition *fragment.Definition) bool {
+	if definition.Target != nil {
+		return s.isOwnAddr(definition.Target)
+	}
+
+	for _, target := range s.targets.targets {
+		if s.isOwnAddr(target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// pathsCollide returns true when a request could match both paths, treating
+// dynamic parts as matching any value.
+func pathsCollide(parts []string, otherParts []string) bool {
+	if len(parts) != len(otherParts) {
+		return false
+	}
+
+	for i := range parts {
+		if strings.HasPrefix(parts[i], ":") || strings.HasPrefix(otherParts[i], ":") {
+			continue
+		}
+
+		if parts[i] != otherParts[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isOwnAddr returns true when target points at the address the server listens
+// on, e.g. `http://localhost:3005` for the default Addr.
+func (s *Server) isOwnAddr(target *url.URL) bool {
+	if target == nil || s.Addr == "" {
+		return false
+	}
+
+	if strings.EqualFold(target.Host, s.Addr) {
+		return true
+	}
+
+	host, port, err := net.SplitHostPort(s.Addr)
+	if err != nil || port != target.Port() {
+		return false
+	}
+
+	return strings.EqualFold(host, target.Hostname()) || (host == "" && isLoopback(target.Hostname()))
+}
+
+func isLoopback(hostname string) bool {
+	if strings.EqualFold(hostname, "localhost") {
+		return true
+	}
+
+	ip := net.ParseIP(hostname)
+	return ip != nil && ip.IsLoopback()
+}
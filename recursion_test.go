@@ -0,0 +1,202 @@
+package viewproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/blakewilliams/viewproxy/pkg/fragment"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFragmentPathCollisions(t *testing.T) {
+	var logs bytes.Buffer
+	// Fragments are requested from the server's own address
+	server := newServer(t, "http://localhost:3005")
+	server.Logger = log.New(&logs, "", 0)
+
+	require.NoError(t, server.Get("/hello/:name", fragment.Define(
+		"/layouts/test_layout",
+		fragment.WithoutValidation(),
+		fragment.WithChild("body", fragment.Define("/hello/:id", fragment.WithoutValidation())),
+		fragment.WithChild("static", fragment.Static([]byte("/hello"))),
+	)))
+	require.Equal(t, "Warning: route /hello/:name fragment root.body: path /hello/:id matches route /hello/:name\n", logs.String())
+
+	// Routes registered later are checked against existing fragments
+	logs.Reset()
+	require.NoError(t, server.Get("/layouts/:name", fragment.Define("/page/:name")))
+	require.Equal(t, "Warning: route /hello/:name fragment root: path /layouts/test_layout matches route /layouts/:name\n", logs.String())
+
+	report := server.ValidateConfiguration(context.Background())
+	require.Len(t, report.Warnings, 2)
+	require.Equal(t, FindingFragmentPathCollision, report.Warnings[0].Code)
+
+	server = newServer(t, "http://localhost:3005")
+	server.StrictFragmentPaths = true
+
+	err := server.Get("/hello/:name", fragment.Define("/hello/:name"))
+	var collision *FragmentPathCollisionError
+	require.ErrorAs(t, err, &collision)
+	require.Equal(t, "root", collision.FragmentKey)
+	require.Empty(t, server.Routes())
+
+	// Fragments fetched from another target can't recurse
+	require.NoError(t, server.Get("/search/:query", fragment.Define("/search/:query", fragment.WithTarget("http://search.internal"))))
+
+	logs.Reset()
+	server = newServer(t, targetServer.URL)
+	server.Logger = log.New(&logs, "", 0)
+	require.NoError(t, server.Get("/hello/:name", fragment.Define("/hello/:name")))
+	require.Empty(t, logs.String())
+}
+
+func TestFragmentPathCollisions_PathPrefix(t *testing.T) {
+	server := newServer(t, "http://localhost:3005", WithPathPrefix("/app"))
+	server.StrictFragmentPaths = true
+
+	// Requests for /hello/:name don't reach the route without the prefix
+	require.NoError(t, server.Get("/hello/:name", fragment.Define("/hello/:name")))
+
+	err := server.Get("/goodbye/:name", fragment.Define("/app/goodbye/:name"))
+	var collision *FragmentPathCollisionError
+	require.ErrorAs(t, err, &collision)
+	require.Equal(t, "/goodbye/:name", collision.MatchedRoute)
+}
+
+func TestFragmentPathCollisions_ReloadRoutes(t *testing.T) {
+	var logs bytes.Buffer
+	server := newServer(t, "http://localhost:3005")
+	server.Logger = log.New(&logs, "", 0)
+
+	helloRoute, err := NewRoute("/hello/:name", fragment.Define("/layouts/test_layout", fragment.WithoutValidation()))
+	require.NoError(t, err)
+	layoutRoute, err := NewRoute("/layouts/:name", fragment.Define("/page/:name"))
+	require.NoError(t, err)
+
+	require.NoError(t, server.ReloadRoutes([]*Route{helloRoute, layoutRoute}))
+	require.Equal(t, "Warning: route /hello/:name fragment root: path /layouts/test_layout matches route /layouts/:name\n", logs.String())
+	require.Len(t, server.Routes(), 2)
+
+	server = newServer(t, "http://localhost:3005")
+	server.StrictFragmentPaths = true
+	require.NoError(t, server.ReloadRoutes([]*Route{helloRoute}))
+
+	// The existing routes are kept when the reload collides
+	err = server.ReloadRoutes([]*Route{helloRoute, layoutRoute})
+	var collision *FragmentPathCollisionError
+	require.ErrorAs(t, err, &collision)
+	require.Equal(t, "/layouts/:name", collision.MatchedRoute)
+	require.Equal(t, []*Route{helloRoute}, server.Routes())
+}
+
+func TestFragmentPathCollisions_GetDiscovered(t *testing.T) {
+	var discoveries int32
+	target := startDiscoveryTargetServer(&discoveries)
+	defer target.Close()
+
+	// Fragments are requested from the server's own address
+	server := newServer(t, target.URL)
+	server.Addr = target.Listener.Addr().String()
+	server.StrictFragmentPaths = true
+	require.NoError(t, server.Get("/body/:name", fragment.Define("/page/:name")))
+
+	err := server.GetDiscovered("/hello/:name")
+	var collision *FragmentPathCollisionError
+	require.ErrorAs(t, err, &collision)
+	require.Equal(t, "root.body", collision.FragmentKey)
+	require.Len(t, server.Routes(), 1)
+}
+
+func TestValidateConfiguration_SelfTarget(t *testing.T) {
+	server := newServer(t, "http://localhost:3005", WithPassThrough("http://127.0.0.1:9000"))
+	server.Addr = ":9000"
+
+	report := server.ValidateConfiguration(context.Background())
+
+	codes := make([]string, 0)
+	for _, finding := range report.Errors {
+		codes = append(codes, finding.Code)
+	}
+	require.Equal(t, []string{FindingSelfTarget}, codes)
+	require.Contains(t, report.Errors[0].Message, "pass through target 127.0.0.1:9000")
+}
+
+func TestMaxRequestDepth(t *testing.T) {
+	var requests int32
+	var handler http.Handler
+	loop := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		handler.ServeHTTP(w, r)
+	}))
+	defer loop.Close()
+
+	// The target routes fragment requests back to viewproxy
+	server := newServer(t, loop.URL)
+	server.Logger = log.New(&bytes.Buffer{}, "", 0)
+	require.NoError(t, server.Get("/hello/:name", fragment.Define("/hello/:name")))
+	handler = server.CreateHandler()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/hello/world", nil))
+
+	require.Equal(t, http.StatusInternalServerError, w.Result().StatusCode)
+	// Depths 1 through 3 are fetched, depth 4 is rejected
+	require.Equal(t, int32(server.MaxRequestDepth+1), atomic.LoadInt32(&requests))
+
+	r := httptest.NewRequest("GET", "/hello/world", nil)
+	r.RemoteAddr = "127.0.0.1:1234"
+	r.Header.Set(HeaderViewProxyDepth, "4")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	require.Equal(t, http.StatusLoopDetected, w.Result().StatusCode)
+}
+
+func TestRequestDepth_Untrusted(t *testing.T) {
+	server := newServer(t, targetServer.URL)
+	server.HmacSecret = "secret"
+
+	r := httptest.NewRequest("GET", "/hello/world?a=b", nil)
+	r.Header.Set(HeaderViewProxyDepth, "4")
+
+	// Clients can't set the depth of their requests
+	require.Equal(t, 0, server.requestDepth(r))
+
+	timestamp := fmt.Sprintf("%d", time.Now().Unix())
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("/hello/world?a=b," + timestamp))
+	r.Header.Set("X-Authorization-Time", timestamp)
+	r.Header.Set("Authorization", hex.EncodeToString(mac.Sum(nil)))
+
+	require.Equal(t, 4, server.requestDepth(r))
+
+	server.HmacSecret = "other"
+	require.Equal(t, 0, server.requestDepth(r))
+}
+
+func TestPassThroughIncrementsDepth(t *testing.T) {
+	depth := make(chan string, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		depth <- r.Header.Get(HeaderViewProxyDepth)
+	}))
+	defer target.Close()
+
+	server := newServer(t, target.URL, WithPassThrough(target.URL))
+
+	r := httptest.NewRequest("GET", "/missing", nil)
+	r.RemoteAddr = "127.0.0.1:1234"
+	r.Header.Set(HeaderViewProxyDepth, "1")
+	server.CreateHandler().ServeHTTP(httptest.NewRecorder(), r)
+
+	require.Equal(t, "2", <-depth)
+}
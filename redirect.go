@@ -0,0 +1,105 @@
+package viewproxy
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// RewriteLocation is the default LocationRewriter. Locations that point at the
+// target or pass through server are rewritten to the public scheme and host of
+// the incoming request, including the server's path prefix. Relative locations
+// and locations on other hosts are returned unchanged.
+func (s *Server) RewriteLocation(location string, r *http.Request) string {
+	parsed, err := url.Parse(location)
+	if err != nil || parsed.Host == "" || !s.isInternalHost(parsed.Host) {
+		return location
+	}
+
+	parsed.Scheme, parsed.Host = s.publicSchemeAndHost(r)
+	parsed.Path = s.pathPrefix + parsed.Path
+	if parsed.RawPath != "" {
+		parsed.RawPath = s.pathPrefix + parsed.RawPath
+	}
+
+	return parsed.String()
+}
+
+// isInternalHost returns true when host is the host of one of the targets or
+// the pass through server.
+func (s *Server) isInternalHost(host string) bool {
+	if s.targets != nil && s.targets.containsHost(host) {
+		return true
+	}
+
+	return s.passThroughURL != nil && strings.EqualFold(host, s.passThroughURL.Host)
+}
+
+// publicSchemeAndHost returns the scheme and host the client used to make the
+// request, honoring X-Forwarded-Proto and X-Forwarded-Host when
+// TrustForwardedHeaders is set.
+func (s *Server) publicSchemeAndHost(r *http.Request) (string, string) {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	host := r.Host
+
+	if s.TrustForwardedHeaders {
+		if proto := firstForwardedValue(r.Header.Get("X-Forwarded-Proto")); proto != "" {
+			scheme = proto
+		}
+		if forwardedHost := firstForwardedValue(r.Header.Get("X-Forwarded-Host")); forwardedHost != "" {
+			host = forwardedHost
+		}
+	}
+
+	return scheme, host
+}
+
+// firstForwardedValue returns the value set by the proxy closest to the
+// client, when multiple proxies have appended to the header.
+func firstForwardedValue(header string) string {
+	value, _, _ := strings.Cut(header, ",")
+	return strings.TrimSpace(value)
+}
+
+// locationResponseWriter rewrites the Location header of redirects written by
+// the target using the server's LocationRewriter.
+type locationResponseWriter struct {
+	http.ResponseWriter
+	request     *http.Request
+	rewrite     func(location string, r *http.Request) string
+	wroteHeader bool
+}
+
+func (lw *locationResponseWriter) WriteHeader(statusCode int) {
+	if !lw.wroteHeader && !isInformational(statusCode) {
+		lw.wroteHeader = true
+
+		location := lw.Header().Get("Location")
+		if location != "" && statusCode >= 300 && statusCode <= 399 {
+			lw.Header().Set("Location", lw.rewrite(location, lw.request))
+		}
+	}
+
+	lw.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (lw *locationResponseWriter) Write(p []byte) (int, error) {
+	if !lw.wroteHeader {
+		lw.WriteHeader(http.StatusOK)
+	}
+
+	return lw.ResponseWriter.Write(p)
+}
+
+func (lw *locationResponseWriter) Flush() {
+	if flusher, ok := lw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (lw *locationResponseWriter) Unwrap() http.ResponseWriter {
+	return lw.ResponseWriter
+}
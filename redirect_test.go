@@ -0,0 +1,100 @@
+package viewproxy
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRewriteLocation(t *testing.T) {
+	server, err := NewServer("http://backend.internal", WithPassThrough("http://legacy.internal:8080"))
+	require.NoError(t, err)
+
+	r := httptest.NewRequest("GET", "http://example.com/account", nil)
+
+	testCases := map[string]struct {
+		location string
+		expected string
+	}{
+		"absolute target":       {"http://backend.internal/login?return_to=/account", "http://example.com/login?return_to=/account"},
+		"absolute pass through": {"http://LEGACY.internal:8080/login", "http://example.com/login"},
+		"scheme relative":       {"//backend.internal/login", "http://example.com/login"},
+		"host relative":         {"/login", "/login"},
+		"path relative":         {"login", "login"},
+		"already public":        {"https://example.com/login", "https://example.com/login"},
+		"other host":            {"https://auth.example.com/login", "https://auth.example.com/login"},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, tc.expected, server.RewriteLocation(tc.location, r))
+		})
+	}
+}
+
+func TestRewriteLocation_PublicURL(t *testing.T) {
+	server, err := NewServer("http://backend.internal", WithPathPrefix("/app"))
+	require.NoError(t, err)
+
+	r := httptest.NewRequest("GET", "http://example.com/app/account", nil)
+	r.Header.Set("X-Forwarded-Proto", "https")
+	r.Header.Set("X-Forwarded-Host", "www.example.com, proxy.internal")
+
+	// Forwarded headers are ignored unless trusted
+	require.Equal(t, "http://example.com/app/login", server.RewriteLocation("http://backend.internal/login", r))
+
+	server.TrustForwardedHeaders = true
+	require.Equal(t, "https://www.example.com/app/login", server.RewriteLocation("http://backend.internal/login", r))
+
+	r = httptest.NewRequest("GET", "https://example.com/app/account", nil)
+	r.TLS = &tls.ConnectionState{}
+	require.Equal(t, "https://example.com/app/login", server.RewriteLocation("http://backend.internal/login", r))
+}
+
+func TestPassThroughRewritesRedirectLocation(t *testing.T) {
+	var target *httptest.Server
+	target = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/account":
+			http.Redirect(w, r, target.URL+"/login?return_to=/account", http.StatusFound)
+		case "/created":
+			w.Header().Set("Location", target.URL+"/items/1")
+			w.WriteHeader(http.StatusCreated)
+		default:
+			http.Redirect(w, r, "/login", http.StatusFound)
+		}
+	}))
+	defer target.Close()
+
+	server, err := NewServer(target.URL, WithPassThrough(target.URL))
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	server.CreateHandler().ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/account", nil))
+
+	require.Equal(t, http.StatusFound, w.Result().StatusCode)
+	require.Equal(t, "http://example.com/login?return_to=/account", w.Header().Get("Location"))
+
+	w = httptest.NewRecorder()
+	server.CreateHandler().ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/relative", nil))
+
+	require.Equal(t, "/login", w.Header().Get("Location"))
+
+	// Only redirects are rewritten
+	w = httptest.NewRecorder()
+	server.CreateHandler().ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/created", nil))
+
+	require.Equal(t, target.URL+"/items/1", w.Header().Get("Location"))
+
+	server.LocationRewriter = func(location string, r *http.Request) string {
+		return "https://login.example.com/?next=" + r.URL.Path
+	}
+
+	w = httptest.NewRecorder()
+	server.CreateHandler().ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/account", nil))
+
+	require.Equal(t, "https://login.example.com/?next=/account", w.Header().Get("Location"))
+}
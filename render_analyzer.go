@@ -0,0 +1,209 @@
+package viewproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"sync"
+)
+
+// timingPlaceholder is replaced with the render duration of each response
+var timingPlaceholder = regexp.MustCompile(regexp.QuoteMeta(timingTag))
+
+// RenderStats contains how much the output of a route changes between
+// sampled renders.
+//
+// Similarities are scaled so identical renders score 1 and unrelated renders
+// score near 0, since unrelated content still shares about half of the bits of
+// its hash.
+type RenderStats struct {
+	// The number of renders that were sampled
+	Samples int `json:"samples"`
+	// The number of sampled renders that were compared to the previous
+	// sampled render of the route
+	Comparisons int `json:"comparisons"`
+	// The similarity of the last comparison, between 0 and 1
+	LastSimilarity float64 `json:"last_similarity"`
+	// The average similarity of all comparisons, between 0 and 1
+	AverageSimilarity float64 `json:"average_similarity"`
+}
+
+type routeRenders struct {
+	// The hash of the previous sampled render, when sampled is true
+	previous        uint64
+	sampled         bool
+	stats           RenderStats
+	totalSimilarity float64
+}
+
+// RenderAnalyzer samples the stitched output of routes and records how similar
+// each render is to the previous render of the route, which can be used to
+// decide which routes are worth caching. Only a hash of the last sampled render
+// is kept for each route.
+//
+// RenderAnalyzer implements http.Handler, serving the stats of each route as
+// JSON so it can be mounted on an admin endpoint.
+type RenderAnalyzer struct {
+	// The ratio of renders that are sampled, between 0 and 1
+	SampleRate float64
+	// Overrides SampleRate for routes, keyed by the route path. Use
+	// SetRouteSampleRate to change it while requests are being served.
+	RouteSampleRates map[string]float64
+	// Matches request specific content, such as CSRF tokens or nonces, that
+	// is masked before renders are compared. The timing placeholder is always
+	// masked.
+	Normalizers []*regexp.Regexp
+	mu          sync.Mutex
+	routes      map[string]*routeRenders
+	random      func() float64
+}
+
+// NewRenderAnalyzer returns a RenderAnalyzer that samples the given ratio of
+// renders.
+func NewRenderAnalyzer(sampleRate float64) *RenderAnalyzer {
+	return &RenderAnalyzer{
+		SampleRate:       sampleRate,
+		RouteSampleRates: make(map[string]float64),
+		Normalizers:      make([]*regexp.Regexp, 0),
+		routes:           make(map[string]*routeRenders),
+		random:           rand.Float64,
+	}
+}
+
+// Stats returns the stats of each route that has been sampled, keyed by the
+// route path.
+func (ra *RenderAnalyzer) Stats() map[string]RenderStats {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	stats := make(map[string]RenderStats, len(ra.routes))
+	for path, renders := range ra.routes {
+		stats[path] = renders.stats
+	}
+
+	return stats
+}
+
+func (ra *RenderAnalyzer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ra.Stats())
+}
+
+// SetRouteSampleRate overrides SampleRate for the route with the given path.
+// It's safe to call while requests are being served.
+func (ra *RenderAnalyzer) SetRouteSampleRate(routePath string, rate float64) {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	if ra.RouteSampleRates == nil {
+		ra.RouteSampleRates = make(map[string]float64)
+	}
+	ra.RouteSampleRates[routePath] = rate
+}
+
+// record samples the body rendered for the route. Renders of different URLs
+// of the route are compared, since routes with dynamic parts rarely render
+// the same URL twice in a row.
+func (ra *RenderAnalyzer) record(routePath string, body []byte) {
+	if !ra.sample(routePath) {
+		return
+	}
+
+	hash := simhash(ra.normalize(body))
+
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	if ra.routes == nil {
+		ra.routes = make(map[string]*routeRenders)
+	}
+
+	renders, ok := ra.routes[routePath]
+	if !ok {
+		renders = &routeRenders{}
+		ra.routes[routePath] = renders
+	}
+
+	renders.stats.Samples++
+
+	if renders.sampled {
+		similarity := similarity(renders.previous, hash)
+
+		renders.stats.Comparisons++
+		renders.stats.LastSimilarity = similarity
+		renders.totalSimilarity += similarity
+		renders.stats.AverageSimilarity = renders.totalSimilarity / float64(renders.stats.Comparisons)
+	}
+
+	renders.previous = hash
+	renders.sampled = true
+}
+
+// sample returns true when the next render of the route should be sampled.
+func (ra *RenderAnalyzer) sample(routePath string) bool {
+	ra.mu.Lock()
+	defer ra.mu.Unlock()
+
+	rate, ok := ra.RouteSampleRates[routePath]
+	if !ok {
+		rate = ra.SampleRate
+	}
+
+	if ra.random == nil {
+		ra.random = rand.Float64
+	}
+
+	return rate > 0 && ra.random() < rate
+}
+
+func (ra *RenderAnalyzer) normalize(body []byte) []byte {
+	body = timingPlaceholder.ReplaceAll(body, nil)
+
+	for _, normalizer := range ra.Normalizers {
+		body = normalizer.ReplaceAll(body, nil)
+	}
+
+	return body
+}
+
+// similarity returns the similarity of two simhashes, between 0 and 1.
+// Unrelated content differs in about half of the bits, so the score is scaled
+// to be 0 from that point.
+func similarity(first uint64, second uint64) float64 {
+	distance := float64(bits.OnesCount64(first ^ second))
+	return math.Max(0, 1-distance/32)
+}
+
+// simhash returns a 64 bit simhash of the whitespace separated tokens of the
+// body. Similar bodies have hashes that differ in fewer bits.
+func simhash(body []byte) uint64 {
+	var weights [64]int
+
+	for _, token := range bytes.Fields(body) {
+		h := fnv.New64a()
+		h.Write(token)
+		tokenHash := h.Sum64()
+
+		for i := 0; i < 64; i++ {
+			if tokenHash&(1<<i) != 0 {
+				weights[i]++
+			} else {
+				weights[i]--
+			}
+		}
+	}
+
+	var hash uint64
+	for i, weight := range weights {
+		if weight > 0 {
+			hash |= 1 << i
+		}
+	}
+
+	return hash
+}
@@ -0,0 +1,127 @@
+package viewproxy
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/blakewilliams/viewproxy/pkg/fragment"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenderAnalyzer_StaticRoute(t *testing.T) {
+	server := newServer(t, targetServer.URL)
+	server.RenderAnalyzer = NewRenderAnalyzer(1)
+	err := server.Get("/hello/:name", fragment.Define(
+		"/layouts/test_layout", fragment.WithoutValidation(),
+		fragment.WithChild("body", fragment.Define("/body/:name")),
+	))
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/hello/world", nil)
+		server.CreateHandler().ServeHTTP(w, r)
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	}
+
+	stats := server.RenderAnalyzer.Stats()["/hello/:name"]
+	require.Equal(t, 3, stats.Samples)
+	require.Equal(t, 2, stats.Comparisons)
+	require.Equal(t, 1.0, stats.LastSimilarity)
+	require.Equal(t, 1.0, stats.AverageSimilarity)
+
+	w := httptest.NewRecorder()
+	server.RenderAnalyzer.ServeHTTP(w, httptest.NewRequest("GET", "/_stats", nil))
+	require.JSONEq(
+		t,
+		`{"/hello/:name": {"samples": 3, "comparisons": 2, "last_similarity": 1, "average_similarity": 1}}`,
+		w.Body.String(),
+	)
+}
+
+func randomWords(random *rand.Rand, n int) []string {
+	words := make([]string, n)
+	for i := range words {
+		words[i] = fmt.Sprintf("%x", random.Int63())
+	}
+
+	return words
+}
+
+func TestRenderAnalyzer_RandomizedRoute(t *testing.T) {
+	analyzer := NewRenderAnalyzer(1)
+	random := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 20; i++ {
+		analyzer.record("/random", []byte(strings.Join(randomWords(random, 200), " ")))
+	}
+
+	stats := analyzer.Stats()["/random"]
+	require.Equal(t, 19, stats.Comparisons)
+	require.Less(t, stats.AverageSimilarity, 0.25)
+}
+
+func TestRenderAnalyzer_SimilarRenders(t *testing.T) {
+	analyzer := NewRenderAnalyzer(1)
+	random := rand.New(rand.NewSource(1))
+	words := randomWords(random, 200)
+
+	for i := 0; i < 20; i++ {
+		words[i] = fmt.Sprintf("user-%d", i)
+		analyzer.record("/hello/:name", []byte(strings.Join(words, " ")))
+	}
+
+	stats := analyzer.Stats()["/hello/:name"]
+	require.Equal(t, 19, stats.Comparisons)
+	require.Greater(t, stats.AverageSimilarity, 0.75)
+}
+
+func TestRenderAnalyzer_Normalizers(t *testing.T) {
+	analyzer := NewRenderAnalyzer(1)
+	analyzer.Normalizers = append(analyzer.Normalizers, regexp.MustCompile(`csrf-[0-9]+`))
+
+	for i := 0; i < 2; i++ {
+		body := fmt.Sprintf("<form><view-proxy-timing></view-proxy-timing> csrf-%d</form>", i)
+		analyzer.record("/form", []byte(body))
+	}
+
+	require.Equal(t, 1.0, analyzer.Stats()["/form"].LastSimilarity)
+}
+
+func TestRenderAnalyzer_Sampling(t *testing.T) {
+	analyzer := NewRenderAnalyzer(1)
+	analyzer.SetRouteSampleRate("/skipped", 0)
+
+	analyzer.record("/skipped", []byte("hello"))
+	analyzer.record("/hello/:name", []byte("hello world"))
+	// Consecutive renders of the route are compared, whatever their URL
+	analyzer.record("/hello/:name", []byte("hello world"))
+
+	stats := analyzer.Stats()
+	require.NotContains(t, stats, "/skipped")
+	require.Equal(t, 2, stats["/hello/:name"].Samples)
+	require.Equal(t, 1, stats["/hello/:name"].Comparisons)
+}
+
+func TestRenderAnalyzer_StructLiteral(t *testing.T) {
+	analyzer := &RenderAnalyzer{SampleRate: 1}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			analyzer.SetRouteSampleRate(fmt.Sprintf("/route/%d", i), 1)
+			analyzer.record("/hello/:name", []byte("hello world"))
+		}(i)
+	}
+	wg.Wait()
+
+	require.Equal(t, 10, analyzer.Stats()["/hello/:name"].Samples)
+}
@@ -3,39 +3,116 @@ package viewproxy
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"net/http"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/blakewilliams/viewproxy/pkg/multiplexer"
 )
 
 type responseBuilder struct {
-	writer     http.ResponseWriter
-	server     Server
-	body       []byte
+	writer http.ResponseWriter
+	server *Server
+	body   []byte
+	// The gzipped form of body, when it's identical to a gzipped upstream
+	// response and can be written without compressing it again
+	compressed []byte
 	StatusCode int
+	// True when the client's cached response matches the ETag, so no body is
+	// written
+	notModified bool
+	// True for HEAD requests, which are written without the body
+	head bool
 }
 
-func newResponseBuilder(server Server, w http.ResponseWriter) *responseBuilder {
-	return &responseBuilder{server: server, writer: w, StatusCode: 200}
+func newResponseBuilder(server *Server, w http.ResponseWriter, r *http.Request) *responseBuilder {
+	return &responseBuilder{server: server, writer: w, StatusCode: 200, head: r.Method == http.MethodHead}
 }
 
-func (rb *responseBuilder) SetFragments(route *Route, results []*multiplexer.Result) {
-	resultMap := mapResultsToFragmentKey(route, results)
-	rb.body = stitch(route.structure, resultMap)
+func (rb *responseBuilder) SetFragments(route *Route, rendered *renderedFragments, results []*multiplexer.Result) error {
+	resultMap := mapResultsToFragmentKey(route, rendered, results)
+	tag := rb.server.FragmentTag
+	if tag == "" {
+		tag = defaultFragmentTag
+	}
+
+	body, err := stitch(route.structure, resultMap, tag)
+	if err != nil {
+		return err
+	}
+
+	rb.body = body
+	if rb.server.ResponseStatusCode != nil {
+		rb.StatusCode = rb.server.ResponseStatusCode(resultMap)
+	}
+
+	// Routes without children render the root's body unchanged, so its
+	// compressed body can be passed through
+	if len(route.structure.DependentStructures()) == 0 {
+		if root, ok := resultMap[route.structure.Key()]; ok && !root.Skipped {
+			rb.compressed = root.CompressedBody
+		}
+	}
+
+	return nil
 }
 
+// The tag replaced with the time in milliseconds taken to render the response
+const timingTag = "<view-proxy-timing></view-proxy-timing>"
+
 func (rb *responseBuilder) SetDuration(duration int64) {
-	outputHtml := bytes.Replace(rb.body, []byte("<view-proxy-timing></view-proxy-timing>"), []byte(strconv.FormatInt(duration, 10)), 1)
-	rb.body = outputHtml
+	if !bytes.Contains(rb.body, []byte(timingTag)) {
+		return
+	}
+
+	rb.body = bytes.Replace(rb.body, []byte(timingTag), []byte(strconv.FormatInt(duration, 10)), 1)
+	rb.compressed = nil
+}
+
+// SetETag sets a strong ETag computed from the body, and responds with 304
+// Not Modified when it matches the If-None-Match header of a GET or HEAD
+// request. It's called once the body is final, before it's gzipped.
+func (rb *responseBuilder) SetETag(r *http.Request) {
+	sum := sha256.Sum256(rb.body)
+	etag := `"` + hex.EncodeToString(sum[:]) + `"`
+	rb.writer.Header().Set("ETag", etag)
+
+	if rb.StatusCode != http.StatusOK || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return
+	}
+
+	if etagMatches(r.Header.Values("If-None-Match"), etag) {
+		rb.StatusCode = http.StatusNotModified
+		rb.notModified = true
+	}
 }
 
 func (rb *responseBuilder) Write() {
-	rb.writer.WriteHeader(rb.StatusCode)
+	if rb.notModified {
+		rb.writer.Header().Del("Content-Encoding")
+		rb.writer.WriteHeader(rb.StatusCode)
+		return
+	}
+
+	compress := rb.writer.Header().Get("Content-Encoding") == "gzip"
+
+	// Compressing small bodies wastes CPU and can grow the response
+	if compress && len(rb.body) < rb.server.MinCompressSize {
+		rb.writer.Header().Del("Content-Encoding")
+		compress = false
+	}
 
-	if rb.writer.Header().Get("Content-Encoding") == "gzip" {
+	body := rb.body
+	if compress && rb.compressed != nil {
+		body = rb.compressed
+	} else if compress {
 		var b bytes.Buffer
 		gzipWriter := gzip.NewWriter(&b)
 
@@ -49,19 +126,121 @@ func (rb *responseBuilder) Write() {
 			rb.server.Logger.Printf("Could not closeto gzip buffer: %s", err)
 		}
 
-		rb.writer.Write(b.Bytes())
+		body = b.Bytes()
+	}
+
+	// HEAD requests receive the headers a GET would, without the body
+	if rb.head {
+		rb.writer.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		rb.writer.WriteHeader(rb.StatusCode)
+		return
+	}
+
+	rb.writer.WriteHeader(rb.StatusCode)
+	rb.writer.Write(body)
+}
+
+// etagMatches returns true when the If-None-Match header values contain the
+// ETag or `*`. Weak ETags match the strong ETag with the same value.
+func etagMatches(values []string, etag string) bool {
+	for _, value := range values {
+		for _, candidate := range strings.Split(value, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// storesResults returns false when any of the results responded with
+// `Cache-Control: no-store`, in which case the response must not be cached or
+// revalidated.
+func storesResults(results []*multiplexer.Result) bool {
+	for _, result := range results {
+		if result == nil {
+			continue
+		}
+
+		for _, value := range result.Header().Values("Cache-Control") {
+			for _, directive := range strings.Split(value, ",") {
+				if strings.EqualFold(strings.TrimSpace(directive), "no-store") {
+					return false
+				}
+			}
+		}
+	}
+
+	return true
+}
+
+// earlyHintsWriter forwards the Link headers of the root fragment's 103 Early
+// Hints responses to the client while fragments are being fetched. Hints are
+// received on the goroutines fetching fragments, so writes are guarded by mu
+// and stop once fetching is done and the response can be written.
+type earlyHintsWriter struct {
+	mu      sync.Mutex
+	writer  http.ResponseWriter
+	stopped bool
+}
+
+func (ew *earlyHintsWriter) forwardRoot(_ context.Context, requestable multiplexer.Requestable, header http.Header) {
+	if kr, ok := requestable.(multiplexer.KeyedRequestable); !ok || kr.Key() != "root" {
+		return
+	}
+
+	links := header.Values("Link")
+	if len(links) == 0 {
+		return
+	}
+
+	ew.mu.Lock()
+	defer ew.mu.Unlock()
+	if ew.stopped {
+		return
+	}
+
+	// Headers set before an informational response are sent with it, so
+	// only the hinted links are set and the previous headers restored
+	header = ew.writer.Header()
+	previous := header.Values("Link")
+	header["Link"] = links
+	ew.writer.WriteHeader(http.StatusEarlyHints)
+
+	if len(previous) > 0 {
+		header["Link"] = previous
 	} else {
-		rb.writer.Write(rb.body)
+		header.Del("Link")
 	}
 }
 
-func withDefaultErrorHandler(next http.Handler) http.Handler {
+// stop prevents hints from being written once the final response can be
+// written. It's a no-op when early hints aren't forwarded.
+func (ew *earlyHintsWriter) stop() {
+	if ew == nil {
+		return
+	}
+
+	ew.mu.Lock()
+	defer ew.mu.Unlock()
+	ew.stopped = true
+}
+
+// isInformational returns true for 1xx status codes, e.g. 103 Early Hints,
+// which are written before the final status code of a response. 101 Switching
+// Protocols is final.
+func isInformational(statusCode int) bool {
+	return statusCode >= 100 && statusCode < 200 && statusCode != http.StatusSwitchingProtocols
+}
+
+func withDefaultErrorHandler(s *Server, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
 		results := multiplexer.ResultsFromContext(r.Context())
 
 		if results != nil && results.Error() != nil {
-			rw.WriteHeader(http.StatusInternalServerError)
-			rw.Write([]byte("500 internal server error"))
+			s.writeErrorBody(rw, r, http.StatusInternalServerError, s.InternalErrorBody, s.InternalErrorContentType)
 		} else {
 			next.ServeHTTP(rw, r)
 		}
@@ -74,43 +253,205 @@ func withCombinedFragments(s *Server) http.Handler {
 		results := multiplexer.ResultsFromContext(r.Context())
 
 		if results != nil && results.Error() == nil {
-			resBuilder := newResponseBuilder(*s, rw)
-			resBuilder.SetFragments(route, results.Results())
+			for _, name := range s.StripResponseHeaders {
+				rw.Header().Del(name)
+			}
+			if s.SurrogateKeys {
+				rw.Header().Set(s.SurrogateKeyHeader, strings.Join(SurrogateKeysFor(route), " "))
+			}
+
+			if s.ConditionalFragments {
+				// The response changes whenever any of the fragments change
+				if lastModified, ok := latestLastModified(results.Results()); ok {
+					rw.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+				}
+
+				if allNotModified(results.Results()) {
+					if s.GenerateETags {
+						rw.Header().Del("ETag")
+					}
+					rw.WriteHeader(http.StatusNotModified)
+					return
+				}
+			}
+
+			if phases := multiplexer.PhaseTimingsFromContext(r.Context()); phases != nil {
+				phases.StitchStarted = time.Now()
+			}
+
+			if stream := fragmentStreamFromContext(r.Context()); stream != nil {
+				writeStream(s, rw, r, route, stream)
+				return
+			}
+
+			resBuilder := newResponseBuilder(s, rw, r)
+			err := resBuilder.SetFragments(route, renderedFragmentsFromContext(r.Context()), results.Results())
+			if err != nil {
+				s.Logger.Printf("Could not stitch %s: %s", route.Path, err)
+				s.writeStitchError(rw, r)
+				return
+			}
+
+			if s.RenderAnalyzer != nil {
+				s.RenderAnalyzer.record(route.Path, resBuilder.body)
+			}
 			elapsed := time.Since(startTimeFromContext(r.Context()))
 			resBuilder.SetDuration(elapsed.Milliseconds())
+			if s.GenerateETags && storesResults(results.Results()) {
+				resBuilder.SetETag(r)
+			} else if s.GenerateETags {
+				// The root's ETag doesn't identify the stitched body
+				rw.Header().Del("ETag")
+			}
 			resBuilder.Write()
 		}
 	})
 }
 
-func stitch(structure *stitchStructure, results map[string]*multiplexer.Result) []byte {
-	childContent := make(map[string][]byte)
+// MissingSlotError is returned when a fragment was rendered but its parent's
+// body doesn't contain the directive for its slot.
+type MissingSlotError struct {
+	// The key of the parent fragment, e.g. `root.body`
+	FragmentKey string
+	// The replacement ID of the missing slot, e.g. `sidebar`
+	Slot string
+}
 
-	for _, childBuild := range structure.DependentStructures() {
-		childContent[childBuild.ReplacementID()] = stitch(childBuild, results)
+func (e *MissingSlotError) Error() string {
+	return fmt.Sprintf("fragment %s is missing the directive for slot %q", e.FragmentKey, e.Slot)
+}
+
+// directivesFor returns the directives that mark where the child with the
+// given replacement ID is inserted, in both the paired and the self closing
+// forms, e.g. `<viewproxy-fragment id="header"></viewproxy-fragment>` and
+// `<viewproxy-fragment id="header"/>`.
+func directivesFor(tag string, id string) [][]byte {
+	return [][]byte{
+		[]byte(fmt.Sprintf("<%s id=\"%s\"></%s>", tag, id, tag)),
+		[]byte(fmt.Sprintf("<%s id=\"%s\"/>", tag, id)),
+	}
+}
+
+// stitch replaces the directives in the fragment's body with the content of
+// its children. Directives are located in the fragment's own body before any
+// child content is inserted, so child content is inserted verbatim and never
+// scanned for directives, even if it contains directive-looking text.
+func stitch(structure *stitchStructure, results map[string]*multiplexer.Result, tag string) ([]byte, error) {
+	result, ok := results[structure.Key()]
+	if !ok {
+		// Conditional fragments that were not rendered have no content
+		return nil, nil
 	}
 
-	self := results[structure.Key()].Body
+	self := result.Body
 
 	// handle edge fragments
-	if len(childContent) == 0 {
-		return self
+	if len(structure.DependentStructures()) == 0 {
+		return self, nil
 	}
 
-	for replacementKey, content := range childContent {
-		directive := []byte(fmt.Sprintf("<viewproxy-fragment id=\"%s\"></viewproxy-fragment>", replacementKey))
-		self = bytes.Replace(self, directive, content, 1)
+	rendered := func(key string) bool {
+		_, ok := results[key]
+		return ok
+	}
+	slots, err := stitchSlots(structure, result, rendered, tag)
+	if err != nil {
+		return nil, err
 	}
 
-	return self
+	for i := range slots {
+		content, err := stitch(slots[i].structure, results, tag)
+		if err != nil {
+			return nil, err
+		}
+		slots[i].content = content
+	}
+
+	size := len(self)
+	for _, slot := range slots {
+		size += len(slot.content) - (slot.end - slot.start)
+	}
+
+	stitched := make([]byte, 0, size)
+	position := 0
+	for _, slot := range slots {
+		stitched = append(stitched, self[position:slot.start]...)
+		stitched = append(stitched, slot.content...)
+		position = slot.end
+	}
+
+	return append(stitched, self[position:]...), nil
+}
+
+// stitchSlots returns the slots of the fragment's children in its body,
+// ordered by their position. rendered returns true for the keys of rendered
+// children, which must have a slot unless the fragment itself was skipped.
+func stitchSlots(structure *stitchStructure, result *multiplexer.Result, rendered func(key string) bool, tag string) ([]stitchSlot, error) {
+	self := result.Body
+	slots := make([]stitchSlot, 0, len(structure.DependentStructures()))
+	for _, childBuild := range structure.DependentStructures() {
+		start, end := -1, -1
+		for _, directive := range directivesFor(tag, childBuild.ReplacementID()) {
+			if start = bytes.Index(self, directive); start != -1 {
+				end = start + len(directive)
+				break
+			}
+		}
+
+		if start == -1 {
+			// Fallback content of skipped fragments isn't expected to
+			// declare the slots of its children.
+			if rendered(childBuild.Key()) && !result.Skipped {
+				return nil, &MissingSlotError{FragmentKey: structure.Key(), Slot: childBuild.ReplacementID()}
+			}
+			continue
+		}
+
+		slots = append(slots, stitchSlot{start: start, end: end, structure: childBuild})
+	}
+
+	sort.Slice(slots, func(i, j int) bool { return slots[i].start < slots[j].start })
+
+	return slots, nil
 }
 
-func mapResultsToFragmentKey(route *Route, results []*multiplexer.Result) map[string]*multiplexer.Result {
+// stitchSlot is the location of a child's directive in its parent's body
+type stitchSlot struct {
+	start     int
+	end       int
+	structure *stitchStructure
+	content   []byte
+}
+
+// mapResultsToFragmentKey maps the results of the requested fragments and the
+// content of static fragments to their fragment key.
+func mapResultsToFragmentKey(route *Route, rendered *renderedFragments, results []*multiplexer.Result) map[string]*multiplexer.Result {
 	resultMap := make(map[string]*multiplexer.Result, len(route.FragmentOrder()))
 
-	for i, key := range route.FragmentOrder() {
+	for i, key := range rendered.requested {
+		// Streamed results that haven't arrived are left out
+		if results[i] == nil {
+			continue
+		}
+
+		if results[i].Skipped {
+			resultMap[key] = &multiplexer.Result{
+				Body:       rendered.fallbacks[key],
+				StatusCode: http.StatusOK,
+				Skipped:    true,
+			}
+			continue
+		}
+
 		resultMap[key] = results[i]
 	}
 
+	for key, content := range rendered.static {
+		resultMap[key] = &multiplexer.Result{
+			Body:       content,
+			StatusCode: http.StatusOK,
+		}
+	}
+
 	return resultMap
 }
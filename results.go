@@ -0,0 +1,51 @@
+package viewproxy
+
+import (
+	"context"
+	"errors"
+
+	"github.com/blakewilliams/viewproxy/pkg/multiplexer"
+)
+
+// ResultsByKey returns the results of the fragments rendered for the request
+// keyed by their fragment key, e.g. `root.body`. Static, lazy, and skipped
+// fragments are included with their rendered content.
+//
+// When fragments responded with a non-2xx status only the results of those
+// fragments are returned, so error handlers can inspect them. Returns nil when
+// the route or results are not available in the context.
+func ResultsByKey(ctx context.Context) map[string]*multiplexer.Result {
+	route := RouteFromContext(ctx)
+	results := multiplexer.ResultsFromContext(ctx)
+	if route == nil || results == nil {
+		return nil
+	}
+
+	if err := results.Error(); err != nil {
+		failed := make(map[string]*multiplexer.Result)
+		for _, err := range multiplexer.Errors(err) {
+			var resultErr *multiplexer.ResultError
+			if errors.As(err, &resultErr) && resultErr.Key != "" {
+				failed[resultErr.Key] = resultErr.Result
+			}
+		}
+
+		if len(failed) == 0 {
+			return nil
+		}
+		return failed
+	}
+
+	rendered := renderedFragmentsFromContext(ctx)
+	if rendered == nil || len(rendered.requested) != len(results.Results()) {
+		return nil
+	}
+
+	return mapResultsToFragmentKey(route, rendered, results.Results())
+}
+
+// ResultForKey returns the result of the fragment with the given key, e.g.
+// `root.body`, or nil if the fragment has no result.
+func ResultForKey(ctx context.Context, key string) *multiplexer.Result {
+	return ResultsByKey(ctx)[key]
+}
@@ -0,0 +1,78 @@
+package viewproxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/blakewilliams/viewproxy/pkg/fragment"
+	"github.com/blakewilliams/viewproxy/pkg/multiplexer"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResultsByKey(t *testing.T) {
+	var results map[string]*multiplexer.Result
+
+	server := newServer(t, targetServer.URL)
+	err := server.Get("/hello/:name", fragment.Define(
+		"/layouts/test_layout", fragment.WithoutValidation(),
+		fragment.WithChild("header", fragment.Define("/header/:name")),
+		fragment.WithChild("body", fragment.Define("/body/:name")),
+		fragment.WithChild("footer", fragment.Define("/footer/:name")),
+	))
+	require.NoError(t, err)
+
+	server.AroundResponse = func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			results = ResultsByKey(r.Context())
+			next.ServeHTTP(w, r)
+		})
+	}
+
+	w := httptest.NewRecorder()
+	server.CreateHandler().ServeHTTP(w, httptest.NewRequest("GET", "/hello/world", nil))
+
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.Len(t, results, 4)
+	require.Equal(t, "hello world", string(results["root.body"].Body))
+	require.Equal(t, "</body>", string(results["root.footer"].Body))
+}
+
+func TestResultForKey_RedirectOnUnauthorizedBody(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/layout":
+			w.Write([]byte(`<viewproxy-fragment id="body"></viewproxy-fragment>`))
+		case "/body":
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer target.Close()
+
+	server := newServer(t, target.URL)
+	err := server.Get("/dashboard", fragment.Define("/layout", fragment.WithChild("body", fragment.Define("/body"))))
+	require.NoError(t, err)
+
+	server.AroundResponse = func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if body := ResultForKey(r.Context(), "root.body"); body != nil && body.StatusCode == http.StatusUnauthorized {
+				http.Redirect(w, r, "/login", http.StatusFound)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+
+	w := httptest.NewRecorder()
+	server.CreateHandler().ServeHTTP(w, httptest.NewRequest("GET", "/dashboard", nil))
+
+	require.Equal(t, http.StatusFound, w.Result().StatusCode)
+	require.Equal(t, "/login", w.Header().Get("Location"))
+}
+
+func TestResultForKey_MissingContext(t *testing.T) {
+	require.Nil(t, ResultsByKey(context.Background()))
+	require.Nil(t, ResultForKey(context.Background(), "root"))
+}
@@ -1,12 +1,17 @@
 package viewproxy
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"net/url"
 	"reflect"
 	"sort"
 	"strings"
+	"sync"
 
 	"github.com/blakewilliams/viewproxy/pkg/fragment"
+	"github.com/blakewilliams/viewproxy/pkg/multiplexer"
 )
 
 type RouteValidationError struct {
@@ -30,53 +35,284 @@ func (rve *RouteValidationError) Error() string {
 	}
 }
 
+// FragmentCycleError is returned when a fragment references one of its own
+// ancestors, which would cause the fragment tree to be infinitely deep.
+type FragmentCycleError struct {
+	Route    *Route
+	Fragment *fragment.Definition
+	// The key of the fragment that references its ancestor, e.g.
+	// `root.body.layout`
+	Key string
+}
+
+func (fce *FragmentCycleError) Error() string {
+	return fmt.Sprintf(
+		"route %s has cyclic fragment %s with route %s",
+		fce.Route.Path,
+		fce.Key,
+		fce.Fragment.Path,
+	)
+}
+
+// FragmentDepthError is returned when fragments are nested more deeply than
+// the route's max fragment depth.
+type FragmentDepthError struct {
+	Route    *Route
+	MaxDepth int
+	// The key of the first fragment that exceeds the max depth, e.g.
+	// `root.body.main`
+	Key string
+}
+
+func (fde *FragmentDepthError) Error() string {
+	return fmt.Sprintf(
+		"route %s fragment %s: fragment nesting exceeds max depth of %d",
+		fde.Route.Path,
+		fde.Key,
+		fde.MaxDepth,
+	)
+}
+
+// FragmentDependencyError is returned when a fragment depends on a fragment
+// the route doesn't request, or fragments depend on each other in a cycle.
+type FragmentDependencyError struct {
+	Route *Route
+	// The key of the fragment with the dependency, e.g. `root.body`
+	Key string
+	// The key of the fragment it depends on
+	Dependency string
+	// True when the dependency depends on the fragment, directly or through
+	// other fragments
+	Cycle bool
+}
+
+func (fde *FragmentDependencyError) Error() string {
+	if fde.Cycle {
+		return fmt.Sprintf("route %s fragment %s has a cyclic dependency on %s", fde.Route.Path, fde.Key, fde.Dependency)
+	}
+
+	return fmt.Sprintf("route %s fragment %s depends on %s, which is not requested by the route", fde.Route.Path, fde.Key, fde.Dependency)
+}
+
+// EmptyFragmentPathError is returned when a fragment that isn't static has an
+// empty path, which would request the root of the target. Fragments that
+// ignore validation are still checked. Use `/` to request the root of the
+// target.
+type EmptyFragmentPathError struct {
+	Route *Route
+	// The key of the fragment with the empty path, e.g. `root.sidebar`
+	Key string
+}
+
+func (efe *EmptyFragmentPathError) Error() string {
+	return fmt.Sprintf("route %s fragment %s has an empty path", efe.Route.Path, efe.Key)
+}
+
+// DefaultMaxFragmentDepth is the default number of levels fragments can be
+// nested, including the root fragment.
+const DefaultMaxFragmentDepth = 10
+
 type Route struct {
-	Path         string
-	Parts        []string
-	dynamicParts []string
-	RootFragment *fragment.Definition
-	Metadata     map[string]string
+	Path string
+	// The host the route is restricted to, or empty to match every host
+	Host          string
+	Parts         []string
+	dynamicParts  []string
+	optionalParts []string
+	RootFragment  *fragment.Definition
+	Metadata      map[string]string
+	// When true, requests are passed through when the root fragment 404s
+	passThroughFallback bool
+	// The number of levels fragments can be nested, including the root
+	maxFragmentDepth int
+	// Overrides the server's MaxFragmentConcurrency when greater than 0
+	maxConcurrency int
+	// The names of the query params forwarded to fragments, or nil to
+	// forward every query param
+	forwardedQueryParams map[string]struct{}
+	// Transforms applied to dynamic parts before they're sent to fragments,
+	// keyed by name including the leading `:`
+	paramTransforms map[string]ParamTransform
+	// Returns false when the route is disabled for a request, see
+	// WithRouteEnabledFunc
+	enabled func(ctx context.Context) bool
+	// Canary percents set by Server.SetCanaryPercent. They override the
+	// percent of the definition, which can be shared by other routes.
+	canaryPercents *canaryPercents
 	// memoized version of the mapping used to stitch fragments back together
 	structure *stitchStructure
 	// memoized version of fragments to request
 	fragmentsToRequest []*fragment.Definition
 	// memoized version mapping fragment names to multiplexer.Result order
 	fragmentOrder []string
+	// Set on placeholder routes whose fragments are discovered on the first
+	// request
+	discovery *pendingDiscovery
+	// Overrides the server's target for routes scoped to a host
+	targetURL *url.URL
+	targetErr error
+}
+
+// NewRoute returns a new validated Route for the given path and root fragment.
+// Routes created with NewRoute can be passed to Server.ReloadRoutes.
+func NewRoute(path string, root *fragment.Definition, opts ...GetOption) (*Route, error) {
+	route := newRoute(path, map[string]string{}, root)
+
+	for _, opt := range opts {
+		opt(route)
+	}
+
+	if err := route.Validate(); err != nil {
+		return nil, err
+	}
+
+	return route, nil
 }
 
 func newRoute(path string, metadata map[string]string, root *fragment.Definition) *Route {
 	route := &Route{
-		Path:         path,
-		Parts:        strings.Split(path, "/"),
-		Metadata:     metadata,
-		RootFragment: root,
+		Path:             path,
+		Parts:            strings.Split(path, "/"),
+		Metadata:         metadata,
+		RootFragment:     root,
+		maxFragmentDepth: DefaultMaxFragmentDepth,
+		canaryPercents:   &canaryPercents{percents: make(map[string]float64)},
 	}
 
 	dynamicParts := make([]string, 0)
+	optionalParts := make([]string, 0)
 	for _, part := range route.Parts {
 		if strings.HasPrefix(part, ":") {
-			dynamicParts = append(dynamicParts, part)
+			name := strings.TrimSuffix(part, "?")
+			dynamicParts = append(dynamicParts, name)
+
+			if name != part {
+				optionalParts = append(optionalParts, name)
+			}
 		}
 	}
 	route.dynamicParts = dynamicParts
-	route.structure = stitchStructureFor(root)
+	route.optionalParts = optionalParts
 
-	route.memoizeFragments()
+	// Cyclic fragment trees can't be walked, Validate will report the error
+	if route.fragmentCycle() == nil {
+		route.structure = stitchStructureFor(root)
+		route.memoizeFragments()
+	}
 
 	return route
 }
 
-// Validates if the route and fragments have compatible dynamic route parts.
+// Validates if the route and fragments have compatible dynamic route parts,
+// that no fragment references one of its ancestors, that fragments aren't
+// nested too deeply, and that fragment dependencies are requested and acyclic.
 func (r *Route) Validate() error {
-	for _, fragment := range r.FragmentsToRequest() {
-		if !fragment.IgnoreValidation && !compareStringSlice(r.dynamicParts, fragment.DynamicParts()) {
-			return &RouteValidationError{Route: r, Fragment: fragment}
+	if r.targetErr != nil {
+		return r.targetErr
+	}
+
+	if err := r.fragmentCycle(); err != nil {
+		return err
+	}
+
+	if key := findFragmentBeyondDepth("root", r.RootFragment, 1, r.maxFragmentDepth); key != "" {
+		return &FragmentDepthError{Route: r, MaxDepth: r.maxFragmentDepth, Key: key}
+	}
+
+	if err := r.fragmentDependencyError(); err != nil {
+		return err
+	}
+
+	for i, part := range r.Parts {
+		if strings.HasPrefix(part, ":") && strings.HasSuffix(part, "?") && i != len(r.Parts)-1 {
+			return fmt.Errorf("optional segment %s must be the last segment of route %s", part, r.Path)
+		}
+	}
+
+	for i, f := range r.FragmentsToRequest() {
+		// Every alternate can be rendered in place of the fragment, so each
+		// one must be valid for the route
+		definitions := append([]*fragment.Definition{f}, f.Alternates()...)
+
+		for _, definition := range definitions {
+			if definition.IsStatic() {
+				continue
+			}
+
+			if definition.HasEmptyPath() {
+				return &EmptyFragmentPathError{Route: r, Key: r.fragmentOrder[i]}
+			}
+
+			if err := definition.TargetError(); err != nil {
+				return err
+			}
+
+			if err := r.validateFragment(definition); err != nil {
+				return err
+			}
+
+			if canary := definition.CanaryDefinition(); canary != nil {
+				if canary.HasEmptyPath() && !canary.IsStatic() {
+					return &EmptyFragmentPathError{Route: r, Key: r.fragmentOrder[i]}
+				}
+
+				if err := canary.TargetError(); err != nil {
+					return err
+				}
+
+				if err := r.validateFragment(canary); err != nil {
+					return err
+				}
+			}
 		}
 	}
 
 	return nil
 }
 
+func (r *Route) validateFragment(f *fragment.Definition) error {
+	if f.IgnoreValidation {
+		return nil
+	}
+
+	// Parts with a default don't need to be provided by the route
+	fragmentParts := make([]string, 0, len(f.DynamicParts()))
+	for _, part := range f.DynamicParts() {
+		if _, ok := f.ParamDefaults()[part]; ok && !containsString(r.dynamicParts, part) {
+			continue
+		}
+		fragmentParts = append(fragmentParts, part)
+	}
+
+	if !compareStringSlice(r.dynamicParts, fragmentParts) {
+		return &RouteValidationError{Route: r, Fragment: f}
+	}
+
+	// Fragments must handle the absence of optional route segments, either
+	// with an optional segment of their own or a default
+	for _, optionalPart := range r.optionalParts {
+		if _, ok := f.ParamDefaults()[optionalPart]; ok {
+			continue
+		}
+
+		if !containsString(f.OptionalParts(), optionalPart) {
+			return &RouteValidationError{Route: r, Fragment: f}
+		}
+	}
+
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (r *Route) FragmentOrder() []string {
 	return r.fragmentOrder
 }
@@ -85,6 +321,28 @@ func (r *Route) FragmentsToRequest() []*fragment.Definition {
 	return r.fragmentsToRequest
 }
 
+// EachFragment calls fn with the key and definition of each fragment requested
+// by the route, in FragmentOrder, until fn returns false.
+func (r *Route) EachFragment(fn func(key string, d *fragment.Definition) bool) {
+	for i, key := range r.fragmentOrder {
+		if !fn(key, r.fragmentsToRequest[i]) {
+			return
+		}
+	}
+}
+
+// Fragment returns the fragment with the given key, e.g. `root.layout.header`,
+// or nil if there is no fragment with that key.
+func (r *Route) Fragment(key string) *fragment.Definition {
+	for i, fragmentKey := range r.fragmentOrder {
+		if fragmentKey == key {
+			return r.fragmentsToRequest[i]
+		}
+	}
+
+	return nil
+}
+
 func compareStringSlice(first []string, other []string) bool {
 	sort.Strings(first)
 	sort.Strings(other)
@@ -92,26 +350,88 @@ func compareStringSlice(first []string, other []string) bool {
 	return reflect.DeepEqual(first, other)
 }
 
+// dynamicPartsFromRequest returns the escaped dynamic parts of the request
+// path keyed by their name including the leading `:`, matching the values
+// returned by EscapedParametersFromContext.
 func (r *Route) dynamicPartsFromRequest(path string) map[string]string {
-	dynamicParts := make(map[string]string)
-	routeParts := strings.Split(path, "/")
+	parameters := r.parametersFor(strings.Split(path, "/"))
+	dynamicParts := make(map[string]string, len(parameters))
 
-	for i, part := range r.Parts {
-		if strings.HasPrefix(part, ":") {
-			dynamicParts[part] = routeParts[i]
-		}
+	for name, value := range parameters {
+		dynamicParts[":"+name] = value
 	}
 
 	return dynamicParts
 }
 
-func (r *Route) matchParts(pathParts []string) bool {
-	if len(r.Parts) != len(pathParts) {
+// fragmentParameters returns the dynamic parts of the request path to use when
+// building fragment requests, along with the query params added by the route's
+// parameter transforms, by the name of the transformed part.
+func (r *Route) fragmentParameters(path string) (map[string]string, map[string]url.Values) {
+	dynamicParts := r.dynamicPartsFromRequest(path)
+	extraQuery := make(map[string]url.Values)
+
+	names := make([]string, 0, len(r.paramTransforms))
+	for name := range r.paramTransforms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		escaped, ok := dynamicParts[name]
+		if !ok {
+			continue
+		}
+
+		raw, err := url.PathUnescape(escaped)
+		if err != nil {
+			raw = escaped
+		}
+
+		pathValue, query := r.paramTransforms[name](raw)
+		dynamicParts[name] = url.PathEscape(pathValue)
+
+		if len(query) > 0 {
+			extraQuery[name] = query
+		}
+	}
+
+	return dynamicParts, extraQuery
+}
+
+// forwardsQueryParam returns true when the query param with the given name is
+// forwarded from the request to fragments.
+func (r *Route) forwardsQueryParam(name string) bool {
+	if r.forwardedQueryParams == nil {
+		return true
+	}
+
+	_, ok := r.forwardedQueryParams[name]
+	return ok
+}
+
+// hasOptionalSegment returns true when the last segment of the route is
+// optional, e.g. `/items/:id?`.
+func (r *Route) hasOptionalSegment() bool {
+	last := r.Parts[len(r.Parts)-1]
+	return strings.HasPrefix(last, ":") && strings.HasSuffix(last, "?")
+}
+
+// matchParts returns true when the path matches the route. Static parts are
+// compared case insensitively when foldCase is true.
+func (r *Route) matchParts(pathParts []string, foldCase bool) bool {
+	if len(r.Parts) != len(pathParts) && !(r.hasOptionalSegment() && len(r.Parts)-1 == len(pathParts)) {
 		return false
 	}
 
-	for i := 0; i < len(r.Parts); i++ {
-		if r.Parts[i] != pathParts[i] && !strings.HasPrefix(r.Parts[i], ":") {
+	for i := 0; i < len(pathParts); i++ {
+		if strings.HasPrefix(r.Parts[i], ":") {
+			continue
+		}
+
+		if foldCase && !strings.EqualFold(r.Parts[i], pathParts[i]) {
+			return false
+		} else if !foldCase && r.Parts[i] != pathParts[i] {
 			return false
 		}
 	}
@@ -119,12 +439,14 @@ func (r *Route) matchParts(pathParts []string) bool {
 	return true
 }
 
+// parametersFor returns the escaped dynamic parts of the path keyed by their
+// name. Optional segments that are absent are omitted.
 func (r *Route) parametersFor(pathParts []string) map[string]string {
 	parameters := make(map[string]string)
 
-	for i := 0; i < len(r.Parts); i++ {
+	for i := 0; i < len(r.Parts) && i < len(pathParts); i++ {
 		if strings.HasPrefix(r.Parts[i], ":") {
-			paramName := r.Parts[i][1:]
+			paramName := strings.TrimSuffix(r.Parts[i][1:], "?")
 			parameters[paramName] = pathParts[i]
 		}
 	}
@@ -132,6 +454,146 @@ func (r *Route) parametersFor(pathParts []string) map[string]string {
 	return parameters
 }
 
+// findFragmentBeyondDepth returns the key of the first fragment nested more
+// deeply than maxDepth, or an empty string if there is none.
+func findFragmentBeyondDepth(key string, f *fragment.Definition, depth int, maxDepth int) string {
+	if depth > maxDepth {
+		return key
+	}
+
+	names := make([]string, 0, len(f.Children()))
+	for name := range f.Children() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if deepKey := findFragmentBeyondDepth(key+"."+name, f.Child(name), depth+1, maxDepth); deepKey != "" {
+			return deepKey
+		}
+	}
+
+	return ""
+}
+
+// fragmentDependencies returns the keys of the fragments each fragment depends
+// on, including the dependencies of its alternates and canaries since any of
+// them can be requested.
+func (r *Route) fragmentDependencies() map[string][]string {
+	dependencies := make(map[string][]string)
+
+	r.EachFragment(func(key string, f *fragment.Definition) bool {
+		definitions := append([]*fragment.Definition{f}, f.Alternates()...)
+		for _, definition := range definitions {
+			if canary := definition.CanaryDefinition(); canary != nil {
+				definitions = append(definitions, canary)
+			}
+		}
+
+		for _, definition := range definitions {
+			for _, dependency := range definition.Dependencies() {
+				if !containsString(dependencies[key], dependency.Key) {
+					dependencies[key] = append(dependencies[key], dependency.Key)
+				}
+			}
+		}
+
+		return true
+	})
+
+	return dependencies
+}
+
+// fragmentDependencyError returns a FragmentDependencyError if a fragment
+// depends on a fragment that isn't requested, or fragments depend on each
+// other in a cycle.
+func (r *Route) fragmentDependencyError() error {
+	dependencies := r.fragmentDependencies()
+	if len(dependencies) == 0 {
+		return nil
+	}
+
+	for _, key := range r.fragmentOrder {
+		for _, dependency := range dependencies[key] {
+			f := r.Fragment(dependency)
+			if f == nil || f.IsStatic() || f.Lazy {
+				return &FragmentDependencyError{Route: r, Key: key, Dependency: dependency}
+			}
+		}
+	}
+
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int, len(dependencies))
+
+	var visit func(key string) error
+	visit = func(key string) error {
+		state[key] = visiting
+
+		for _, dependency := range dependencies[key] {
+			switch state[dependency] {
+			case visiting:
+				return &FragmentDependencyError{Route: r, Key: key, Dependency: dependency, Cycle: true}
+			case 0:
+				if err := visit(dependency); err != nil {
+					return err
+				}
+			}
+		}
+
+		state[key] = visited
+		return nil
+	}
+
+	for _, key := range r.fragmentOrder {
+		if state[key] == 0 {
+			if err := visit(key); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// fragmentCycle returns a FragmentCycleError if a fragment in the tree is its
+// own ancestor. The same definition can be used multiple times in the tree as
+// long as it isn't nested within itself.
+func (r *Route) fragmentCycle() error {
+	key, f := findFragmentCycle("root", r.RootFragment, make(map[*fragment.Definition]struct{}))
+
+	if f != nil {
+		return &FragmentCycleError{Route: r, Fragment: f, Key: key}
+	}
+
+	return nil
+}
+
+func findFragmentCycle(key string, f *fragment.Definition, ancestors map[*fragment.Definition]struct{}) (string, *fragment.Definition) {
+	if _, ok := ancestors[f]; ok {
+		return key, f
+	}
+
+	ancestors[f] = struct{}{}
+	defer delete(ancestors, f)
+
+	names := make([]string, 0, len(f.Children()))
+	for name := range f.Children() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if cycleKey, cycleFragment := findFragmentCycle(key+"."+name, f.Child(name), ancestors); cycleFragment != nil {
+			return cycleKey, cycleFragment
+		}
+	}
+
+	return "", nil
+}
+
 func (r *Route) memoizeFragments() {
 	mapping := fragmentMapping(r.RootFragment)
 
@@ -153,6 +615,180 @@ func (r *Route) memoizeFragments() {
 	r.fragmentsToRequest = fragments
 }
 
+// canaryPercents are the canary percents of a route's fragments, by key.
+type canaryPercents struct {
+	mu       sync.RWMutex
+	percents map[string]float64
+}
+
+// setCanaryPercent sets the percentage of requests served by the canary of
+// the fragment with the given key for this route only.
+func (r *Route) setCanaryPercent(key string, percent float64) error {
+	f := r.Fragment(key)
+	if f == nil {
+		return fmt.Errorf("route %s has no fragment %s", r.Path, key)
+	}
+
+	if f.CanaryDefinition() == nil {
+		return fmt.Errorf("fragment %s has no canary", f.Path)
+	}
+
+	if percent < 0 || percent > 100 {
+		return fmt.Errorf("canary percent must be between 0 and 100, got %v", percent)
+	}
+
+	r.canaryPercents.mu.Lock()
+	defer r.canaryPercents.mu.Unlock()
+
+	r.canaryPercents.percents[key] = percent
+
+	return nil
+}
+
+// selectCanary selects between the definition of the fragment with the given
+// key and its canary, using the percent set for this route when there is one.
+func (r *Route) selectCanary(key string, definition *fragment.Definition, canaryKey string) (*fragment.Definition, bool) {
+	if r.canaryPercents == nil {
+		return definition.SelectCanary(canaryKey)
+	}
+
+	r.canaryPercents.mu.RLock()
+	percent, ok := r.canaryPercents.percents[key]
+	r.canaryPercents.mu.RUnlock()
+
+	if !ok {
+		return definition.SelectCanary(canaryKey)
+	}
+
+	return definition.SelectCanaryWithPercent(canaryKey, percent)
+}
+
+// enabledFor returns false when the route is disabled for the request with the
+// given context.
+func (r *Route) enabledFor(ctx context.Context) bool {
+	return r.enabled == nil || r.enabled(ctx)
+}
+
+// routesEqual returns true when both routes have the same path, metadata, and
+// fragment tree.
+func routesEqual(route *Route, other *Route) bool {
+	return route.Path == other.Path &&
+		route.Host == other.Host &&
+		reflect.DeepEqual(route.targetURL, other.targetURL) &&
+		route.passThroughFallback == other.passThroughFallback &&
+		route.maxConcurrency == other.maxConcurrency &&
+		reflect.DeepEqual(route.forwardedQueryParams, other.forwardedQueryParams) &&
+		paramTransformsEqual(route.paramTransforms, other.paramTransforms) &&
+		funcsEqual(route.enabled, other.enabled) &&
+		reflect.DeepEqual(route.Metadata, other.Metadata) &&
+		definitionsEqual(route.RootFragment, other.RootFragment)
+}
+
+func definitionsEqual(d *fragment.Definition, other *fragment.Definition) bool {
+	if d == other {
+		return true
+	}
+
+	if d == nil || other == nil {
+		return false
+	}
+
+	if d.Path != other.Path ||
+		d.IgnoreValidation != other.IgnoreValidation ||
+		!fetchersEqual(d.Fetcher, other.Fetcher) ||
+		!bytes.Equal(d.StaticContent, other.StaticContent) ||
+		d.IsStatic() != other.IsStatic() ||
+		d.RetryPolicy != other.RetryPolicy ||
+		d.Shared != other.Shared ||
+		d.TimingLabel != other.TimingLabel ||
+		!reflect.DeepEqual(d.SLO, other.SLO) ||
+		d.MaxBodySize != other.MaxBodySize ||
+		!reflect.DeepEqual(d.Query, other.Query) ||
+		d.OverrideQuery != other.OverrideQuery ||
+		!reflect.DeepEqual(d.Headers, other.Headers) ||
+		d.Method != other.Method ||
+		!bytes.Equal(d.Body, other.Body) ||
+		!reflect.DeepEqual(d.AllowedStatusCodes, other.AllowedStatusCodes) ||
+		!reflect.DeepEqual(d.Target, other.Target) ||
+		d.Lazy != other.Lazy ||
+		d.Priority != other.Priority ||
+		!bytes.Equal(d.Fallback, other.Fallback) ||
+		!reflect.DeepEqual(d.ParamDefaults(), other.ParamDefaults()) ||
+		!funcsEqual(d.Condition, other.Condition) ||
+		!dependenciesEqual(d.Dependencies(), other.Dependencies()) ||
+		len(d.Alternates()) != len(other.Alternates()) ||
+		!reflect.DeepEqual(d.SharedHeaders, other.SharedHeaders) ||
+		!definitionsEqual(d.CanaryDefinition(), other.CanaryDefinition()) ||
+		d.CanaryPercent() != other.CanaryPercent() ||
+		!reflect.DeepEqual(d.Metadata, other.Metadata) ||
+		!reflect.DeepEqual(d.TypedMetadata(), other.TypedMetadata()) ||
+		len(d.Children()) != len(other.Children()) {
+		return false
+	}
+
+	for name, child := range d.Children() {
+		if !definitionsEqual(child, other.Child(name)) {
+			return false
+		}
+	}
+
+	for i, alternate := range d.Alternates() {
+		if !definitionsEqual(alternate, other.Alternates()[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// funcsEqual returns true when both functions are nil. Closures of the same
+// function share a code pointer while capturing different values, so non-nil
+// functions are never considered equal.
+func funcsEqual(fn interface{}, other interface{}) bool {
+	return reflect.ValueOf(fn).IsNil() && reflect.ValueOf(other).IsNil()
+}
+
+func dependenciesEqual(dependencies []multiplexer.Dependency, other []multiplexer.Dependency) bool {
+	if len(dependencies) != len(other) {
+		return false
+	}
+
+	for i, dependency := range dependencies {
+		if dependency.Key != other[i].Key || !funcsEqual(dependency.Inject, other[i].Inject) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func paramTransformsEqual(transforms map[string]ParamTransform, other map[string]ParamTransform) bool {
+	if len(transforms) != len(other) {
+		return false
+	}
+
+	for name, transform := range transforms {
+		if !funcsEqual(transform, other[name]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func fetchersEqual(f multiplexer.FragmentFetcher, other multiplexer.FragmentFetcher) bool {
+	if f == nil || other == nil {
+		return f == nil && other == nil
+	}
+
+	// Comparing uncomparable types would panic
+	if reflect.TypeOf(f) != reflect.TypeOf(other) || !reflect.TypeOf(f).Comparable() {
+		return false
+	}
+
+	return f == other
+}
+
 // fragmentMapping returns a map of fragment keys and their fragments.
 //
 // Fragment keys consist of each parent's name separated by a `.`. The top-level
@@ -1,11 +1,14 @@
 package viewproxy
 
 import (
+	"context"
+	"net/http"
 	"reflect"
 	"strings"
 	"testing"
 
 	fragment "github.com/blakewilliams/viewproxy/pkg/fragment"
+	"github.com/blakewilliams/viewproxy/pkg/multiplexer"
 	"github.com/stretchr/testify/require"
 )
 
@@ -13,21 +16,30 @@ func TestRoute_MatchParts(t *testing.T) {
 	tests := map[string]struct {
 		routePath   string
 		providedUrl string
+		foldCase    bool
 		want        bool
 	}{
-		"root":                     {routePath: "/", providedUrl: "/", want: true},
-		"mismatched root route":    {routePath: "/", providedUrl: "/hello-world", want: false},
-		"matching static routes":   {routePath: "/hello/world", providedUrl: "/hello/world", want: true},
-		"mismatched static routes": {routePath: "/hello/world", providedUrl: "/hello/false", want: false},
-		"valid dynamic route":      {routePath: "/hello/:name", providedUrl: "/hello/world", want: true},
-		"invalid dynamic route":    {routePath: "/hello/:name", providedUrl: "/hello/world/wow", want: false},
+		"root":                      {routePath: "/", providedUrl: "/", want: true},
+		"mismatched root route":     {routePath: "/", providedUrl: "/hello-world", want: false},
+		"matching static routes":    {routePath: "/hello/world", providedUrl: "/hello/world", want: true},
+		"mismatched static routes":  {routePath: "/hello/world", providedUrl: "/hello/false", want: false},
+		"valid dynamic route":       {routePath: "/hello/:name", providedUrl: "/hello/world", want: true},
+		"invalid dynamic route":     {routePath: "/hello/:name", providedUrl: "/hello/world/wow", want: false},
+		"optional segment present":  {routePath: "/items/:id?", providedUrl: "/items/1", want: true},
+		"optional segment absent":   {routePath: "/items/:id?", providedUrl: "/items", want: true},
+		"optional segment extra":    {routePath: "/items/:id?", providedUrl: "/items/1/2", want: false},
+		"optional segment prefix":   {routePath: "/items/:id?", providedUrl: "/things", want: false},
+		"mixed case static":         {routePath: "/hello/world", providedUrl: "/Hello/WORLD", want: false},
+		"folded mixed case static":  {routePath: "/hello/world", providedUrl: "/Hello/WORLD", foldCase: true, want: true},
+		"folded mixed case dynamic": {routePath: "/Hello/:name", providedUrl: "/hELLO/World", foldCase: true, want: true},
+		"folded mismatched static":  {routePath: "/hello/world", providedUrl: "/hello/worlds", foldCase: true, want: false},
 	}
 
 	for name, test := range tests {
 		t.Run(name, func(t *testing.T) {
-			route := newRoute(test.routePath, map[string]string{}, fragment.Define(""))
+			route := newRoute(test.routePath, map[string]string{}, fragment.Define("/"))
 			providedUrlParts := strings.Split(test.providedUrl, "/")
-			got := route.matchParts(providedUrlParts)
+			got := route.matchParts(providedUrlParts, test.foldCase)
 
 			if got != test.want {
 				t.Fatalf("expected route %s to match URL %s", test.routePath, test.providedUrl)
@@ -42,13 +54,15 @@ func TestRoute_ParametersFor(t *testing.T) {
 		providedUrl string
 		want        map[string]string
 	}{
-		"simple":      {routePath: "/", providedUrl: "/", want: map[string]string{}},
-		"multi false": {routePath: "/hello/:name", providedUrl: "/hello/world", want: map[string]string{"name": "world"}},
+		"simple":                   {routePath: "/", providedUrl: "/", want: map[string]string{}},
+		"multi false":              {routePath: "/hello/:name", providedUrl: "/hello/world", want: map[string]string{"name": "world"}},
+		"optional segment present": {routePath: "/items/:id?", providedUrl: "/items/1", want: map[string]string{"id": "1"}},
+		"optional segment absent":  {routePath: "/items/:id?", providedUrl: "/items", want: map[string]string{}},
 	}
 
 	for name, test := range tests {
 		t.Run(name, func(t *testing.T) {
-			route := newRoute(test.routePath, map[string]string{}, fragment.Define(""))
+			route := newRoute(test.routePath, map[string]string{}, fragment.Define("/"))
 			providedUrlParts := strings.Split(test.providedUrl, "/")
 			got := route.parametersFor(providedUrlParts)
 
@@ -117,6 +131,43 @@ func TestRoute_Validate(t *testing.T) {
 			)),
 			errorString: "static route /foo has mismatched fragment route /_viewproxy/hello/:name/layout",
 		},
+		"optional segment": {
+			routePath: "/items/:id?",
+			root: fragment.Define("/_viewproxy/items/layout", fragment.WithoutValidation(), fragment.WithChild(
+				"body", fragment.Define("/_viewproxy/items/:id?/body"),
+			)),
+		},
+		"optional segment required by fragment": {
+			routePath: "/items/:id?",
+			root: fragment.Define("/_viewproxy/items/layout", fragment.WithoutValidation(), fragment.WithChild(
+				"body", fragment.Define("/_viewproxy/items/:id/body"),
+			)),
+			errorString: "dynamic route /items/:id? has mismatched fragment route /_viewproxy/items/:id/body",
+		},
+		"optional segment with default": {
+			routePath: "/items/:id?",
+			root:      fragment.Define("/items/:id", fragment.WithParamDefault(":id", "all")),
+		},
+		"optional segment not last": {
+			routePath:   "/items/:id?/edit",
+			root:        fragment.Define("/_viewproxy/items/:id?/edit"),
+			errorString: "optional segment :id? must be the last segment of route /items/:id?/edit",
+		},
+		"static route with defaulted dynamic body": {
+			routePath: "/foo",
+			root: fragment.Define("/_viewproxy/foo/layout", fragment.WithChild(
+				"body", fragment.Define("/_viewproxy/hello/:name/body", fragment.WithParamDefault(":name", "guest")),
+			)),
+		},
+		"dynamic route with query template": {
+			routePath: "/hello/:name",
+			root:      fragment.Define("/_viewproxy/render?partial=hello&name=:name"),
+		},
+		"static route with query template": {
+			routePath:   "/hello",
+			root:        fragment.Define("/_viewproxy/render?partial=hello&name=:name"),
+			errorString: "static route /hello has mismatched fragment route /_viewproxy/render?partial=hello&name=:name",
+		},
 		"static route with dynamic body": {
 			routePath: "/foo",
 			root: fragment.Define("/_viewproxy/foo/layout", fragment.WithChild(
@@ -157,3 +208,218 @@ func TestFragmentMapping(t *testing.T) {
 	require.Equal(t, body, mapping["root.body"])
 	require.Equal(t, root, mapping["root"])
 }
+
+func TestRoute_EachFragment(t *testing.T) {
+	root := fragment.Define("/layout", fragment.WithChildren(fragment.Children{
+		"header": fragment.Define("/header"),
+		"body":   fragment.Define("/body"),
+	}))
+	route := newRoute("/", map[string]string{}, root)
+
+	keys := make([]string, 0)
+	route.EachFragment(func(key string, d *fragment.Definition) bool {
+		require.Same(t, route.Fragment(key), d)
+		keys = append(keys, key)
+		return true
+	})
+	require.Equal(t, route.FragmentOrder(), keys)
+
+	keys = keys[:0]
+	route.EachFragment(func(key string, d *fragment.Definition) bool {
+		keys = append(keys, key)
+		return false
+	})
+	require.Equal(t, route.FragmentOrder()[:1], keys)
+}
+
+func TestRoute_ValidateCycles(t *testing.T) {
+	layout := fragment.Define("/layout")
+	body := fragment.Define("/body", fragment.WithChild("layout", layout))
+	fragment.WithChild("body", body)(layout)
+
+	route := newRoute("/", map[string]string{}, layout)
+	require.EqualError(t, route.Validate(), "route / has cyclic fragment root.body.layout with route /layout")
+
+	self := fragment.Define("/self")
+	fragment.WithChild("self", self)(self)
+
+	route = newRoute("/", map[string]string{}, self)
+	require.EqualError(t, route.Validate(), "route / has cyclic fragment root.self with route /self")
+}
+
+func TestRoute_ValidateMaxFragmentDepth(t *testing.T) {
+	root := fragment.Define("/layout", fragment.WithChild(
+		"body", fragment.Define("/body", fragment.WithChild(
+			"main", fragment.Define("/main", fragment.WithChild(
+				"comments", fragment.Define("/comments"),
+			)),
+		)),
+	))
+
+	_, err := NewRoute("/", root)
+	require.NoError(t, err)
+
+	_, err = NewRoute("/", root, WithMaxFragmentDepth(3))
+
+	var depthErr *FragmentDepthError
+	require.ErrorAs(t, err, &depthErr)
+	require.Equal(t, "root.body.main.comments", depthErr.Key)
+	require.EqualError(t, err, "route / fragment root.body.main.comments: fragment nesting exceeds max depth of 3")
+
+	_, err = NewRoute("/", root, WithMaxFragmentDepth(4))
+	require.NoError(t, err)
+}
+
+func TestRoute_ValidateEmptyFragmentPath(t *testing.T) {
+	root := fragment.Define("/layout", fragment.WithChild("sidebar", fragment.Define("", fragment.WithoutValidation())))
+
+	_, err := NewRoute("/", root)
+
+	var emptyErr *EmptyFragmentPathError
+	require.ErrorAs(t, err, &emptyErr)
+	require.Equal(t, "root.sidebar", emptyErr.Key)
+	require.EqualError(t, err, "route / fragment root.sidebar has an empty path")
+
+	_, err = NewRoute("/", fragment.Define("?partial=header"))
+	require.ErrorAs(t, err, &emptyErr)
+	require.Equal(t, "root", emptyErr.Key)
+
+	// The root of the target and static fragments are allowed
+	root = fragment.Define("/", fragment.WithChild("sidebar", fragment.Static([]byte("sidebar"))))
+	_, err = NewRoute("/", root)
+	require.NoError(t, err)
+}
+
+func TestRoute_FragmentDependencies(t *testing.T) {
+	root := fragment.Define(
+		"/layout",
+		fragment.WithChild("body", fragment.Define("/body", fragment.DependsOn("root", nil))),
+	)
+	_, err := NewRoute("/", root)
+	require.NoError(t, err)
+
+	root = fragment.Define(
+		"/layout",
+		fragment.WithChild("body", fragment.Define("/body", fragment.DependsOn("root.header", nil))),
+	)
+	_, err = NewRoute("/", root)
+	require.EqualError(t, err, "route / fragment root.body depends on root.header, which is not requested by the route")
+
+	root = fragment.Define(
+		"/layout",
+		fragment.DependsOn("root.body", nil),
+		fragment.WithChild("body", fragment.Define("/body", fragment.DependsOn("root", nil))),
+	)
+	_, err = NewRoute("/", root)
+
+	var dependencyErr *FragmentDependencyError
+	require.ErrorAs(t, err, &dependencyErr)
+	require.True(t, dependencyErr.Cycle)
+	require.EqualError(t, err, "route / fragment root.body has a cyclic dependency on root")
+}
+
+func TestRoute_SharedFragments(t *testing.T) {
+	shared := fragment.Define("/shared")
+	root := fragment.Define(
+		"/layout",
+		fragment.WithChild("header", fragment.Define("/header", fragment.WithChild("shared", shared))),
+		fragment.WithChild("footer", fragment.Define("/footer", fragment.WithChild("shared", shared))),
+	)
+
+	route := newRoute("/", map[string]string{}, root)
+	require.NoError(t, route.Validate())
+
+	require.Len(t, route.FragmentsToRequest(), 5)
+	require.Contains(t, route.FragmentOrder(), "root.header.shared")
+	require.Contains(t, route.FragmentOrder(), "root.footer.shared")
+}
+
+func TestRoutesEqual(t *testing.T) {
+	fetcher := &fakeFetcher{}
+	otherFetcher := &fakeFetcher{}
+
+	testCases := map[string]struct {
+		route *Route
+		other *Route
+		want  bool
+	}{
+		"identical": {
+			route: newRoute("/hello/:name", map[string]string{"a": "b"}, fragment.Define("/layout", fragment.WithChild("body", fragment.Define("/body/:name")))),
+			other: newRoute("/hello/:name", map[string]string{"a": "b"}, fragment.Define("/layout", fragment.WithChild("body", fragment.Define("/body/:name")))),
+			want:  true,
+		},
+		"different path": {
+			route: newRoute("/hello/:name", map[string]string{}, fragment.Define("/layout")),
+			other: newRoute("/goodbye/:name", map[string]string{}, fragment.Define("/layout")),
+			want:  false,
+		},
+		"different metadata": {
+			route: newRoute("/hello", map[string]string{"a": "b"}, fragment.Define("/layout")),
+			other: newRoute("/hello", map[string]string{"a": "c"}, fragment.Define("/layout")),
+			want:  false,
+		},
+		"different child path": {
+			route: newRoute("/hello", map[string]string{}, fragment.Define("/layout", fragment.WithChild("body", fragment.Define("/body")))),
+			other: newRoute("/hello", map[string]string{}, fragment.Define("/layout", fragment.WithChild("body", fragment.Define("/new_body")))),
+			want:  false,
+		},
+		"different child name": {
+			route: newRoute("/hello", map[string]string{}, fragment.Define("/layout", fragment.WithChild("body", fragment.Define("/body")))),
+			other: newRoute("/hello", map[string]string{}, fragment.Define("/layout", fragment.WithChild("main", fragment.Define("/body")))),
+			want:  false,
+		},
+		"added grandchild": {
+			route: newRoute("/hello", map[string]string{}, fragment.Define("/layout", fragment.WithChild("body", fragment.Define("/body")))),
+			other: newRoute("/hello", map[string]string{}, fragment.Define("/layout", fragment.WithChild("body", fragment.Define("/body", fragment.WithChild("main", fragment.Define("/main")))))),
+			want:  false,
+		},
+		"different fragment metadata": {
+			route: newRoute("/hello", map[string]string{}, fragment.Define("/layout", fragment.WithMetadata(map[string]string{"a": "b"}))),
+			other: newRoute("/hello", map[string]string{}, fragment.Define("/layout", fragment.WithMetadata(map[string]string{"a": "c"}))),
+			want:  false,
+		},
+		"different validation": {
+			route: newRoute("/hello", map[string]string{}, fragment.Define("/layout")),
+			other: newRoute("/hello", map[string]string{}, fragment.Define("/layout", fragment.WithoutValidation())),
+			want:  false,
+		},
+		"same fetcher": {
+			route: newRoute("/hello", map[string]string{}, fragment.Define("/layout", fragment.WithFetcher(fetcher))),
+			other: newRoute("/hello", map[string]string{}, fragment.Define("/layout", fragment.WithFetcher(fetcher))),
+			want:  true,
+		},
+		"closures of the same function": {
+			route: newRoute("/hello", map[string]string{}, fragment.Define("/layout", fragment.WithCondition(headerCondition("a")))),
+			other: newRoute("/hello", map[string]string{}, fragment.Define("/layout", fragment.WithCondition(headerCondition("b")))),
+			want:  false,
+		},
+		"different fetcher": {
+			route: newRoute("/hello", map[string]string{}, fragment.Define("/layout", fragment.WithFetcher(fetcher))),
+			other: newRoute("/hello", map[string]string{}, fragment.Define("/layout", fragment.WithFetcher(otherFetcher))),
+			want:  false,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, tc.want, routesEqual(tc.route, tc.other))
+		})
+	}
+}
+
+// headerCondition returns a condition that's true when the request has the
+// header, so each returned condition has the same code pointer.
+func headerCondition(name string) func(*http.Request) bool {
+	return func(r *http.Request) bool {
+		return r.Header.Get(name) != ""
+	}
+}
+
+type fakeFetcher struct {
+	// Ensures pointers to fakeFetcher are distinct
+	_ int
+}
+
+func (f *fakeFetcher) Fetch(ctx context.Context, requestable multiplexer.Requestable, header http.Header) (*multiplexer.Result, error) {
+	return &multiplexer.Result{}, nil
+}
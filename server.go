@@ -2,18 +2,27 @@ package viewproxy
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"html"
 	"log"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/blakewilliams/viewproxy/pkg/fragment"
 	"github.com/blakewilliams/viewproxy/pkg/multiplexer"
+	"github.com/blakewilliams/viewproxy/pkg/notifier"
 	"github.com/blakewilliams/viewproxy/pkg/secretfilter"
+	"github.com/blakewilliams/viewproxy/pkg/tracing"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/trace"
@@ -21,6 +30,23 @@ import (
 
 const (
 	HeaderViewProxyOriginalPath = "X-Viewproxy-Original-Path"
+	// The number of times a request has passed through viewproxy, sent with
+	// fragment and pass through requests
+	HeaderViewProxyDepth = "X-Viewproxy-Depth"
+)
+
+const (
+	// Emitted around the handling of every request
+	EventServeHTTP = "viewproxy.serve_http"
+	// Emitted around requests that are proxied to the pass through target
+	EventProxy = "viewproxy.proxy"
+	// Emitted after the response has been written. The status code and
+	// duration of the response are available via StatusCodeFromContext and
+	// DurationFromContext.
+	EventResponseComplete = "viewproxy.response_complete"
+	// Emitted when a hedged request is made for a slow fragment. The fragment
+	// is available via multiplexer.RequestableFromContext.
+	EventFragmentHedged = "viewproxy.fragment_hedged"
 )
 
 // Re-export ResultError for convenience
@@ -50,40 +76,334 @@ type Server struct {
 	// request URL to a route. This only applies to routes that are not declared
 	// with an explicit trailing slash.
 	IgnoreTrailingSlash bool
-	routes              []Route
-	target              string
-	targetURL           *url.URL
-	httpServer          *http.Server
-	reverseProxy        *httputil.ReverseProxy
-	Logger              logger
-	passThrough         bool
-	SecretFilter        secretfilter.Filter
+	// Redirects requests with a trailing slash to the canonical path without
+	// it with a 301 when only the canonical path matches a route, instead of
+	// serving the route at both paths. Takes precedence over
+	// IgnoreTrailingSlash.
+	RedirectTrailingSlash bool
+	// Matches the static parts of routes case insensitively, e.g. `/Hello/World`
+	// matches `/hello/:name`. The values of dynamic parts keep their casing.
+	CaseInsensitivePaths bool
+	routes               []*Route
+	routesMu             sync.RWMutex
+	target               string
+	targetURL            *url.URL
+	targets              *targetSet
+	httpServer           *http.Server
+	reverseProxy         *httputil.ReverseProxy
+	clientTLSConfig      *tls.Config
+	transport            transportConfig
+	prefetcher           *prefetcher
+	passThroughURL       *url.URL
+	Logger               logger
+	passThrough          bool
+	pathPrefix           string
+	SecretFilter         secretfilter.Filter
+	// Emits events that can be subscribed to for instrumentation
+	Notifier               notifier.Notifier
+	tracingConfig          tracing.TracingConfig
+	tracingShutdown        func()
+	tracingHooksRegistered bool
+	tracingMu              sync.Mutex
 	// Sets the secret used to generate an HMAC that can be used by the target
 	// server to validate that a request came from viewproxy.
 	//
 	// When set, two headers are sent to the target URL for fragment and layout
 	// requests. The `X-Authorization-Timestamp` header, which is a timestamp
 	// generated at the start of the request, and `X-Authorization`, which is a
-	// hex encoded HMAC of "urlPathWithQueryParams,timestamp`.
+	// hex encoded HMAC of "urlPathWithQueryParams,timestamp`. Fragments
+	// requested with a method other than GET sign
+	// "method,urlPathWithQueryParams,timestamp" instead.
 	HmacSecret string
-	// The transport passed to `http.Client` when fetching fragments or proxying
-	// requests.
-	// HttpTransport      http.RoundTripper
+	// Makes the requests that fetch fragments. Defaults to a standard tripper
+	// using the client given to WithHTTPClient or WithTransport, or a zero
+	// value http.Client.
 	MultiplexerTripper multiplexer.Tripper
 	// A function to wrap the entire request handling with other middleware
 	AroundRequest func(http.Handler) http.Handler
 	// A function to wrap around the generating of the response after the fragment
-	// requests have completed or errored
+	// requests have completed or errored, or once the root fragment has
+	// arrived when the response is streamed
 	AroundResponse func(http.Handler) http.Handler
+	// The maximum number of bytes of a failed fragment's response body kept
+	// in its ResultError.BodySnippet, for error pages and notifier
+	// subscribers. Secrets added to the SecretFilter are filtered from
+	// snippets. No snippet is kept when 0.
+	ErrorSnippetSize int
+	// Sets the minimum size in bytes a stitched response body must be before it
+	// is gzipped, like nginx's gzip_min_length. Smaller responses are written
+	// uncompressed, without the Content-Encoding header. Defaults to 1024,
+	// while 0 gzips every response.
+	MinCompressSize int
+	// When true, a strong ETag computed from the stitched body, before it's
+	// gzipped, is set on responses and GET requests with a matching
+	// If-None-Match header receive a 304 Not Modified. No ETag is set when a
+	// fragment responds with `Cache-Control: no-store`.
+	GenerateETags bool
+	// When true, stitched responses are written as the fragments arrive
+	// instead of once every fragment has been fetched. Streaming starts once
+	// the root fragment has arrived, so the status code and headers are those
+	// available at that point, and ResultsFromContext contains nil for the
+	// fragments still being fetched. When a fragment fails after the first
+	// byte was written, the response is truncated and the error is logged.
+	//
+	// Responses are buffered when they're gzipped, when the root contains the
+	// timing tag, or when GenerateETags, ConditionalFragments, or the
+	// RenderAnalyzer need the whole body.
+	StreamResponses bool
+	// When true, the If-None-Match and If-Modified-Since headers of requests
+	// are forwarded to fragments and a 304 Not Modified is returned without
+	// stitching when every fragment responds with a 304. Fragments that
+	// respond with a 304 while others changed are fetched again without the
+	// conditional headers. Conditional headers are never forwarded otherwise,
+	// or to routes with fragment dependencies.
+	ConditionalFragments bool
+	// Returns the status code of stitched responses from the results of the
+	// route's fragments, by fragment key. Static and skipped fragments are
+	// 200s, and fragments only respond with non-2xx statuses allowed by
+	// their definition's AllowedStatusCodes. Defaults to
+	// RootStatusCode, while MaxStatusCode responds with the highest status of
+	// any fragment. Redirects from the root fragment are always passed
+	// through with their Location header.
+	ResponseStatusCode func(results map[string]*multiplexer.Result) int
+	// When true, stitched responses list the SurrogateKeysFor their route in
+	// the SurrogateKeyHeader, so a CDN can purge every page rendering a
+	// fragment when the fragment's template changes.
+	SurrogateKeys bool
+	// The name of the header listing surrogate keys. Defaults to
+	// `Surrogate-Key`.
+	SurrogateKeyHeader string
+	// Headers removed from stitched responses before they're written, e.g.
+	// the surrogate keys or `Surrogate-Control` of fragments when no CDN
+	// strips them before they reach browsers. The SurrogateKeyHeader is set
+	// after headers are removed.
+	StripResponseHeaders []string
+	// Returns the key used to consistently select between a fragment and its
+	// canary for a request, so a client keeps seeing the same definition.
+	// Defaults to the client's address, which is the first X-Forwarded-For
+	// address when TrustForwardedHeaders is set.
+	CanaryKey func(*http.Request) string
+	// Caches fragments marked as shared across requests for a short duration
+	SharedCache *multiplexer.SharedCache
+	// The file the popular keys of the SharedCache are persisted to by
+	// PersistCacheKeys and read from by WarmCache
+	CacheKeysPath string
+	// The response header the target sets while it's in maintenance mode.
+	// WarmCache pauses for WarmupBackoff while fragments respond with it.
+	MaintenanceHeader string
+	// How long WarmCache pauses when the target is in maintenance mode or
+	// responds with a 503 without a Retry-After header. Defaults to 5 seconds.
+	WarmupBackoff time.Duration
+	// Sets the maximum number of bytes, request headers and bodies, that can
+	// be sent to the target server while handling a single request. Requests
+	// that exceed the limit fail with a multiplexer.OutboundBytesExceededError.
+	// No limit is enforced when 0.
+	MaxOutboundBytes int64
+	// Sets the default maximum size in bytes of a fragment's response body,
+	// which can be overridden per fragment with fragment.WithMaxBodySize.
+	// Larger responses fail with a multiplexer.ErrBodyTooLarge. No limit is
+	// enforced when 0.
+	MaxBodyBytes int64
+	// Samples rendered routes to measure how much their output changes
+	// between requests. Disabled when nil.
+	RenderAnalyzer *RenderAnalyzer
+	// Rolls up the latency and errors of fragments defined with
+	// fragment.WithSLO so their SLOs can be evaluated by MonitorSLOs.
+	// Disabled when nil.
+	SLOMonitor *SLOMonitor
+	// When the server has a path prefix, includes the prefix in the
+	// X-Viewproxy-Original-Path header sent to the target
+	OriginalPathIncludesPrefix bool
+	// The fraction of ProxyTimeout, between 0 and 1, after which optional
+	// fragments that are still pending are skipped and rendered using their
+	// fallback content. Disabled when 0.
+	OptionalFragmentBudget float64
+	// The maximum number of fragments fetched at once for a request, the rest
+	// wait for a fetch to complete. Unlimited when 0, and can be overridden
+	// per route via WithMaxConcurrency.
+	MaxFragmentConcurrency int
+	// When set, fragments that haven't responded after this duration are
+	// requested a second time, using whichever response arrives first.
+	// Disabled when 0.
+	FragmentHedgeAfter time.Duration
+	// When true, the DNS, connect, TLS, first byte, and body read time of
+	// fragments are recorded in Result.Timing and reported in the
+	// Server-Timing header for fragments with a timing label
+	DetailedFragmentTiming bool
+	// When set, it's called with a copy of the headers of each fragment
+	// request before it's signed, and returns the headers to send, e.g.
+	// without the Cookie header for fragments that are cacheable for
+	// anonymous users. The requestable is a *fragment.Request. Nil sends the
+	// same headers for every fragment.
+	FragmentHeaderFunc func(requestable multiplexer.Requestable, header http.Header) http.Header
+	// Decides which Set-Cookie header is forwarded when several fragments
+	// set a cookie with the same name. Defaults to the last fragment's, in
+	// the order of their keys with the root first.
+	SetCookiePolicy multiplexer.SetCookiePolicy
+	// When true, Link headers of 103 Early Hints responses to the root
+	// fragment are forwarded to the client in a 103 response while fragments
+	// are still being fetched, so the client can start preloading
+	ForwardEarlyHints bool
+	// When true, fragment bodies are read into pooled buffers that are
+	// reused once the response is written, reducing allocations under load.
+	// Results must not be retained by AroundResponse handlers, error
+	// handlers, or event hooks after they return. Released bodies are
+	// poisoned in race and `-tags debug` builds to detect misuse.
+	PooledBuffers bool
+	// The number of times a fragment request that fails with a connection
+	// error is made again to another healthy target given to WithTargets.
+	// Status code errors never fail over. Failovers are made via the
+	// MultiplexerTripper, which can identify them using
+	// multiplexer.FailoverFromContext. Disabled when 0.
+	MaxTargetFailovers int
+	// Rewrites the Location header of redirects returned by the pass through
+	// server before they're sent to the client, given the incoming request.
+	// Defaults to RewriteLocation.
+	LocationRewriter func(location string, r *http.Request) string
+	// Honors the X-Forwarded-Proto and X-Forwarded-Host headers of incoming
+	// requests when determining the public URL of the server. Only enable when
+	// the server is behind a proxy that sets them.
+	TrustForwardedHeaders bool
+	// The names of query params that are never forwarded from the request to
+	// fragments, e.g. tracking params like `utm_source`. Applies in addition
+	// to WithForwardedQueryParams.
+	StripQueryParams []string
+	// The name of the tag that marks where child fragments are inserted into
+	// their parent, e.g. `<viewproxy-fragment id="header"></viewproxy-fragment>`
+	// or `<viewproxy-fragment id="header"/>`
+	FragmentTag string
+	// Returns the markup rendered in place of lazy fragments, given the
+	// secret filtered path and query of the fragment
+	LazyPlaceholder func(src string) []byte
+	// The body of 404 responses for requests that don't match a route when
+	// pass through is disabled. It's an html/template that can reference the
+	// request path via `{{.Path}}`.
+	NotFoundBody string
+	// The Content-Type of 404 responses
+	NotFoundContentType string
+	// The body of 500 responses written when fetching fragments fails. It's an
+	// html/template that can reference the request path via `{{.Path}}`.
+	InternalErrorBody string
+	// The Content-Type of 500 responses
+	InternalErrorContentType string
+	// Called by ReloadRoutes with each route that was added
+	OnRouteAdded func(*Route)
+	// Called by ReloadRoutes with the new version of each route that changed
+	OnRouteChanged func(*Route)
+	// Called by ReloadRoutes with each route that was removed
+	OnRouteRemoved func(*Route)
+	// The maximum X-Viewproxy-Depth of incoming requests. Requests that are
+	// deeper, e.g. because the target routes fragment requests back to
+	// viewproxy, are rejected with a 508. The header is only trusted on
+	// requests signed with the HmacSecret or made from a loopback address.
+	// Defaults to 3, disabled when 0.
+	MaxRequestDepth int
+	// When true, Get, ReloadRoutes, and discovered routes return a
+	// FragmentPathCollisionError when a fragment requested from the server's
+	// own address matches the path of a route, instead of logging a warning.
+	StrictFragmentPaths bool
 }
 
 type ServerOption = func(*Server) error
 
+// OptionError is returned by NewServer when a ServerOption fails.
+type OptionError struct {
+	// The name of the option that failed, e.g. `WithPassThrough`
+	Option string
+	Err    error
+}
+
+func (oe *OptionError) Error() string {
+	return fmt.Sprintf("option %s: %s", oe.Option, oe.Err)
+}
+
+func (oe *OptionError) Unwrap() error {
+	return oe.Err
+}
+
+// namedOption returns a ServerOption that wraps errors returned by fn in an
+// OptionError with the given option name.
+func namedOption(name string, fn func(*Server) error) ServerOption {
+	return func(server *Server) error {
+		if err := fn(server); err != nil {
+			return &OptionError{Option: name, Err: err}
+		}
+
+		return nil
+	}
+}
+
+var (
+	// ErrInvalidFragmentTag is returned by WithFragmentTag when the tag isn't
+	// a valid tag name
+	ErrInvalidFragmentTag = errors.New("invalid fragment tag")
+	// ErrInvalidPathPrefix is returned by WithPathPrefix when the prefix
+	// contains a query or fragment
+	ErrInvalidPathPrefix = errors.New("invalid path prefix")
+	// ErrNilHTTPClient is returned by WithHTTPClient and WithTransport when
+	// given nil
+	ErrNilHTTPClient = errors.New("http client is nil")
+)
+
 type routeContextKey struct{}
+type suppressedRouteContextKey struct{}
 type parametersContextKey struct{}
+type escapedParametersContextKey struct{}
 type startTimeKey struct{}
+type statusCodeContextKey struct{}
+type durationContextKey struct{}
+type fanOutContextKey struct{}
+type renderedFragmentsContextKey struct{}
+
+// renderedFragments contains the keys of the fragments rendered for a request.
+type renderedFragments struct {
+	// The keys of requested fragments, in the same order as the multiplexer
+	// results
+	requested []string
+	// The content of static fragments, keyed by fragment key
+	static map[string][]byte
+	// The content rendered for requested fragments that are skipped, keyed by
+	// fragment key
+	fallbacks map[string][]byte
+}
+
+// FanOut describes how many fragments were fetched to render a route.
+type FanOut struct {
+	// The number of fragments defined for the route, excluding the fragments
+	// rendered from static content
+	Configured int
+	// The number of fetches made for the fragments. Identical fragments share
+	// a single fetch.
+	Fetched int
+	// The number of static fragments that were rendered without a request
+	Static int
+	// The errors of the fragments that failed, in the order of their keys
+	// with the root first. Several errors are reported when fragments fail
+	// at the same time.
+	Errors []error
+}
+
+// Skipped returns the number of fragments defined for the route that were not
+// fetched themselves, including fragments sharing the fetch of an identical
+// fragment.
+func (f *FanOut) Skipped() int {
+	return f.Configured - f.Fetched
+}
+
+func init() {
+	// The fan out is populated while the request is handled, so async
+	// subscribers get it as it was when the event was emitted
+	notifier.RegisterSnapshot(fanOutContextKey{}, func(value interface{}) interface{} {
+		fanOut := *value.(*FanOut)
+		fanOut.Errors = append([]error(nil), fanOut.Errors...)
+		return &fanOut
+	})
+}
 
 const defaultTimeout = 10 * time.Second
+const defaultMinCompressSize = 1024
+const defaultSharedCacheTTL = time.Second
+const defaultFragmentTag = "viewproxy-fragment"
 
 func emptyMiddleware(h http.Handler) http.Handler { return h }
 
@@ -96,22 +416,40 @@ func NewServer(target string, opts ...ServerOption) (*Server, error) {
 	}
 
 	server := &Server{
-		MultiplexerTripper:  multiplexer.NewStandardTripper(&http.Client{}),
-		Logger:              log.Default(),
-		SecretFilter:        secretfilter.New(),
-		Addr:                "localhost:3005",
-		ProxyTimeout:        defaultTimeout,
-		ReadTimeout:         defaultTimeout,
-		WriteTimeout:        defaultTimeout,
-		passThrough:         false,
-		AroundRequest:       emptyMiddleware,
-		AroundResponse:      emptyMiddleware,
-		IgnoreTrailingSlash: true,
-		target:              target,
-		targetURL:           targetURL,
-		routes:              make([]Route, 0),
+		MultiplexerTripper:       multiplexer.NewStandardTripper(&http.Client{}),
+		Logger:                   log.Default(),
+		SecretFilter:             secretfilter.New(),
+		Notifier:                 notifier.New(),
+		Addr:                     "localhost:3005",
+		ProxyTimeout:             defaultTimeout,
+		ReadTimeout:              defaultTimeout,
+		WriteTimeout:             defaultTimeout,
+		passThrough:              false,
+		AroundRequest:            emptyMiddleware,
+		AroundResponse:           emptyMiddleware,
+		IgnoreTrailingSlash:      true,
+		MinCompressSize:          defaultMinCompressSize,
+		ErrorSnippetSize:         multiplexer.DefaultErrorSnippetSize,
+		ResponseStatusCode:       RootStatusCode,
+		SurrogateKeyHeader:       defaultSurrogateKeyHeader,
+		FragmentTag:              defaultFragmentTag,
+		LazyPlaceholder:          defaultLazyPlaceholder,
+		NotFoundBody:             defaultNotFoundBody,
+		NotFoundContentType:      defaultErrorContentType,
+		InternalErrorBody:        defaultInternalErrorBody,
+		InternalErrorContentType: defaultErrorContentType,
+		SharedCache:              multiplexer.NewSharedCache(defaultSharedCacheTTL),
+		WarmupBackoff:            defaultWarmupBackoff,
+		MaxRequestDepth:          defaultMaxRequestDepth,
+		target:                   target,
+		targetURL:                targetURL,
+		targets:                  newTargetSet([]*url.URL{targetURL}, nil),
+		routes:                   make([]*Route, 0),
 	}
 
+	server.LocationRewriter = server.RewriteLocation
+	server.CanaryKey = server.clientAddress
+
 	for _, fn := range opts {
 		err := fn(server)
 
@@ -120,22 +458,113 @@ func NewServer(target string, opts ...ServerOption) (*Server, error) {
 		}
 	}
 
+	server.configureMultiplexerTripper()
+
 	return server, nil
 }
 
 func WithPassThrough(passthroughTarget string) ServerOption {
-	return func(server *Server) error {
+	return namedOption("WithPassThrough", func(server *Server) error {
 		targetURL, err := url.Parse(passthroughTarget)
 
 		if err != nil {
-			return fmt.Errorf("WithPassThrough error: %w", err)
+			return err
 		}
 
 		server.passThrough = true
+		server.passThroughURL = targetURL
 		server.reverseProxy = httputil.NewSingleHostReverseProxy(targetURL)
+		server.configurePassThroughTLS()
 
 		return nil
-	}
+	})
+}
+
+// WithHTTPClient fetches fragments using the given client, e.g. with a tuned
+// transport, instead of a zero value http.Client. The client is modified to
+// have no cookie jar and to not follow redirects. It's replaced when
+// MultiplexerTripper is set after the server is created. It can't be combined
+// with other options that replace the client, like WithTransport.
+func WithHTTPClient(client *http.Client) ServerOption {
+	return namedOption("WithHTTPClient", func(server *Server) error {
+		if client == nil {
+			return ErrNilHTTPClient
+		}
+
+		if err := server.transport.choose("WithHTTPClient"); err != nil {
+			return err
+		}
+
+		server.transport.client = client
+		return server.checkClientTLS()
+	})
+}
+
+// WithTransport fetches fragments using an http.Client with the given
+// transport, e.g. an http.Transport with a higher MaxIdleConnsPerHost.
+func WithTransport(transport http.RoundTripper) ServerOption {
+	return namedOption("WithTransport", func(server *Server) error {
+		if transport == nil {
+			return ErrNilHTTPClient
+		}
+
+		if err := server.transport.choose("WithTransport"); err != nil {
+			return err
+		}
+
+		server.transport.client = &http.Client{Transport: transport}
+		return server.checkClientTLS()
+	})
+}
+
+// WithH2C fetches fragments over HTTP/2 cleartext connections using
+// multiplexer.NewH2CTransport, multiplexing concurrent fragment requests to a
+// target over a single connection. Every target must accept h2c. It can't be
+// combined with options that configure the transport, like WithTransport.
+func WithH2C() ServerOption {
+	return namedOption("WithH2C", func(server *Server) error {
+		if err := server.transport.choose("WithH2C"); err != nil {
+			return err
+		}
+
+		server.transport.h2c = true
+		return server.checkClientTLS()
+	})
+}
+
+// WithTripperOptions fetches fragments using a transport returned by
+// multiplexer.NewTransport, which is tuned for fetching fragments from a few
+// hosts, configured by the given options, e.g.
+// `WithTripperOptions(multiplexer.WithMaxIdleConnsPerHost(128))`. Fragment
+// requests are still bounded by ProxyTimeout rather than a client timeout.
+// Options given to several WithTripperOptions are combined. It can't be
+// combined with options that replace the transport, like WithTransport.
+func WithTripperOptions(opts ...multiplexer.TransportOption) ServerOption {
+	return namedOption("WithTripperOptions", func(server *Server) error {
+		if err := server.transport.choose("WithTripperOptions"); err != nil {
+			return err
+		}
+
+		server.transport.tuned = true
+		server.transport.options = append(server.transport.options, opts...)
+		return nil
+	})
+}
+
+var validFragmentTag = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9-]*$`)
+
+// WithFragmentTag sets the name of the tag that marks where child fragments
+// are inserted, for templates that already use `<viewproxy-fragment>` for
+// other purposes.
+func WithFragmentTag(tag string) ServerOption {
+	return namedOption("WithFragmentTag", func(server *Server) error {
+		if !validFragmentTag.MatchString(tag) {
+			return fmt.Errorf("%w: %q", ErrInvalidFragmentTag, tag)
+		}
+
+		server.FragmentTag = tag
+		return nil
+	})
 }
 
 func (s *Server) PassThroughEnabled() bool {
@@ -150,79 +579,447 @@ func WithRouteMetadata(metadata map[string]string) GetOption {
 	}
 }
 
-func (s *Server) Get(path string, root *fragment.Definition, opts ...GetOption) error {
-	route := newRoute(path, map[string]string{}, root)
+// WithPassThroughFallback passes requests through to the pass through target
+// when the root fragment of the route returns a 404, instead of handling it as
+// an error. This allows pages to be migrated to viewproxy incrementally.
+func WithPassThroughFallback() GetOption {
+	return func(route *Route) {
+		route.passThroughFallback = true
+	}
+}
+
+// WithMaxFragmentDepth sets the number of levels fragments can be nested in
+// the route, including the root fragment. Defaults to DefaultMaxFragmentDepth.
+func WithMaxFragmentDepth(depth int) GetOption {
+	return func(route *Route) {
+		route.maxFragmentDepth = depth
+	}
+}
+
+// WithForwardedQueryParams restricts the query params forwarded from the
+// request to fragments to the given names, dropping the rest. All query params
+// are forwarded by default.
+func WithForwardedQueryParams(names []string) GetOption {
+	return func(route *Route) {
+		route.forwardedQueryParams = make(map[string]struct{}, len(names))
+		for _, name := range names {
+			route.forwardedQueryParams[name] = struct{}{}
+		}
+	}
+}
+
+// WithMaxConcurrency sets the maximum number of fragments fetched at once for
+// requests to the route, overriding the server's MaxFragmentConcurrency.
+func WithMaxConcurrency(concurrency int) GetOption {
+	return func(route *Route) {
+		route.maxConcurrency = concurrency
+	}
+}
+
+// WithRouteEnabledFunc calls enabled for each request matching the route, e.g.
+// to check a feature flag. When it returns false the route is treated as
+// unmatched, so the request is passed through or receives a 404, and the
+// route is available via SuppressedRouteFromContext. It's called for every
+// matching request, so it must be cheap or cache its result.
+func WithRouteEnabledFunc(enabled func(ctx context.Context) bool) GetOption {
+	return func(route *Route) {
+		route.enabled = enabled
+	}
+}
+
+// ParamTransform reshapes how a matched dynamic segment is delivered to
+// fragments. It's given the unescaped value of the segment and returns the
+// value to use in fragment paths, along with query params to add to the
+// requests of the fragments whose paths use the segment.
+type ParamTransform = func(raw string) (pathValue string, extraQuery url.Values)
 
-	for _, opt := range opts {
-		opt(route)
+// WithParamTransform transforms the named dynamic segment, e.g. `:tags`, before
+// it's used to build fragment requests. The original value is still available
+// via ParametersFromContext.
+func WithParamTransform(name string, transform ParamTransform) GetOption {
+	return func(route *Route) {
+		if route.paramTransforms == nil {
+			route.paramTransforms = make(map[string]ParamTransform)
+		}
+
+		route.paramTransforms[":"+strings.TrimPrefix(name, ":")] = transform
 	}
+}
 
-	err := route.Validate()
+func (s *Server) Get(path string, root *fragment.Definition, opts ...GetOption) error {
+	route, err := NewRoute(path, root, opts...)
 	if err != nil {
 		return err
 	}
 
-	s.routes = append(s.routes, *route)
+	s.routesMu.Lock()
+	defer s.routesMu.Unlock()
+
+	// Fragments requesting a route from the server itself recurse
+	if err := s.checkFragmentPaths(s.fragmentPathCollisions(route, s.routes)); err != nil {
+		return err
+	}
+
+	s.routes = append(s.routes, route)
 
 	return nil
 }
 
+// ReloadRoutes replaces the routes defined on the server with the given
+// routes.
+//
+// Routes that are unchanged keep their existing *Route so that any state
+// associated with them survives the reload. The OnRouteAdded, OnRouteChanged,
+// and OnRouteRemoved hooks are called after the new routes are in place.
+//
+// When StrictFragmentPaths is set and a fragment of the given routes collides
+// with one of them, the existing routes are kept and the collision is
+// returned.
+func (s *Server) ReloadRoutes(routes []*Route) error {
+	var collisions []*FragmentPathCollisionError
+	for _, route := range routes {
+		collisions = append(collisions, s.collidingFragments(route, routes)...)
+	}
+	if err := s.checkFragmentPaths(collisions); err != nil {
+		return err
+	}
+
+	s.routesMu.Lock()
+
+	existing := make(map[string]*Route, len(s.routes))
+	for _, route := range s.routes {
+		existing[routeKey(route)] = route
+	}
+
+	newRoutes := make([]*Route, 0, len(routes))
+	var added, changed []*Route
+
+	for _, route := range routes {
+		oldRoute, ok := existing[routeKey(route)]
+
+		switch {
+		case !ok:
+			added = append(added, route)
+			newRoutes = append(newRoutes, route)
+		case routesEqual(oldRoute, route):
+			newRoutes = append(newRoutes, oldRoute)
+		default:
+			changed = append(changed, route)
+			newRoutes = append(newRoutes, route)
+		}
+
+		delete(existing, routeKey(route))
+	}
+
+	// Retain the original ordering of removed routes for the hooks
+	removed := make([]*Route, 0, len(existing))
+	for _, route := range s.routes {
+		if _, ok := existing[routeKey(route)]; ok {
+			removed = append(removed, route)
+		}
+	}
+
+	s.routes = newRoutes
+	s.routesMu.Unlock()
+
+	callRouteHook(s.OnRouteAdded, added)
+	callRouteHook(s.OnRouteChanged, changed)
+	callRouteHook(s.OnRouteRemoved, removed)
+
+	return nil
+}
+
+func callRouteHook(hook func(*Route), routes []*Route) {
+	if hook == nil {
+		return
+	}
+
+	for _, route := range routes {
+		hook(route)
+	}
+}
+
+// SetCanaryPercent sets the percentage of requests that are served by the
+// canary of the fragment with the given key, e.g. `root.layout`, in the route
+// with the given path. Other routes rendering the same definition keep their
+// percent.
+func (s *Server) SetCanaryPercent(routePath string, fragmentKey string, percent float64) error {
+	s.routesMu.RLock()
+	defer s.routesMu.RUnlock()
+
+	for _, route := range s.routes {
+		if route.Path != routePath {
+			continue
+		}
+
+		return route.setCanaryPercent(fragmentKey, percent)
+	}
+
+	return fmt.Errorf("no route defined for %s", routePath)
+}
+
+func defaultLazyPlaceholder(src string) []byte {
+	return []byte(fmt.Sprintf(`<div data-viewproxy-lazy-src="%s"></div>`, html.EscapeString(src)))
+}
+
+// clientAddress returns the address of the client that made the request,
+// which is the first X-Forwarded-For address when TrustForwardedHeaders is
+// set.
+func (s *Server) clientAddress(r *http.Request) string {
+	if s.TrustForwardedHeaders {
+		if forwardedFor := firstForwardedValue(r.Header.Get("X-Forwarded-For")); forwardedFor != "" {
+			return forwardedFor
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
 // target returns the configured http target
 func (s *Server) Target() string {
 	return s.target
 }
 
-// routes returns a slice containing routes defined on the server.
-func (s *Server) Routes() []Route {
-	return s.routes
+// Routes returns a slice containing the routes defined on the server. The
+// routes are shared with the server and must not be modified.
+func (s *Server) Routes() []*Route {
+	s.routesMu.RLock()
+	defer s.routesMu.RUnlock()
+
+	routes := make([]*Route, len(s.routes))
+	copy(routes, s.routes)
+
+	return routes
+}
+
+// EachRoute calls fn with each route defined on the server until fn returns
+// false, without copying the routes. fn must not add or remove routes.
+func (s *Server) EachRoute(fn func(*Route) bool) {
+	s.routesMu.RLock()
+	defer s.routesMu.RUnlock()
+
+	for _, route := range s.routes {
+		if !fn(route) {
+			return
+		}
+	}
 }
 
+// Shutdown gracefully shuts down the server, then waits for the events queued
+// for async notifier subscriptions to be handled, e.g. by
+// notifier.DefaultNotifier.OnAsync, until the context is done.
 func (s *Server) Shutdown(ctx context.Context) error {
-	return s.httpServer.Shutdown(ctx)
+	if err := s.httpServer.Shutdown(ctx); err != nil {
+		return err
+	}
+	s.prefetcher.stop()
+
+	if n, ok := s.Notifier.(interface{ Shutdown(context.Context) error }); ok {
+		return n.Shutdown(ctx)
+	}
+
+	return nil
 }
 
 func (s *Server) Close() {
 	s.httpServer.Close()
+	s.prefetcher.stop()
 }
 
-// TODO this should probably be a tree structure for faster lookups
+// MatchingRoute returns the route matching the path, ignoring routes scoped to
+// a host.
 func (s *Server) MatchingRoute(path string) (*Route, map[string]string) {
-	if s.IgnoreTrailingSlash && path != "/" {
+	return s.MatchingRouteForHost("", path)
+}
+
+// MatchingRouteForHost returns the route matching the host and escaped path.
+// Routes without a host match every host. The parameters are decoded, like
+// those returned by ParametersFromContext.
+func (s *Server) MatchingRouteForHost(host string, path string) (*Route, map[string]string) {
+	route, escaped := s.matchingRequestRoute(host, path)
+	return route, decodeParameters(escaped)
+}
+
+// matchingRequestRoute returns the route matching the host and escaped request
+// path along with the escaped parameters.
+func (s *Server) matchingRequestRoute(host string, path string) (*Route, map[string]string) {
+	if s.IgnoreTrailingSlash && !s.RedirectTrailingSlash && path != "/" {
 		path = strings.TrimRight(path, "/")
 	}
+
+	return s.matchingRoute(host, path)
+}
+
+// TODO this should probably be a tree structure for faster lookups
+func (s *Server) matchingRoute(host string, path string) (*Route, map[string]string) {
 	parts := strings.Split(path, "/")
 
+	s.routesMu.RLock()
+	defer s.routesMu.RUnlock()
+
 	for _, route := range s.routes {
-		if route.matchParts(parts) {
+		if route.matchesHost(host) && route.matchParts(parts, s.CaseInsensitivePaths) {
 			parameters := route.parametersFor(parts)
-			return &route, parameters
+			return route, parameters
 		}
 	}
 
 	return nil, nil
 }
 
+// canonicalLocation returns the path and query to redirect to when the request
+// path has a trailing slash and only the path without it matches a route.
+func (s *Server) canonicalLocation(r *http.Request, host string) (string, bool) {
+	path := r.URL.EscapedPath()
+	if path == "/" || !strings.HasSuffix(path, "/") {
+		return "", false
+	}
+
+	canonical := strings.TrimRight(path, "/")
+	// Paths starting with `//` would redirect to another host
+	if canonical == "" || strings.HasPrefix(canonical, "//") {
+		return "", false
+	}
+
+	if route, _ := s.matchingRoute(host, path); route != nil {
+		return "", false
+	}
+	if route, _ := s.matchingRoute(host, canonical); route == nil || !route.enabledFor(r.Context()) {
+		return "", false
+	}
+
+	if r.URL.RawQuery != "" {
+		canonical += "?" + r.URL.RawQuery
+	}
+
+	return canonical, true
+}
+
 func (s *Server) rootHandler(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ctx := r.Context()
+		ctx := context.WithValue(r.Context(), startTimeKey{}, time.Now())
 		ctx = otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(r.Header))
 
+		if s.pathPrefix != "" {
+			stripped, ok := s.stripPathPrefix(r.WithContext(ctx))
+			if !ok {
+				s.serveHTTP(ctx, w, r, http.NotFoundHandler())
+				return
+			}
+
+			r = stripped
+			ctx = r.Context()
+			w = &prefixedResponseWriter{ResponseWriter: w, prefix: s.pathPrefix}
+		}
+
 		tracer := otel.Tracer("server")
 		var span trace.Span
 		ctx, span = tracer.Start(ctx, "ServeHTTP")
 		defer span.End()
 
-		route, parameters := s.MatchingRoute(r.URL.EscapedPath())
+		if depth := s.requestDepth(r); s.MaxRequestDepth > 0 && depth > s.MaxRequestDepth {
+			s.Logger.Printf("Rejected request for %s with depth %d, the target may be routing requests back to viewproxy", r.URL.Path, depth)
+			s.serveHTTP(ctx, w, r, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				s.writeErrorBody(w, r, http.StatusLoopDetected, http.StatusText(http.StatusLoopDetected), defaultErrorContentType)
+			}))
+			return
+		}
+
+		_, host := s.publicSchemeAndHost(r)
+
+		if s.RedirectTrailingSlash {
+			if location, ok := s.canonicalLocation(r, host); ok {
+				s.serveHTTP(ctx, w, r, http.RedirectHandler(location, http.StatusMovedPermanently))
+				return
+			}
+		}
+
+		route, escapedParameters := s.matchingRequestRoute(host, r.URL.EscapedPath())
+
+		if route != nil && !route.enabledFor(ctx) {
+			ctx = context.WithValue(ctx, suppressedRouteContextKey{}, route)
+			route = nil
+		}
+
+		if route != nil && route.discovery != nil {
+			var err error
+			if route, err = s.resolveDiscovery(ctx, route); err != nil {
+				s.Logger.Printf("Could not discover route: %s", err)
+				s.serveHTTP(ctx, w, r, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					s.writeErrorBody(w, r, http.StatusInternalServerError, s.InternalErrorBody, s.InternalErrorContentType)
+				}))
+				return
+			}
+		}
 
 		if route != nil {
 			ctx = context.WithValue(ctx, routeContextKey{}, route)
-			ctx = context.WithValue(ctx, parametersContextKey{}, parameters)
+			ctx = context.WithValue(ctx, parametersContextKey{}, decodeParameters(escapedParameters))
+			ctx = context.WithValue(ctx, escapedParametersContextKey{}, escapedParameters)
+			// Populated by handleRequest so it can be read by middleware and
+			// subscribers once the request has been handled
+			ctx = context.WithValue(ctx, fanOutContextKey{}, &FanOut{})
+			ctx = context.WithValue(ctx, fragmentHeadersContextKey{}, &fragmentHeaders{header: make(http.Header)})
+			ctx = multiplexer.ContextWithOutboundBytes(ctx, multiplexer.NewOutboundBytes(s.MaxOutboundBytes))
+			ctx = multiplexer.ContextWithPhaseTimings(ctx, &multiplexer.PhaseTimings{})
 		}
 
-		next.ServeHTTP(w, r.WithContext(ctx))
+		s.serveHTTP(ctx, w, r, next)
 	})
 }
 
+// serveHTTP serves the request with the handler, emitting EventServeHTTP
+// around it and EventResponseComplete once it has responded. Requests
+// rejected before a route is matched are served by it too, so subscribers
+// see every response.
+func (s *Server) serveHTTP(ctx context.Context, w http.ResponseWriter, r *http.Request, handler http.Handler) {
+	recorder := &statusRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+	s.Notifier.Emit(EventServeHTTP, ctx, func(ctx context.Context) {
+		handler.ServeHTTP(recorder, r.WithContext(ctx))
+	})
+
+	ctx = context.WithValue(ctx, statusCodeContextKey{}, recorder.statusCode)
+	ctx = context.WithValue(ctx, durationContextKey{}, time.Since(startTimeFromContext(ctx)))
+	s.Notifier.Emit(EventResponseComplete, ctx, func(context.Context) {})
+}
+
+// statusRecorder records the status code written to the wrapped
+// ResponseWriter.
+type statusRecorder struct {
+	http.ResponseWriter
+	statusCode  int
+	wroteHeader bool
+}
+
+func (sr *statusRecorder) WriteHeader(statusCode int) {
+	if !sr.wroteHeader && !isInformational(statusCode) {
+		sr.statusCode = statusCode
+		sr.wroteHeader = true
+	}
+
+	sr.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (sr *statusRecorder) Write(p []byte) (int, error) {
+	sr.wroteHeader = true
+	return sr.ResponseWriter.Write(p)
+}
+
+func (sr *statusRecorder) Flush() {
+	if flusher, ok := sr.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
 func (s *Server) requestHandler() http.Handler {
 	responseHandler := s.createResponseHandler()
 
@@ -244,29 +1041,100 @@ func (s *Server) CreateHandler() http.Handler {
 
 func (s *Server) createResponseHandler() http.Handler {
 	handler := withCombinedFragments(s)
-	handler = withDefaultErrorHandler(handler)
+	handler = withDefaultErrorHandler(s, handler)
 	handler = s.AroundResponse(handler)
-	handler = multiplexer.WithDefaultHeaders(handler)
+	handler = multiplexer.WithResponseHeaders(s.SetCookiePolicy)(handler)
 
 	return handler
 }
 
 func (s *Server) newRequest() *multiplexer.Request {
-	req := multiplexer.NewRequest(s.MultiplexerTripper)
+	req := multiplexer.NewRequest(s.MultiplexerTripper, multiplexer.WithNotifier(s.Notifier))
 	req.SecretFilter = s.SecretFilter
+	req.ErrorSnippetSize = s.ErrorSnippetSize
 	req.Timeout = s.ProxyTimeout
+	req.SharedCache = s.SharedCache
+	req.MaxOutboundBytes = s.MaxOutboundBytes
+	req.MaxBodyBytes = s.MaxBodyBytes
+	req.OptionalBudget = s.OptionalFragmentBudget
+	req.MaxConcurrency = s.MaxFragmentConcurrency
+	req.HedgeAfter = s.FragmentHedgeAfter
+	req.DetailedTiming = s.DetailedFragmentTiming
+	req.PooledBodies = s.PooledBuffers
+	req.HeaderFunc = s.FragmentHeaderFunc
+	if s.MaxTargetFailovers > 0 {
+		req.Failover = s.targets.failover
+		req.MaxFailovers = s.MaxTargetFailovers
+	}
+	req.OnHedge = func(ctx context.Context, requestable multiplexer.Requestable) {
+		s.Notifier.Emit(EventFragmentHedged, ctx, func(context.Context) {})
+	}
 	return req
 }
 
-func (s *Server) handleRequest(w http.ResponseWriter, r *http.Request, route *Route, parameters map[string]string, ctx context.Context, handler http.Handler) {
-	startTime := time.Now()
+// newRouteRequest returns a request for the fragments of the route.
+func (s *Server) newRouteRequest(route *Route) *multiplexer.Request {
 	req := s.newRequest()
 	req.HmacSecret = s.HmacSecret
+	if route.maxConcurrency > 0 {
+		req.MaxConcurrency = route.maxConcurrency
+	}
+	if s.SLOMonitor != nil {
+		req.OnFetchComplete = func(ctx context.Context, requestable multiplexer.Requestable, duration time.Duration, err error) {
+			s.recordSLO(ctx, route, requestable, duration, err)
+		}
+	}
+
+	return req
+}
+
+func (s *Server) handleRequest(w http.ResponseWriter, r *http.Request, route *Route, parameters map[string]string, ctx context.Context, handler http.Handler) {
+	req := s.newRouteRequest(route)
+	// Only the root of routes without children is written without stitching
+	req.KeepCompressedBody = len(route.structure.DependentStructures()) == 0
+	requestables := make([]multiplexer.Requestable, 0, len(route.FragmentsToRequest()))
+	dependent := false
+
+	canaryKey := s.CanaryKey(r)
+	rendered := &renderedFragments{
+		requested: make([]string, 0, len(route.FragmentsToRequest())),
+		static:    make(map[string][]byte),
+		fallbacks: make(map[string][]byte),
+	}
+	skipped := make([]string, 0)
+	staticCount := 0
+	rootURL := ""
+	var root multiplexer.Requestable
+	dynamicParts, extraQuery := route.fragmentParameters(r.URL.EscapedPath())
+
+	for i, f := range route.FragmentsToRequest() {
+		key := route.FragmentOrder()[i]
+
+		// Fragments are ordered by key, so parents are always checked before
+		// their children
+		if hasSkippedAncestor(key, skipped) {
+			continue
+		}
+
+		selected := f.SelectFor(r)
+		if selected == nil {
+			skipped = append(skipped, key)
+			continue
+		}
+
+		if selected.IsStatic() {
+			rendered.static[key] = selected.StaticContent
+			staticCount++
+			continue
+		}
 
-	for _, f := range route.FragmentsToRequest() {
 		query := url.Values{}
 
 		for name, values := range r.URL.Query() {
+			if !route.forwardsQueryParam(name) || s.stripsQueryParam(name) {
+				continue
+			}
+
 			if query.Get(name) == "" {
 				for _, value := range values {
 					query.Add(name, value)
@@ -274,34 +1142,159 @@ func (s *Server) handleRequest(w http.ResponseWriter, r *http.Request, route *Ro
 			}
 		}
 
-		dynamicParts := route.dynamicPartsFromRequest(r.URL.EscapedPath())
-		requestable, err := f.Requestable(s.targetURL, dynamicParts, query)
-		if len(r.URL.Query()) > 0 {
-			requestable.RequestURL.RawQuery = query.Encode()
+		// Each fragment request is balanced across the target replicas
+		targetURL := route.targetURL
+		if targetURL == nil {
+			targetURL = s.targets.next()
 		}
 
+		definition, canary := route.selectCanary(key, selected, canaryKey)
+
+		// Query params added by a transform only go to the fragments using
+		// the transformed part
+		for _, part := range definition.DynamicParts() {
+			for name, values := range extraQuery[part] {
+				for _, value := range values {
+					query.Add(name, value)
+				}
+			}
+		}
+
+		requestable, err := definition.Requestable(targetURL, dynamicParts, query)
 		if err != nil {
-			// This can be caused due to invalid encoding
-			panic(err)
+			// This can be caused by invalid encoding or a missing parameter,
+			// so let the error handler respond instead of panicking
+			handlerCtx := multiplexer.ContextWithResults(r.Context(), nil, err)
+			handler.ServeHTTP(w, r.WithContext(handlerCtx))
+			return
+		}
+
+		// Lazy fragments and their children are loaded by the client
+		if definition.Lazy {
+			src := s.SecretFilter.FilterURL(requestable.RequestURL).RequestURI()
+			rendered.static[key] = s.LazyPlaceholder(src)
+			skipped = append(skipped, key)
+			continue
+		}
+
+		requestable.Canary = canary
+		requestable.FragmentKey = key
+		if key == "root" {
+			rootURL = requestable.URL()
+			root = requestable
 		}
 		req.WithRequestable(requestable)
+		requestables = append(requestables, requestable)
+		dependent = dependent || len(requestable.Dependencies()) > 0
+		rendered.requested = append(rendered.requested, key)
+		rendered.fallbacks[key] = definition.Fallback
+	}
+
+	if fanOut := FanOutFromContext(ctx); fanOut != nil {
+		fanOut.Configured = len(route.FragmentsToRequest()) - staticCount
+		fanOut.Fetched = req.FetchCount()
+		fanOut.Static = staticCount
 	}
 
 	req.WithHeadersFromRequest(r)
-	req.Header.Set(HeaderViewProxyOriginalPath, r.URL.RequestURI())
-	results, err := req.Do(ctx)
+	// A copy is applied so headers set while fragments are fetched can't race
+	// with the requests reading them
+	for key, values := range FragmentHeadersFromContext(ctx) {
+		req.Header[key] = values
+	}
+	originalPath := r.URL.RequestURI()
+	if s.OriginalPathIncludesPrefix {
+		originalPath = PathPrefixFromContext(ctx) + originalPath
+	}
+	req.Header.Set(HeaderViewProxyOriginalPath, originalPath)
+	req.Header.Set(HeaderViewProxyDepth, strconv.Itoa(s.requestDepth(r)+1))
+	// Dependencies need the bodies of the fragments they depend on
+	conditional := s.ConditionalFragments && !dependent
+	if !conditional {
+		for _, name := range multiplexer.ConditionalHeaders {
+			req.Header.Del(name)
+		}
+	}
+	var hints *earlyHintsWriter
+	if s.ForwardEarlyHints {
+		hints = &earlyHintsWriter{writer: w}
+		req.OnEarlyHints = hints.forwardRoot
+	}
+	var results []*multiplexer.Result
+	var stream *fragmentStream
+	var err error
+	if s.streamsResponses(r) {
+		results, stream, err = doStreaming(ctx, req, rendered)
+	} else {
+		results, err = req.Do(ctx)
+	}
+	hints.stop()
+	if conditional && err == nil {
+		results, err = s.refetchNotModified(ctx, route, req.Header, requestables, results)
+	}
 
-	handlerCtx := context.WithValue(r.Context(), startTimeKey{}, startTime)
+	if stream != nil {
+		// Fragments that haven't been written, e.g. because the response
+		// failed, are still received before their bodies are reused
+		defer func() {
+			err := stream.finish()
+			if fanOut := FanOutFromContext(ctx); fanOut != nil {
+				fanOut.Errors = multiplexer.Errors(err)
+			}
+			multiplexer.ReleaseResults(stream.received, err)
+		}()
+	} else {
+		if fanOut := FanOutFromContext(ctx); fanOut != nil {
+			fanOut.Errors = multiplexer.Errors(err)
+		}
+		// Pooled bodies are reused once the response is written
+		defer multiplexer.ReleaseResults(results, err)
+	}
+
+	if err == nil && s.prefetcher != nil {
+		s.prefetcher.enqueueHints(r, rootResult(rendered.requested, results))
+	}
+
+	if route.passThroughFallback && s.rootNotFound(ctx, route, req.Header, root, err) {
+		s.handlePassThrough(w, r)
+		return
+	}
+
+	if redirect := rootRedirect(err, rootURL, rootResult(rendered.requested, results)); redirect != nil {
+		s.writeRedirect(w, r, redirect)
+		return
+	}
+
+	handlerCtx := context.WithValue(r.Context(), renderedFragmentsContextKey{}, rendered)
 	handlerCtx = multiplexer.ContextWithResults(handlerCtx, results, err)
+	if stream != nil {
+		handlerCtx = context.WithValue(handlerCtx, fragmentStreamContextKey{}, stream)
+	}
 	handler.ServeHTTP(w, r.WithContext(handlerCtx))
 }
 
+// stripsQueryParam returns true when the query param with the given name is in
+// StripQueryParams.
+func (s *Server) stripsQueryParam(name string) bool {
+	for _, stripped := range s.StripQueryParams {
+		if name == stripped {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (s *Server) handlePassThrough(w http.ResponseWriter, r *http.Request) {
 	if s.passThrough {
-		s.reverseProxy.ServeHTTP(w, r)
+		w = &locationResponseWriter{ResponseWriter: w, request: r, rewrite: s.LocationRewriter}
+		r.Header.Set(HeaderViewProxyDepth, strconv.Itoa(s.requestDepth(r)+1))
+
+		s.Notifier.Emit(EventProxy, r.Context(), func(ctx context.Context) {
+			s.reverseProxy.ServeHTTP(w, r.WithContext(ctx))
+		})
 	} else {
-		w.WriteHeader(404)
-		w.Write([]byte("404 not found"))
+		s.writeErrorBody(w, r, http.StatusNotFound, s.NotFoundBody, s.NotFoundContentType)
 	}
 }
 
@@ -316,6 +1309,24 @@ func RouteFromContext(ctx context.Context) *Route {
 	return nil
 }
 
+// SuppressedRouteFromContext returns the route that matched the request but
+// was disabled by its WithRouteEnabledFunc, or nil.
+func SuppressedRouteFromContext(ctx context.Context) *Route {
+	if ctx == nil {
+		return nil
+	}
+
+	if route, ok := ctx.Value(suppressedRouteContextKey{}).(*Route); ok {
+		return route
+	}
+	return nil
+}
+
+// ParametersFromContext returns the dynamic segments of the request path
+// matched by the route, keyed by their name without the leading `:`. Values
+// are decoded, e.g. `a%2Fb` is `a/b`, and `+` is kept as is since it only
+// means a space in queries. Values that aren't valid escaped UTF-8 are left
+// escaped.
 func ParametersFromContext(ctx context.Context) map[string]string {
 	if ctx == nil {
 		return nil
@@ -327,6 +1338,146 @@ func ParametersFromContext(ctx context.Context) map[string]string {
 	return nil
 }
 
+// EscapedParametersFromContext returns the dynamic segments of the request
+// path as they appear in the path, without decoding them. These are the values
+// used to build fragment paths.
+func EscapedParametersFromContext(ctx context.Context) map[string]string {
+	if ctx == nil {
+		return nil
+	}
+
+	if parameters := ctx.Value(escapedParametersContextKey{}); parameters != nil {
+		return parameters.(map[string]string)
+	}
+	return nil
+}
+
+// decodeParameters returns a copy of the escaped parameters with each value
+// decoded, leaving values that can't be decoded to valid UTF-8 escaped.
+func decodeParameters(escaped map[string]string) map[string]string {
+	if escaped == nil {
+		return nil
+	}
+
+	decoded := make(map[string]string, len(escaped))
+	for name, value := range escaped {
+		unescaped, err := url.PathUnescape(value)
+		if err != nil || !utf8.ValidString(unescaped) {
+			unescaped = value
+		}
+
+		decoded[name] = unescaped
+	}
+
+	return decoded
+}
+
+// FanOutFromContext returns the FanOut of the current request. The FanOut is
+// populated once the fragments for the request are fetched, so it should be
+// read after the request is handled, e.g. after calling the next handler in
+// middleware.
+func FanOutFromContext(ctx context.Context) *FanOut {
+	if ctx == nil {
+		return nil
+	}
+
+	if fanOut := ctx.Value(fanOutContextKey{}); fanOut != nil {
+		return fanOut.(*FanOut)
+	}
+	return nil
+}
+
+// rootNotFound returns true when the root fragment responded with a 404.
+// When another fragment failed first, the root's fetch can be canceled before
+// its response arrives, so the root is fetched again on its own to check its
+// status.
+func (s *Server) rootNotFound(ctx context.Context, route *Route, header http.Header, root multiplexer.Requestable, err error) bool {
+	if err == nil || root == nil {
+		return false
+	}
+
+	if resultErr := rootResultError(err, root.URL()); resultErr != nil {
+		return resultErr.Result.StatusCode == http.StatusNotFound
+	}
+
+	for _, fragmentErr := range multiplexer.Errors(err) {
+		var transportErr *multiplexer.FragmentTransportError
+		if errors.As(fragmentErr, &transportErr) && transportErr.Key == "root" {
+			return false
+		}
+	}
+
+	req := s.newRouteRequest(route)
+	req.Header = header
+	req.WithRequestable(root)
+
+	results, err := req.Do(ctx)
+	multiplexer.ReleaseResults(results, err)
+
+	resultErr := rootResultError(err, root.URL())
+	return resultErr != nil && resultErr.Result.StatusCode == http.StatusNotFound
+}
+
+// rootResultError returns the ResultError of the root fragment when it's one of
+// the errors of err.
+func rootResultError(err error, rootURL string) *multiplexer.ResultError {
+	for _, fragmentErr := range multiplexer.Errors(err) {
+		var resultErr *multiplexer.ResultError
+		if errors.As(fragmentErr, &resultErr) && resultErr.Result.Url == rootURL {
+			return resultErr
+		}
+	}
+
+	return nil
+}
+
+func hasSkippedAncestor(key string, skipped []string) bool {
+	for _, skippedKey := range skipped {
+		if strings.HasPrefix(key, skippedKey+".") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func renderedFragmentsFromContext(ctx context.Context) *renderedFragments {
+	if ctx == nil {
+		return nil
+	}
+
+	if rendered := ctx.Value(renderedFragmentsContextKey{}); rendered != nil {
+		return rendered.(*renderedFragments)
+	}
+	return nil
+}
+
+// StatusCodeFromContext returns the status code of the response. It is only
+// available to EventResponseComplete subscribers.
+func StatusCodeFromContext(ctx context.Context) int {
+	if ctx == nil {
+		return 0
+	}
+
+	if statusCode := ctx.Value(statusCodeContextKey{}); statusCode != nil {
+		return statusCode.(int)
+	}
+	return 0
+}
+
+// DurationFromContext returns the time taken to handle the request and write
+// the response. It is only available to EventResponseComplete subscribers.
+func DurationFromContext(ctx context.Context) time.Duration {
+	if ctx == nil {
+		return 0
+	}
+
+	if duration := ctx.Value(durationContextKey{}); duration != nil {
+		return duration.(time.Duration)
+	}
+	return 0
+}
+
 func startTimeFromContext(ctx context.Context) time.Time {
 	if ctx == nil {
 		return time.Time{}
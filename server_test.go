@@ -8,24 +8,36 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
 	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/blakewilliams/viewproxy/pkg/fragment"
 	"github.com/blakewilliams/viewproxy/pkg/multiplexer"
+	"github.com/blakewilliams/viewproxy/pkg/notifier"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
-var targetServer *httptest.Server
+var targetServer *testTarget
 
 func TestMain(m *testing.M) {
 	targetServer = startTargetServer()
@@ -73,6 +85,28 @@ func TestServer(t *testing.T) {
 	require.Equal(t, "<html><body>hello world</body></html>", string(body))
 }
 
+func TestServer_Head(t *testing.T) {
+	viewProxyServer := newServer(t, targetServer.URL)
+	viewProxyServer.Logger = log.New(ioutil.Discard, "", log.Ldate|log.Ltime)
+
+	root := fragment.Define(
+		"/layouts/test_layout", fragment.WithoutValidation(),
+		fragment.WithChild("header", fragment.Define("/header/:name")),
+		fragment.WithChild("body", fragment.Define("/body/:name")),
+		fragment.WithChild("footer", fragment.Define("/footer/:name")),
+	)
+	require.NoError(t, viewProxyServer.Get("/hello/:name", root))
+
+	r := httptest.NewRequest(http.MethodHead, "/hello/world", nil)
+	w := httptest.NewRecorder()
+	viewProxyServer.CreateHandler().ServeHTTP(w, r)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "37", w.Header().Get("Content-Length"))
+	require.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	require.Empty(t, w.Body.String())
+}
+
 func TestServerRoot(t *testing.T) {
 	instance := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(500)
@@ -127,6 +161,224 @@ func TestQueryParamForwardingServer(t *testing.T) {
 	require.Equal(t, "viewproxy", resp.Header.Get("x-name"), "Expected response to have an X-Name header")
 }
 
+func TestForwardedQueryParams(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path + "?" + r.URL.RawQuery))
+	}))
+	defer server.Close()
+
+	viewProxyServer := newServer(t, server.URL)
+	err := viewProxyServer.Get("/hello/:name", fragment.Define("/body/:name"), WithForwardedQueryParams([]string{"page"}))
+	require.NoError(t, err)
+
+	r := httptest.NewRequest("GET", "/hello/world?page=2&utm_source=newsletter&_=123", nil)
+	w := httptest.NewRecorder()
+	viewProxyServer.CreateHandler().ServeHTTP(w, r)
+
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.Equal(t, "/body/world?page=2", w.Body.String())
+}
+
+// Emitting with a new context would hide the request's span and values from
+// subscribers
+func TestEmitUsesRequestContext(t *testing.T) {
+	files, err := filepath.Glob("*.go")
+	require.NoError(t, err)
+
+	fset := token.NewFileSet()
+	for _, file := range files {
+		if strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+
+		parsed, err := parser.ParseFile(fset, file, nil, 0)
+		require.NoError(t, err)
+
+		ast.Inspect(parsed, func(node ast.Node) bool {
+			call, ok := node.(*ast.CallExpr)
+			if !ok || len(call.Args) < 2 {
+				return true
+			}
+			if selector, ok := call.Fun.(*ast.SelectorExpr); !ok || selector.Sel.Name != "Emit" {
+				return true
+			}
+
+			if ctxCall, ok := call.Args[1].(*ast.CallExpr); ok {
+				if selector, ok := ctxCall.Fun.(*ast.SelectorExpr); ok {
+					if pkg, ok := selector.X.(*ast.Ident); ok && pkg.Name == "context" && (selector.Sel.Name == "Background" || selector.Sel.Name == "TODO") {
+						t.Errorf("%s: Emit is called with context.%s instead of the request's context", fset.Position(call.Pos()), selector.Sel.Name)
+					}
+				}
+			}
+
+			return true
+		})
+	}
+}
+
+func TestStripQueryParams(t *testing.T) {
+	secret := "6ccd9547b7042e0f1101ce68931d6b2c"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(fmt.Sprintf("%s,%s", r.URL.RequestURI(), r.Header.Get("X-Authorization-Time"))))
+		require.Equal(t, hex.EncodeToString(mac.Sum(nil)), r.Header.Get("Authorization"))
+
+		w.Write([]byte(r.URL.RequestURI()))
+	}))
+	defer server.Close()
+
+	viewProxyServer := newServer(t, server.URL)
+	viewProxyServer.HmacSecret = secret
+	viewProxyServer.StripQueryParams = []string{"utm_source", "gclid"}
+	err := viewProxyServer.Get("/hello/:name", fragment.Define("/body/:name"))
+	require.NoError(t, err)
+
+	r := httptest.NewRequest("GET", "/hello/world?page=2&utm_source=newsletter&gclid=abc", nil)
+	w := httptest.NewRecorder()
+	viewProxyServer.CreateHandler().ServeHTTP(w, r)
+
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.Equal(t, "/body/world?page=2", w.Body.String())
+}
+
+func TestAllowedStatusCodesAreStitched(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/layout":
+			w.Write([]byte(`<html><viewproxy-fragment id="ads"></viewproxy-fragment><viewproxy-fragment id="body"></viewproxy-fragment></html>`))
+		case "/body":
+			w.Write([]byte("hello world"))
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer server.Close()
+
+	viewProxyServer := newServer(t, server.URL)
+	err := viewProxyServer.Get("/hello", fragment.Define(
+		"/layout",
+		fragment.WithChild("ads", fragment.Define("/ads", fragment.WithAllowedStatusCodes(204, 404))),
+		fragment.WithChild("body", fragment.Define("/body")),
+	))
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	viewProxyServer.CreateHandler().ServeHTTP(w, httptest.NewRequest("GET", "/hello", nil))
+
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.Equal(t, "<html>hello world</html>", w.Body.String())
+}
+
+func TestFragmentTarget(t *testing.T) {
+	secret := "6ccb4e8d4c5a2b5d1f1e7c3d6a0c2b4e"
+	verifyHmac := func(t *testing.T, r *http.Request) {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(fmt.Sprintf("%s,%s", r.URL.RequestURI(), r.Header.Get("X-Authorization-Time"))))
+		require.Equal(t, hex.EncodeToString(mac.Sum(nil)), r.Header.Get("Authorization"))
+	}
+
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		verifyHmac(t, r)
+		w.Write([]byte(`<html><viewproxy-fragment id="search"></viewproxy-fragment></html>`))
+	}))
+	defer app.Close()
+
+	search := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		verifyHmac(t, r)
+		w.Write([]byte("search " + r.URL.RequestURI()))
+	}))
+	defer search.Close()
+
+	viewProxyServer := newServer(t, app.URL)
+	viewProxyServer.HmacSecret = secret
+	err := viewProxyServer.Get("/hello/:name", fragment.Define(
+		"/layout",
+		fragment.WithoutValidation(),
+		fragment.WithChild("search", fragment.Define("/search/:name", fragment.WithTarget(search.URL))),
+	))
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	viewProxyServer.CreateHandler().ServeHTTP(w, httptest.NewRequest("GET", "/hello/world?q=1", nil))
+
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.Equal(t, "<html>search /search/world?q=1</html>", w.Body.String())
+
+	err = viewProxyServer.Get("/broken", fragment.Define("/layout", fragment.WithTarget("://invalid")))
+	require.ErrorContains(t, err, "fragment /layout has invalid target")
+}
+
+func TestFragmentDependsOn(t *testing.T) {
+	secret := "6ccb4e8d4c5a2b5d1f1e7c3d6a0c2b4e"
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/layout" {
+			w.Header().Set("X-Personalization-Token", "abc123")
+			w.Write([]byte(`<html><viewproxy-fragment id="body"></viewproxy-fragment></html>`))
+			return
+		}
+
+		// Injected query params are signed
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(fmt.Sprintf("%s,%s", r.URL.RequestURI(), r.Header.Get("X-Authorization-Time"))))
+		require.Equal(t, hex.EncodeToString(mac.Sum(nil)), r.Header.Get("Authorization"))
+
+		w.Write([]byte("body " + r.URL.RequestURI() + " " + r.Header.Get("X-Personalization-Token")))
+	}))
+	defer app.Close()
+
+	viewProxyServer := newServer(t, app.URL)
+	viewProxyServer.HmacSecret = secret
+	err := viewProxyServer.Get("/hello", fragment.Define(
+		"/layout",
+		fragment.WithChild("body", fragment.Define("/body", fragment.DependsOn("root", func(dep *multiplexer.Result, q url.Values, h http.Header) {
+			q.Set("token", dep.HttpResponse.Header.Get("X-Personalization-Token"))
+			h.Set("X-Personalization-Token", dep.HttpResponse.Header.Get("X-Personalization-Token"))
+		}))),
+	))
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	viewProxyServer.CreateHandler().ServeHTTP(w, httptest.NewRequest("GET", "/hello", nil))
+
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.Equal(t, "<html>body /body?token=abc123 abc123</html>", w.Body.String())
+}
+
+func TestFragmentHedgeAfter(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The first request is slow, the hedged request responds immediately
+		if atomic.AddInt32(&requests, 1) == 1 {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+
+		w.Write([]byte("hello world"))
+	}))
+	defer server.Close()
+
+	viewProxyServer := newServer(t, server.URL)
+	viewProxyServer.FragmentHedgeAfter = 10 * time.Millisecond
+	require.NoError(t, viewProxyServer.Get("/hello", fragment.Define("/body")))
+
+	n := notifier.New()
+	var hedged []string
+	n.On(EventFragmentHedged, func(ctx context.Context) {
+		hedged = append(hedged, multiplexer.RequestableFromContext(ctx).URL())
+	})
+	viewProxyServer.Notifier = n
+
+	w := httptest.NewRecorder()
+	viewProxyServer.CreateHandler().ServeHTTP(w, httptest.NewRequest("GET", "/hello", nil))
+
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.Equal(t, "hello world", w.Body.String())
+	require.Equal(t, []string{server.URL + "/body"}, hedged)
+}
+
 func TestServer_EscapedNamedFragments(t *testing.T) {
 	viewProxyServer := newServer(t, targetServer.URL)
 
@@ -153,25 +405,62 @@ func TestServer_EscapedNamedFragments(t *testing.T) {
 	require.Equal(t, expected, string(body))
 }
 
-func TestPassThroughEnabled(t *testing.T) {
-	viewProxyServer := newServer(t, targetServer.URL, WithPassThrough(targetServer.URL))
-	viewProxyServer.Logger = log.New(ioutil.Discard, "", log.Ldate|log.Ltime)
+type inProcessFetcher struct{}
 
-	r := httptest.NewRequest("GET", "/oops", nil)
+func (f *inProcessFetcher) Fetch(ctx context.Context, requestable multiplexer.Requestable, header http.Header) (*multiplexer.Result, error) {
+	fragmentRequest := requestable.(*fragment.Request)
+	body := fmt.Sprintf("in-process %s", fragmentRequest.Parameters[":name"])
+
+	return &multiplexer.Result{Body: []byte(body)}, nil
+}
+
+func TestServer_FragmentFetcher(t *testing.T) {
+	viewProxyServer := newServer(t, targetServer.URL)
+
+	root := fragment.Define("/layouts/test_layout",
+		fragment.WithoutValidation(),
+		fragment.WithChild("header", fragment.Define("/header/:name")),
+		fragment.WithChild("body", fragment.Define("/in_process/:name", fragment.WithFetcher(&inProcessFetcher{}))),
+		fragment.WithChild("footer", fragment.Define("/footer/:name")),
+	)
+	err := viewProxyServer.Get("/hello/:name", root)
+	require.NoError(t, err)
+
+	r := httptest.NewRequest("GET", "/hello/world", nil)
 	w := httptest.NewRecorder()
 
 	viewProxyServer.CreateHandler().ServeHTTP(w, r)
 
 	resp := w.Result()
+
 	body, err := ioutil.ReadAll(resp.Body)
 	require.Nil(t, err)
 
-	require.Equal(t, 500, resp.StatusCode)
-	require.Equal(t, "Something went wrong", string(body))
+	require.Equal(t, 200, resp.StatusCode)
+	require.Equal(t, "<html><body>in-process world</body></html>", string(body))
 }
 
-func TestPassThroughDisabled(t *testing.T) {
+func TestServer_StaticFragments(t *testing.T) {
+	tripper := &contextTestTripper{}
 	viewProxyServer := newServer(t, targetServer.URL)
+	viewProxyServer.MultiplexerTripper = tripper
+
+	root := fragment.Define("/layouts/test_layout",
+		fragment.WithoutValidation(),
+		fragment.WithChild("header", fragment.Static([]byte("<body>"))),
+		fragment.WithChild("body", fragment.Define("/body/:name")),
+		fragment.WithChild("footer", fragment.Define("/footer/:name", fragment.WithStaticContent([]byte("</body>")))),
+	)
+	err := viewProxyServer.Get("/hello/:name", root)
+	require.NoError(t, err)
+
+	var fanOut *FanOut
+	n := notifier.New()
+	n.Around(EventServeHTTP, func(ctx context.Context, next func(context.Context)) {
+		next(ctx)
+		fanOut = FanOutFromContext(ctx)
+	})
+	viewProxyServer.Notifier = n
 
 	r := httptest.NewRequest("GET", "/hello/world", nil)
 	w := httptest.NewRecorder()
@@ -179,131 +468,1216 @@ func TestPassThroughDisabled(t *testing.T) {
 	viewProxyServer.CreateHandler().ServeHTTP(w, r)
 
 	resp := w.Result()
+
 	body, err := ioutil.ReadAll(resp.Body)
 	require.Nil(t, err)
 
-	require.Equal(t, 404, resp.StatusCode)
-	require.Equal(t, "404 not found", string(body))
+	require.Equal(t, 200, resp.StatusCode)
+	require.Equal(t, "<html><body>hello world</body></html>", string(body))
+	require.Len(t, tripper.requestables, 2)
+	require.Equal(t, 2, fanOut.Configured)
+	require.Equal(t, 2, fanOut.Fetched)
+	require.Equal(t, 2, fanOut.Static)
 }
 
-func TestPassThroughPostRequest(t *testing.T) {
-	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
-	defer cancel()
-	done := make(chan struct{})
-
-	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		defer close(done)
+func TestServer_ConditionalFragments(t *testing.T) {
+	tripper := &contextTestTripper{}
+	viewProxyServer := newServer(t, targetServer.URL)
+	viewProxyServer.MultiplexerTripper = tripper
 
-		body, err := io.ReadAll(r.Body)
+	isMobile := func(r *http.Request) bool { return r.Header.Get("X-Mobile") != "" }
+	hasFooter := func(r *http.Request) bool {
+		_, err := r.Cookie("footer")
+		return err == nil
+	}
 
-		require.Nil(t, err)
-		require.Equal(t, http.MethodPost, r.Method)
-		require.Equal(t, "hello", string(body))
-	}))
+	root := fragment.Define("/layouts/test_layout",
+		fragment.WithoutValidation(),
+		fragment.WithChild("header", fragment.Define(
+			"/header/:name",
+			fragment.WithAlternate(fragment.Static([]byte("<mobile>"), fragment.WithCondition(isMobile))),
+		)),
+		fragment.WithChild("body", fragment.Define("/body/:name")),
+		fragment.WithChild("footer", fragment.Define("/footer/:name", fragment.WithCondition(hasFooter))),
+	)
+	err := viewProxyServer.Get("/hello/:name", root)
+	require.NoError(t, err)
 
-	viewProxyServer := newServer(t, server.URL, WithPassThrough(server.URL))
+	var fanOut *FanOut
+	n := notifier.New()
+	n.Around(EventServeHTTP, func(ctx context.Context, next func(context.Context)) {
+		next(ctx)
+		fanOut = FanOutFromContext(ctx)
+	})
+	viewProxyServer.Notifier = n
 
-	r := httptest.NewRequest("POST", "/hello/world", strings.NewReader("hello"))
+	r := httptest.NewRequest("GET", "/hello/world", nil)
 	w := httptest.NewRecorder()
+	viewProxyServer.CreateHandler().ServeHTTP(w, r)
 
+	body, err := ioutil.ReadAll(w.Result().Body)
+	require.NoError(t, err)
+	require.Equal(t, "<html><body>hello world</html>", string(body))
+	require.Len(t, tripper.requestables, 3)
+	require.Equal(t, 1, fanOut.Skipped())
+
+	tripper.requestables = nil
+	r = httptest.NewRequest("GET", "/hello/world", nil)
+	r.Header.Set("X-Mobile", "1")
+	r.AddCookie(&http.Cookie{Name: "footer", Value: "1"})
+	w = httptest.NewRecorder()
 	viewProxyServer.CreateHandler().ServeHTTP(w, r)
 
-	select {
-	case <-done:
-		server.Close()
-	case <-ctx.Done():
-		require.Fail(t, ctx.Err().Error())
+	body, err = ioutil.ReadAll(w.Result().Body)
+	require.NoError(t, err)
+	require.Equal(t, "<html><mobile>hello world</body></html>", string(body))
+	require.Len(t, tripper.requestables, 3)
+	// The static alternate was rendered, not skipped
+	require.Equal(t, 1, fanOut.Static)
+	require.Equal(t, 0, fanOut.Skipped())
+
+	for _, requestable := range tripper.requestables {
+		require.NotContains(t, requestable.URL(), "/header/")
 	}
 }
 
-func TestFragmentSendsVerifiableHmacWhenSet(t *testing.T) {
-	done := make(chan struct{})
-	secret := "6ccd9547b7042e0f1101ce68931d6b2c"
+func TestServer_ConditionalFragmentsValidation(t *testing.T) {
+	viewProxyServer := newServer(t, targetServer.URL)
+
+	root := fragment.Define("/body/:name", fragment.WithAlternate(fragment.Define("/body/:login")))
+	err := viewProxyServer.Get("/hello/:name", root)
+	require.EqualError(t, err, "dynamic route /hello/:name has mismatched fragment route /body/:login")
+}
+
+func TestServer_MaxFragmentConcurrency(t *testing.T) {
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
 
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		defer close(done)
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
 
-		time := r.Header.Get("X-Authorization-Time")
-		require.NotEqual(t, "", time, "Expected X-Authorization-Time header to be present")
+		time.Sleep(10 * time.Millisecond)
 
-		key := fmt.Sprintf("%s,%s", r.URL.Path, time)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
 
-		mac := hmac.New(sha256.New, []byte(secret))
-		mac.Write(
-			[]byte(key),
+		if r.URL.Path == "/layout" {
+			w.Write([]byte(`<viewproxy-fragment id="a"></viewproxy-fragment><viewproxy-fragment id="b"></viewproxy-fragment><viewproxy-fragment id="c"></viewproxy-fragment>`))
+			return
+		}
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer server.Close()
+
+	layout := func() *fragment.Definition {
+		return fragment.Define(
+			"/layout",
+			fragment.WithChild("a", fragment.Define("/a")),
+			fragment.WithChild("b", fragment.Define("/b")),
+			fragment.WithChild("c", fragment.Define("/c")),
 		)
+	}
 
-		authorization := r.Header.Get("Authorization")
-		require.NotEqual(t, "", authorization, "Expected Authorization header to be present")
-
-		expected := hex.EncodeToString(mac.Sum(nil))
+	viewProxyServer := newServer(t, server.URL)
+	viewProxyServer.MaxFragmentConcurrency = 2
+	require.NoError(t, viewProxyServer.Get("/server", layout()))
+	require.NoError(t, viewProxyServer.Get("/route", layout(), WithMaxConcurrency(1)))
 
-		require.Equal(t, expected, authorization)
+	for path, expected := range map[string]int{"/server": 2, "/route": 1} {
+		maxInFlight = 0
 
-		w.WriteHeader(http.StatusOK)
-	}))
+		w := httptest.NewRecorder()
+		viewProxyServer.CreateHandler().ServeHTTP(w, httptest.NewRequest("GET", path, nil))
 
-	viewProxyServer := newServer(t, server.URL)
-	err := viewProxyServer.Get("/hello/:name", fragment.Define("/foo/:name"))
-	require.NoError(t, err)
-	viewProxyServer.HmacSecret = secret
+		require.Equal(t, "/a/b/c", w.Body.String())
+		require.Equal(t, expected, maxInFlight, path)
+	}
+}
 
-	r := httptest.NewRequest("GET", "/hello/world", strings.NewReader("hello"))
-	w := httptest.NewRecorder()
+func TestServer_CyclicFragmentsValidation(t *testing.T) {
+	viewProxyServer := newServer(t, targetServer.URL)
 
-	viewProxyServer.CreateHandler().ServeHTTP(w, r)
+	layout := fragment.Define("/layout")
+	fragment.WithChild("body", fragment.Define("/body", fragment.WithChild("layout", layout)))(layout)
 
-	<-done
+	err := viewProxyServer.Get("/hello", layout)
 
-	server.Close()
+	var cycleErr *FragmentCycleError
+	require.ErrorAs(t, err, &cycleErr)
+	require.Equal(t, "root.body.layout", cycleErr.Key)
+	require.Len(t, viewProxyServer.Routes(), 0)
 }
 
-func TestSupportsGzip(t *testing.T) {
-	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		var b bytes.Buffer
+func TestServer_SharedFragments(t *testing.T) {
+	var mu sync.Mutex
+	counts := make(map[string]int)
 
-		gzWriter := gzip.NewWriter(&b)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		counts[r.URL.Path]++
+		mu.Unlock()
 
-		if strings.HasPrefix(r.URL.Path, "/layout") {
-			gzWriter.Write([]byte(`<body><viewproxy-fragment id="fragment"></viewproxy-fragment></body>`))
-		} else if strings.HasPrefix(r.URL.Path, "/fragment") {
-			gzWriter.Write([]byte("wow gzipped!"))
+		if r.URL.Path == "/layouts/shared" {
+			w.Write([]byte(`<html><viewproxy-fragment id="body"></viewproxy-fragment></html>`))
 		} else {
-			panic("Unexpected URL")
+			w.Write([]byte(r.URL.Path))
 		}
-
-		gzWriter.Close()
-
-		w.Header().Set("Content-Encoding", "gzip")
-		w.WriteHeader(http.StatusOK)
-		w.Write(b.Bytes())
 	}))
+	defer server.Close()
 
 	viewProxyServer := newServer(t, server.URL)
-	viewProxyServer.Get(
-		"/hello/:name",
-		fragment.Define("/layout/:name", fragment.WithChild("fragment", fragment.Define("/fragment/:name"))),
-	)
+	viewProxyServer.SharedCache = multiplexer.NewSharedCache(time.Minute)
 
-	r := httptest.NewRequest("GET", "/hello/world", nil)
-	r.Header.Set("Accept-Encoding", "gzip")
-	w := httptest.NewRecorder()
+	layout := func(body *fragment.Definition) *fragment.Definition {
+		return fragment.Define("/layouts/shared", fragment.Shared(), fragment.WithChild("body", body))
+	}
+	require.NoError(t, viewProxyServer.Get("/foo", layout(fragment.Define("/foo"))))
+	require.NoError(t, viewProxyServer.Get("/bar", layout(fragment.Define("/bar"))))
 
-	viewProxyServer.CreateHandler().ServeHTTP(w, r)
+	handler := viewProxyServer.CreateHandler()
+	wg := sync.WaitGroup{}
 
-	resp := w.Result()
+	for i := 0; i < 20; i++ {
+		for _, path := range []string{"/foo", "/bar"} {
+			wg.Add(1)
+			go func(path string) {
+				defer wg.Done()
 
-	gzReader, err := gzip.NewReader(resp.Body)
-	require.Nil(t, err)
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
 
-	body, err := ioutil.ReadAll(gzReader)
-	require.Nil(t, err)
+				require.Equal(t, fmt.Sprintf("<html>%s</html>", path), w.Body.String())
+			}(path)
+		}
+	}
+	wg.Wait()
 
-	require.Equal(t, "<body>wow gzipped!</body>", string(body))
+	require.Equal(t, 1, counts["/layouts/shared"])
+	require.Equal(t, 20, counts["/foo"])
+	require.Equal(t, 20, counts["/bar"])
+	require.Equal(t, multiplexer.SharedCacheStats{Hits: 39, Misses: 1}, viewProxyServer.SharedCache.Stats())
+
+	// Requests with cookies are not shared without declared headers
+	r := httptest.NewRequest("GET", "/foo", nil)
+	r.Header.Set("Cookie", "user=1")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	require.Equal(t, 2, counts["/layouts/shared"])
+}
+
+func TestServer_OptionalSegment(t *testing.T) {
+	viewProxyServer := newServer(t, targetServer.URL)
+
+	root := fragment.Define("/layouts/test_layout",
+		fragment.WithoutValidation(),
+		fragment.WithChild("header", fragment.Define("/header/:name?")),
+		fragment.WithChild("body", fragment.Define("/body/:name?")),
+		fragment.WithChild("footer", fragment.Define("/footer/:name?")),
+	)
+	err := viewProxyServer.Get("/hello/:name?", root)
+	require.NoError(t, err)
+
+	r := httptest.NewRequest("GET", "/hello/world", nil)
+	w := httptest.NewRecorder()
+	viewProxyServer.CreateHandler().ServeHTTP(w, r)
+
+	require.Equal(t, 200, w.Result().StatusCode)
+	require.Equal(t, "<html><body>hello world</body></html>", w.Body.String())
+	route, parameters := viewProxyServer.MatchingRoute("/hello/world")
+	require.Equal(t, "/hello/:name?", route.Path)
+	require.Equal(t, map[string]string{"name": "world"}, parameters)
+
+	route, parameters = viewProxyServer.MatchingRoute("/hello")
+	require.Equal(t, "/hello/:name?", route.Path)
+	require.Equal(t, map[string]string{}, parameters)
+}
+
+func TestParametersFromContext_Encoded(t *testing.T) {
+	tripper := &contextTestTripper{}
+	viewProxyServer := newServer(t, targetServer.URL)
+	viewProxyServer.MultiplexerTripper = tripper
+	require.NoError(t, viewProxyServer.Get("/hello/:name", fragment.Define("/body/:name")))
+
+	var parameters, escapedParameters map[string]string
+	n := notifier.New()
+	n.Around(EventServeHTTP, func(ctx context.Context, next func(context.Context)) {
+		next(ctx)
+		parameters = ParametersFromContext(ctx)
+		escapedParameters = EscapedParametersFromContext(ctx)
+	})
+	viewProxyServer.Notifier = n
+
+	testCases := map[string]struct {
+		path    string
+		decoded string
+		escaped string
+	}{
+		"encoded slash": {path: "/hello/a%2Fb", decoded: "a/b", escaped: "a%2Fb"},
+		"plus":          {path: "/hello/a+b", decoded: "a+b", escaped: "a+b"},
+		"space":         {path: "/hello/a%20b", decoded: "a b", escaped: "a%20b"},
+		"encoded emoji": {path: "/hello/%F0%9F%9A%80", decoded: "🚀", escaped: "%F0%9F%9A%80"},
+		"raw emoji":     {path: "/hello/🚀", decoded: "🚀", escaped: "%F0%9F%9A%80"},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			tripper.requestables = nil
+			w := httptest.NewRecorder()
+			viewProxyServer.CreateHandler().ServeHTTP(w, httptest.NewRequest("GET", tc.path, nil))
+
+			require.Equal(t, http.StatusOK, w.Code)
+			require.Equal(t, map[string]string{"name": tc.decoded}, parameters)
+			require.Equal(t, map[string]string{"name": tc.escaped}, escapedParameters)
+
+			_, matched := viewProxyServer.MatchingRoute(tc.path)
+			require.Equal(t, parameters, matched)
+
+			// Fragments receive the value as it was escaped in the request
+			require.Len(t, tripper.requestables, 1)
+			fragmentURL, err := url.Parse(tripper.requestables[0].URL())
+			require.NoError(t, err)
+			require.Equal(t, "/body/"+tc.escaped, fragmentURL.EscapedPath())
+			require.Equal(t, "hello "+tc.decoded, w.Body.String())
+		})
+	}
+
+	// Values that aren't valid UTF-8 are left escaped
+	_, matched := viewProxyServer.MatchingRoute("/hello/%FF")
+	require.Equal(t, map[string]string{"name": "%FF"}, matched)
+}
+
+func TestServer_ParamTransform(t *testing.T) {
+	tripper := &contextTestTripper{}
+	viewProxyServer := newServer(t, targetServer.URL)
+	viewProxyServer.MultiplexerTripper = tripper
+
+	splitTags := func(raw string) (string, url.Values) {
+		query := url.Values{}
+		for _, tag := range strings.Split(raw, ",") {
+			query.Add("tag", tag)
+		}
+
+		return "all tags", query
+	}
+	err := viewProxyServer.Get("/tags/:tags", fragment.Define("/body/:tags"), WithParamTransform(":tags", splitTags))
+	require.NoError(t, err)
+
+	var parameters map[string]string
+	n := notifier.New()
+	n.Around(EventServeHTTP, func(ctx context.Context, next func(context.Context)) {
+		next(ctx)
+		parameters = ParametersFromContext(ctx)
+	})
+	viewProxyServer.Notifier = n
+
+	r := httptest.NewRequest("GET", "/tags/a%2Fb,c%20d", nil)
+	w := httptest.NewRecorder()
+	viewProxyServer.CreateHandler().ServeHTTP(w, r)
+
+	require.Equal(t, 200, w.Result().StatusCode)
+	require.Len(t, tripper.requestables, 1)
+	require.Equal(t, targetServer.URL+"/body/all%20tags?tag=a%2Fb&tag=c+d", tripper.requestables[0].URL())
+	require.Equal(t, map[string]string{"tags": "a/b,c d"}, parameters)
+
+	tripper.requestables = nil
+	r = httptest.NewRequest("GET", "/tags/,", nil)
+	w = httptest.NewRecorder()
+	viewProxyServer.CreateHandler().ServeHTTP(w, r)
+
+	require.Len(t, tripper.requestables, 1)
+	require.Equal(t, targetServer.URL+"/body/all%20tags?tag=&tag=", tripper.requestables[0].URL())
+}
+
+func TestServer_ParamTransformOnlyQueriesFragmentsUsingParam(t *testing.T) {
+	tripper := &contextTestTripper{}
+	viewProxyServer := newServer(t, targetServer.URL)
+	viewProxyServer.MultiplexerTripper = tripper
+
+	splitTags := func(raw string) (string, url.Values) {
+		return "all tags", url.Values{"tag": strings.Split(raw, ",")}
+	}
+	root := fragment.Define("/layouts/test_layout",
+		fragment.WithoutValidation(),
+		fragment.WithChild("body", fragment.Define("/body/:tags")),
+	)
+	require.NoError(t, viewProxyServer.Get("/tags/:tags", root, WithParamTransform(":tags", splitTags)))
+
+	w := httptest.NewRecorder()
+	viewProxyServer.CreateHandler().ServeHTTP(w, httptest.NewRequest("GET", "/tags/a,b", nil))
+
+	urls := make([]string, 0, len(tripper.requestables))
+	for _, requestable := range tripper.requestables {
+		urls = append(urls, requestable.URL())
+	}
+	require.ElementsMatch(t, []string{
+		targetServer.URL + "/layouts/test_layout",
+		targetServer.URL + "/body/all%20tags?tag=a&tag=b",
+	}, urls)
+}
+
+func TestServer_ServerTiming(t *testing.T) {
+	viewProxyServer := newServer(t, targetServer.URL)
+	viewProxyServer.AroundResponse = multiplexer.WithCombinedServerTimingHeader
+
+	root := fragment.Define("/layouts/test_layout",
+		fragment.WithoutValidation(),
+		fragment.WithTimingLabel("layout"),
+		fragment.WithChild("body", fragment.Define("/body/:name", fragment.WithTimingLabel("body"))),
+		fragment.WithChild("footer", fragment.Define("/footer/:name")),
+	)
+	err := viewProxyServer.Get("/hello/:name", root)
+	require.NoError(t, err)
+
+	r := httptest.NewRequest("GET", "/hello/world", nil)
+	w := httptest.NewRecorder()
+	viewProxyServer.CreateHandler().ServeHTTP(w, r)
+
+	require.Equal(t, 200, w.Result().StatusCode)
+	require.Regexp(t, `^layout;dur=[\d.]+, body;dur=[\d.]+$`, w.Result().Header.Get("Server-Timing"))
+}
+
+func TestPassThroughEnabled(t *testing.T) {
+	viewProxyServer := newServer(t, targetServer.URL, WithPassThrough(targetServer.URL))
+	viewProxyServer.Logger = log.New(ioutil.Discard, "", log.Ldate|log.Ltime)
+
+	r := httptest.NewRequest("GET", "/oops", nil)
+	w := httptest.NewRecorder()
+
+	viewProxyServer.CreateHandler().ServeHTTP(w, r)
+
+	resp := w.Result()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.Nil(t, err)
+
+	require.Equal(t, 500, resp.StatusCode)
+	require.Equal(t, "Something went wrong", string(body))
+}
+
+func TestPassThroughFallback(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("origin " + r.URL.Path))
+	}))
+	defer origin.Close()
+
+	viewProxyServer := newServer(t, targetServer.URL, WithPassThrough(origin.URL))
+	viewProxyServer.Logger = log.New(ioutil.Discard, "", log.Ldate|log.Ltime)
+
+	err := viewProxyServer.Get("/migrating/:name", fragment.Define("/missing/:name"), WithPassThroughFallback())
+	require.NoError(t, err)
+	err = viewProxyServer.Get("/broken/:name", fragment.Define("/missing/:name"))
+	require.NoError(t, err)
+
+	r := httptest.NewRequest("GET", "/migrating/world", nil)
+	w := httptest.NewRecorder()
+	viewProxyServer.CreateHandler().ServeHTTP(w, r)
+
+	resp := w.Result()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, 200, resp.StatusCode)
+	require.Equal(t, "origin /migrating/world", string(body))
+
+	// Routes without the fallback still error
+	r = httptest.NewRequest("GET", "/broken/world", nil)
+	w = httptest.NewRecorder()
+	viewProxyServer.CreateHandler().ServeHTTP(w, r)
+
+	require.Equal(t, 500, w.Result().StatusCode)
+}
+
+func TestPassThroughFallback_SiblingFailsFirst(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("origin " + r.URL.Path))
+	}))
+	defer origin.Close()
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/failing" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		// The root responds after the sibling failed
+		select {
+		case <-time.After(50 * time.Millisecond):
+		case <-r.Context().Done():
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer target.Close()
+
+	viewProxyServer := newServer(t, target.URL, WithPassThrough(origin.URL))
+	viewProxyServer.Logger = log.New(ioutil.Discard, "", log.Ldate|log.Ltime)
+	err := viewProxyServer.Get("/migrating", fragment.Define("/missing",
+		fragment.WithoutValidation(),
+		fragment.WithChild("sidebar", fragment.Define("/failing")),
+	), WithPassThroughFallback())
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	viewProxyServer.CreateHandler().ServeHTTP(w, httptest.NewRequest("GET", "/migrating", nil))
+
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "origin /migrating", w.Body.String())
+}
+
+func TestPassThroughDisabled(t *testing.T) {
+	viewProxyServer := newServer(t, targetServer.URL)
+
+	r := httptest.NewRequest("GET", "/hello/world", nil)
+	w := httptest.NewRecorder()
+
+	viewProxyServer.CreateHandler().ServeHTTP(w, r)
+
+	resp := w.Result()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.Nil(t, err)
+
+	require.Equal(t, 404, resp.StatusCode)
+	require.Equal(t, "404 not found", string(body))
+	require.Equal(t, "text/plain; charset=utf-8", resp.Header.Get("Content-Type"))
+}
+
+func TestWithRouteEnabledFunc(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("origin " + r.URL.Path))
+	}))
+	defer origin.Close()
+
+	var enabled atomic.Bool
+	var suppressed *Route
+	get := func(server *Server, path string) *httptest.ResponseRecorder {
+		suppressed = nil
+		server.AroundRequest = func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				suppressed = SuppressedRouteFromContext(r.Context())
+				next.ServeHTTP(w, r)
+			})
+		}
+
+		w := httptest.NewRecorder()
+		server.CreateHandler().ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	viewProxyServer := newServer(t, targetServer.URL, WithPassThrough(origin.URL))
+	err := viewProxyServer.Get("/hello/:name", fragment.Define("/body/:name"), WithRouteEnabledFunc(func(ctx context.Context) bool {
+		return enabled.Load()
+	}))
+	require.NoError(t, err)
+
+	enabled.Store(true)
+	w := get(viewProxyServer, "/hello/world")
+	require.Equal(t, "hello world", w.Body.String())
+	require.Nil(t, suppressed)
+
+	// Disabled routes are treated as unmatched without being removed
+	enabled.Store(false)
+	w = get(viewProxyServer, "/hello/world")
+	require.Equal(t, "origin /hello/world", w.Body.String())
+	require.NotNil(t, suppressed)
+	require.Equal(t, "/hello/:name", suppressed.Path)
+
+	enabled.Store(true)
+	w = get(viewProxyServer, "/hello/world")
+	require.Equal(t, "hello world", w.Body.String())
+
+	// Without pass through, requests to disabled routes 404
+	viewProxyServer = newServer(t, targetServer.URL)
+	err = viewProxyServer.Get("/hello/:name", fragment.Define("/body/:name"), WithRouteEnabledFunc(func(ctx context.Context) bool {
+		return enabled.Load()
+	}))
+	require.NoError(t, err)
+
+	enabled.Store(false)
+	w = get(viewProxyServer, "/hello/world")
+	require.Equal(t, http.StatusNotFound, w.Code)
+	require.NotNil(t, suppressed)
+}
+
+func TestCustomNotFoundBody(t *testing.T) {
+	viewProxyServer := newServer(t, targetServer.URL)
+	viewProxyServer.NotFoundBody = "<h1>Nicht gefunden: {{.Path}}</h1>"
+	viewProxyServer.NotFoundContentType = "text/html; charset=utf-8"
+
+	r := httptest.NewRequest("GET", "/<script>alert(1)</script>", nil)
+	w := httptest.NewRecorder()
+	viewProxyServer.CreateHandler().ServeHTTP(w, r)
+
+	require.Equal(t, http.StatusNotFound, w.Result().StatusCode)
+	require.Equal(t, "text/html; charset=utf-8", w.Result().Header.Get("Content-Type"))
+	require.Equal(t, "<h1>Nicht gefunden: /&lt;script&gt;alert(1)&lt;/script&gt;</h1>", w.Body.String())
+}
+
+func TestCustomInternalErrorBody(t *testing.T) {
+	viewProxyServer := newServer(t, targetServer.URL)
+	viewProxyServer.InternalErrorBody = "<p>Something went wrong on {{.Path}}</p>"
+	viewProxyServer.InternalErrorContentType = "text/html; charset=utf-8"
+	err := viewProxyServer.Get("/oops/:name", fragment.Define("/oops", fragment.WithoutValidation()))
+	require.NoError(t, err)
+
+	r := httptest.NewRequest("GET", "/oops/<script>", nil)
+	w := httptest.NewRecorder()
+	viewProxyServer.CreateHandler().ServeHTTP(w, r)
+
+	require.Equal(t, http.StatusInternalServerError, w.Result().StatusCode)
+	require.Equal(t, "text/html; charset=utf-8", w.Result().Header.Get("Content-Type"))
+	require.Equal(t, "<p>Something went wrong on /oops/&lt;script&gt;</p>", w.Body.String())
+}
+
+func TestPassThroughPostRequest(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	done := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(done)
+
+		body, err := io.ReadAll(r.Body)
+
+		require.Nil(t, err)
+		require.Equal(t, http.MethodPost, r.Method)
+		require.Equal(t, "hello", string(body))
+	}))
+
+	viewProxyServer := newServer(t, server.URL, WithPassThrough(server.URL))
+
+	r := httptest.NewRequest("POST", "/hello/world", strings.NewReader("hello"))
+	w := httptest.NewRecorder()
+
+	viewProxyServer.CreateHandler().ServeHTTP(w, r)
+
+	select {
+	case <-done:
+		server.Close()
+	case <-ctx.Done():
+		require.Fail(t, ctx.Err().Error())
+	}
+}
+
+func TestFragmentSendsVerifiableHmacWhenSet(t *testing.T) {
+	done := make(chan struct{})
+	secret := "6ccd9547b7042e0f1101ce68931d6b2c"
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(done)
+
+		time := r.Header.Get("X-Authorization-Time")
+		require.NotEqual(t, "", time, "Expected X-Authorization-Time header to be present")
+
+		key := fmt.Sprintf("%s,%s", r.URL.Path, time)
+
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(
+			[]byte(key),
+		)
+
+		authorization := r.Header.Get("Authorization")
+		require.NotEqual(t, "", authorization, "Expected Authorization header to be present")
+
+		expected := hex.EncodeToString(mac.Sum(nil))
+
+		require.Equal(t, expected, authorization)
+
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	viewProxyServer := newServer(t, server.URL)
+	err := viewProxyServer.Get("/hello/:name", fragment.Define("/foo/:name"))
+	require.NoError(t, err)
+	viewProxyServer.HmacSecret = secret
+
+	r := httptest.NewRequest("GET", "/hello/world", strings.NewReader("hello"))
+	w := httptest.NewRecorder()
+
+	viewProxyServer.CreateHandler().ServeHTTP(w, r)
+
+	<-done
+
+	server.Close()
+}
+
+func TestFragmentParamDefaultIsSigned(t *testing.T) {
+	secret := "6ccd9547b7042e0f1101ce68931d6b2c"
+	paths := make(chan string, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(fmt.Sprintf("%s,%s", r.URL.Path, r.Header.Get("X-Authorization-Time"))))
+		require.Equal(t, hex.EncodeToString(mac.Sum(nil)), r.Header.Get("Authorization"))
+
+		paths <- r.URL.Path
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	viewProxyServer := newServer(t, server.URL)
+	err := viewProxyServer.Get("/hello", fragment.Define("/foo/:name", fragment.WithParamDefault(":name", "guest")))
+	require.NoError(t, err)
+	viewProxyServer.HmacSecret = secret
+
+	r := httptest.NewRequest("GET", "/hello", nil)
+	w := httptest.NewRecorder()
+	viewProxyServer.CreateHandler().ServeHTTP(w, r)
+
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.Equal(t, "/foo/guest", <-paths)
+}
+
+func TestMissingFragmentParameterRespondsWithError(t *testing.T) {
+	server := newServer(t, targetServer.URL)
+	err := server.Get("/hello", fragment.Define("/body/:name", fragment.WithoutValidation()))
+	require.NoError(t, err)
+
+	var handledErr error
+	server.AroundResponse = func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handledErr = multiplexer.ResultsFromContext(r.Context()).Error()
+			next.ServeHTTP(w, r)
+		})
+	}
+
+	r := httptest.NewRequest("GET", "/hello", nil)
+	w := httptest.NewRecorder()
+	server.CreateHandler().ServeHTTP(w, r)
+
+	require.Equal(t, http.StatusInternalServerError, w.Result().StatusCode)
+	require.EqualError(t, handledErr, "no parameter was provided for :name in route /body/:name")
+}
+
+func TestStitchingIgnoresDirectivesInChildContent(t *testing.T) {
+	hostile := `<p>Use <viewproxy-fragment id="body"></viewproxy-fragment> to render the body</p>`
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/layout":
+			w.Write([]byte(`<header><viewproxy-fragment id="header"></viewproxy-fragment></header><main><viewproxy-fragment id="body"></viewproxy-fragment></main>`))
+		case "/header":
+			w.Write([]byte(hostile))
+		case "/body":
+			w.Write([]byte("the body"))
+		}
+	}))
+	defer server.Close()
+
+	viewProxyServer := newServer(t, server.URL)
+	err := viewProxyServer.Get("/hello", fragment.Define(
+		"/layout",
+		fragment.WithChild("header", fragment.Define("/header")),
+		fragment.WithChild("body", fragment.Define("/body")),
+	))
+	require.NoError(t, err)
+
+	// Children are stitched in map order, so render multiple times to catch
+	// order dependent substitution
+	for i := 0; i < 10; i++ {
+		r := httptest.NewRequest("GET", "/hello", nil)
+		w := httptest.NewRecorder()
+		viewProxyServer.CreateHandler().ServeHTTP(w, r)
+
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+		require.Equal(t, "<header>"+hostile+"</header><main>the body</main>", w.Body.String())
+	}
+}
+
+func TestServer_FragmentTag(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/layout":
+			w.Write([]byte(`<viewproxy-fragment id="body"></viewproxy-fragment><vp-slot id="body"/><vp-slot id="body"/>`))
+		case "/body":
+			w.Write([]byte("the body"))
+		case "/standalone":
+			w.Write([]byte("no slots here"))
+		}
+	}))
+	defer server.Close()
+
+	viewProxyServer := newServer(t, server.URL, WithFragmentTag("vp-slot"))
+	require.NoError(t, viewProxyServer.Get("/hello", fragment.Define("/layout", fragment.WithChild("body", fragment.Define("/body")))))
+	require.NoError(t, viewProxyServer.Get("/standalone", fragment.Define("/standalone")))
+
+	r := httptest.NewRequest("GET", "/hello", nil)
+	w := httptest.NewRecorder()
+	viewProxyServer.CreateHandler().ServeHTTP(w, r)
+
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.Equal(t, `<viewproxy-fragment id="body"></viewproxy-fragment>the body<vp-slot id="body"/>`, w.Body.String())
+
+	r = httptest.NewRequest("GET", "/standalone", nil)
+	w = httptest.NewRecorder()
+	viewProxyServer.CreateHandler().ServeHTTP(w, r)
+
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.Equal(t, "no slots here", w.Body.String())
+}
+
+func TestWithFragmentTag_Error(t *testing.T) {
+	_, err := NewServer(targetServer.URL, WithFragmentTag("<oops>"))
+
+	var optionErr *OptionError
+	require.ErrorAs(t, err, &optionErr)
+	require.Equal(t, "WithFragmentTag", optionErr.Option)
+	require.ErrorIs(t, err, ErrInvalidFragmentTag)
+	require.Contains(t, err.Error(), `option WithFragmentTag: invalid fragment tag: "<oops>"`)
+}
+
+func TestServer_LazyFragments(t *testing.T) {
+	var requestedMu sync.Mutex
+	requested := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestedMu.Lock()
+		requested = append(requested, r.URL.Path)
+		requestedMu.Unlock()
+		w.Write([]byte(`<main>post</main><viewproxy-fragment id="comments"></viewproxy-fragment>`))
+	}))
+	defer server.Close()
+
+	viewProxyServer := newServer(t, server.URL)
+	viewProxyServer.SecretFilter.Allow("page")
+	err := viewProxyServer.Get("/posts/:id", fragment.Define(
+		"/layout/:id",
+		fragment.WithChild("comments", fragment.Define(
+			"/comments/:id",
+			fragment.Lazy(),
+			fragment.WithChild("author", fragment.Define("/author/:id")),
+		)),
+	))
+	require.NoError(t, err)
+
+	r := httptest.NewRequest("GET", "/posts/123?page=2&token=secret", nil)
+	w := httptest.NewRecorder()
+	viewProxyServer.CreateHandler().ServeHTTP(w, r)
+
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.Equal(
+		t,
+		`<main>post</main><div data-viewproxy-lazy-src="/comments/123?page=2&amp;token=FILTERED"></div>`,
+		w.Body.String(),
+	)
+	requestedMu.Lock()
+	require.Equal(t, []string{"/layout/123"}, requested)
+	requestedMu.Unlock()
+
+	viewProxyServer.LazyPlaceholder = func(src string) []byte {
+		return []byte("<lazy-fragment src=\"" + src + "\"></lazy-fragment>")
+	}
+	r = httptest.NewRequest("GET", "/posts/123", nil)
+	w = httptest.NewRecorder()
+	viewProxyServer.CreateHandler().ServeHTTP(w, r)
+
+	require.Equal(t, `<main>post</main><lazy-fragment src="/comments/123"></lazy-fragment>`, w.Body.String())
+}
+
+func TestSupportsGzip(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var b bytes.Buffer
+
+		gzWriter := gzip.NewWriter(&b)
+
+		if strings.HasPrefix(r.URL.Path, "/layout") {
+			gzWriter.Write([]byte(`<body><viewproxy-fragment id="fragment"></viewproxy-fragment></body>`))
+		} else if strings.HasPrefix(r.URL.Path, "/fragment") {
+			gzWriter.Write([]byte("wow gzipped!"))
+		} else {
+			panic("Unexpected URL")
+		}
+
+		gzWriter.Close()
+
+		w.Header().Set("Content-Encoding", "gzip")
+		w.WriteHeader(http.StatusOK)
+		w.Write(b.Bytes())
+	}))
+
+	viewProxyServer := newServer(t, server.URL)
+	viewProxyServer.MinCompressSize = 0
+	viewProxyServer.Get(
+		"/hello/:name",
+		fragment.Define("/layout/:name", fragment.WithChild("fragment", fragment.Define("/fragment/:name"))),
+	)
+
+	r := httptest.NewRequest("GET", "/hello/world", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+
+	viewProxyServer.CreateHandler().ServeHTTP(w, r)
+
+	resp := w.Result()
+
+	gzReader, err := gzip.NewReader(resp.Body)
+	require.Nil(t, err)
+
+	body, err := ioutil.ReadAll(gzReader)
+	require.Nil(t, err)
+
+	require.Equal(t, "<body>wow gzipped!</body>", string(body))
 
 	server.Close()
 }
 
+func TestSupportsGzip_MissingSlot(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var b bytes.Buffer
+
+		gzWriter := gzip.NewWriter(&b)
+		if strings.HasPrefix(r.URL.Path, "/layout") {
+			// The layout is missing the fragment's slot
+			gzWriter.Write([]byte(`<body></body>`))
+			w.Header().Set("ETag", `"layout"`)
+			w.Header().Set("Last-Modified", "Wed, 21 Oct 2015 07:28:00 GMT")
+		} else {
+			gzWriter.Write([]byte("wow gzipped!"))
+		}
+		gzWriter.Close()
+
+		w.Header().Set("Content-Encoding", "gzip")
+		w.WriteHeader(http.StatusOK)
+		w.Write(b.Bytes())
+	}))
+	defer server.Close()
+
+	for _, streamResponses := range []bool{false, true} {
+		viewProxyServer := newServer(t, server.URL)
+		viewProxyServer.Logger = log.New(io.Discard, "", 0)
+		viewProxyServer.StreamResponses = streamResponses
+		err := viewProxyServer.Get(
+			"/hello/:name",
+			fragment.Define("/layout/:name", fragment.WithoutValidation(), fragment.WithChild("fragment", fragment.Define("/fragment/:name"))),
+		)
+		require.NoError(t, err)
+
+		r := httptest.NewRequest("GET", "/hello/world", nil)
+		w := httptest.NewRecorder()
+		viewProxyServer.CreateHandler().ServeHTTP(w, r)
+
+		// The plain error body doesn't describe the layout's response
+		resp := w.Result()
+		require.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+		require.Empty(t, resp.Header.Get("Content-Encoding"))
+		require.Empty(t, resp.Header.Get("ETag"))
+		require.Empty(t, resp.Header.Get("Last-Modified"))
+		require.Equal(t, defaultInternalErrorBody, w.Body.String())
+	}
+}
+
+func TestMinCompressSize(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var b bytes.Buffer
+
+		gzWriter := gzip.NewWriter(&b)
+
+		if strings.HasPrefix(r.URL.Path, "/layout") {
+			gzWriter.Write([]byte(`<body><viewproxy-fragment id="fragment"></viewproxy-fragment></body>`))
+		} else if r.URL.Path == "/fragment/small" {
+			gzWriter.Write([]byte("small"))
+		} else if r.URL.Path == "/fragment/large" {
+			gzWriter.Write([]byte(strings.Repeat("a", 2048)))
+		} else {
+			panic("Unexpected URL")
+		}
+
+		gzWriter.Close()
+
+		w.Header().Set("Content-Encoding", "gzip")
+		w.WriteHeader(http.StatusOK)
+		w.Write(b.Bytes())
+	}))
+	defer server.Close()
+
+	viewProxyServer := newServer(t, server.URL)
+	viewProxyServer.MinCompressSize = 1024
+	err := viewProxyServer.Get(
+		"/hello/:name",
+		fragment.Define("/layout/:name", fragment.WithChild("fragment", fragment.Define("/fragment/:name"))),
+	)
+	require.NoError(t, err)
+
+	r := httptest.NewRequest("GET", "/hello/small", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+
+	viewProxyServer.CreateHandler().ServeHTTP(w, r)
+
+	resp := w.Result()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	require.Equal(t, "", resp.Header.Get("Content-Encoding"))
+	require.Equal(t, "<body>small</body>", string(body))
+
+	r = httptest.NewRequest("GET", "/hello/large", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w = httptest.NewRecorder()
+
+	viewProxyServer.CreateHandler().ServeHTTP(w, r)
+
+	resp = w.Result()
+	require.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+
+	gzReader, err := gzip.NewReader(resp.Body)
+	require.NoError(t, err)
+
+	body, err = ioutil.ReadAll(gzReader)
+	require.NoError(t, err)
+
+	require.Equal(t, "<body>"+strings.Repeat("a", 2048)+"</body>", string(body))
+}
+
+func TestGenerateETags(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var b bytes.Buffer
+		gzWriter := gzip.NewWriter(&b)
+
+		if strings.HasPrefix(r.URL.Path, "/layout") {
+			w.Header().Set("ETag", `"layout"`)
+			gzWriter.Write([]byte(`<body><viewproxy-fragment id="fragment"></viewproxy-fragment></body>`))
+		} else {
+			if r.URL.Path == "/fragment/private" {
+				w.Header().Set("Cache-Control", "private, no-store")
+			}
+			gzWriter.Write([]byte(strings.Repeat("a", 2048)))
+		}
+		gzWriter.Close()
+
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(b.Bytes())
+	}))
+	defer server.Close()
+
+	viewProxyServer := newServer(t, server.URL)
+	viewProxyServer.GenerateETags = true
+	err := viewProxyServer.Get(
+		"/hello/:name",
+		fragment.Define("/layout/:name", fragment.WithoutValidation(), fragment.WithChild("fragment", fragment.Define("/fragment/:name", fragment.WithoutValidation()))),
+	)
+	require.NoError(t, err)
+
+	get := func(path string, header http.Header) *http.Response {
+		r := httptest.NewRequest("GET", path, nil)
+		for name, values := range header {
+			r.Header[name] = values
+		}
+		w := httptest.NewRecorder()
+		viewProxyServer.CreateHandler().ServeHTTP(w, r)
+
+		return w.Result()
+	}
+
+	sum := sha256.Sum256([]byte("<body>" + strings.Repeat("a", 2048) + "</body>"))
+	etag := `"` + hex.EncodeToString(sum[:]) + `"`
+
+	// The ETag is computed before the body is gzipped
+	resp := get("/hello/world", http.Header{"Accept-Encoding": {"gzip"}})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	require.Equal(t, etag, resp.Header.Get("ETag"))
+
+	resp = get("/hello/world", http.Header{"If-None-Match": {`"stale", W/` + etag}})
+	require.Equal(t, http.StatusNotModified, resp.StatusCode)
+	require.Equal(t, etag, resp.Header.Get("ETag"))
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Empty(t, body)
+
+	resp = get("/hello/world", http.Header{"If-None-Match": {`"stale"`}})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Responses containing fragments that must not be stored have no ETag
+	resp = get("/hello/private", http.Header{"If-None-Match": {"*"}})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Empty(t, resp.Header.Get("ETag"))
+}
+
+func TestGzipPassThrough(t *testing.T) {
+	layout := `<html><viewproxy-fragment id="header"></viewproxy-fragment>` + strings.Repeat("<p>content</p>", 256) + `</html>`
+	var compressed bytes.Buffer
+	gzWriter, err := gzip.NewWriterLevel(&compressed, gzip.BestSpeed)
+	require.NoError(t, err)
+	gzWriter.Write([]byte(layout))
+	require.NoError(t, gzWriter.Close())
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/timing") {
+			var b bytes.Buffer
+			gzWriter := gzip.NewWriter(&b)
+			gzWriter.Write([]byte(layout + "<view-proxy-timing></view-proxy-timing>"))
+			gzWriter.Close()
+
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(b.Bytes())
+			return
+		}
+
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(compressed.Bytes())
+	}))
+	defer server.Close()
+
+	viewProxyServer := newServer(t, server.URL)
+	viewProxyServer.MinCompressSize = 0
+	require.NoError(t, viewProxyServer.Get("/single", fragment.Define("/layout")))
+	require.NoError(t, viewProxyServer.Get("/timing", fragment.Define("/timing")))
+	require.NoError(t, viewProxyServer.Get("/stitched", fragment.Define(
+		"/layout",
+		fragment.WithChild("header", fragment.Static([]byte("<header></header>"))),
+	)))
+
+	get := func(path string) []byte {
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+
+		viewProxyServer.CreateHandler().ServeHTTP(w, r)
+		require.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+
+		return w.Body.Bytes()
+	}
+
+	decompress := func(body []byte) string {
+		gzReader, err := gzip.NewReader(bytes.NewReader(body))
+		require.NoError(t, err)
+
+		decompressed, err := ioutil.ReadAll(gzReader)
+		require.NoError(t, err)
+
+		return string(decompressed)
+	}
+
+	// Routes without children pass the upstream bytes through
+	body := get("/single")
+	require.Equal(t, compressed.Bytes(), body)
+	require.Equal(t, layout, decompress(body))
+
+	// Bodies that change are compressed again
+	body = get("/timing")
+	decompressed := decompress(body)
+	require.True(t, strings.HasPrefix(decompressed, layout))
+	require.NotContains(t, decompressed, "<view-proxy-timing>")
+
+	body = get("/stitched")
+	require.NotEqual(t, compressed.Bytes(), body)
+	require.Equal(t, strings.Replace(layout, `<viewproxy-fragment id="header"></viewproxy-fragment>`, "<header></header>", 1), decompress(body))
+}
+
+func BenchmarkGzipPassThrough(b *testing.B) {
+	layout := `<html><viewproxy-fragment id="header"></viewproxy-fragment>`
+	for i := 0; len(layout) < 300*1024; i++ {
+		layout += fmt.Sprintf("<p>row %d</p>", i)
+	}
+	layout += "</html>"
+
+	var compressed bytes.Buffer
+	gzWriter := gzip.NewWriter(&compressed)
+	gzWriter.Write([]byte(layout))
+	gzWriter.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(compressed.Bytes())
+	}))
+	defer server.Close()
+
+	viewProxyServer := newServer(b, server.URL)
+	viewProxyServer.Logger = log.New(ioutil.Discard, "", log.Ldate|log.Ltime)
+	require.NoError(b, viewProxyServer.Get("/single", fragment.Define("/layout")))
+	// An empty static child forces the body to be stitched and compressed again
+	require.NoError(b, viewProxyServer.Get("/stitched", fragment.Define(
+		"/layout",
+		fragment.WithChild("header", fragment.Static([]byte{})),
+	)))
+
+	for name, path := range map[string]string{"PassThrough": "/single", "Recompressed": "/stitched"} {
+		path := path
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				r := httptest.NewRequest("GET", path, nil)
+				r.Header.Set("Accept-Encoding", "gzip")
+				w := httptest.NewRecorder()
+
+				viewProxyServer.CreateHandler().ServeHTTP(w, r)
+			}
+		})
+	}
+}
+
+func TestPooledBuffers(t *testing.T) {
+	viewProxyServer := newServer(t, targetServer.URL)
+	viewProxyServer.PooledBuffers = true
+	require.NoError(t, viewProxyServer.Get("/hello/:name", fragment.Define(
+		"/layouts/test_layout",
+		fragment.WithoutValidation(),
+		fragment.WithChild("header", fragment.Define("/header/:name")),
+		fragment.WithChild("body", fragment.Define("/body/:name")),
+		fragment.WithChild("footer", fragment.Define("/footer/:name")),
+	)))
+
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		viewProxyServer.CreateHandler().ServeHTTP(w, httptest.NewRequest("GET", "/hello/world", nil))
+
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+		require.Equal(t, "<html><body>hello world</body></html>", w.Body.String())
+	}
+}
+
+// BenchmarkPooledBuffers renders a 6 fragment route with ~32KB fragments
+// concurrently, with and without PooledBuffers.
+func BenchmarkPooledBuffers(b *testing.B) {
+	content := bytes.Repeat([]byte("<p>fragment</p>"), 2048)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/layout" {
+			w.Write([]byte(`<html>`))
+			for _, id := range []string{"a", "b", "c", "d", "e"} {
+				fmt.Fprintf(w, `<viewproxy-fragment id="%s"></viewproxy-fragment>`, id)
+			}
+			w.Write([]byte(`</html>`))
+			return
+		}
+
+		w.Write(content)
+	}))
+	defer server.Close()
+
+	for name, pooled := range map[string]bool{"Copied": false, "Pooled": true} {
+		pooled := pooled
+		b.Run(name, func(b *testing.B) {
+			viewProxyServer := newServer(b, server.URL)
+			viewProxyServer.PooledBuffers = pooled
+			require.NoError(b, viewProxyServer.Get("/page", fragment.Define(
+				"/layout",
+				fragment.WithChild("a", fragment.Define("/a")),
+				fragment.WithChild("b", fragment.Define("/b")),
+				fragment.WithChild("c", fragment.Define("/c")),
+				fragment.WithChild("d", fragment.Define("/d")),
+				fragment.WithChild("e", fragment.Define("/e")),
+			)))
+			handler := viewProxyServer.CreateHandler()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					w := httptest.NewRecorder()
+					handler.ServeHTTP(w, httptest.NewRequest("GET", "/page", nil))
+					if w.Code != http.StatusOK {
+						b.Fatalf("unexpected status %d", w.Code)
+					}
+				}
+			})
+		})
+	}
+}
+
 func TestAroundRequestCallback(t *testing.T) {
 	done := make(chan struct{})
 
@@ -323,17 +1697,308 @@ func TestAroundRequestCallback(t *testing.T) {
 		})
 	}
 
-	w := httptest.NewRecorder()
-	r := httptest.NewRequest("GET", "/hello/world", nil)
-	r.RemoteAddr = "192.168.1.1"
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/hello/world", nil)
+	r.RemoteAddr = "192.168.1.1"
+
+	server.CreateHandler().ServeHTTP(w, r)
+
+	resp := w.Result()
+
+	require.Equal(t, "true", resp.Header.Get("x-viewproxy"))
+
+	<-done
+}
+
+func TestNotifierEvents(t *testing.T) {
+	events := make([]string, 0)
+	n := notifier.New()
+	n.On(EventServeHTTP, func(ctx context.Context) {
+		events = append(events, EventServeHTTP)
+		require.Equal(t, "/hello/:name", RouteFromContext(ctx).Path)
+	})
+	n.On(EventProxy, func(ctx context.Context) {
+		events = append(events, EventProxy)
+	})
+
+	server := newServer(t, targetServer.URL, WithPassThrough(targetServer.URL))
+	server.Notifier = n
+	err := server.Get("/hello/:name", fragment.Define("/body/:name"))
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/hello/world", nil)
+	server.CreateHandler().ServeHTTP(w, r)
+
+	require.Equal(t, []string{EventServeHTTP}, events)
+
+	n = notifier.New()
+	n.On(EventServeHTTP, func(ctx context.Context) {
+		events = append(events, EventServeHTTP)
+		require.Nil(t, RouteFromContext(ctx))
+	})
+	n.On(EventProxy, func(ctx context.Context) {
+		events = append(events, EventProxy)
+	})
+	server.Notifier = n
+	events = make([]string, 0)
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/oops", nil)
+	server.CreateHandler().ServeHTTP(w, r)
+
+	require.Equal(t, []string{EventServeHTTP, EventProxy}, events)
+}
+
+func TestEventResponseComplete(t *testing.T) {
+	server := newServer(t, targetServer.URL, WithPassThrough(targetServer.URL))
+	err := server.Get("/hello/:name", fragment.Define("/body/:name"))
+	require.NoError(t, err)
+
+	var statusCodes []int
+	n := notifier.New()
+	n.On(EventResponseComplete, func(ctx context.Context) {
+		statusCodes = append(statusCodes, StatusCodeFromContext(ctx))
+		require.Greater(t, DurationFromContext(ctx), time.Duration(0))
+	})
+	server.Notifier = n
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/hello/world", nil)
+	server.CreateHandler().ServeHTTP(w, r)
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "/oops", nil)
+	server.CreateHandler().ServeHTTP(w, r)
+
+	require.Equal(t, []int{200, 500}, statusCodes)
+}
+
+func TestEventResponseComplete_RejectedRequests(t *testing.T) {
+	var discoveries int32
+	discoveryTarget := startDiscoveryTargetServer(&discoveries)
+	defer discoveryTarget.Close()
+
+	serve := func(server *Server, path string, header http.Header) []string {
+		var events []string
+		n := notifier.New()
+		n.Around(EventServeHTTP, func(ctx context.Context, next func(context.Context)) {
+			events = append(events, EventServeHTTP)
+			next(ctx)
+		})
+		n.On(EventResponseComplete, func(ctx context.Context) {
+			events = append(events, fmt.Sprintf("%s %d", EventResponseComplete, StatusCodeFromContext(ctx)))
+		})
+		server.Notifier = n
+
+		r := httptest.NewRequest("GET", path, nil)
+		// The depth header is only trusted on requests from the loopback address
+		r.RemoteAddr = "127.0.0.1:1234"
+		for name, values := range header {
+			r.Header[name] = values
+		}
+		server.CreateHandler().ServeHTTP(httptest.NewRecorder(), r)
+
+		return events
+	}
+
+	server := newServer(t, targetServer.URL, WithPathPrefix("/app"))
+	require.Equal(t, []string{EventServeHTTP, EventResponseComplete + " 404"}, serve(server, "/hello", nil))
+
+	server = newServer(t, targetServer.URL)
+	server.RedirectTrailingSlash = true
+	require.NoError(t, server.Get("/hello/:name", fragment.Define("/body/:name")))
+	require.Equal(t, []string{EventServeHTTP, EventResponseComplete + " 301"}, serve(server, "/hello/world/", nil))
+
+	server = newServer(t, targetServer.URL)
+	header := http.Header{HeaderViewProxyDepth: {strconv.Itoa(server.MaxRequestDepth + 1)}}
+	require.Equal(t, []string{EventServeHTTP, EventResponseComplete + " 508"}, serve(server, "/hello/world", header))
+
+	server = newServer(t, discoveryTarget.URL)
+	require.NoError(t, server.GetDiscovered("/missing", DeferDiscovery()))
+	require.Equal(t, []string{EventServeHTTP, EventResponseComplete + " 500"}, serve(server, "/missing", nil))
+}
+
+func TestOnAsyncSnapshotsRequestState(t *testing.T) {
+	server := newServer(t, targetServer.URL)
+	require.NoError(t, server.Get("/hello/:name", fragment.Define(
+		"/layouts/test_layout", fragment.WithoutValidation(),
+		fragment.WithChild("header", fragment.Define("/header/:name")),
+		fragment.WithChild("body", fragment.Define("/body/:name")),
+	)))
+
+	// Async subscribers read the state of the request while it's still
+	// being handled, which is reported by the race detector unless it's
+	// snapshotted when the event is emitted
+	var mu sync.Mutex
+	var fetched []*multiplexer.Result
+	var fanOuts []FanOut
+	n := notifier.New()
+	n.OnAsync(multiplexer.EventFetchSingle, func(ctx context.Context) {
+		fetch := multiplexer.FetchFromContext(ctx)
+
+		mu.Lock()
+		fetched = append(fetched, fetch.Result)
+		mu.Unlock()
+	}, notifier.WithWorkers(4))
+	n.OnAsync(EventServeHTTP, func(ctx context.Context) {
+		fanOut := FanOutFromContext(ctx)
+		_ = multiplexer.PhaseTimingsFromContext(ctx).FetchesDone
+
+		mu.Lock()
+		fanOuts = append(fanOuts, *fanOut)
+		mu.Unlock()
+	}, notifier.WithWorkers(4))
+	server.Notifier = n
+
+	for i := 0; i < 10; i++ {
+		w := httptest.NewRecorder()
+		server.CreateHandler().ServeHTTP(w, httptest.NewRequest("GET", "/hello/world", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+	require.NoError(t, n.Shutdown(context.Background()))
+
+	// The events are emitted before the work they wrap
+	require.Len(t, fetched, 30)
+	for _, result := range fetched {
+		require.Nil(t, result)
+	}
+	require.Equal(t, make([]FanOut, 10), fanOuts)
+}
+
+func TestFanOutFromContext(t *testing.T) {
+	server := newServer(t, targetServer.URL)
+	err := server.Get("/hello/:name", fragment.Define(
+		"/layouts/test_layout", fragment.WithoutValidation(),
+		fragment.WithChild("header", fragment.Define("/header/:name")),
+		fragment.WithChild("body", fragment.Define("/body/:name")),
+	))
+	require.NoError(t, err)
+
+	var fanOut *FanOut
+	n := notifier.New()
+	n.Around(EventServeHTTP, func(ctx context.Context, next func(context.Context)) {
+		next(ctx)
+		fanOut = FanOutFromContext(ctx)
+	})
+	server.Notifier = n
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/hello/world", nil)
+	server.CreateHandler().ServeHTTP(w, r)
+
+	require.NotNil(t, fanOut)
+	require.Equal(t, 3, fanOut.Configured)
+	require.Equal(t, 3, fanOut.Fetched)
+	require.Equal(t, 0, fanOut.Skipped())
+
+	// Identical fragments are coalesced into a single fetch
+	err = server.Get("/twice/:name", fragment.Define(
+		"/layouts/test_layout", fragment.WithoutValidation(),
+		fragment.WithChild("header", fragment.Define("/body/:name")),
+		fragment.WithChild("body", fragment.Define("/body/:name")),
+	))
+	require.NoError(t, err)
+
+	w = httptest.NewRecorder()
+	server.CreateHandler().ServeHTTP(w, httptest.NewRequest("GET", "/twice/world", nil))
+
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.Equal(t, 3, fanOut.Configured)
+	require.Equal(t, 2, fanOut.Fetched)
+}
+
+func TestMaxOutboundBytes(t *testing.T) {
+	server := newServer(t, targetServer.URL)
+	err := server.Get("/hello/:name", fragment.Define(
+		"/layouts/test_layout", fragment.WithoutValidation(),
+		fragment.WithChild("body", fragment.Define("/body/:name")),
+	))
+	require.NoError(t, err)
+
+	var outbound *multiplexer.OutboundBytes
+	n := notifier.New()
+	n.Around(EventServeHTTP, func(ctx context.Context, next func(context.Context)) {
+		next(ctx)
+		outbound = multiplexer.OutboundBytesFromContext(ctx)
+	})
+	server.Notifier = n
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/hello/world", nil)
+	server.CreateHandler().ServeHTTP(w, r)
+
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.Greater(t, outbound.Total(), int64(0))
+
+	server.MaxOutboundBytes = outbound.Total() / 2
+	w = httptest.NewRecorder()
+	server.CreateHandler().ServeHTTP(w, r)
+
+	require.Equal(t, http.StatusInternalServerError, w.Result().StatusCode)
+}
+
+func TestServer_OptionalFragments(t *testing.T) {
+	done := make(chan struct{})
+	defer close(done)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/layout":
+			w.Write([]byte(`<main><viewproxy-fragment id="recommendations"></viewproxy-fragment></main>`))
+		case "/recommendations":
+			select {
+			case <-r.Context().Done():
+			case <-done:
+			}
+		}
+	}))
+	defer server.Close()
+
+	viewProxyServer := newServer(t, server.URL)
+	viewProxyServer.ProxyTimeout = time.Second
+	viewProxyServer.OptionalFragmentBudget = 0.1
+	err := viewProxyServer.Get("/", fragment.Define(
+		"/layout",
+		fragment.WithChild("recommendations", fragment.Define(
+			"/recommendations",
+			fragment.WithPriority(1),
+			fragment.WithFallback([]byte("<p>No recommendations</p>")),
+		)),
+	))
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	viewProxyServer.CreateHandler().ServeHTTP(w, r)
+
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.Equal(t, "<main><p>No recommendations</p></main>", w.Body.String())
+}
 
-	server.CreateHandler().ServeHTTP(w, r)
+func TestPhaseTimings(t *testing.T) {
+	server := newServer(t, targetServer.URL)
+	err := server.Get("/hello/:name", fragment.Define(
+		"/layouts/test_layout", fragment.WithoutValidation(),
+		fragment.WithChild("body", fragment.Define("/body/:name")),
+	))
+	require.NoError(t, err)
 
-	resp := w.Result()
+	var phases *multiplexer.PhaseTimings
+	n := notifier.New()
+	n.On(EventResponseComplete, func(ctx context.Context) {
+		phases = multiplexer.PhaseTimingsFromContext(ctx)
+	})
+	server.Notifier = n
 
-	require.Equal(t, "true", resp.Header.Get("x-viewproxy"))
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/hello/world", nil)
+	server.CreateHandler().ServeHTTP(w, r)
 
-	<-done
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.False(t, phases.FetchesDone.IsZero())
+	require.False(t, phases.DoReturned.Before(phases.FetchesDone))
+	require.False(t, phases.StitchStarted.Before(phases.DoReturned))
 }
 
 func TestErrorHandler(t *testing.T) {
@@ -466,12 +2131,428 @@ func TestIgnoreTrailingSlash(t *testing.T) {
 	require.Equal(t, 404, resp.StatusCode)
 }
 
+func TestCaseInsensitivePaths(t *testing.T) {
+	viewProxyServer := newServer(t, targetServer.URL)
+	require.NoError(t, viewProxyServer.Get("/hello/:name", fragment.Define("/body/:name")))
+
+	route, _ := viewProxyServer.MatchingRoute("/Hello/World")
+	require.Nil(t, route)
+
+	viewProxyServer.CaseInsensitivePaths = true
+
+	route, parameters := viewProxyServer.MatchingRoute("/Hello/World")
+	require.NotNil(t, route)
+	require.Equal(t, "/hello/:name", route.Path)
+	require.Equal(t, map[string]string{"name": "World"}, parameters)
+
+	w := httptest.NewRecorder()
+	viewProxyServer.CreateHandler().ServeHTTP(w, httptest.NewRequest("GET", "/HELLO/World", nil))
+
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.Equal(t, "hello World", w.Body.String())
+}
+
+func TestRedirectTrailingSlash(t *testing.T) {
+	viewProxyServer := newServer(t, targetServer.URL)
+	viewProxyServer.RedirectTrailingSlash = true
+
+	root := fragment.Define(
+		"/layouts/test_layout", fragment.WithoutValidation(),
+		fragment.WithChild("body", fragment.Define("/body/:name")),
+	)
+	require.NoError(t, viewProxyServer.Get("/hello/:name", root))
+	require.NoError(t, viewProxyServer.Get("/slashed/", fragment.Define("/layouts/test_layout")))
+
+	r := httptest.NewRequest("GET", "/hello/world/?important=true&name=override", nil)
+	w := httptest.NewRecorder()
+	viewProxyServer.CreateHandler().ServeHTTP(w, r)
+
+	require.Equal(t, http.StatusMovedPermanently, w.Result().StatusCode)
+	require.Equal(t, "/hello/world?important=true&name=override", w.Header().Get("Location"))
+
+	// Routes declared with a trailing slash are served
+	r = httptest.NewRequest("GET", "/slashed/", nil)
+	w = httptest.NewRecorder()
+	viewProxyServer.CreateHandler().ServeHTTP(w, r)
+
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	// Paths that would redirect to another host are not redirected
+	r = httptest.NewRequest("GET", "/", nil)
+	r.URL.Path = "//hello/world/"
+	w = httptest.NewRecorder()
+	viewProxyServer.CreateHandler().ServeHTTP(w, r)
+
+	require.NotEqual(t, http.StatusMovedPermanently, w.Result().StatusCode)
+}
+
+func TestRedirectTrailingSlash_PathPrefix(t *testing.T) {
+	viewProxyServer, err := NewServer(targetServer.URL, WithPathPrefix("/app"))
+	require.NoError(t, err)
+	viewProxyServer.RedirectTrailingSlash = true
+	require.NoError(t, viewProxyServer.Get("/hello/:name", fragment.Define("/body/:name")))
+
+	w := httptest.NewRecorder()
+	viewProxyServer.CreateHandler().ServeHTTP(w, httptest.NewRequest("GET", "/app/hello/world/", nil))
+
+	require.Equal(t, http.StatusMovedPermanently, w.Result().StatusCode)
+	require.Equal(t, "/app/hello/world", w.Header().Get("Location"))
+}
+
+func TestServer_Canary(t *testing.T) {
+	viewProxyServer := newServer(t, targetServer.URL)
+
+	body := fragment.Define("/body/:name", fragment.Canary(fragment.Define("/footer/:name"), 0))
+	root := fragment.Define("/layouts/test_layout",
+		fragment.WithoutValidation(),
+		fragment.WithChild("header", fragment.Define("/header/:name")),
+		fragment.WithChild("body", body),
+		fragment.WithChild("footer", fragment.Define("/footer/:name")),
+	)
+	err := viewProxyServer.Get("/hello/:name", root)
+	require.NoError(t, err)
+
+	render := func() string {
+		r := httptest.NewRequest("GET", "/hello/world", nil)
+		w := httptest.NewRecorder()
+
+		viewProxyServer.CreateHandler().ServeHTTP(w, r)
+
+		body, err := ioutil.ReadAll(w.Result().Body)
+		require.NoError(t, err)
+
+		return string(body)
+	}
+
+	require.Equal(t, "<html><body>hello world</body></html>", render())
+
+	require.NoError(t, viewProxyServer.SetCanaryPercent("/hello/:name", "root.body", 100))
+	require.Equal(t, "<html><body></body></body></html>", render())
+
+	// Other routes rendering the same definition keep their percent
+	otherRoute, err := NewRoute("/other/:name", body)
+	require.NoError(t, err)
+	definition, canary := otherRoute.selectCanary("root", body, "127.0.0.1")
+	require.False(t, canary)
+	require.Equal(t, body, definition)
+	require.Equal(t, float64(0), body.CanaryPercent())
+
+	require.EqualError(t, viewProxyServer.SetCanaryPercent("/hello/:name", "root.missing", 100), "route /hello/:name has no fragment root.missing")
+	require.EqualError(t, viewProxyServer.SetCanaryPercent("/missing", "root.body", 100), "no route defined for /missing")
+}
+
+func TestServer_CanaryKey(t *testing.T) {
+	viewProxyServer := newServer(t, targetServer.URL)
+
+	r := httptest.NewRequest("GET", "/hello/world", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "192.168.1.1, 10.0.0.2")
+	r.Header.Set("X-Request-Id", "abc123")
+	require.Equal(t, "10.0.0.1", viewProxyServer.CanaryKey(r))
+
+	viewProxyServer.TrustForwardedHeaders = true
+	require.Equal(t, "192.168.1.1", viewProxyServer.CanaryKey(r))
+}
+
+func TestServer_CanaryValidation(t *testing.T) {
+	viewProxyServer := newServer(t, targetServer.URL)
+
+	root := fragment.Define("/body/:name", fragment.Canary(fragment.Define("/body/:login"), 5))
+	err := viewProxyServer.Get("/hello/:name", root)
+	require.EqualError(t, err, "dynamic route /hello/:name has mismatched fragment route /body/:login")
+}
+
+func TestReloadRoutes(t *testing.T) {
+	server := newServer(t, targetServer.URL)
+
+	unchanged := fragment.Define("/layouts/test_layout", fragment.WithoutValidation(), fragment.WithChild("body", fragment.Define("/body/:name")))
+	require.NoError(t, server.Get("/hello/:name", unchanged))
+	require.NoError(t, server.Get("/changed/:name", fragment.Define("/layouts/test_layout", fragment.WithoutValidation(), fragment.WithChild("body", fragment.Define("/body/:name")))))
+	require.NoError(t, server.Get("/removed", fragment.Define("/layouts/test_layout")))
+
+	originalRoute, _ := server.MatchingRoute("/hello/world")
+	originalChangedRoute, _ := server.MatchingRoute("/changed/world")
+
+	var added, changed, removed []string
+	server.OnRouteAdded = func(r *Route) { added = append(added, r.Path) }
+	server.OnRouteChanged = func(r *Route) { changed = append(changed, r.Path) }
+	server.OnRouteRemoved = func(r *Route) { removed = append(removed, r.Path) }
+
+	helloRoute, err := NewRoute("/hello/:name", fragment.Define("/layouts/test_layout", fragment.WithoutValidation(), fragment.WithChild("body", fragment.Define("/body/:name"))))
+	require.NoError(t, err)
+	// Only a fragment in the tree changed
+	changedRoute, err := NewRoute("/changed/:name", fragment.Define("/layouts/test_layout", fragment.WithoutValidation(), fragment.WithChild("body", fragment.Define("/footer/:name"))))
+	require.NoError(t, err)
+	addedRoute, err := NewRoute("/added", fragment.Define("/layouts/test_layout"))
+	require.NoError(t, err)
+
+	require.NoError(t, server.ReloadRoutes([]*Route{helloRoute, changedRoute, addedRoute}))
+
+	require.Equal(t, []string{"/added"}, added)
+	require.Equal(t, []string{"/changed/:name"}, changed)
+	require.Equal(t, []string{"/removed"}, removed)
+
+	route, _ := server.MatchingRoute("/hello/world")
+	require.Same(t, originalRoute, route)
+
+	route, _ = server.MatchingRoute("/changed/world")
+	require.NotSame(t, originalChangedRoute, route)
+	require.Same(t, changedRoute, route)
+
+	route, _ = server.MatchingRoute("/added")
+	require.Same(t, addedRoute, route)
+
+	route, _ = server.MatchingRoute("/removed")
+	require.Nil(t, route)
+
+	r := httptest.NewRequest("GET", "/changed/world", nil)
+	w := httptest.NewRecorder()
+	server.CreateHandler().ServeHTTP(w, r)
+
+	body, err := ioutil.ReadAll(w.Result().Body)
+	require.NoError(t, err)
+	require.Contains(t, string(body), "</body>")
+	require.NotContains(t, string(body), "hello world")
+}
+
+func TestReloadRoutes_CanaryPercent(t *testing.T) {
+	server := newServer(t, targetServer.URL)
+	newCanaryRoute := func(percent float64) *Route {
+		route, err := NewRoute("/hello/:name", fragment.Define("/body/:name",
+			fragment.Canary(fragment.Define("/body/:name?canary=1"), percent),
+		))
+		require.NoError(t, err)
+
+		return route
+	}
+
+	require.NoError(t, server.ReloadRoutes([]*Route{newCanaryRoute(0)}))
+
+	var changed []string
+	server.OnRouteChanged = func(r *Route) { changed = append(changed, r.Path) }
+
+	// Rolling out the canary is a change to the route
+	require.NoError(t, server.ReloadRoutes([]*Route{newCanaryRoute(100)}))
+
+	require.Equal(t, []string{"/hello/:name"}, changed)
+	route, _ := server.MatchingRoute("/hello/world")
+	require.Equal(t, 100.0, route.RootFragment.CanaryPercent())
+}
+
 func TestWithPassThrough_Error(t *testing.T) {
 	_, err := NewServer(targetServer.URL, WithPassThrough("%invalid%"))
 
 	require.Error(t, err)
 	require.Contains(t, err.Error(), "viewproxy.ServerOption error")
-	require.Contains(t, err.Error(), "WithPassThrough error")
+	require.Contains(t, err.Error(), "option WithPassThrough:")
+
+	var optionErr *OptionError
+	require.ErrorAs(t, err, &optionErr)
+	require.Equal(t, "WithPassThrough", optionErr.Option)
+
+	var urlErr *url.Error
+	require.ErrorAs(t, err, &urlErr)
+	require.ErrorIs(t, err, urlErr.Err)
+}
+
+type countingTransport struct {
+	requests int32
+}
+
+func (ct *countingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&ct.requests, 1)
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestWithTransport(t *testing.T) {
+	transport := &countingTransport{}
+	viewProxyServer := newServer(t, targetServer.URL, WithTransport(transport))
+	require.NoError(t, viewProxyServer.Get("/hello/:name", fragment.Define(
+		"/layouts/test_layout",
+		fragment.WithoutValidation(),
+		fragment.WithChild("body", fragment.Define("/body/:name")),
+	)))
+
+	w := httptest.NewRecorder()
+	viewProxyServer.CreateHandler().ServeHTTP(w, httptest.NewRequest("GET", "/hello/world", nil))
+
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, int32(2), atomic.LoadInt32(&transport.requests))
+
+	client := &http.Client{Transport: transport}
+	viewProxyServer = newServer(t, targetServer.URL, WithHTTPClient(client))
+	require.NoError(t, viewProxyServer.Get("/hello/:name", fragment.Define("/layouts/test_layout", fragment.WithoutValidation())))
+
+	w = httptest.NewRecorder()
+	viewProxyServer.CreateHandler().ServeHTTP(w, httptest.NewRequest("GET", "/hello/world", nil))
+
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, int32(3), atomic.LoadInt32(&transport.requests))
+
+	_, err := NewServer(targetServer.URL, WithHTTPClient(nil))
+	require.ErrorIs(t, err, ErrNilHTTPClient)
+
+	// Options replacing each other's transport conflict
+	_, err = NewServer(targetServer.URL, WithHTTPClient(client), WithTransport(transport))
+	require.ErrorIs(t, err, ErrConflictingTransportOptions)
+	require.Contains(t, err.Error(), "WithHTTPClient and WithTransport")
+}
+
+func TestFragmentHeaderFunc(t *testing.T) {
+	var mu sync.Mutex
+	cookies := make(map[string]string)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		cookies[r.URL.Path] = r.Header.Get("Cookie")
+		mu.Unlock()
+
+		if r.URL.Path == "/layout" {
+			w.Write([]byte(`<html><viewproxy-fragment id="body"></viewproxy-fragment></html>`))
+		}
+	}))
+	defer target.Close()
+
+	viewProxyServer := newServer(t, target.URL)
+	viewProxyServer.FragmentHeaderFunc = func(requestable multiplexer.Requestable, header http.Header) http.Header {
+		if requestable.(*fragment.Request).FragmentKey == "root.body" {
+			header.Del("Cookie")
+		}
+
+		return header
+	}
+	root := fragment.Define("/layout", fragment.WithChild("body", fragment.Define("/body")))
+	require.NoError(t, viewProxyServer.Get("/hello", root))
+
+	r := httptest.NewRequest("GET", "/hello", nil)
+	r.Header.Set("Cookie", "session=abc")
+	w := httptest.NewRecorder()
+	viewProxyServer.CreateHandler().ServeHTTP(w, r)
+
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, map[string]string{"/layout": "session=abc", "/body": ""}, cookies)
+}
+
+func TestFragmentSetCookies(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/layout" {
+			w.Header().Add("Set-Cookie", "session=layout")
+			w.Write([]byte(`<html><viewproxy-fragment id="body"></viewproxy-fragment></html>`))
+		} else {
+			w.Header().Add("Set-Cookie", "session=body")
+			w.Header().Add("Set-Cookie", "cart=1")
+			w.Write([]byte("hello"))
+		}
+	}))
+	defer target.Close()
+
+	viewProxyServer := newServer(t, target.URL)
+	root := fragment.Define("/layout", fragment.WithChild("body", fragment.Define("/body")))
+	require.NoError(t, viewProxyServer.Get("/hello", root))
+
+	w := httptest.NewRecorder()
+	viewProxyServer.CreateHandler().ServeHTTP(w, httptest.NewRequest("GET", "/hello", nil))
+
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, []string{"session=body", "cart=1"}, w.Header().Values("Set-Cookie"))
+
+	viewProxyServer.SetCookiePolicy = multiplexer.FirstSetCookieWins
+	w = httptest.NewRecorder()
+	viewProxyServer.CreateHandler().ServeHTTP(w, httptest.NewRequest("GET", "/hello", nil))
+
+	require.Equal(t, []string{"session=layout", "cart=1"}, w.Header().Values("Set-Cookie"))
+}
+
+func TestForwardEarlyHints(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", "</"+strings.TrimPrefix(r.URL.Path, "/")+".css>; rel=preload; as=style")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Header().Del("Link")
+
+		if r.URL.Path == "/layout" {
+			w.Write([]byte(`<html><viewproxy-fragment id="body"></viewproxy-fragment></html>`))
+		} else {
+			w.Write([]byte("hello"))
+		}
+	}))
+	defer target.Close()
+
+	viewProxyServer := newServer(t, target.URL)
+	viewProxyServer.ForwardEarlyHints = true
+	root := fragment.Define("/layout", fragment.WithChild("body", fragment.Define("/body")))
+	require.NoError(t, viewProxyServer.Get("/hello", root))
+
+	server := httptest.NewServer(viewProxyServer.CreateHandler())
+	defer server.Close()
+
+	hints := make([]string, 0, 1)
+	ctx := httptrace.WithClientTrace(context.Background(), &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			require.Equal(t, http.StatusEarlyHints, code)
+			hints = append(hints, header.Values("Link")...)
+			return nil
+		},
+	})
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/hello", nil)
+	require.NoError(t, err)
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "<html>hello</html>", string(body))
+	// Only the root fragment's hints are forwarded
+	require.Equal(t, []string{"</layout.css>; rel=preload; as=style"}, hints)
+	require.Empty(t, resp.Header.Values("Link"))
+}
+
+func TestWithH2C(t *testing.T) {
+	target := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}), &http2.Server{}))
+	defer target.Close()
+
+	viewProxyServer := newServer(t, target.URL, WithH2C())
+	require.NoError(t, viewProxyServer.Get("/protocol", fragment.Define("/protocol", fragment.WithoutValidation())))
+
+	w := httptest.NewRecorder()
+	viewProxyServer.CreateHandler().ServeHTTP(w, httptest.NewRequest("GET", "/protocol", nil))
+
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "HTTP/2.0", w.Body.String())
+
+	_, err := NewServer(target.URL, WithH2C(), WithTripperOptions(multiplexer.WithMaxIdleConnsPerHost(8)))
+	require.ErrorIs(t, err, ErrConflictingTransportOptions)
+	require.Contains(t, err.Error(), "WithH2C and WithTripperOptions")
+}
+
+func TestWithTripperOptions(t *testing.T) {
+	var dials int32
+	countDials := func(transport *http.Transport) {
+		dial := transport.DialContext
+		transport.DialContext = func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+			return dial(ctx, network, addr)
+		}
+	}
+
+	// Options given to each WithTripperOptions are combined
+	viewProxyServer := newServer(t, targetServer.URL,
+		WithTripperOptions(multiplexer.WithMaxIdleConnsPerHost(8)),
+		WithTripperOptions(countDials),
+	)
+	require.NoError(t, viewProxyServer.Get("/hello/:name", fragment.Define("/layouts/test_layout", fragment.WithoutValidation())))
+
+	w := httptest.NewRecorder()
+	viewProxyServer.CreateHandler().ServeHTTP(w, httptest.NewRequest("GET", "/hello/world", nil))
+
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, int32(1), atomic.LoadInt32(&dials))
+
+	_, err := NewServer(targetServer.URL, WithTripperOptions(countDials), WithTransport(&countingTransport{}))
+	require.ErrorIs(t, err, ErrConflictingTransportOptions)
 }
 
 func BenchmarkServer(b *testing.B) {
@@ -505,45 +2586,202 @@ func BenchmarkServer(b *testing.B) {
 	}
 }
 
-func startTargetServer() *httptest.Server {
-	instance := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		parts := strings.Split(r.URL.EscapedPath(), "/")
-		name, err := url.PathUnescape(parts[len(parts)-1])
+func TestEachRoute(t *testing.T) {
+	viewProxyServer := newServer(t, targetServer.URL)
+	for _, path := range []string{"/one", "/two", "/three"} {
+		require.NoError(t, viewProxyServer.Get(path, fragment.Define("/layouts/test_layout")))
+	}
+
+	paths := make([]string, 0)
+	viewProxyServer.EachRoute(func(route *Route) bool {
+		paths = append(paths, route.Path)
+		return route.Path != "/two"
+	})
 
-		w.Header().Set("EtAg", "1234")
-		w.Header().Set("X-Name", "viewproxy")
+	require.Equal(t, []string{"/one", "/two"}, paths)
 
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(err.Error()))
-		}
-
-		if r.URL.Path == "/layouts/test_layout" {
-			w.WriteHeader(http.StatusOK)
-			w.Write([]byte(`<html><viewproxy-fragment id="header"></viewproxy-fragment><viewproxy-fragment id="body"></viewproxy-fragment><viewproxy-fragment id="footer"></viewproxy-fragment></html>`))
-		} else if strings.HasPrefix(r.URL.Path, "/header/") {
-			w.WriteHeader(http.StatusOK)
-			w.Write([]byte("<body>"))
-		} else if strings.HasPrefix(r.URL.Path, "/body/") {
-			w.WriteHeader(http.StatusOK)
-			w.Write([]byte(fmt.Sprintf("hello %s", name)))
-			if r.URL.Query().Get("important") != "" {
-				w.Write([]byte("!"))
+	routes := viewProxyServer.Routes()
+	require.Len(t, routes, 3)
+	route, _ := viewProxyServer.MatchingRoute("/one")
+	require.Same(t, route, routes[0])
+}
+
+func BenchmarkRouteEnumeration(b *testing.B) {
+	viewProxyServer := newServer(b, targetServer.URL)
+	for i := 0; i < 5000; i++ {
+		root := fragment.Define(
+			"/layouts/test_layout", fragment.WithoutValidation(), fragment.WithChildren(fragment.Children{
+				"header": fragment.Define("/header/:name"),
+				"body":   fragment.Define("/body/:name"),
+			}),
+		)
+		require.NoError(b, viewProxyServer.Get(fmt.Sprintf("/routes/%d/:name", i), root))
+	}
+
+	// The previous Routes implementation, which copied each route
+	b.Run("RouteValues", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			viewProxyServer.routesMu.RLock()
+			routes := make([]Route, 0, len(viewProxyServer.routes))
+			for _, route := range viewProxyServer.routes {
+				routes = append(routes, *route)
+			}
+			viewProxyServer.routesMu.RUnlock()
+
+			for j := range routes {
+				_ = routes[j].FragmentOrder()
 			}
-		} else if strings.HasPrefix(r.URL.Path, "/footer/") {
-			w.WriteHeader(http.StatusOK)
-			w.Write([]byte("</body>"))
-		} else if r.URL.Path == "/oops" {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte("Something went wrong"))
-		} else {
-			w.WriteHeader(http.StatusNotFound)
-			w.Write([]byte("target: 404 not found"))
 		}
 	})
 
-	testServer := httptest.NewServer(instance)
-	return testServer
+	b.Run("Routes", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, route := range viewProxyServer.Routes() {
+				_ = route.FragmentOrder()
+			}
+		}
+	})
+
+	b.Run("EachRoute", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			viewProxyServer.EachRoute(func(route *Route) bool {
+				_ = route.FragmentOrder()
+				return true
+			})
+		}
+	})
+}
+
+// testTarget is the target fragments are fetched from in tests. It records the
+// headers of the requests it receives, and responds with the response given
+// to respond for a path, if any.
+type testTarget struct {
+	*httptest.Server
+	mu        sync.Mutex
+	responses map[string]*targetResponse
+	requests  map[string][]http.Header
+}
+
+// targetResponse is a response of a testTarget. Responses with a
+// Last-Modified header respond with 304 Not Modified to requests that are
+// still fresh.
+type targetResponse struct {
+	status int
+	header http.Header
+	body   string
+	// The response is written once delay has elapsed and wait is closed
+	delay time.Duration
+	wait  chan struct{}
+}
+
+func startTargetServer() *testTarget {
+	target := &testTarget{
+		responses: make(map[string]*targetResponse),
+		requests:  make(map[string][]http.Header),
+	}
+	target.Server = httptest.NewServer(target)
+
+	return target
+}
+
+// startTarget starts a target that's closed once the test completes.
+func startTarget(t *testing.T) *testTarget {
+	target := startTargetServer()
+	t.Cleanup(target.Close)
+
+	return target
+}
+
+// respond sets the response of the target for the path.
+func (tt *testTarget) respond(path string, response *targetResponse) {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+
+	tt.responses[path] = response
+}
+
+// requestHeaders returns the headers of each request made for the path, in
+// the order they were received.
+func (tt *testTarget) requestHeaders(path string) []http.Header {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+
+	return append([]http.Header(nil), tt.requests[path]...)
+}
+
+func (tt *testTarget) count(path string) int {
+	return len(tt.requestHeaders(path))
+}
+
+func (tt *testTarget) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	tt.mu.Lock()
+	tt.requests[r.URL.Path] = append(tt.requests[r.URL.Path], r.Header.Clone())
+	response, ok := tt.responses[r.URL.Path]
+	tt.mu.Unlock()
+
+	if ok {
+		response.write(w, r)
+		return
+	}
+
+	parts := strings.Split(r.URL.EscapedPath(), "/")
+	name, err := url.PathUnescape(parts[len(parts)-1])
+
+	w.Header().Set("EtAg", "1234")
+	w.Header().Set("X-Name", "viewproxy")
+
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+	}
+
+	if r.URL.Path == "/layouts/test_layout" {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`<html><viewproxy-fragment id="header"></viewproxy-fragment><viewproxy-fragment id="body"></viewproxy-fragment><viewproxy-fragment id="footer"></viewproxy-fragment></html>`))
+	} else if strings.HasPrefix(r.URL.Path, "/header/") {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("<body>"))
+	} else if strings.HasPrefix(r.URL.Path, "/body/") {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(fmt.Sprintf("hello %s", name)))
+		if r.URL.Query().Get("important") != "" {
+			w.Write([]byte("!"))
+		}
+	} else if strings.HasPrefix(r.URL.Path, "/footer/") {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("</body>"))
+	} else if r.URL.Path == "/oops" {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Something went wrong"))
+	} else {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("target: 404 not found"))
+	}
+}
+
+func (tr *targetResponse) write(w http.ResponseWriter, r *http.Request) {
+	time.Sleep(tr.delay)
+	if tr.wait != nil {
+		<-tr.wait
+	}
+
+	for name, values := range tr.header {
+		w.Header()[name] = values
+	}
+
+	modified, err := http.ParseTime(tr.header.Get("Last-Modified"))
+	if since, sinceErr := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && sinceErr == nil && !modified.After(since) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if tr.status != 0 {
+		w.WriteHeader(tr.status)
+	}
+	w.Write([]byte(tr.body))
 }
 
 func newServer(tb testing.TB, target string, opts ...ServerOption) *Server {
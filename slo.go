@@ -0,0 +1,406 @@
+package viewproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/blakewilliams/viewproxy/pkg/fragment"
+	"github.com/blakewilliams/viewproxy/pkg/multiplexer"
+)
+
+// Emitted when a fragment starts breaching its SLO, once per objective until
+// the fragment is compliant again. The breach is available via
+// SLOBreachFromContext.
+const EventSLOBreach = "viewproxy.slo_breach"
+
+// The number of slots the SLOMonitor's window is split into. The window rolls
+// forward one slot at a time.
+const sloSlots = 10
+
+// latencyBounds are the upper bounds of the buckets of the latency histograms
+// used to estimate p99 latencies, growing by 10% from 1ms to a minute.
+var latencyBounds = func() []time.Duration {
+	bounds := make([]time.Duration, 0, 128)
+	for bound := time.Millisecond; bound < time.Minute; bound = bound * 11 / 10 {
+		bounds = append(bounds, bound)
+	}
+
+	return append(bounds, time.Minute)
+}()
+
+// SLOObjective identifies the objective of an SLO that was breached.
+type SLOObjective string
+
+const (
+	// The fragment's p99 latency exceeded fragment.SLO.P99
+	SLOLatency SLOObjective = "latency"
+	// The fragment's error rate exceeded fragment.SLO.MaxErrorRate
+	SLOErrorRate SLOObjective = "error_rate"
+)
+
+// SLOBreach describes a fragment that started breaching its SLO.
+type SLOBreach struct {
+	// The path of the route the fragment belongs to
+	Route string
+	// The key of the fragment, e.g. `root.sidebar`
+	Key string
+	// The objective that was breached
+	Objective SLOObjective
+	// The measured p99 latency in seconds, or the measured error rate
+	Value float64
+	// The objective's p99 latency in seconds, or its maximum error rate
+	Threshold float64
+}
+
+type sloBreachContextKey struct{}
+
+// SLOBreachFromContext returns the SLO breach. It is only available to
+// EventSLOBreach subscribers.
+func SLOBreachFromContext(ctx context.Context) *SLOBreach {
+	if ctx == nil {
+		return nil
+	}
+
+	if breach := ctx.Value(sloBreachContextKey{}); breach != nil {
+		return breach.(*SLOBreach)
+	}
+	return nil
+}
+
+// SLOCompliance is the compliance of a fragment with its SLO over the
+// SLOMonitor's window. Fragments with fewer than MinRequests requests in the
+// window are always compliant.
+type SLOCompliance struct {
+	// The path of the route the fragment belongs to
+	Route string `json:"route"`
+	// The key of the fragment, e.g. `root.sidebar`
+	Key string `json:"key"`
+	// The number of requests made for the fragment in the window
+	Requests int64 `json:"requests"`
+	// The number of those requests that failed
+	Errors int64 `json:"errors"`
+	// The estimated p99 latency of the requests, rounded up
+	P99 time.Duration `json:"p99"`
+	// The ratio of the requests that failed
+	ErrorRate float64 `json:"error_rate"`
+	// The p99 latency objective of the fragment
+	TargetP99 time.Duration `json:"target_p99"`
+	// The maximum error rate objective of the fragment
+	MaxErrorRate float64 `json:"max_error_rate"`
+	// Whether less than 1% of requests were slower than the SLO's P99
+	LatencyCompliant bool `json:"latency_compliant"`
+	// Whether the error rate is at most the SLO's MaxErrorRate
+	ErrorRateCompliant bool `json:"error_rate_compliant"`
+}
+
+type sloKey struct {
+	route string
+	key   string
+}
+
+type sloSlot struct {
+	// The number of the slot since the unix epoch, used to detect slots
+	// that have rolled out of the window
+	epoch    int64
+	requests int64
+	errors   int64
+	// Requests slower than the SLO's P99
+	slow      int64
+	latencies []int64
+}
+
+type fragmentRollup struct {
+	slo   fragment.SLO
+	slots [sloSlots]sloSlot
+	// Whether each objective is breached, so that only the start of a
+	// breach emits an event
+	latencyBreached   bool
+	errorRateBreached bool
+}
+
+// SLOMonitor rolls up the latency and errors of fragments defined with
+// fragment.WithSLO, per route, over a rolling window. Compliance is evaluated
+// by Server.MonitorSLOs on a ticker, off the request path.
+//
+// SLOMonitor implements http.Handler, serving the current compliance of each
+// fragment as JSON so it can be mounted on an admin endpoint.
+type SLOMonitor struct {
+	// The duration of the rolling window compliance is evaluated over. It
+	// must not change once requests are recorded.
+	Window time.Duration
+	// The minimum number of requests in the window before a fragment can
+	// breach its SLO, so a handful of slow requests don't cause a breach
+	MinRequests int64
+	mu          sync.Mutex
+	fragments   map[sloKey]*fragmentRollup
+	now         func() time.Time
+}
+
+// NewSLOMonitor returns an SLOMonitor that evaluates compliance over the given
+// window.
+func NewSLOMonitor(window time.Duration) *SLOMonitor {
+	return &SLOMonitor{
+		Window:      window,
+		MinRequests: 100,
+		fragments:   make(map[sloKey]*fragmentRollup),
+		now:         time.Now,
+	}
+}
+
+// Compliance returns the compliance of each fragment with requests in the
+// window, ordered by route and key.
+func (sm *SLOMonitor) Compliance() []SLOCompliance {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	epoch := sm.epoch(sm.clock())
+	compliance := make([]SLOCompliance, 0, len(sm.fragments))
+	for key, rollup := range sm.fragments {
+		if c := sm.compliance(key, rollup, epoch); c.Requests > 0 {
+			compliance = append(compliance, c)
+		}
+	}
+
+	sort.Slice(compliance, func(i, j int) bool {
+		if compliance[i].Route != compliance[j].Route {
+			return compliance[i].Route < compliance[j].Route
+		}
+		return compliance[i].Key < compliance[j].Key
+	})
+
+	return compliance
+}
+
+func (sm *SLOMonitor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sm.Compliance())
+}
+
+// MonitorSLOs evaluates the SLOs of fragments every interval until ctx is
+// done, emitting EventSLOBreach for each fragment that starts breaching its
+// SLO. Nothing is evaluated when the server has no SLOMonitor.
+func (s *Server) MonitorSLOs(ctx context.Context, interval time.Duration) {
+	if s.SLOMonitor == nil {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.evaluateSLOs(ctx)
+			}
+		}
+	}()
+}
+
+func (s *Server) evaluateSLOs(ctx context.Context) {
+	for _, breach := range s.SLOMonitor.evaluate() {
+		eventCtx := context.WithValue(ctx, sloBreachContextKey{}, breach)
+		s.Notifier.Emit(EventSLOBreach, eventCtx, func(context.Context) {})
+	}
+}
+
+// recordSLO records the fetch of a fragment that has an SLO. Fetches canceled
+// because the request was canceled, e.g. when another fragment failed, aren't
+// recorded.
+func (s *Server) recordSLO(ctx context.Context, route *Route, requestable multiplexer.Requestable, duration time.Duration, err error) {
+	fr, ok := requestable.(*fragment.Request)
+	if !ok || fr.Definition.SLO == nil {
+		return
+	}
+
+	if err != nil && errors.Is(ctx.Err(), context.Canceled) {
+		return
+	}
+
+	s.SLOMonitor.record(route.Path, fr.FragmentKey, *fr.Definition.SLO, duration, err != nil)
+}
+
+// record adds a request for the fragment to the current slot of the window.
+func (sm *SLOMonitor) record(route string, key string, slo fragment.SLO, duration time.Duration, failed bool) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if sm.fragments == nil {
+		sm.fragments = make(map[sloKey]*fragmentRollup)
+	}
+
+	rollup, ok := sm.fragments[sloKey{route, key}]
+	// Slow requests are counted against the SLO, so the rollup starts over
+	// when the SLO changes, e.g. when routes are reloaded
+	if !ok || rollup.slo != slo {
+		rollup = &fragmentRollup{slo: slo}
+		sm.fragments[sloKey{route, key}] = rollup
+	}
+
+	epoch := sm.epoch(sm.clock())
+	slot := &rollup.slots[epoch%sloSlots]
+	if slot.epoch != epoch || slot.latencies == nil {
+		*slot = sloSlot{epoch: epoch, latencies: make([]int64, len(latencyBounds))}
+	}
+
+	slot.requests++
+	if failed {
+		slot.errors++
+	}
+	if duration > slo.P99 {
+		slot.slow++
+	}
+	slot.latencies[latencyBucket(duration)]++
+}
+
+// evaluate returns the objectives that fragments started breaching since the
+// last evaluation. Fragments without requests in the window are forgotten.
+func (sm *SLOMonitor) evaluate() []*SLOBreach {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	epoch := sm.epoch(sm.clock())
+	breaches := make([]*SLOBreach, 0)
+
+	for key, rollup := range sm.fragments {
+		c := sm.compliance(key, rollup, epoch)
+		if c.Requests == 0 {
+			delete(sm.fragments, key)
+			continue
+		}
+
+		if !c.LatencyCompliant && !rollup.latencyBreached {
+			breaches = append(breaches, &SLOBreach{
+				Route:     key.route,
+				Key:       key.key,
+				Objective: SLOLatency,
+				Value:     c.P99.Seconds(),
+				Threshold: c.TargetP99.Seconds(),
+			})
+		}
+		if !c.ErrorRateCompliant && !rollup.errorRateBreached {
+			breaches = append(breaches, &SLOBreach{
+				Route:     key.route,
+				Key:       key.key,
+				Objective: SLOErrorRate,
+				Value:     c.ErrorRate,
+				Threshold: c.MaxErrorRate,
+			})
+		}
+
+		rollup.latencyBreached = !c.LatencyCompliant
+		rollup.errorRateBreached = !c.ErrorRateCompliant
+	}
+
+	sort.Slice(breaches, func(i, j int) bool {
+		if breaches[i].Route != breaches[j].Route {
+			return breaches[i].Route < breaches[j].Route
+		}
+		if breaches[i].Key != breaches[j].Key {
+			return breaches[i].Key < breaches[j].Key
+		}
+		return breaches[i].Objective < breaches[j].Objective
+	})
+
+	return breaches
+}
+
+// compliance sums the slots of the rollup that are in the window ending with
+// the slot of the given epoch.
+func (sm *SLOMonitor) compliance(key sloKey, rollup *fragmentRollup, epoch int64) SLOCompliance {
+	c := SLOCompliance{
+		Route:        key.route,
+		Key:          key.key,
+		TargetP99:    rollup.slo.P99,
+		MaxErrorRate: rollup.slo.MaxErrorRate,
+	}
+	latencies := make([]int64, len(latencyBounds))
+	var slow int64
+
+	for i := range rollup.slots {
+		slot := &rollup.slots[i]
+		if slot.latencies == nil || epoch-slot.epoch >= sloSlots {
+			continue
+		}
+
+		c.Requests += slot.requests
+		c.Errors += slot.errors
+		slow += slot.slow
+		for bucket, count := range slot.latencies {
+			latencies[bucket] += count
+		}
+	}
+
+	c.LatencyCompliant = true
+	c.ErrorRateCompliant = true
+	if c.Requests == 0 {
+		return c
+	}
+
+	c.P99 = percentile(latencies, c.Requests, 0.99)
+	c.ErrorRate = float64(c.Errors) / float64(c.Requests)
+
+	if c.Requests >= sm.MinRequests {
+		c.LatencyCompliant = float64(slow) <= float64(c.Requests)*0.01
+		c.ErrorRateCompliant = c.ErrorRate <= rollup.slo.MaxErrorRate
+	}
+
+	return c
+}
+
+// clock returns the current time, defaulting to time.Now for monitors that
+// weren't created by NewSLOMonitor.
+func (sm *SLOMonitor) clock() time.Time {
+	if sm.now == nil {
+		return time.Now()
+	}
+
+	return sm.now()
+}
+
+// epoch returns the number of the window slot the time falls in.
+func (sm *SLOMonitor) epoch(now time.Time) int64 {
+	slotWidth := sm.Window / sloSlots
+	if slotWidth <= 0 {
+		slotWidth = 1
+	}
+
+	return now.UnixNano() / int64(slotWidth)
+}
+
+// latencyBucket returns the index of the histogram bucket the duration is
+// counted in. Durations over a minute are counted in the last bucket.
+func latencyBucket(duration time.Duration) int {
+	bucket := sort.Search(len(latencyBounds), func(i int) bool {
+		return latencyBounds[i] >= duration
+	})
+
+	if bucket == len(latencyBounds) {
+		return bucket - 1
+	}
+	return bucket
+}
+
+// percentile returns the upper bound of the histogram bucket containing the
+// given percentile of the total count.
+func percentile(latencies []int64, total int64, p float64) time.Duration {
+	rank := int64(math.Ceil(float64(total) * p))
+
+	var seen int64
+	for bucket, count := range latencies {
+		seen += count
+		if seen >= rank {
+			return latencyBounds[bucket]
+		}
+	}
+
+	return latencyBounds[len(latencyBounds)-1]
+}
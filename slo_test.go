@@ -0,0 +1,188 @@
+package viewproxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/blakewilliams/viewproxy/pkg/fragment"
+	"github.com/blakewilliams/viewproxy/pkg/multiplexer"
+	"github.com/blakewilliams/viewproxy/pkg/notifier"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (fc *fakeClock) Now() time.Time                 { return fc.now }
+func (fc *fakeClock) Advance(duration time.Duration) { fc.now = fc.now.Add(duration) }
+
+// monitorSLOs sets an SLOMonitor on the server using a fake clock, returning
+// the clock and the breaches emitted.
+func monitorSLOs(server *Server) (*fakeClock, *[]SLOBreach) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	monitor := NewSLOMonitor(time.Minute)
+	monitor.MinRequests = 10
+	monitor.now = clock.Now
+
+	breaches := make([]SLOBreach, 0)
+	n := notifier.New()
+	n.On(EventSLOBreach, func(ctx context.Context) {
+		breaches = append(breaches, *SLOBreachFromContext(ctx))
+	})
+
+	server.SLOMonitor = monitor
+	server.Notifier = n
+
+	return clock, &breaches
+}
+
+func TestSLOMonitor_LatencyBreachEpisodes(t *testing.T) {
+	server := newServer(t, "http://localhost:9999")
+	clock, breaches := monitorSLOs(server)
+	slo := fragment.SLO{P99: 100 * time.Millisecond, MaxErrorRate: 0.05}
+	record := func(count int, latency time.Duration) {
+		for i := 0; i < count; i++ {
+			server.SLOMonitor.record("/hello", "root.sidebar", slo, latency, false)
+		}
+	}
+
+	record(100, 50*time.Millisecond)
+	server.evaluateSLOs(context.Background())
+	require.Empty(t, *breaches)
+
+	// 2 of 102 requests are over the p99 objective
+	record(2, 200*time.Millisecond)
+	server.evaluateSLOs(context.Background())
+	require.Len(t, *breaches, 1)
+
+	breach := (*breaches)[0]
+	require.Equal(t, "/hello", breach.Route)
+	require.Equal(t, "root.sidebar", breach.Key)
+	require.Equal(t, SLOLatency, breach.Objective)
+	require.Equal(t, 0.1, breach.Threshold)
+	require.Greater(t, breach.Value, 0.2)
+	require.Less(t, breach.Value, 0.22)
+
+	// The breach continues without emitting another event
+	clock.Advance(10 * time.Second)
+	record(10, 50*time.Millisecond)
+	server.evaluateSLOs(context.Background())
+	require.Len(t, *breaches, 1)
+
+	// The slow requests roll out of the window, ending the episode
+	clock.Advance(time.Minute)
+	record(100, 50*time.Millisecond)
+	server.evaluateSLOs(context.Background())
+	require.Len(t, *breaches, 1)
+
+	record(2, 200*time.Millisecond)
+	server.evaluateSLOs(context.Background())
+	require.Len(t, *breaches, 2)
+}
+
+func TestSLOMonitor_ErrorRateBreach(t *testing.T) {
+	server := newServer(t, "http://localhost:9999")
+	_, breaches := monitorSLOs(server)
+	slo := fragment.SLO{P99: time.Second, MaxErrorRate: 0.1}
+
+	for i := 0; i < 20; i++ {
+		server.SLOMonitor.record("/hello", "root", slo, 10*time.Millisecond, i%4 == 0)
+	}
+
+	server.evaluateSLOs(context.Background())
+	server.evaluateSLOs(context.Background())
+	require.Equal(t, []SLOBreach{{Route: "/hello", Key: "root", Objective: SLOErrorRate, Value: 0.25, Threshold: 0.1}}, *breaches)
+}
+
+func TestSLOMonitor_MinRequests(t *testing.T) {
+	server := newServer(t, "http://localhost:9999")
+	_, breaches := monitorSLOs(server)
+	slo := fragment.SLO{P99: 100 * time.Millisecond}
+
+	for i := 0; i < 9; i++ {
+		server.SLOMonitor.record("/hello", "root", slo, time.Second, true)
+	}
+
+	server.evaluateSLOs(context.Background())
+	require.Empty(t, *breaches)
+}
+
+func TestSLOMonitor_RecordsFragments(t *testing.T) {
+	target := startTarget(t)
+	target.respond("/layout", &targetResponse{body: `<viewproxy-fragment id="sidebar"></viewproxy-fragment>`})
+	// Fails once the layout has been fetched, so it isn't canceled
+	target.respond("/sidebar", &targetResponse{status: http.StatusInternalServerError, delay: 20 * time.Millisecond})
+
+	server := newServer(t, target.URL)
+	monitorSLOs(server)
+	require.NoError(t, server.Get("/hello", fragment.Define("/layout",
+		fragment.WithoutValidation(),
+		fragment.WithSLO(time.Second, 0),
+		fragment.WithChild("sidebar", fragment.Define("/sidebar", fragment.WithoutValidation(), fragment.WithSLO(time.Second, 0.5))),
+	)))
+
+	w := httptest.NewRecorder()
+	server.CreateHandler().ServeHTTP(w, httptest.NewRequest("GET", "/hello", nil))
+	require.Equal(t, http.StatusInternalServerError, w.Code)
+
+	w = httptest.NewRecorder()
+	server.SLOMonitor.ServeHTTP(w, httptest.NewRequest("GET", "/_slo", nil))
+	require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	var compliance []SLOCompliance
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &compliance))
+	require.Len(t, compliance, 2)
+
+	require.Equal(t, "root", compliance[0].Key)
+	require.Equal(t, int64(1), compliance[0].Requests)
+	require.Equal(t, int64(0), compliance[0].Errors)
+
+	require.Equal(t, "/hello", compliance[1].Route)
+	require.Equal(t, "root.sidebar", compliance[1].Key)
+	require.Equal(t, int64(1), compliance[1].Errors)
+	require.Equal(t, 1.0, compliance[1].ErrorRate)
+	require.Equal(t, 0.5, compliance[1].MaxErrorRate)
+	// There are fewer requests than MinRequests
+	require.True(t, compliance[1].ErrorRateCompliant)
+}
+
+func TestSLOMonitor_StructLiteral(t *testing.T) {
+	monitor := &SLOMonitor{Window: time.Minute}
+	monitor.record("/hello", "root", fragment.SLO{P99: time.Second}, time.Millisecond, false)
+
+	compliance := monitor.Compliance()
+	require.Len(t, compliance, 1)
+	require.Equal(t, int64(1), compliance[0].Requests)
+	require.Empty(t, monitor.evaluate())
+}
+
+func TestSLOMonitor_SkipsCachedResults(t *testing.T) {
+	target := startTarget(t)
+	target.respond("/layout", &targetResponse{body: "/layout"})
+
+	server := newServer(t, target.URL)
+	monitorSLOs(server)
+	server.SharedCache = multiplexer.NewSharedCache(time.Minute)
+	require.NoError(t, server.Get("/hello", fragment.Define("/layout",
+		fragment.WithoutValidation(),
+		fragment.Shared(),
+		fragment.WithSLO(time.Second, 0),
+	)))
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		server.CreateHandler().ServeHTTP(w, httptest.NewRequest("GET", "/hello", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	// The cached result doesn't reflect the target's latency
+	compliance := server.SLOMonitor.Compliance()
+	require.Len(t, compliance, 1)
+	require.Equal(t, int64(1), compliance[0].Requests)
+	require.Equal(t, multiplexer.SharedCacheStats{Hits: 1, Misses: 1}, server.SharedCache.Stats())
+}
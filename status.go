@@ -0,0 +1,69 @@
+package viewproxy
+
+import (
+	"net/http"
+
+	"github.com/blakewilliams/viewproxy/pkg/multiplexer"
+)
+
+// RootStatusCode returns the status code of the root fragment, or 200 when
+// the root is static. It's the default ResponseStatusCode of servers.
+func RootStatusCode(results map[string]*multiplexer.Result) int {
+	if root, ok := results["root"]; ok && root.StatusCode != 0 {
+		return root.StatusCode
+	}
+
+	return http.StatusOK
+}
+
+// MaxStatusCode returns the highest status code of the fragments, so a body
+// fragment responding with a 404 inside a 200 layout responds with a 404.
+func MaxStatusCode(results map[string]*multiplexer.Result) int {
+	statusCode := http.StatusOK
+	for _, result := range results {
+		if result.StatusCode > statusCode {
+			statusCode = result.StatusCode
+		}
+	}
+
+	return statusCode
+}
+
+// rootRedirect returns the result of the root fragment when it responded with
+// a redirect, either as the error of the request or, when the redirect is
+// allowed by AllowedStatusCodes, as its result.
+func rootRedirect(err error, rootURL string, root *multiplexer.Result) *multiplexer.Result {
+	if resultErr := rootResultError(err, rootURL); resultErr != nil {
+		root = resultErr.Result
+	} else if err != nil {
+		return nil
+	}
+
+	if root == nil {
+		return nil
+	}
+
+	switch root.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return root
+	}
+
+	return nil
+}
+
+// writeRedirect responds with the root fragment's redirect and its headers,
+// with its Location rewritten by the LocationRewriter.
+func (s *Server) writeRedirect(w http.ResponseWriter, r *http.Request, root *multiplexer.Result) {
+	for name, values := range root.HeadersWithoutProxyHeaders() {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+	w.Header().Del("Content-Length")
+
+	if location := w.Header().Get("Location"); location != "" {
+		w.Header().Set("Location", s.LocationRewriter(location, r))
+	}
+
+	w.WriteHeader(root.StatusCode)
+}
@@ -0,0 +1,84 @@
+package viewproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/blakewilliams/viewproxy/pkg/fragment"
+	"github.com/blakewilliams/viewproxy/pkg/multiplexer"
+	"github.com/stretchr/testify/require"
+)
+
+func getStatus(t *testing.T, strategy func(map[string]*multiplexer.Result) int, layoutStatus int, bodyStatus int) *httptest.ResponseRecorder {
+	target := startTarget(t)
+	target.respond("/layout", &targetResponse{status: layoutStatus, body: `<html><viewproxy-fragment id="body"></viewproxy-fragment></html>`})
+	target.respond("/body", &targetResponse{status: bodyStatus, body: "/body"})
+
+	server := newServer(t, target.URL)
+	if strategy != nil {
+		server.ResponseStatusCode = strategy
+	}
+	require.NoError(t, server.Get("/hello", fragment.Define("/layout",
+		fragment.WithoutValidation(),
+		fragment.WithAllowedStatusCodes(http.StatusNotFound),
+		fragment.WithChild("body", fragment.Define("/body",
+			fragment.WithoutValidation(),
+			fragment.WithAllowedStatusCodes(http.StatusNotFound, http.StatusGone),
+		)),
+	)))
+
+	w := httptest.NewRecorder()
+	server.CreateHandler().ServeHTTP(w, httptest.NewRequest("GET", "/hello", nil))
+
+	return w
+}
+
+func TestResponseStatusCode_Root(t *testing.T) {
+	w := getStatus(t, nil, http.StatusNotFound, http.StatusOK)
+	require.Equal(t, http.StatusNotFound, w.Code)
+	require.Equal(t, "<html>/body</html>", w.Body.String())
+
+	w = getStatus(t, nil, http.StatusOK, http.StatusNotFound)
+	require.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestResponseStatusCode_Max(t *testing.T) {
+	w := getStatus(t, MaxStatusCode, http.StatusOK, http.StatusGone)
+	require.Equal(t, http.StatusGone, w.Code)
+	require.Equal(t, "<html>/body</html>", w.Body.String())
+}
+
+func TestResponseStatusCode_Func(t *testing.T) {
+	strategy := func(results map[string]*multiplexer.Result) int {
+		if results["root.body"].StatusCode == http.StatusNotFound {
+			return http.StatusGone
+		}
+
+		return http.StatusOK
+	}
+
+	w := getStatus(t, strategy, http.StatusOK, http.StatusNotFound)
+	require.Equal(t, http.StatusGone, w.Code)
+}
+
+func TestRootRedirect(t *testing.T) {
+	target := startTarget(t)
+	target.respond("/login", &targetResponse{
+		status: http.StatusFound,
+		header: http.Header{"Location": {target.URL + "/sessions/new"}, "Set-Cookie": {"return_to=/hello"}},
+	})
+
+	server := newServer(t, target.URL)
+	require.NoError(t, server.Get("/hello", fragment.Define("/login",
+		fragment.WithChild("body", fragment.Define("/body")),
+	)))
+
+	w := httptest.NewRecorder()
+	server.CreateHandler().ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/hello", nil))
+
+	require.Equal(t, http.StatusFound, w.Code)
+	require.Equal(t, "http://example.com/sessions/new", w.Header().Get("Location"))
+	require.Equal(t, "return_to=/hello", w.Header().Get("Set-Cookie"))
+	require.Empty(t, w.Body.String())
+}
@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	"github.com/blakewilliams/viewproxy/pkg/fragment"
+	"github.com/blakewilliams/viewproxy/pkg/multiplexer"
 	"github.com/stretchr/testify/require"
 )
 
@@ -51,3 +52,65 @@ func TestStitchStructure(t *testing.T) {
 	require.Contains(t, bodyReplacementIDs, "main")
 	require.Contains(t, bodyReplacementIDs, "sidebar")
 }
+
+func TestStitch_ThreeLevels(t *testing.T) {
+	rootFragment := fragment.Define("layout", fragment.WithChildren(fragment.Children{
+		"header": fragment.Define("header"),
+		"body": fragment.Define("body", fragment.WithChildren(fragment.Children{
+			"main": fragment.Define("main", fragment.WithChildren(fragment.Children{
+				"comments": fragment.Define("comments"),
+			})),
+		})),
+	}))
+
+	results := map[string]*multiplexer.Result{
+		"root":                    {Body: []byte(`<html><viewproxy-fragment id="header"></viewproxy-fragment><viewproxy-fragment id="body"></viewproxy-fragment></html>`)},
+		"root.header":             {Body: []byte("<header></header>")},
+		"root.body":               {Body: []byte(`<body><viewproxy-fragment id="main"></viewproxy-fragment></body>`)},
+		"root.body.main":          {Body: []byte(`<main><viewproxy-fragment id="comments"></viewproxy-fragment></main>`)},
+		"root.body.main.comments": {Body: []byte("<p>comments</p>")},
+	}
+
+	stitched, err := stitch(stitchStructureFor(rootFragment), results, defaultFragmentTag)
+	require.NoError(t, err)
+
+	require.Equal(t, "<html><header></header><body><main><p>comments</p></main></body></html>", string(stitched))
+}
+
+func TestStitch_NamedSlots(t *testing.T) {
+	rootFragment := fragment.Define("layout", fragment.WithChildren(fragment.Children{
+		"main":    fragment.Define("main"),
+		"sidebar": fragment.Define("sidebar"),
+	}))
+
+	results := map[string]*multiplexer.Result{
+		"root":         {Body: []byte(`<aside><viewproxy-fragment id="sidebar"/></aside><main><viewproxy-fragment id="main"></viewproxy-fragment></main>`)},
+		"root.main":    {Body: []byte("<p>main</p>")},
+		"root.sidebar": {Body: []byte("<p>sidebar</p>")},
+	}
+
+	stitched, err := stitch(stitchStructureFor(rootFragment), results, defaultFragmentTag)
+	require.NoError(t, err)
+
+	require.Equal(t, "<aside><p>sidebar</p></aside><main><p>main</p></main>", string(stitched))
+}
+
+func TestStitch_MissingSlot(t *testing.T) {
+	rootFragment := fragment.Define("layout", fragment.WithChildren(fragment.Children{
+		"main":    fragment.Define("main"),
+		"sidebar": fragment.Define("sidebar"),
+	}))
+
+	results := map[string]*multiplexer.Result{
+		"root":         {Body: []byte(`<main><viewproxy-fragment id="main"/></main>`)},
+		"root.main":    {Body: []byte("<p>main</p>")},
+		"root.sidebar": {Body: []byte("<p>sidebar</p>")},
+	}
+
+	_, err := stitch(stitchStructureFor(rootFragment), results, defaultFragmentTag)
+
+	var missingSlotErr *MissingSlotError
+	require.ErrorAs(t, err, &missingSlotErr)
+	require.Equal(t, "root", missingSlotErr.FragmentKey)
+	require.Equal(t, "sidebar", missingSlotErr.Slot)
+}
@@ -0,0 +1,289 @@
+package viewproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/blakewilliams/viewproxy/pkg/multiplexer"
+)
+
+type fragmentStreamContextKey struct{}
+
+// fragmentStream receives the results of a request's fragments as they
+// arrive, so the response can be written before every fragment has been
+// fetched. It's only used by the goroutine handling the request.
+type fragmentStream struct {
+	results <-chan *multiplexer.Result
+	errs    <-chan error
+	// The results received so far, by index. Results that haven't arrived
+	// are nil.
+	received []*multiplexer.Result
+	closed   bool
+	err      error
+}
+
+func newFragmentStream(results <-chan *multiplexer.Result, errs <-chan error, count int) *fragmentStream {
+	return &fragmentStream{results: results, errs: errs, received: make([]*multiplexer.Result, count)}
+}
+
+// wait receives results until the result at index has arrived, returning
+// the error of the request if fetching failed first.
+func (fs *fragmentStream) wait(index int) (*multiplexer.Result, error) {
+	for fs.received[index] == nil {
+		if !fs.receive() {
+			break
+		}
+	}
+
+	if fs.err != nil {
+		return nil, fs.err
+	}
+
+	return fs.received[index], nil
+}
+
+// receive receives the next result, returning false once the stream is
+// closed.
+func (fs *fragmentStream) receive() bool {
+	if fs.closed {
+		return false
+	}
+
+	result, ok := <-fs.results
+	if !ok {
+		fs.closed = true
+		fs.err = <-fs.errs
+		return false
+	}
+
+	fs.received[result.Index] = result
+	return true
+}
+
+// complete returns true when every result has arrived.
+func (fs *fragmentStream) complete() bool {
+	for _, result := range fs.received {
+		if result == nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// finish receives the remaining results, returning once every fetch has
+// returned.
+func (fs *fragmentStream) finish() error {
+	for fs.receive() {
+	}
+
+	return fs.err
+}
+
+// doStreaming fetches the fragments of the request, returning once the root
+// fragment has arrived when the response can be streamed. The returned
+// stream is nil when the response is buffered, in which case every result
+// has arrived or fetching failed.
+func doStreaming(ctx context.Context, req *multiplexer.Request, rendered *renderedFragments) ([]*multiplexer.Result, *fragmentStream, error) {
+	results, errs := req.DoStream(ctx)
+	stream := newFragmentStream(results, errs, len(rendered.requested))
+
+	for i, key := range rendered.requested {
+		if key != "root" {
+			continue
+		}
+
+		root, err := stream.wait(i)
+		if err == nil && streamable(root) && !stream.complete() {
+			return stream.received, stream, nil
+		}
+	}
+
+	if err := stream.finish(); err != nil {
+		return make([]*multiplexer.Result, 0), nil, err
+	}
+
+	return stream.received, nil, nil
+}
+
+// writeStream writes the response as the results of its fragments arrive.
+// Errors before the first byte is written respond with a 500, while errors
+// after that truncate the response.
+func writeStream(s *Server, w http.ResponseWriter, r *http.Request, route *Route, stream *fragmentStream) {
+	sw := newStreamWriter(s, w, r, route, renderedFragmentsFromContext(r.Context()), stream)
+	err := sw.write(route.structure)
+	if err == nil {
+		return
+	}
+
+	if sw.started {
+		s.Logger.Printf("Truncated the response for %s: %s", route.Path, err)
+		return
+	}
+
+	var slotErr *MissingSlotError
+	if errors.As(err, &slotErr) {
+		s.Logger.Printf("Could not stitch %s: %s", route.Path, err)
+	}
+	s.writeStitchError(w, r)
+}
+
+// streamsResponses returns true when the response to r can be streamed, which
+// isn't possible when the whole body is needed before it's written, or to
+// compute the Content-Length of HEAD requests.
+func (s *Server) streamsResponses(r *http.Request) bool {
+	return s.StreamResponses && r.Method != http.MethodHead && !s.GenerateETags && !s.ConditionalFragments && s.RenderAnalyzer == nil
+}
+
+// streamable returns true when the response can be streamed once the root
+// fragment has arrived. Gzipped responses are compressed as a whole, and the
+// timing tag in the root is replaced once every fragment has been fetched.
+func streamable(root *multiplexer.Result) bool {
+	return root.Header().Get("Content-Encoding") != "gzip" &&
+		!bytes.Contains(root.Body, []byte(timingTag))
+}
+
+func fragmentStreamFromContext(ctx context.Context) *fragmentStream {
+	if stream, ok := ctx.Value(fragmentStreamContextKey{}).(*fragmentStream); ok {
+		return stream
+	}
+
+	return nil
+}
+
+// streamWriter writes the stitched response in document order, writing each
+// fragment up to the slot of its next child and waiting for that child's
+// result before continuing.
+type streamWriter struct {
+	writer   http.ResponseWriter
+	rendered *renderedFragments
+	stream   *fragmentStream
+	tag      string
+	start    time.Time
+	// The index of each requested fragment, by key
+	indexes map[string]int
+	// The status code written before the first byte
+	statusCode int
+	// True once the status code and the first bytes have been written
+	started bool
+	timed   bool
+}
+
+func newStreamWriter(s *Server, w http.ResponseWriter, r *http.Request, route *Route, rendered *renderedFragments, stream *fragmentStream) *streamWriter {
+	tag := s.FragmentTag
+	if tag == "" {
+		tag = defaultFragmentTag
+	}
+
+	indexes := make(map[string]int, len(rendered.requested))
+	for i, key := range rendered.requested {
+		indexes[key] = i
+	}
+
+	// Only the fragments that have arrived can determine the status code
+	statusCode := http.StatusOK
+	if s.ResponseStatusCode != nil {
+		statusCode = s.ResponseStatusCode(mapResultsToFragmentKey(route, rendered, stream.received))
+	}
+
+	return &streamWriter{
+		writer:     w,
+		statusCode: statusCode,
+		rendered:   rendered,
+		stream:     stream,
+		tag:        tag,
+		start:      startTimeFromContext(r.Context()),
+		indexes:    indexes,
+	}
+}
+
+// write writes the fragment and its children. Results that haven't arrived
+// are waited for once everything before their slot has been written.
+func (sw *streamWriter) write(structure *stitchStructure) error {
+	result, err := sw.result(structure.Key())
+	if err != nil || result == nil {
+		// Conditional fragments that were not rendered have no content
+		return err
+	}
+
+	slots, err := stitchSlots(structure, result, sw.isRendered, sw.tag)
+	if err != nil {
+		return err
+	}
+
+	position := 0
+	for _, slot := range slots {
+		sw.writeChunk(result.Body[position:slot.start])
+		if err := sw.write(slot.structure); err != nil {
+			return err
+		}
+		position = slot.end
+	}
+	sw.writeChunk(result.Body[position:])
+
+	return nil
+}
+
+// result returns the result of the fragment with the given key, flushing
+// what has been written so far when the result has to be waited for. Skipped
+// fragments are rendered with their fallback content.
+func (sw *streamWriter) result(key string) (*multiplexer.Result, error) {
+	if content, ok := sw.rendered.static[key]; ok {
+		return &multiplexer.Result{Body: content, StatusCode: http.StatusOK}, nil
+	}
+
+	index, ok := sw.indexes[key]
+	if !ok {
+		return nil, nil
+	}
+
+	if sw.stream.received[index] == nil && sw.started {
+		if flusher, ok := sw.writer.(http.Flusher); ok {
+			flusher.Flush()
+		}
+	}
+
+	result, err := sw.stream.wait(index)
+	if err != nil {
+		return nil, err
+	}
+
+	if result.Skipped {
+		return &multiplexer.Result{Body: sw.rendered.fallbacks[key], StatusCode: http.StatusOK, Skipped: true}, nil
+	}
+
+	return result, nil
+}
+
+func (sw *streamWriter) isRendered(key string) bool {
+	_, static := sw.rendered.static[key]
+	_, requested := sw.indexes[key]
+
+	return static || requested
+}
+
+// writeChunk writes part of a fragment's body, writing the status code before
+// the first byte. The first timing tag is replaced with the time elapsed
+// when it's written.
+func (sw *streamWriter) writeChunk(chunk []byte) {
+	if len(chunk) == 0 {
+		return
+	}
+
+	if !sw.timed && bytes.Contains(chunk, []byte(timingTag)) {
+		elapsed := strconv.FormatInt(time.Since(sw.start).Milliseconds(), 10)
+		chunk = bytes.Replace(chunk, []byte(timingTag), []byte(elapsed), 1)
+		sw.timed = true
+	}
+
+	if !sw.started {
+		sw.writer.WriteHeader(sw.statusCode)
+		sw.started = true
+	}
+
+	sw.writer.Write(chunk)
+}
@@ -0,0 +1,134 @@
+package viewproxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/blakewilliams/viewproxy/pkg/fragment"
+	"github.com/stretchr/testify/require"
+)
+
+// startStreamTarget starts a target whose /body fragment responds with the
+// given status once release is closed.
+func startStreamTarget(t *testing.T, layout string, bodyStatus int, release chan struct{}) *testTarget {
+	target := startTarget(t)
+	target.respond("/layout", &targetResponse{body: layout})
+	target.respond("/body", &targetResponse{status: bodyStatus, body: "body <view-proxy-timing></view-proxy-timing>", wait: release})
+	target.respond("/footer", &targetResponse{body: "/footer"})
+
+	return target
+}
+
+func newStreamServer(t *testing.T, target string, logs io.Writer) *httptest.Server {
+	server := newServer(t, target)
+	server.StreamResponses = true
+	server.Logger = log.New(logs, "", 0)
+	require.NoError(t, server.Get("/hello", fragment.Define("/layout",
+		fragment.WithoutValidation(),
+		fragment.WithChild("body", fragment.Define("/body", fragment.WithoutValidation())),
+		fragment.WithChild("footer", fragment.Define("/footer", fragment.WithoutValidation())),
+	)))
+
+	proxy := httptest.NewServer(server.CreateHandler())
+	t.Cleanup(proxy.Close)
+
+	return proxy
+}
+
+func TestStreamResponses(t *testing.T) {
+	release := make(chan struct{})
+	target := startStreamTarget(t, `<html><viewproxy-fragment id="body"></viewproxy-fragment><viewproxy-fragment id="footer"></viewproxy-fragment></html>`, http.StatusOK, release)
+	proxy := newStreamServer(t, target.URL, io.Discard)
+
+	resp, err := http.Get(proxy.URL + "/hello")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// The layout is written while the body is still being fetched
+	reader := bufio.NewReader(resp.Body)
+	start := make([]byte, len("<html>"))
+	_, err = io.ReadFull(reader, start)
+	require.NoError(t, err)
+	require.Equal(t, "<html>", string(start))
+
+	close(release)
+	rest, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Regexp(t, `^body \d+/footer</html>$`, string(rest))
+}
+
+func TestStreamResponses_TruncatedOnFailure(t *testing.T) {
+	release := make(chan struct{})
+	target := startStreamTarget(t, `<html><viewproxy-fragment id="body"></viewproxy-fragment><viewproxy-fragment id="footer"></viewproxy-fragment></html>`, http.StatusInternalServerError, release)
+	var logs syncBuffer
+	proxy := newStreamServer(t, target.URL, &logs)
+
+	resp, err := http.Get(proxy.URL + "/hello")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	close(release)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "<html>", string(body))
+	require.Contains(t, logs.String(), "Truncated the response for /hello: status: 500")
+}
+
+func TestStreamResponses_FailureBeforeFirstByte(t *testing.T) {
+	release := make(chan struct{})
+	target := startStreamTarget(t, `<viewproxy-fragment id="body"></viewproxy-fragment><viewproxy-fragment id="footer"></viewproxy-fragment>`, http.StatusInternalServerError, release)
+	proxy := newStreamServer(t, target.URL, io.Discard)
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		close(release)
+	}()
+
+	resp, err := http.Get(proxy.URL + "/hello")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+}
+
+func TestStreamResponses_BufferedWithTimingTag(t *testing.T) {
+	release := make(chan struct{})
+	close(release)
+	target := startStreamTarget(t, `<html><view-proxy-timing></view-proxy-timing><viewproxy-fragment id="body"></viewproxy-fragment><viewproxy-fragment id="footer"></viewproxy-fragment></html>`, http.StatusOK, release)
+	proxy := newStreamServer(t, target.URL, io.Discard)
+
+	resp, err := http.Get(proxy.URL + "/hello")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Regexp(t, `^<html>\d+body <view-proxy-timing></view-proxy-timing>/footer</html>$`, string(body))
+}
+
+// syncBuffer is a bytes.Buffer that's safe to write to from the server's
+// goroutines while the test reads it.
+type syncBuffer struct {
+	mu     sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (sb *syncBuffer) Write(p []byte) (int, error) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.buffer.Write(p)
+}
+
+func (sb *syncBuffer) String() string {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.buffer.String()
+}
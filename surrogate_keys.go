@@ -0,0 +1,54 @@
+package viewproxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/blakewilliams/viewproxy/pkg/fragment"
+)
+
+const defaultSurrogateKeyHeader = "Surrogate-Key"
+
+// SurrogateKeysFor returns the surrogate keys of the responses stitched for
+// the route: a key for the route's path, followed by a key for the path of
+// each fragment the route can render, including alternates and canaries.
+//
+// Keys are hashes of the paths, so they're short and stable across runs and
+// servers. Fragments rendered by several routes, e.g. a shared layout, have
+// the same key for each route, so purging the key invalidates every page
+// that renders the fragment.
+func SurrogateKeysFor(route *Route) []string {
+	keys := []string{surrogateKey("route", route.Host+route.Path)}
+	seen := map[string]struct{}{keys[0]: {}}
+
+	route.EachFragment(func(_ string, definition *fragment.Definition) bool {
+		definitions := append([]*fragment.Definition{definition}, definition.Alternates()...)
+		if canary := definition.CanaryDefinition(); canary != nil {
+			definitions = append(definitions, canary)
+		}
+
+		for _, d := range definitions {
+			if d.IsStatic() {
+				continue
+			}
+
+			key := surrogateKey("fragment", d.Path)
+			if _, ok := seen[key]; !ok {
+				seen[key] = struct{}{}
+				keys = append(keys, key)
+			}
+		}
+
+		return true
+	})
+
+	return keys
+}
+
+// surrogateKey returns the first 16 hex characters of the SHA-256 hash of the
+// kind and path, so routes and fragments with the same path have different
+// keys.
+func surrogateKey(kind string, path string) string {
+	sum := sha256.Sum256([]byte(kind + " " + path))
+	return hex.EncodeToString(sum[:8])
+}
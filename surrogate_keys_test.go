@@ -0,0 +1,57 @@
+package viewproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/blakewilliams/viewproxy/pkg/fragment"
+	"github.com/stretchr/testify/require"
+)
+
+func newSurrogateRoute(t *testing.T, path string) *Route {
+	route, err := NewRoute(path, fragment.Define("/layout",
+		fragment.WithoutValidation(),
+		fragment.WithChild("header", fragment.Define("", fragment.WithStaticContent([]byte("header")))),
+		fragment.WithChild("body", fragment.Define("/body/:name",
+			fragment.WithAlternate(fragment.Define("/body/:name?variant=b")),
+		)),
+	))
+	require.NoError(t, err)
+
+	return route
+}
+
+func TestSurrogateKeysFor(t *testing.T) {
+	keys := SurrogateKeysFor(newSurrogateRoute(t, "/hello/:name"))
+
+	// Keys are hashes of the paths, so they're the same in every run
+	require.Equal(t, []string{"46eace4ca9ca8e63", "28144910081bd7a2", "7de9a668e8655e8b", "e8ed5cf4d4d6d245"}, keys)
+	require.Equal(t, keys, SurrogateKeysFor(newSurrogateRoute(t, "/hello/:name")))
+
+	// Fragments shared between routes have the same keys
+	require.Equal(t, append([]string{"580941d3e978397b"}, keys[1:]...), SurrogateKeysFor(newSurrogateRoute(t, "/goodbye/:name")))
+}
+
+func TestSurrogateKeys(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Surrogate-Key", "layout")
+		w.Header().Set("Surrogate-Control", "max-age=60")
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer target.Close()
+
+	server := newServer(t, target.URL)
+	server.SurrogateKeys = true
+	server.SurrogateKeyHeader = "Cache-Tag"
+	server.StripResponseHeaders = []string{"Surrogate-Key", "Surrogate-Control"}
+	require.NoError(t, server.Get("/goodbye", fragment.Define("/layout", fragment.WithoutValidation())))
+
+	w := httptest.NewRecorder()
+	server.CreateHandler().ServeHTTP(w, httptest.NewRequest("GET", "/goodbye", nil))
+
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "be5b2fa31abe7392 28144910081bd7a2", w.Header().Get("Cache-Tag"))
+	require.Empty(t, w.Header().Values("Surrogate-Key"))
+	require.Empty(t, w.Header().Values("Surrogate-Control"))
+}
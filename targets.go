@@ -0,0 +1,215 @@
+package viewproxy
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrNoTargets is returned by WithTargets when no targets are given
+var ErrNoTargets = errors.New("no targets")
+
+// BalancingStrategy selects the target replica a fragment is fetched from.
+// Select is only called with healthy targets, and is called concurrently.
+type BalancingStrategy interface {
+	Select(targets []*url.URL) *url.URL
+}
+
+// RoundRobin returns a BalancingStrategy that selects each target in turn.
+func RoundRobin() BalancingStrategy {
+	return &roundRobin{}
+}
+
+type roundRobin struct {
+	next uint64
+}
+
+func (rr *roundRobin) Select(targets []*url.URL) *url.URL {
+	i := atomic.AddUint64(&rr.next, 1) - 1
+	return targets[i%uint64(len(targets))]
+}
+
+// Random returns a BalancingStrategy that selects a random target.
+func Random() BalancingStrategy {
+	return randomStrategy{}
+}
+
+type randomStrategy struct{}
+
+func (randomStrategy) Select(targets []*url.URL) *url.URL {
+	return targets[rand.Intn(len(targets))]
+}
+
+// WithTargets fetches fragments from the given target replicas instead of the
+// target passed to NewServer, selecting a replica for each fragment request
+// using the server's BalancingStrategy. The first target is returned by
+// Target and used for route discovery.
+//
+// Shared fragments are cached by URL, so each replica is cached separately.
+func WithTargets(targets []string) ServerOption {
+	return namedOption("WithTargets", func(server *Server) error {
+		if len(targets) == 0 {
+			return ErrNoTargets
+		}
+
+		targetURLs := make([]*url.URL, 0, len(targets))
+		for _, target := range targets {
+			targetURL, err := url.Parse(target)
+			if err != nil {
+				return err
+			}
+
+			targetURLs = append(targetURLs, targetURL)
+		}
+
+		server.target = targets[0]
+		server.targetURL = targetURLs[0]
+		server.targets = newTargetSet(targetURLs, server.targets.strategy)
+
+		return nil
+	})
+}
+
+// WithBalancingStrategy sets the strategy used to select between the targets
+// given to WithTargets. Defaults to RoundRobin.
+func WithBalancingStrategy(strategy BalancingStrategy) ServerOption {
+	return namedOption("WithBalancingStrategy", func(server *Server) error {
+		server.targets.strategy = strategy
+		return nil
+	})
+}
+
+// MarkTargetUnhealthy removes the target from rotation for the given duration,
+// e.g. after a failed health check. Fragments are fetched from every target
+// when none are healthy.
+func (s *Server) MarkTargetUnhealthy(target string, duration time.Duration) error {
+	return s.targets.setUnhealthyUntil(target, time.Now().Add(duration))
+}
+
+// MarkTargetHealthy returns a target removed by MarkTargetUnhealthy to
+// rotation.
+func (s *Server) MarkTargetHealthy(target string) error {
+	return s.targets.setUnhealthyUntil(target, time.Time{})
+}
+
+// targetSet selects between the target replicas of the server.
+type targetSet struct {
+	targets  []*url.URL
+	strategy BalancingStrategy
+	mu       sync.RWMutex
+	// When each unhealthy target returns to rotation, keyed by URL
+	unhealthyUntil map[string]time.Time
+}
+
+func newTargetSet(targets []*url.URL, strategy BalancingStrategy) *targetSet {
+	if strategy == nil {
+		strategy = RoundRobin()
+	}
+
+	return &targetSet{
+		targets:        targets,
+		strategy:       strategy,
+		unhealthyUntil: make(map[string]time.Time),
+	}
+}
+
+// next returns the target to fetch the next fragment from.
+func (ts *targetSet) next() *url.URL {
+	if len(ts.targets) == 1 {
+		return ts.targets[0]
+	}
+
+	ts.mu.RLock()
+	if len(ts.unhealthyUntil) == 0 {
+		ts.mu.RUnlock()
+		return ts.strategy.Select(ts.targets)
+	}
+
+	now := time.Now()
+	healthy := make([]*url.URL, 0, len(ts.targets))
+	for _, target := range ts.targets {
+		if until, ok := ts.unhealthyUntil[target.String()]; !ok || now.After(until) {
+			healthy = append(healthy, target)
+		}
+	}
+	ts.mu.RUnlock()
+
+	if len(healthy) == 0 {
+		return ts.strategy.Select(ts.targets)
+	}
+
+	return ts.strategy.Select(healthy)
+}
+
+// failover returns a healthy target other than the one that failed, or nil
+// when the failed URL isn't for one of the targets or there's no other healthy
+// target.
+func (ts *targetSet) failover(failed *url.URL) *url.URL {
+	if len(ts.targets) == 1 || !ts.containsHost(failed.Host) {
+		return nil
+	}
+
+	now := time.Now()
+	candidates := make([]*url.URL, 0, len(ts.targets)-1)
+
+	ts.mu.RLock()
+	for _, target := range ts.targets {
+		if strings.EqualFold(target.Host, failed.Host) {
+			continue
+		}
+
+		if until, ok := ts.unhealthyUntil[target.String()]; !ok || now.After(until) {
+			candidates = append(candidates, target)
+		}
+	}
+	ts.mu.RUnlock()
+
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	return ts.strategy.Select(candidates)
+}
+
+// containsHost returns true when host is the host of one of the targets.
+func (ts *targetSet) containsHost(host string) bool {
+	for _, target := range ts.targets {
+		if strings.EqualFold(target.Host, host) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (ts *targetSet) setUnhealthyUntil(target string, until time.Time) error {
+	targetURL, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+
+	key := targetURL.String()
+	for _, t := range ts.targets {
+		if t.String() != key {
+			continue
+		}
+
+		ts.mu.Lock()
+		defer ts.mu.Unlock()
+
+		if until.IsZero() {
+			delete(ts.unhealthyUntil, key)
+		} else {
+			ts.unhealthyUntil[key] = until
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("%s is not a target of the server", target)
+}
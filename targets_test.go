@@ -0,0 +1,122 @@
+package viewproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/blakewilliams/viewproxy/pkg/fragment"
+	"github.com/stretchr/testify/require"
+)
+
+func startReplica(t *testing.T, name string) *httptest.Server {
+	replica := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(name))
+	}))
+	t.Cleanup(replica.Close)
+
+	return replica
+}
+
+func TestWithTargets_RoundRobin(t *testing.T) {
+	first := startReplica(t, "first")
+	second := startReplica(t, "second")
+
+	server := newServer(t, "http://localhost:9999", WithTargets([]string{first.URL, second.URL}))
+	require.Equal(t, first.URL, server.Target())
+	require.NoError(t, server.Get("/hello", fragment.Define("/hello", fragment.WithoutValidation())))
+
+	bodies := make([]string, 0, 4)
+	for i := 0; i < 4; i++ {
+		w := httptest.NewRecorder()
+		server.CreateHandler().ServeHTTP(w, httptest.NewRequest("GET", "/hello", nil))
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+		bodies = append(bodies, w.Body.String())
+	}
+
+	require.Equal(t, []string{"first", "second", "first", "second"}, bodies)
+}
+
+func TestMarkTargetUnhealthy(t *testing.T) {
+	first := startReplica(t, "first")
+	second := startReplica(t, "second")
+
+	server := newServer(t, first.URL, WithTargets([]string{first.URL, second.URL}))
+	require.NoError(t, server.Get("/hello", fragment.Define("/hello", fragment.WithoutValidation())))
+
+	get := func() string {
+		w := httptest.NewRecorder()
+		server.CreateHandler().ServeHTTP(w, httptest.NewRequest("GET", "/hello", nil))
+		return w.Body.String()
+	}
+
+	require.NoError(t, server.MarkTargetUnhealthy(first.URL, time.Minute))
+	require.Equal(t, "second", get())
+	require.Equal(t, "second", get())
+
+	// Every target is used when none are healthy
+	require.NoError(t, server.MarkTargetUnhealthy(second.URL, time.Minute))
+	require.Contains(t, []string{"first", "second"}, get())
+
+	require.NoError(t, server.MarkTargetHealthy(first.URL))
+	require.Equal(t, "first", get())
+	require.Equal(t, "first", get())
+
+	require.EqualError(t, server.MarkTargetHealthy("http://localhost:1"), "http://localhost:1 is not a target of the server")
+}
+
+func TestWithTargets_Empty(t *testing.T) {
+	_, err := NewServer("http://localhost:9999", WithTargets(nil))
+
+	var optionErr *OptionError
+	require.ErrorAs(t, err, &optionErr)
+	require.ErrorIs(t, err, ErrNoTargets)
+}
+
+func TestRandomBalancingStrategy(t *testing.T) {
+	first, _ := url.Parse("http://localhost:1")
+	second, _ := url.Parse("http://localhost:2")
+	targets := newTargetSet([]*url.URL{first, second}, Random())
+
+	for i := 0; i < 10; i++ {
+		require.Contains(t, []*url.URL{first, second}, targets.next())
+	}
+}
+
+func TestTargetsAreInternalHosts(t *testing.T) {
+	server := newServer(t, "http://localhost:9999", WithTargets([]string{"http://app-1.internal", "http://app-2.internal"}))
+
+	require.True(t, server.isInternalHost("APP-2.internal"))
+	require.False(t, server.isInternalHost("example.com"))
+}
+
+func TestMaxTargetFailovers(t *testing.T) {
+	live := startReplica(t, "live")
+	dead := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	dead.Close()
+
+	server := newServer(t, dead.URL, WithTargets([]string{dead.URL, live.URL}))
+	require.NoError(t, server.Get("/hello", fragment.Define("/hello", fragment.WithoutValidation())))
+
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		server.CreateHandler().ServeHTTP(w, httptest.NewRequest("GET", "/hello", nil))
+		return w
+	}
+
+	// The dead target is selected first
+	require.Equal(t, http.StatusInternalServerError, get().Code)
+
+	server.MaxTargetFailovers = 1
+	for i := 0; i < 2; i++ {
+		w := get()
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "live", w.Body.String())
+	}
+
+	// Requests only fail over to healthy targets
+	require.NoError(t, server.MarkTargetUnhealthy(live.URL, time.Minute))
+	require.Equal(t, http.StatusInternalServerError, get().Code)
+}
@@ -0,0 +1,88 @@
+package viewproxy
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/blakewilliams/viewproxy/pkg/notifier"
+	"github.com/blakewilliams/viewproxy/pkg/tracing"
+	"github.com/blakewilliams/viewproxy/pkg/tracinghooks"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ConfigureTracing registers a global tracer provider using the given config
+// and subscribes tracing hooks to the server's Notifier. The returned function
+// flushes pending spans and shuts down the provider.
+//
+// Calling ConfigureTracing again shuts down the previously configured
+// provider before registering the new one. Hooks are only subscribed once, and
+// only when the Notifier is a *notifier.DefaultNotifier.
+func (s *Server) ConfigureTracing(config tracing.TracingConfig) (func(), error) {
+	s.tracingMu.Lock()
+	defer s.tracingMu.Unlock()
+
+	if s.tracingShutdown != nil {
+		s.tracingShutdown()
+		s.tracingShutdown = nil
+	}
+
+	shutdown, err := tracing.Instrument(config)
+	if err != nil {
+		if config.ErrorHandler != nil {
+			config.ErrorHandler.Handle(err)
+		}
+
+		return nil, err
+	}
+
+	s.tracingConfig = config
+	s.tracingShutdown = shutdown
+
+	if n, ok := s.Notifier.(*notifier.DefaultNotifier); ok && !s.tracingHooksRegistered {
+		registerTracingHooks(n)
+		s.tracingHooksRegistered = true
+	}
+
+	return shutdown, nil
+}
+
+// registerTracingHooks subscribes to server events to record route and
+// response details on the request's span, and to trace pass through requests
+// and fragment fetches.
+func registerTracingHooks(n *notifier.DefaultNotifier) {
+	tracinghooks.RegisterMultiplexer(n)
+
+	n.On(EventServeHTTP, func(ctx context.Context) {
+		route := RouteFromContext(ctx)
+		if route == nil {
+			return
+		}
+
+		span := trace.SpanFromContext(ctx)
+		span.SetAttributes(attribute.String("viewproxy.route", route.Path))
+		for key, value := range route.Metadata {
+			span.SetAttributes(attribute.String("viewproxy.route."+key, value))
+		}
+	})
+
+	n.On(EventResponseComplete, func(ctx context.Context) {
+		span := trace.SpanFromContext(ctx)
+		statusCode := StatusCodeFromContext(ctx)
+
+		span.SetAttributes(semconv.HTTPStatusCode(statusCode))
+		if statusCode >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(statusCode))
+		}
+	})
+
+	n.Around(EventProxy, func(ctx context.Context, next func(context.Context)) {
+		ctx, span := otel.Tracer("server").Start(ctx, "proxy")
+		defer span.End()
+
+		next(ctx)
+	})
+}
@@ -0,0 +1,99 @@
+package viewproxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/blakewilliams/viewproxy/pkg/fragment"
+	"github.com/blakewilliams/viewproxy/pkg/tracing"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+type testSpanExporter struct {
+	spans []sdktrace.ReadOnlySpan
+}
+
+func (e *testSpanExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func (e *testSpanExporter) Shutdown(ctx context.Context) error { return nil }
+
+func (e *testSpanExporter) named(name string) []sdktrace.ReadOnlySpan {
+	spans := make([]sdktrace.ReadOnlySpan, 0)
+	for _, span := range e.spans {
+		if span.Name() == name {
+			spans = append(spans, span)
+		}
+	}
+
+	return spans
+}
+
+type errorHandlerFunc func(error)
+
+func (fn errorHandlerFunc) Handle(err error) { fn(err) }
+
+func TestConfigureTracing(t *testing.T) {
+	previous := otel.GetTracerProvider()
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	server := newServer(t, targetServer.URL, WithPassThrough(targetServer.URL))
+	err := server.Get("/hello/:name", fragment.Define("/body/:name"), WithRouteMetadata(map[string]string{"controller": "hello"}))
+	require.NoError(t, err)
+
+	exporter := &testSpanExporter{}
+	_, err = server.ConfigureTracing(tracing.TracingConfig{ServiceName: "viewproxy", Exporter: &testSpanExporter{}})
+	require.NoError(t, err)
+	// Configuring tracing again replaces the provider without duplicating hooks
+	shutdown, err := server.ConfigureTracing(tracing.TracingConfig{ServiceName: "viewproxy", Exporter: exporter})
+	require.NoError(t, err)
+
+	for _, path := range []string{"/hello/world", "/oops"} {
+		r := httptest.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		server.CreateHandler().ServeHTTP(w, r)
+	}
+	shutdown()
+
+	serveSpans := exporter.named("ServeHTTP")
+	require.Len(t, serveSpans, 2)
+
+	attributes := attribute.NewSet(serveSpans[0].Attributes()...)
+	route, _ := attributes.Value("viewproxy.route")
+	require.Equal(t, "/hello/:name", route.AsString())
+	controller, _ := attributes.Value("viewproxy.route.controller")
+	require.Equal(t, "hello", controller.AsString())
+	statusCode, _ := attributes.Value("http.status_code")
+	require.Equal(t, int64(http.StatusOK), statusCode.AsInt64())
+
+	// Fragment fetches are traced via the multiplexer events
+	fetchSpans := exporter.named("fetch_url")
+	require.Len(t, fetchSpans, 1)
+	require.Equal(t, serveSpans[0].SpanContext().TraceID(), fetchSpans[0].SpanContext().TraceID())
+
+	// The proxy span is a child of the request's span
+	proxySpans := exporter.named("proxy")
+	require.Len(t, proxySpans, 1)
+	require.Equal(t, serveSpans[1].SpanContext().TraceID(), proxySpans[0].SpanContext().TraceID())
+	require.Equal(t, serveSpans[1].SpanContext().SpanID(), proxySpans[0].Parent().SpanID())
+}
+
+func TestConfigureTracing_ErrorHandler(t *testing.T) {
+	server := newServer(t, targetServer.URL)
+
+	var handled error
+	_, err := server.ConfigureTracing(tracing.TracingConfig{
+		ExporterKind: "zipkin",
+		ErrorHandler: errorHandlerFunc(func(err error) { handled = err }),
+	})
+
+	require.EqualError(t, err, `unknown tracing exporter "zipkin"`)
+	require.Equal(t, err, handled)
+}
@@ -0,0 +1,107 @@
+package viewproxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/blakewilliams/viewproxy/pkg/multiplexer"
+)
+
+// ErrConflictingTransportOptions is returned by NewServer when it's given
+// options that configure how fragments are fetched in ways that can't be
+// combined, e.g. WithHTTPClient and WithTransport.
+var ErrConflictingTransportOptions = errors.New("conflicting transport options")
+
+// transportConfig records the options that configure the MultiplexerTripper,
+// so it's built once every option is applied regardless of the order they're
+// given in.
+type transportConfig struct {
+	// The name of the option that chose the transport, e.g. `WithHTTPClient`
+	chosenBy string
+	// The client given to WithHTTPClient or WithTransport
+	client *http.Client
+	// Set by WithH2C
+	h2c bool
+	// Set by WithTripperOptions, fragments are fetched using a transport
+	// returned by multiplexer.NewTransport with options
+	tuned   bool
+	options []multiplexer.TransportOption
+}
+
+// choose records that the named option chose the transport, returning an
+// ErrConflictingTransportOptions when another option already did. Giving the
+// same option more than once doesn't conflict.
+func (tc *transportConfig) choose(name string) error {
+	if tc.chosenBy != "" && tc.chosenBy != name {
+		return fmt.Errorf("%w: %s and %s", ErrConflictingTransportOptions, tc.chosenBy, name)
+	}
+
+	tc.chosenBy = name
+	return nil
+}
+
+// checkClientTLS returns an ErrConflictingTransportOptions when the client
+// certificate given to WithClientCertificate can't be used by the transport
+// chosen by another option, e.g. WithH2C's cleartext connections or a custom
+// http.RoundTripper.
+func (s *Server) checkClientTLS() error {
+	if s.clientTLSConfig == nil {
+		return nil
+	}
+
+	if s.transport.h2c || (s.transport.client != nil && !isHTTPTransport(s.transport.client.Transport)) {
+		return fmt.Errorf("%w: WithClientCertificate and %s", ErrConflictingTransportOptions, s.transport.chosenBy)
+	}
+
+	return nil
+}
+
+func isHTTPTransport(transport http.RoundTripper) bool {
+	_, ok := transport.(*http.Transport)
+	return transport == nil || ok
+}
+
+// configureMultiplexerTripper sets the MultiplexerTripper chosen by the
+// server's options, keeping the default when no option chose one. The client
+// certificate given to WithClientCertificate is used by whichever transport
+// is chosen.
+func (s *Server) configureMultiplexerTripper() {
+	switch {
+	case s.transport.client != nil:
+		client := s.transport.client
+		if s.clientTLSConfig != nil {
+			client = clientWithTLSConfig(client, s.clientTLSConfig)
+		}
+
+		s.MultiplexerTripper = multiplexer.NewStandardTripper(client)
+	case s.transport.h2c:
+		s.MultiplexerTripper = multiplexer.NewStandardTripper(&http.Client{Transport: multiplexer.NewH2CTransport()})
+	case s.transport.tuned || s.clientTLSConfig != nil:
+		options := s.transport.options
+		if s.clientTLSConfig != nil {
+			options = append(options[:len(options):len(options)], multiplexer.WithTLSConfig(s.clientTLSConfig))
+		}
+
+		s.MultiplexerTripper = multiplexer.NewStandardTripperWithTransport(multiplexer.NewTransport(options...))
+	}
+}
+
+// clientWithTLSConfig returns a copy of the client whose transport, a clone of
+// the client's http.Transport, uses the TLS configuration. The client and its
+// transport may be shared, so they're left as is.
+func clientWithTLSConfig(client *http.Client, config *tls.Config) *http.Client {
+	transport, ok := client.Transport.(*http.Transport)
+	if !ok {
+		transport = http.DefaultTransport.(*http.Transport)
+	}
+
+	transport = transport.Clone()
+	transport.TLSClientConfig = config
+
+	copied := *client
+	copied.Transport = transport
+
+	return &copied
+}
@@ -0,0 +1,234 @@
+package viewproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type ValidationSeverity string
+
+const (
+	SeverityInfo    ValidationSeverity = "info"
+	SeverityWarning ValidationSeverity = "warning"
+	SeverityError   ValidationSeverity = "error"
+)
+
+// Codes identifying each kind of validation finding
+const (
+	FindingRoutes                 = "routes"
+	FindingInvalidRoute           = "invalid_route"
+	FindingDuplicateRoute         = "duplicate_route"
+	FindingFragmentDepth          = "fragment_depth"
+	FindingFragmentCount          = "fragment_count"
+	FindingTimeout                = "timeout"
+	FindingRetryTimeout           = "retry_timeout"
+	FindingMissingHmacSecret      = "missing_hmac_secret"
+	FindingPassThroughReachable   = "pass_through_reachable"
+	FindingPassThroughUnreachable = "pass_through_unreachable"
+	FindingFragmentPathCollision  = "fragment_path_collision"
+	FindingSelfTarget             = "self_target"
+)
+
+const (
+	// Routes with fragments nested deeper than this are reported as warnings
+	maxFragmentDepth = 5
+	// Routes with more fragments than this are reported as warnings
+	maxFragmentCount = 30
+)
+
+// ValidationFinding is a single finding of ValidateConfiguration.
+type ValidationFinding struct {
+	Severity ValidationSeverity `json:"severity"`
+	Code     string             `json:"code"`
+	// The path of the route the finding applies to, if any
+	Route   string `json:"route,omitempty"`
+	Message string `json:"message"`
+}
+
+// ValidationReport contains the findings of ValidateConfiguration grouped by
+// severity.
+type ValidationReport struct {
+	Errors   []ValidationFinding `json:"errors"`
+	Warnings []ValidationFinding `json:"warnings"`
+	Info     []ValidationFinding `json:"info"`
+}
+
+// Severity returns the highest severity of the findings in the report.
+func (vr *ValidationReport) Severity() ValidationSeverity {
+	switch {
+	case len(vr.Errors) > 0:
+		return SeverityError
+	case len(vr.Warnings) > 0:
+		return SeverityWarning
+	default:
+		return SeverityInfo
+	}
+}
+
+func (vr *ValidationReport) add(severity ValidationSeverity, code string, route string, message string) {
+	finding := ValidationFinding{Severity: severity, Code: code, Route: route, Message: message}
+
+	switch severity {
+	case SeverityError:
+		vr.Errors = append(vr.Errors, finding)
+	case SeverityWarning:
+		vr.Warnings = append(vr.Warnings, finding)
+	default:
+		vr.Info = append(vr.Info, finding)
+	}
+}
+
+type validationConfig struct {
+	probePassThrough bool
+}
+
+type ValidationOption = func(*validationConfig)
+
+// WithPassThroughProbe makes a HEAD request to the pass through target to
+// verify that it's reachable.
+func WithPassThroughProbe() ValidationOption {
+	return func(config *validationConfig) {
+		config.probePassThrough = true
+	}
+}
+
+// ValidateConfiguration checks the routes and configuration of the server,
+// returning a report that can be used to gate deploys.
+func (s *Server) ValidateConfiguration(ctx context.Context, opts ...ValidationOption) ValidationReport {
+	config := &validationConfig{}
+	for _, opt := range opts {
+		opt(config)
+	}
+
+	report := ValidationReport{
+		Errors:   make([]ValidationFinding, 0),
+		Warnings: make([]ValidationFinding, 0),
+		Info:     make([]ValidationFinding, 0),
+	}
+
+	s.routesMu.RLock()
+	routes := make([]*Route, len(s.routes))
+	copy(routes, s.routes)
+	s.routesMu.RUnlock()
+
+	report.add(SeverityInfo, FindingRoutes, "", fmt.Sprintf("%d routes defined", len(routes)))
+	s.validateRoutes(&report, routes)
+	s.validateTimeouts(&report, routes)
+
+	if s.targetURL.Scheme == "https" && s.HmacSecret == "" {
+		report.add(SeverityWarning, FindingMissingHmacSecret, "", "target is https but no HmacSecret is set, the target can't verify requests came from viewproxy")
+	}
+
+	for _, target := range s.targets.targets {
+		if s.isOwnAddr(target) {
+			report.add(SeverityError, FindingSelfTarget, "", fmt.Sprintf("target %s is the server's own address, fragment requests will recurse", target.Host))
+		}
+	}
+
+	if s.passThrough && s.isOwnAddr(s.passThroughURL) {
+		report.add(SeverityError, FindingSelfTarget, "", fmt.Sprintf("pass through target %s is the server's own address, proxied requests will recurse", s.passThroughURL.Host))
+	}
+
+	if config.probePassThrough && s.passThrough {
+		s.probePassThrough(ctx, &report)
+	}
+
+	return report
+}
+
+func (s *Server) validateRoutes(report *ValidationReport, routes []*Route) {
+	seen := make(map[string]bool, len(routes))
+
+	for _, route := range routes {
+		if seen[routeKey(route)] {
+			report.add(SeverityError, FindingDuplicateRoute, route.Path, fmt.Sprintf("route %s is defined more than once", route.Path))
+		}
+		seen[routeKey(route)] = true
+
+		if err := route.Validate(); err != nil {
+			report.add(SeverityError, FindingInvalidRoute, route.Path, err.Error())
+			continue
+		}
+
+		severity := SeverityWarning
+		if s.StrictFragmentPaths {
+			severity = SeverityError
+		}
+		for _, collision := range s.collidingFragments(route, routes) {
+			report.add(severity, FindingFragmentPathCollision, route.Path, collision.Error())
+		}
+
+		depth := 0
+		for _, key := range route.FragmentOrder() {
+			if keyDepth := strings.Count(key, "."); keyDepth > depth {
+				depth = keyDepth
+			}
+		}
+
+		if depth > maxFragmentDepth {
+			report.add(SeverityWarning, FindingFragmentDepth, route.Path, fmt.Sprintf("fragments are nested %d levels deep, more than %d", depth, maxFragmentDepth))
+		}
+
+		if count := len(route.FragmentsToRequest()); count > maxFragmentCount {
+			report.add(SeverityWarning, FindingFragmentCount, route.Path, fmt.Sprintf("route has %d fragments, more than %d", count, maxFragmentCount))
+		}
+	}
+}
+
+func (s *Server) validateTimeouts(report *ValidationReport, routes []*Route) {
+	if s.ProxyTimeout <= 0 {
+		report.add(SeverityError, FindingTimeout, "", "ProxyTimeout must be greater than 0")
+		return
+	}
+
+	if s.WriteTimeout > 0 && s.ProxyTimeout > s.WriteTimeout {
+		report.add(SeverityWarning, FindingTimeout, "", fmt.Sprintf("ProxyTimeout (%s) should not exceed WriteTimeout (%s)", s.ProxyTimeout, s.WriteTimeout))
+	}
+
+	for _, route := range routes {
+		for i, f := range route.FragmentsToRequest() {
+			policy := f.RetryPolicy
+			if policy.Attempts < 2 {
+				continue
+			}
+
+			backoff := time.Duration(policy.Attempts-1) * policy.Backoff
+			if backoff >= s.ProxyTimeout {
+				report.add(
+					SeverityWarning,
+					FindingRetryTimeout,
+					route.Path,
+					fmt.Sprintf("fragment %s waits %s between retries, which exceeds ProxyTimeout (%s)", route.FragmentOrder()[i], backoff, s.ProxyTimeout),
+				)
+			}
+		}
+	}
+}
+
+func (s *Server) probePassThrough(ctx context.Context, report *ValidationReport) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, s.passThroughURL.String(), nil)
+	if err != nil {
+		report.add(SeverityError, FindingPassThroughUnreachable, "", err.Error())
+		return
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		// Omit the URL from the error, it may contain secrets
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+
+		report.add(SeverityError, FindingPassThroughUnreachable, "", fmt.Sprintf("pass through target is unreachable: %s", err))
+		return
+	}
+	resp.Body.Close()
+
+	report.add(SeverityInfo, FindingPassThroughReachable, "", fmt.Sprintf("pass through target responded with %d", resp.StatusCode))
+}
@@ -0,0 +1,112 @@
+package viewproxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/blakewilliams/viewproxy/pkg/fragment"
+	"github.com/stretchr/testify/require"
+)
+
+func findingCodes(findings []ValidationFinding) []string {
+	codes := make([]string, 0, len(findings))
+	for _, finding := range findings {
+		codes = append(codes, finding.Code)
+	}
+
+	return codes
+}
+
+func TestValidateConfiguration_Valid(t *testing.T) {
+	server := newServer(t, targetServer.URL)
+	err := server.Get("/hello/:name", fragment.Define("/body/:name"))
+	require.NoError(t, err)
+
+	report := server.ValidateConfiguration(context.Background())
+
+	require.Equal(t, SeverityInfo, report.Severity())
+	require.Empty(t, report.Errors)
+	require.Empty(t, report.Warnings)
+	require.Equal(t, []string{FindingRoutes}, findingCodes(report.Info))
+	require.Equal(t, "1 routes defined", report.Info[0].Message)
+}
+
+func TestValidateConfiguration_Errors(t *testing.T) {
+	server := newServer(t, targetServer.URL)
+	err := server.Get("/hello/:name", fragment.Define("/body/:name"))
+	require.NoError(t, err)
+	err = server.Get("/hello/:name", fragment.Define("/header/:name"))
+	require.NoError(t, err)
+
+	// Routes added without validation, e.g. by a misbehaving importer
+	server.routes = append(server.routes, newRoute("/bye/:name", map[string]string{}, fragment.Define("/body/:login")))
+	server.ProxyTimeout = 0
+
+	report := server.ValidateConfiguration(context.Background())
+
+	require.Equal(t, SeverityError, report.Severity())
+	require.Equal(t, []string{FindingDuplicateRoute, FindingInvalidRoute, FindingTimeout}, findingCodes(report.Errors))
+	require.Equal(t, "/hello/:name", report.Errors[0].Route)
+	require.Equal(t, "dynamic route /bye/:name has mismatched fragment route /body/:login", report.Errors[1].Message)
+}
+
+func TestValidateConfiguration_Warnings(t *testing.T) {
+	server := newServer(t, "https://example.com")
+	server.ProxyTimeout = 2 * time.Second
+	server.WriteTimeout = time.Second
+
+	root := fragment.Define("/layout", fragment.WithChild("body", fragment.Define("/body", fragment.WithRetry(3, time.Second))))
+	for i := 0; i < maxFragmentDepth; i++ {
+		root = fragment.Define("/layout", fragment.WithChild("body", root))
+	}
+	err := server.Get("/hello", root)
+	require.NoError(t, err)
+
+	report := server.ValidateConfiguration(context.Background())
+
+	require.Equal(t, SeverityWarning, report.Severity())
+	require.Equal(
+		t,
+		[]string{FindingFragmentDepth, FindingTimeout, FindingRetryTimeout, FindingMissingHmacSecret},
+		findingCodes(report.Warnings),
+	)
+}
+
+func TestValidateConfiguration_PassThroughProbe(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	server := newServer(t, targetServer.URL, WithPassThrough(origin.URL))
+
+	report := server.ValidateConfiguration(context.Background(), WithPassThroughProbe())
+	require.Equal(t, []string{FindingRoutes, FindingPassThroughReachable}, findingCodes(report.Info))
+	require.Equal(t, "pass through target responded with 204", report.Info[1].Message)
+
+	origin.Close()
+	report = server.ValidateConfiguration(context.Background(), WithPassThroughProbe())
+	require.Equal(t, []string{FindingPassThroughUnreachable}, findingCodes(report.Errors))
+
+	// The pass through target is only probed when requested
+	report = server.ValidateConfiguration(context.Background())
+	require.Empty(t, report.Errors)
+}
+
+func TestValidationReport_JSON(t *testing.T) {
+	report := ValidationReport{
+		Errors:   []ValidationFinding{{Severity: SeverityError, Code: FindingDuplicateRoute, Route: "/hello", Message: "route /hello is defined more than once"}},
+		Warnings: []ValidationFinding{},
+		Info:     []ValidationFinding{{Severity: SeverityInfo, Code: FindingRoutes, Message: "2 routes defined"}},
+	}
+
+	b, err := json.Marshal(report)
+	require.NoError(t, err)
+	require.JSONEq(t, `{
+		"errors": [{"severity": "error", "code": "duplicate_route", "route": "/hello", "message": "route /hello is defined more than once"}],
+		"warnings": [],
+		"info": [{"severity": "info", "code": "routes", "message": "2 routes defined"}]
+	}`, string(b))
+}